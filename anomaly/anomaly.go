@@ -0,0 +1,556 @@
+// Package anomaly watches the retrieval attempts of aggregate events for
+// storage providers whose performance suddenly degrades, and sends alerts to a
+// webhook.
+//
+// For every storage provider, the analyzer keeps two exponentially weighted
+// moving averages of its success rate, time to first byte and share of each
+// error category: a baseline over many attempts and a recent average over the
+// last few. An alert is raised when the recent average is significantly worse
+// than the baseline, with the IDs of recent retrievals that show the
+// degradation.
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/filecoin-project/lassie-event-recorder/webhook"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-log/v2"
+)
+
+var logger = log.Logger("lassie/anomaly")
+
+var _ eventrecorder.Sink = (*Analyzer)(nil)
+
+// Kinds of alerts.
+const (
+	// SuccessRateDrop is raised when the recent success rate of a storage
+	// provider drops well below its baseline.
+	SuccessRateDrop = "success_rate"
+	// TimeToFirstByteSpike is raised when the recent time to first byte of a
+	// storage provider rises well above its baseline.
+	TimeToFirstByteSpike = "time_to_first_byte"
+	// ErrorCategorySpike is raised when the share of attempts failing with
+	// one category of error rises well above its baseline.
+	ErrorCategorySpike = "error_category"
+)
+
+type Config struct {
+	// WebhookURL receives every alert as a JSON POST request.
+	WebhookURL string `json:"webhookUrl"`
+	// WebhookSecret, if set, is the key used to sign alerts, in the same way
+	// as the webhook sink signs events; receivers check them with
+	// webhook.Verify.
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+
+	// BaselineAttempts and RecentAttempts are the number of attempts that the
+	// baseline and recent averages of each storage provider span.
+	BaselineAttempts int `json:"baselineAttempts,omitempty"`
+	RecentAttempts   int `json:"recentAttempts,omitempty"`
+	// MinAttempts is the number of attempts a storage provider must have
+	// before its baseline is trusted enough to raise alerts.
+	MinAttempts int `json:"minAttempts,omitempty"`
+
+	// SuccessDrop is how far, between 0 and 1, the recent success rate must
+	// fall below the baseline to raise an alert.
+	SuccessDrop float64 `json:"successDrop,omitempty"`
+	// TimeToFirstByteFactor is how many times the baseline the recent time to
+	// first byte must reach to raise an alert.
+	TimeToFirstByteFactor float64 `json:"timeToFirstByteFactor,omitempty"`
+	// ErrorSpike is how far, between 0 and 1, the recent share of attempts
+	// failing with one category of error must rise above the baseline to
+	// raise an alert.
+	ErrorSpike float64 `json:"errorSpike,omitempty"`
+
+	// Cooldown is the least time between two alerts of the same kind for the
+	// same storage provider.
+	Cooldown webhook.Duration `json:"cooldown,omitempty"`
+	// Samples is the number of retrieval IDs included in an alert.
+	Samples int `json:"samples,omitempty"`
+	// QueueSize is the maximum number of events waiting to be analyzed.
+	// Events are dropped while the queue is full.
+	QueueSize int `json:"queueSize,omitempty"`
+	// Timeout bounds each webhook request.
+	Timeout webhook.Duration `json:"timeout,omitempty"`
+	// MaxRetries is the number of times a failed webhook request is retried
+	// before its alert is dropped. Defaults to 3 if unset; zero disables
+	// retries.
+	MaxRetries *int `json:"maxRetries,omitempty"`
+	// Client sends the webhook requests. Defaults to http.DefaultClient.
+	Client *http.Client `json:"-"`
+}
+
+func (c *Config) applyDefaults() {
+	if c.BaselineAttempts == 0 {
+		c.BaselineAttempts = 500
+	}
+	if c.RecentAttempts == 0 {
+		c.RecentAttempts = 20
+	}
+	if c.MinAttempts == 0 {
+		c.MinAttempts = 100
+	}
+	if c.SuccessDrop == 0 {
+		c.SuccessDrop = 0.4
+	}
+	if c.TimeToFirstByteFactor == 0 {
+		c.TimeToFirstByteFactor = 3
+	}
+	if c.ErrorSpike == 0 {
+		c.ErrorSpike = 0.3
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = webhook.Duration(time.Hour)
+	}
+	if c.Samples == 0 {
+		c.Samples = 10
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 10_000
+	}
+	if c.Timeout == 0 {
+		c.Timeout = webhook.Duration(10 * time.Second)
+	}
+	if c.MaxRetries == nil {
+		maxRetries := 3
+		c.MaxRetries = &maxRetries
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+}
+
+func (c Config) validate() error {
+	u, err := url.Parse(c.WebhookURL)
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid alert webhook URL %q: %w", c.WebhookURL, err)
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("alert webhook URL %q must be http or https", c.WebhookURL)
+	case c.RecentAttempts >= c.BaselineAttempts:
+		return errors.New("recent attempts must be fewer than baseline attempts")
+	case c.SuccessDrop > 1 || c.ErrorSpike > 1:
+		return errors.New("success drop and error spike must be at most 1")
+	case c.TimeToFirstByteFactor <= 1:
+		return errors.New("time to first byte factor must be greater than 1")
+	case c.RecentAttempts < 0 || c.MinAttempts < 0 || c.SuccessDrop < 0 || c.ErrorSpike < 0 || c.Cooldown < 0 ||
+		c.Samples < 0 || c.QueueSize < 0 || c.Timeout < 0 || *c.MaxRetries < 0:
+		return errors.New("anomaly detection limits cannot be negative")
+	}
+	return nil
+}
+
+// LoadConfig reads a Config from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode anomaly detection config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Alert describes a degradation of a storage provider.
+type Alert struct {
+	Kind              string `json:"kind"`
+	StorageProviderID string `json:"storageProviderId"`
+	// Category is the error category of ErrorCategorySpike alerts.
+	Category string `json:"category,omitempty"`
+	// Baseline and Recent are the averages compared: success rates or shares
+	// of attempts between 0 and 1, or times to first byte in seconds.
+	Baseline float64 `json:"baseline"`
+	Recent   float64 `json:"recent"`
+	// Attempts is the number of attempts of the storage provider analyzed so
+	// far.
+	Attempts int64 `json:"attempts"`
+	// RetrievalIDs are recent retrievals showing the degradation.
+	RetrievalIDs []string  `json:"retrievalIds"`
+	DetectedAt   time.Time `json:"detectedAt"`
+}
+
+// Analyzer detects storage provider degradations in the aggregate events
+// accepted by the recorder. Events are analyzed in the background, so
+// recording never waits on analysis or alert delivery.
+type Analyzer struct {
+	cfg Config
+	now func() time.Time
+
+	// providers is only used by the analyzing goroutine.
+	providers map[string]*provider
+
+	// dropped counts the events dropped since last logged, so that a full
+	// queue is logged once per dropLogInterval rather than once per event.
+	dropped atomic.Int64
+
+	events   chan eventrecorder.AggregateEvent
+	alerts   chan Alert
+	closing  chan struct{}
+	analyzed chan struct{}
+	closed   chan struct{}
+	// ctx is cancelled when delivery is abandoned on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// dropLogInterval is how often events dropped from analysis are logged.
+const dropLogInterval = time.Minute
+
+func New(cfg Config) (*Analyzer, error) {
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Analyzer{
+		cfg:       cfg,
+		now:       time.Now,
+		providers: make(map[string]*provider),
+		events:    make(chan eventrecorder.AggregateEvent, cfg.QueueSize),
+		alerts:    make(chan Alert, 100),
+		closing:   make(chan struct{}),
+		analyzed:  make(chan struct{}),
+		closed:    make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	go a.run()
+	go a.deliverAll()
+	return a, nil
+}
+
+// RecordEvents does nothing; only aggregate events are analyzed.
+func (a *Analyzer) RecordEvents(context.Context, []eventrecorder.Event) error {
+	return nil
+}
+
+// RecordAggregateEvents queues events for analysis. It never blocks.
+func (a *Analyzer) RecordAggregateEvents(_ context.Context, events []eventrecorder.AggregateEvent) error {
+	for _, event := range events {
+		select {
+		case a.events <- event:
+		default:
+			a.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+func (a *Analyzer) run() {
+	defer close(a.analyzed)
+	ticker := time.NewTicker(dropLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-a.events:
+			a.analyze(event)
+		case <-ticker.C:
+			a.logDropped()
+		case <-a.closing:
+			for {
+				select {
+				case event := <-a.events:
+					a.analyze(event)
+				default:
+					a.logDropped()
+					return
+				}
+			}
+		}
+	}
+}
+
+// logDropped logs the events dropped since last logged, if any.
+func (a *Analyzer) logDropped() {
+	if dropped := a.dropped.Swap(0); dropped > 0 {
+		logger.Warnw("Dropped events from anomaly detection because it is behind", "total", dropped)
+	}
+}
+
+// analyze updates the averages of every storage provider attempted by an
+// event, and queues any alerts they raise.
+func (a *Analyzer) analyze(event eventrecorder.AggregateEvent) {
+	now := a.now()
+	for storageProviderID, attempt := range event.RetrievalAttempts {
+		if storageProviderID == types.BitswapIndentifier {
+			continue
+		}
+		p, ok := a.providers[storageProviderID]
+		if !ok {
+			p = newProvider()
+			a.providers[storageProviderID] = p
+		}
+		var timeToFirstByte time.Duration
+		if attempt.TimeToFirstByte != "" {
+			timeToFirstByte, _ = time.ParseDuration(attempt.TimeToFirstByte)
+		}
+		p.observe(a.cfg, event.RetrievalID, attempt.Error, timeToFirstByte)
+		for _, alert := range p.detect(a.cfg, now) {
+			alert.StorageProviderID = storageProviderID
+			logger.Warnw("Detected storage provider degradation", "alert", alert)
+			select {
+			case a.alerts <- alert:
+			default:
+				logger.Errorw("Dropped alert while the alert webhook is backed up", "alert", alert)
+			}
+		}
+	}
+}
+
+func (a *Analyzer) deliverAll() {
+	defer close(a.closed)
+	var abandoned int
+	for alert := range a.alerts {
+		if a.ctx.Err() != nil {
+			abandoned++
+			continue
+		}
+		a.deliver(alert)
+	}
+	if abandoned > 0 {
+		logger.Errorw("Abandoned alerts on shutdown", "total", abandoned)
+	}
+}
+
+// deliver sends an alert, retrying with exponential backoff. While closing,
+// failed alerts are not retried so that shutdown is not held up.
+func (a *Analyzer) deliver(alert Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		logger.Errorw("Failed to encode alert", "err", err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := a.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= *a.cfg.MaxRetries {
+			logger.Errorw("Failed to deliver alert", "alert", alert, "attempts", attempt+1, "err", err)
+			return
+		}
+		logger.Warnw("Retrying alert", "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-a.closing:
+			logger.Errorw("Abandoned alert on shutdown", "alert", alert, "err", err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single request, reporting whether a failure may succeed if
+// retried.
+func (a *Analyzer) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.cfg.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.cfg.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhook.TimestampHeader, timestamp)
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign(a.cfg.WebhookSecret, timestamp, body))
+	}
+	resp, err := a.cfg.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("alert webhook responded with %s", resp.Status)
+	default:
+		return false, fmt.Errorf("alert webhook responded with %s", resp.Status)
+	}
+}
+
+// Close analyzes any queued events and delivers their alerts without
+// retrying, for at most one webhook timeout; alerts still queued after that
+// are abandoned.
+func (a *Analyzer) Close() error {
+	close(a.closing)
+	<-a.analyzed
+	close(a.alerts)
+	timer := time.NewTimer(time.Duration(a.cfg.Timeout))
+	defer timer.Stop()
+	select {
+	case <-a.closed:
+	case <-timer.C:
+		a.cancel()
+		<-a.closed
+	}
+	a.cancel()
+	return nil
+}
+
+// averages are moving averages of the attempts of a storage provider.
+type averages struct {
+	success float64
+	// timeToFirstByte is in seconds, averaged over attempts that received a
+	// first byte.
+	timeToFirstByte float64
+	// errors is the share of attempts failing with each error category.
+	errors map[string]float64
+}
+
+// update adds an attempt to the averages. alpha is the weight of the attempt,
+// and firstByteAlpha its weight in the time to first byte average.
+func (s *averages) update(alpha, firstByteAlpha float64, success bool, category string, timeToFirstByte time.Duration) {
+	v := 0.0
+	if success {
+		v = 1
+	}
+	s.success += alpha * (v - s.success)
+	if timeToFirstByte > 0 {
+		s.timeToFirstByte += firstByteAlpha * (timeToFirstByte.Seconds() - s.timeToFirstByte)
+	}
+	for c := range s.errors {
+		s.errors[c] -= alpha * s.errors[c]
+	}
+	if category != "" {
+		s.errors[category] += alpha
+	}
+}
+
+// weight is the weight of the nth sample of a moving average spanning window
+// samples. Until the window fills, samples are weighed equally, so that the
+// average does not lean towards the first sample.
+func weight(n int64, window int) float64 {
+	if n < int64(window) {
+		return 1 / float64(n)
+	}
+	return 1 / float64(window)
+}
+
+// sample is a recent attempt kept as evidence for alerts.
+type sample struct {
+	retrievalID string
+	// category is the error category of failed attempts.
+	category        string
+	timeToFirstByte time.Duration
+}
+
+type provider struct {
+	attempts     int64
+	firstBytes   int64
+	baseline     averages
+	recent       averages
+	samples      []sample
+	lastAlerted  map[string]time.Time
+	nextSampleAt int
+}
+
+func newProvider() *provider {
+	return &provider{
+		baseline:    averages{errors: make(map[string]float64)},
+		recent:      averages{errors: make(map[string]float64)},
+		lastAlerted: make(map[string]time.Time),
+	}
+}
+
+func (p *provider) observe(cfg Config, retrievalID, errMsg string, timeToFirstByte time.Duration) {
+	var category string
+	if errMsg != "" {
+		category = metrics.ErrorCategory(errMsg)
+	}
+	p.attempts++
+	if timeToFirstByte > 0 {
+		p.firstBytes++
+	}
+	success := errMsg == ""
+	p.baseline.update(weight(p.attempts, cfg.BaselineAttempts), weight(p.firstBytes, cfg.BaselineAttempts), success, category, timeToFirstByte)
+	p.recent.update(weight(p.attempts, cfg.RecentAttempts), weight(p.firstBytes, cfg.RecentAttempts), success, category, timeToFirstByte)
+
+	// Samples are kept in a ring spanning the recent average.
+	s := sample{retrievalID: retrievalID, category: category, timeToFirstByte: timeToFirstByte}
+	if len(p.samples) < cfg.RecentAttempts {
+		p.samples = append(p.samples, s)
+	} else {
+		p.samples[p.nextSampleAt] = s
+		p.nextSampleAt = (p.nextSampleAt + 1) % len(p.samples)
+	}
+}
+
+// detect returns the alerts raised by the latest averages, unless the same
+// alert was raised within the cooldown.
+func (p *provider) detect(cfg Config, now time.Time) []Alert {
+	if p.attempts < int64(cfg.MinAttempts) {
+		return nil
+	}
+	var alerts []Alert
+	raise := func(alert Alert, match func(sample) bool) {
+		key := alert.Kind + "/" + alert.Category
+		if last, ok := p.lastAlerted[key]; ok && now.Sub(last) < time.Duration(cfg.Cooldown) {
+			return
+		}
+		p.lastAlerted[key] = now
+		alert.Attempts = p.attempts
+		alert.DetectedAt = now
+		alert.RetrievalIDs = p.sampleIDs(cfg.Samples, match)
+		alerts = append(alerts, alert)
+	}
+
+	if p.baseline.success-p.recent.success >= cfg.SuccessDrop {
+		raise(Alert{Kind: SuccessRateDrop, Baseline: p.baseline.success, Recent: p.recent.success},
+			func(s sample) bool { return s.category != "" })
+	}
+	if p.firstBytes >= int64(cfg.MinAttempts) && p.recent.timeToFirstByte >= cfg.TimeToFirstByteFactor*p.baseline.timeToFirstByte {
+		slow := time.Duration(p.baseline.timeToFirstByte * float64(time.Second))
+		raise(Alert{Kind: TimeToFirstByteSpike, Baseline: p.baseline.timeToFirstByte, Recent: p.recent.timeToFirstByte},
+			func(s sample) bool { return s.timeToFirstByte > slow })
+	}
+	categories := make([]string, 0, len(p.recent.errors))
+	for category := range p.recent.errors {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		recent, baseline := p.recent.errors[category], p.baseline.errors[category]
+		if recent-baseline >= cfg.ErrorSpike {
+			category := category
+			raise(Alert{Kind: ErrorCategorySpike, Category: category, Baseline: baseline, Recent: recent},
+				func(s sample) bool { return s.category == category })
+		}
+	}
+	return alerts
+}
+
+// sampleIDs returns the IDs of up to n of the latest samples that match,
+// latest first.
+func (p *provider) sampleIDs(n int, match func(sample) bool) []string {
+	ids := []string{}
+	for i := 1; i <= len(p.samples) && len(ids) < n; i++ {
+		s := p.samples[(p.nextSampleAt-i+len(p.samples))%len(p.samples)]
+		if match(s) {
+			ids = append(ids, s.retrievalID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,135 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/anomaly"
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/webhook"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+const degraded, healthy = "12D3KooWDegraded", "12D3KooWHealthy"
+
+// degradingEvents returns the events of a storage provider with the odd
+// failure that suddenly starts timing out, raising two alerts.
+func degradingEvents() []eventrecorder.AggregateEvent {
+	event := func(i int, degradedErr string) eventrecorder.AggregateEvent {
+		return eventrecorder.AggregateEvent{
+			RetrievalID: fmt.Sprintf("retrieval-%d", i),
+			RetrievalAttempts: map[string]*eventrecorder.RetrievalAttempt{
+				degraded:                 {Error: degradedErr, TimeToFirstByte: "100ms"},
+				healthy:                  {TimeToFirstByte: "100ms"},
+				types.BitswapIndentifier: {Error: "timeout after 1s"},
+			},
+		}
+	}
+	var events []eventrecorder.AggregateEvent
+	for i := 0; i < 100; i++ {
+		var err string
+		if i%10 == 0 {
+			err = "failed to dial"
+		}
+		events = append(events, event(i, err))
+	}
+	for i := 100; i < 110; i++ {
+		events = append(events, event(i, "retrieval timed out after 20s"))
+	}
+	return events
+}
+
+func TestAnalyzer(t *testing.T) {
+	var lk sync.Mutex
+	var alerts []anomaly.Alert
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.True(t, webhook.Verify("secret", req.Header.Get(webhook.TimestampHeader), body, req.Header.Get(webhook.SignatureHeader)))
+		var alert anomaly.Alert
+		require.NoError(t, json.Unmarshal(body, &alert))
+		lk.Lock()
+		alerts = append(alerts, alert)
+		lk.Unlock()
+	}))
+	defer ts.Close()
+
+	analyzer, err := anomaly.New(anomaly.Config{
+		WebhookURL:       ts.URL,
+		WebhookSecret:    "secret",
+		BaselineAttempts: 200,
+		RecentAttempts:   10,
+		MinAttempts:      50,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, analyzer.RecordAggregateEvents(context.Background(), degradingEvents()))
+	require.NoError(t, analyzer.Close())
+
+	// The share of timeouts rises faster than the success rate drops. Each
+	// kind of alert is only raised once within the cooldown.
+	require.Len(t, alerts, 2)
+	require.Equal(t, anomaly.ErrorCategorySpike, alerts[0].Kind)
+	require.Equal(t, degraded, alerts[0].StorageProviderID)
+	require.Equal(t, "timeout", alerts[0].Category)
+	require.Equal(t, []string{"retrieval-103", "retrieval-102", "retrieval-101", "retrieval-100"}, alerts[0].RetrievalIDs)
+	require.Equal(t, anomaly.SuccessRateDrop, alerts[1].Kind)
+	require.Equal(t, degraded, alerts[1].StorageProviderID)
+	require.Greater(t, alerts[1].Baseline, 0.8)
+	require.Less(t, alerts[1].Recent, 0.5)
+	require.Contains(t, alerts[1].RetrievalIDs, "retrieval-100")
+}
+
+func TestAnalyzer_CloseAbandonsRetries(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	maxRetries := 10
+	analyzer, err := anomaly.New(anomaly.Config{
+		WebhookURL:       ts.URL,
+		BaselineAttempts: 200,
+		RecentAttempts:   10,
+		MinAttempts:      50,
+		MaxRetries:       &maxRetries,
+	})
+	require.NoError(t, err)
+	require.NoError(t, analyzer.RecordAggregateEvents(context.Background(), degradingEvents()))
+
+	// Retries back off for seconds, which shutdown does not wait for: each
+	// alert is attempted once.
+	start := time.Now()
+	require.NoError(t, analyzer.Close())
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(2), requests.Load())
+}
+
+func TestNewAnalyzer(t *testing.T) {
+	_, err := anomaly.New(anomaly.Config{WebhookURL: "ftp://example.com"})
+	require.ErrorContains(t, err, "must be http or https")
+	_, err = anomaly.New(anomaly.Config{WebhookURL: "http://example.com", RecentAttempts: 500})
+	require.ErrorContains(t, err, "recent attempts must be fewer than baseline attempts")
+	_, err = anomaly.New(anomaly.Config{WebhookURL: "http://example.com", SuccessDrop: 2})
+	require.ErrorContains(t, err, "must be at most 1")
+	negative := -1
+	_, err = anomaly.New(anomaly.Config{WebhookURL: "http://example.com", MaxRetries: &negative})
+	require.ErrorContains(t, err, "cannot be negative")
+
+	// An explicit zero disables retries rather than taking the default.
+	var cfg anomaly.Config
+	require.NoError(t, json.Unmarshal([]byte(`{"maxRetries": 0}`), &cfg))
+	require.NotNil(t, cfg.MaxRetries)
+	require.Zero(t, *cfg.MaxRetries)
+}
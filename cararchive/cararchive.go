@@ -0,0 +1,355 @@
+// Package cararchive packages each day of aggregate retrieval events into a
+// content addressed CAR file so that it can be published, for example stored
+// on Filecoin, for public research.
+//
+// An archive is a CARv1 file of DAG-CBOR blocks. Its single root is a map of
+//
+//	{"version": 1, "day": "2006-01-02", "events": <count>, "pages": [<link>, ...]}
+//
+// where every page is a list of events in start time order. Events have the
+// same fields as in the recorder's /v2/retrieval-events JSON payload. Each
+// archive written is recorded, with its root CID, in the archives table.
+package cararchive
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-log/v2"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multihash"
+)
+
+var logger = log.Logger("lassie/cararchive")
+
+const (
+	// Version is the version of the archive layout written in the root block.
+	Version = 1
+
+	dayLayout = "2006-01-02"
+
+	// maxPageEvents and maxPageSize bound the events in a page so that every
+	// block stays well below the 1MiB limit of most IPFS implementations.
+	maxPageEvents = 1000
+	maxPageSize   = 512 << 10
+)
+
+var linkPrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    cid.DagCBOR,
+	MhType:   multihash.SHA2_256,
+	MhLength: -1,
+}}
+
+// Archive describes a written archive file.
+type Archive struct {
+	// Day is the UTC day whose events are archived.
+	Day     time.Time
+	RootCid cid.Cid
+	Path    string
+	Events  int64
+	Size    int64
+}
+
+// Root is the decoded root block of an archive.
+type Root struct {
+	Version int64
+	Day     string
+	Events  int64
+	Pages   []cid.Cid
+}
+
+// Filename returns the name of the archive file of a day.
+func Filename(day time.Time) string {
+	return "aggregate-events-" + day.UTC().Format(dayLayout) + ".car"
+}
+
+// Day truncates a time to the start of its UTC day.
+func Day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// WriteDay archives the aggregate events stored in db that started on the
+// UTC day of day to a file in dir, then records the archive in the archives
+// table, replacing any previous archive of the same day.
+func WriteDay(ctx context.Context, db *sql.DB, dialect migrations.Dialect, dir string, day time.Time) (Archive, error) {
+	day = Day(day)
+	archive := Archive{Day: day, Path: filepath.Join(dir, Filename(day))}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return archive, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	// Write to a temporary file so that a failed run never leaves a partial
+	// archive behind.
+	tmp, err := os.CreateTemp(dir, Filename(day)+".tmp-*")
+	if err != nil {
+		return archive, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := newWriter(tmp)
+	if err != nil {
+		return archive, errors.Join(err, tmp.Close())
+	}
+	err = eventrecorder.ReadAggregateEvents(ctx, db, dialect, day, day.Add(24*time.Hour), w.add)
+	if err == nil {
+		archive.RootCid, err = w.finish(day)
+	}
+	if syncErr := tmp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return archive, fmt.Errorf("failed to write archive of %s: %w", day.Format(dayLayout), err)
+	}
+	// The root is only known once every page is written, so the placeholder
+	// written in the header is replaced by the real root of the same size.
+	if err := carv2.ReplaceRootsInFile(tmp.Name(), []cid.Cid{archive.RootCid}); err != nil {
+		return archive, fmt.Errorf("failed to set archive root: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), archive.Path); err != nil {
+		return archive, err
+	}
+	archive.Events = w.events
+	if fi, err := os.Stat(archive.Path); err == nil {
+		archive.Size = fi.Size()
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		insert into archives(day, root_cid, path, event_count, size_bytes)
+		values ($1, $2, $3, $4, $5)
+		on conflict (day) do update set
+			root_cid = excluded.root_cid,
+			path = excluded.path,
+			event_count = excluded.event_count,
+			size_bytes = excluded.size_bytes,
+			created_at = current_timestamp
+		`,
+		day.Format(dayLayout),
+		archive.RootCid.String(),
+		archive.Path,
+		archive.Events,
+		archive.Size,
+	); err != nil {
+		return archive, fmt.Errorf("failed to record archive: %w", err)
+	}
+	logger.Infow("Archived aggregate events", "day", day.Format(dayLayout), "root", archive.RootCid, "events", archive.Events, "path", archive.Path)
+	return archive, nil
+}
+
+// LatestDay returns the most recent day that has been archived, if any.
+func LatestDay(ctx context.Context, db *sql.DB) (time.Time, bool, error) {
+	var day sql.NullString
+	// Postgres returns dates as times, so compare them as text in both
+	// dialects.
+	if err := db.QueryRowContext(ctx, `select max(cast(day as text)) from archives`).Scan(&day); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query archives: %w", err)
+	}
+	if !day.Valid {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(dayLayout, day.String)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid archive day %q: %w", day.String, err)
+	}
+	return t, true, nil
+}
+
+// writer streams pages of events to a CAR file.
+type writer struct {
+	car  storage.WritableCar
+	lsys linking.LinkSystem
+
+	page     []datamodel.Node
+	pageSize int
+	pages    []cid.Cid
+	events   int64
+}
+
+func newWriter(f *os.File) (*writer, error) {
+	placeholder, err := linkPrototype.Sum([]byte{0xf6})
+	if err != nil {
+		return nil, err
+	}
+	car, err := storage.NewWritable(f, []cid.Cid{placeholder}, carv2.WriteAsCarV1(true))
+	if err != nil {
+		return nil, err
+	}
+	w := &writer{car: car, lsys: cidlink.DefaultLinkSystem()}
+	w.lsys.SetWriteStorage(car)
+	return w, nil
+}
+
+func (w *writer) add(event eventrecorder.AggregateEvent) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagjson.Decode(nb, bytes.NewReader(encoded)); err != nil {
+		return fmt.Errorf("failed to convert event %s: %w", event.RetrievalID, err)
+	}
+	if len(w.page) > 0 && w.pageSize+len(encoded) > maxPageSize {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.page = append(w.page, nb.Build())
+	w.pageSize += len(encoded)
+	w.events++
+	if len(w.page) >= maxPageEvents {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *writer) flush() error {
+	if len(w.page) == 0 {
+		return nil
+	}
+	page, err := qp.BuildList(basicnode.Prototype.Any, int64(len(w.page)), func(la datamodel.ListAssembler) {
+		for _, event := range w.page {
+			qp.ListEntry(la, qp.Node(event))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	link, err := w.lsys.Store(linking.LinkContext{}, linkPrototype, page)
+	if err != nil {
+		return fmt.Errorf("failed to store page: %w", err)
+	}
+	w.pages = append(w.pages, link.(cidlink.Link).Cid)
+	w.page = w.page[:0]
+	w.pageSize = 0
+	return nil
+}
+
+func (w *writer) finish(day time.Time) (cid.Cid, error) {
+	if err := w.flush(); err != nil {
+		return cid.Undef, err
+	}
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 4, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "version", qp.Int(Version))
+		qp.MapEntry(ma, "day", qp.String(day.Format(dayLayout)))
+		qp.MapEntry(ma, "events", qp.Int(w.events))
+		qp.MapEntry(ma, "pages", qp.List(int64(len(w.pages)), func(la datamodel.ListAssembler) {
+			for _, page := range w.pages {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: page}))
+			}
+		}))
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	link, err := w.lsys.Store(linking.LinkContext{}, linkPrototype, root)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to store root: %w", err)
+	}
+	return link.(cidlink.Link).Cid, nil
+}
+
+// ReadFile decodes the archive at path, calling fn with every event in order,
+// and returns its root.
+func ReadFile(path string, fn func(eventrecorder.AggregateEvent) error) (Root, error) {
+	var root Root
+	f, err := os.Open(path)
+	if err != nil {
+		return root, err
+	}
+	defer f.Close()
+	car, err := storage.OpenReadable(f)
+	if err != nil {
+		return root, fmt.Errorf("failed to open archive: %w", err)
+	}
+	if len(car.Roots()) != 1 {
+		return root, fmt.Errorf("archive has %d roots, expected 1", len(car.Roots()))
+	}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(car)
+
+	rootNode, err := lsys.Load(linking.LinkContext{}, cidlink.Link{Cid: car.Roots()[0]}, basicnode.Prototype.Any)
+	if err != nil {
+		return root, fmt.Errorf("failed to load archive root: %w", err)
+	}
+	if root.Version, err = lookupInt(rootNode, "version"); err != nil {
+		return root, err
+	}
+	if root.Version != Version {
+		return root, fmt.Errorf("unsupported archive version %d", root.Version)
+	}
+	if root.Events, err = lookupInt(rootNode, "events"); err != nil {
+		return root, err
+	}
+	dayNode, err := rootNode.LookupByString("day")
+	if err != nil {
+		return root, err
+	}
+	if root.Day, err = dayNode.AsString(); err != nil {
+		return root, err
+	}
+	pagesNode, err := rootNode.LookupByString("pages")
+	if err != nil {
+		return root, err
+	}
+	for it := pagesNode.ListIterator(); it != nil && !it.Done(); {
+		_, pageLink, err := it.Next()
+		if err != nil {
+			return root, err
+		}
+		link, err := pageLink.AsLink()
+		if err != nil {
+			return root, err
+		}
+		root.Pages = append(root.Pages, link.(cidlink.Link).Cid)
+		page, err := lsys.Load(linking.LinkContext{}, link, basicnode.Prototype.Any)
+		if err != nil {
+			return root, fmt.Errorf("failed to load page %s: %w", link, err)
+		}
+		for pit := page.ListIterator(); pit != nil && !pit.Done(); {
+			_, eventNode, err := pit.Next()
+			if err != nil {
+				return root, err
+			}
+			var buf bytes.Buffer
+			if err := dagjson.Encode(eventNode, &buf); err != nil {
+				return root, err
+			}
+			var event eventrecorder.AggregateEvent
+			if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+				return root, fmt.Errorf("failed to decode event: %w", err)
+			}
+			if err := fn(event); err != nil {
+				return root, err
+			}
+		}
+	}
+	return root, nil
+}
+
+func lookupInt(n datamodel.Node, key string) (int64, error) {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return 0, fmt.Errorf("archive root has no %s: %w", key, err)
+	}
+	return v.AsInt()
+}
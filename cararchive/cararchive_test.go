@@ -0,0 +1,102 @@
+package cararchive_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/cararchive"
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/spmap"
+	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "recorder.db")
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN(dsn),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start(ctx))
+
+	encoded, err := os.ReadFile("../testdata/aggregategood.json")
+	require.NoError(t, err)
+	var batch eventrecorder.AggregateEventBatch
+	require.NoError(t, json.Unmarshal(encoded, &batch))
+	require.NoError(t, recorder.RecordAggregateEvents(ctx, batch.Events))
+	recorder.Shutdown()
+
+	db, dialect, err := eventrecorder.OpenDatabase(dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, ok, err := cararchive.LatestDay(ctx, db)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	dir := t.TempDir()
+	day := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	archive, err := cararchive.WriteDay(ctx, db, dialect, dir, day.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, day, archive.Day)
+	require.Equal(t, filepath.Join(dir, "aggregate-events-1970-01-01.car"), archive.Path)
+	require.Equal(t, int64(len(batch.Events)), archive.Events)
+
+	var got []eventrecorder.AggregateEvent
+	root, err := cararchive.ReadFile(archive.Path, func(event eventrecorder.AggregateEvent) error {
+		got = append(got, event)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "1970-01-01", root.Day)
+	require.Equal(t, int64(len(batch.Events)), root.Events)
+	require.Len(t, root.Pages, 1)
+	require.Len(t, got, len(batch.Events))
+	byID := make(map[string]eventrecorder.AggregateEvent)
+	for _, event := range got {
+		byID[event.RetrievalID] = event
+	}
+	for _, want := range batch.Events {
+		want.StartTime = want.StartTime.UTC()
+		want.EndTime = want.EndTime.UTC()
+		require.Equal(t, want, byID[want.RetrievalID])
+	}
+
+	// Archives are content addressed, so rewriting a day yields the same root.
+	rewritten, err := cararchive.WriteDay(ctx, db, dialect, dir, day)
+	require.NoError(t, err)
+	require.Equal(t, archive.RootCid, rewritten.RootCid)
+
+	var rootCid string
+	var count int
+	require.NoError(t, db.QueryRowContext(ctx, `select root_cid, count(*) from archives`).Scan(&rootCid, &count))
+	require.Equal(t, archive.RootCid.String(), rootCid)
+	require.Equal(t, 1, count)
+	latest, ok, err := cararchive.LatestDay(ctx, db)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, day, latest)
+
+	// A day without events is archived as an empty archive.
+	empty, err := cararchive.WriteDay(ctx, db, dialect, dir, day.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, empty.Events)
+	root, err = cararchive.ReadFile(empty.Path, func(eventrecorder.AggregateEvent) error {
+		t.Fatal("unexpected event")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, root.Pages)
+}
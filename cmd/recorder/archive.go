@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/cararchive"
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/ipfs/go-log/v2"
+)
+
+const archiveUsage = `Usage: recorder archive [flags]
+
+  Package each day of aggregate events into a DAG-CBOR CAR file named
+  aggregate-events-<YYYY-MM-DD>.car and record its root CID in the archives
+  table. Without -day, every complete UTC day after the latest archived one is
+  archived, or only yesterday if nothing has been archived yet.
+
+Flags:
+`
+
+func archive(args []string) {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), archiveUsage)
+		fs.PrintDefaults()
+	}
+	dbDSN := fs.String("dbDSN", "", "The database Data Source Name, either a postgres connection string or sqlite://<path> for a SQLite database file. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
+	dir := fs.String("dir", "", "The directory to write archives to.")
+	day := fs.String("day", "", "A single UTC day to archive in YYYY-MM-DD format, replacing any existing archive of that day.")
+	logLevel := fs.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
+	_ = fs.Parse(args)
+
+	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
+		_ = log.SetLogLevel("*", *logLevel)
+	}
+	if v, set := os.LookupEnv("LASSIE_EVENT_RECORDER_DB_DSN"); set {
+		dbDSN = &v
+	}
+	if *dbDSN == "" {
+		logger.Fatal("A database DSN must be specified")
+	}
+	if *dir == "" {
+		logger.Fatal("An archive directory must be specified")
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	today := cararchive.Day(time.Now())
+	var days []time.Time
+	if *day != "" {
+		d, err := time.Parse("2006-01-02", *day)
+		if err != nil {
+			logger.Fatalf("Day must be in YYYY-MM-DD format, got %q", *day)
+		}
+		if !d.Before(today) {
+			logger.Fatalf("Day %s is not complete yet", *day)
+		}
+		days = append(days, d)
+	}
+
+	db, dialect, err := eventrecorder.OpenDatabase(*dbDSN)
+	if err != nil {
+		logger.Fatalw("Failed to open database", "err", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if days == nil {
+		next := today.Add(-24 * time.Hour)
+		latest, ok, err := cararchive.LatestDay(ctx, db)
+		if err != nil {
+			logger.Fatalw("Failed to find the latest archive", "err", err)
+		}
+		if ok {
+			next = latest.Add(24 * time.Hour)
+		}
+		for d := next; d.Before(today); d = d.Add(24 * time.Hour) {
+			days = append(days, d)
+		}
+	}
+	if len(days) == 0 {
+		fmt.Println("no days to archive")
+		return
+	}
+	for _, d := range days {
+		a, err := cararchive.WriteDay(ctx, db, dialect, *dir, d)
+		if err != nil {
+			logger.Fatalw("Failed to archive day", "day", d.Format("2006-01-02"), "err", err)
+		}
+		fmt.Printf("archived %s: %d events, root %s, %s\n", d.Format("2006-01-02"), a.Events, a.RootCid, a.Path)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/ipfs/go-log/v2"
+)
+
+const backfillUsage = `Usage: recorder backfill-aggregates [flags]
+
+  Reconstruct aggregate events and retrieval attempts from the v1 events in
+  retrieval_events, for retrievals that have no aggregate event. Retrievals
+  are processed in windows by the time of their indexer started event. Without
+  -from, the backfill resumes from where the last one stopped, so it can be
+  interrupted and re-run at any time.
+
+Flags:
+`
+
+func backfillAggregates(args []string) {
+	fs := flag.NewFlagSet("backfill-aggregates", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), backfillUsage)
+		fs.PrintDefaults()
+	}
+	dbDSN := fs.String("dbDSN", "", "The database Data Source Name, either a postgres connection string or sqlite://<path> for a SQLite database file. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
+	autoMigrate := fs.Bool("autoMigrate", false, "Whether to apply pending database schema migrations before backfilling.")
+	spLookupConcurrency := fs.Int("spLookupConcurrency", 16, "The number of concurrent storage provider ID lookups.")
+	from := fs.String("from", "", "Backfill retrievals started at or after this RFC 3339 time, without reading or saving the checkpoint.")
+	to := fs.String("to", "", "Backfill retrievals started before this RFC 3339 time. Defaults to -horizon before now.")
+	window := fs.Duration("window", time.Hour, "The time range of retrievals assembled at once.")
+	horizon := fs.Duration("horizon", time.Hour, "How long after a retrieval started its events are read.")
+	logLevel := fs.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
+	_ = fs.Parse(args)
+
+	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
+		_ = log.SetLogLevel("*", *logLevel)
+	}
+	if v, set := os.LookupEnv("LASSIE_EVENT_RECORDER_DB_DSN"); set {
+		dbDSN = &v
+	}
+	if *dbDSN == "" {
+		logger.Fatal("A database DSN must be specified")
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg := eventrecorder.BackfillConfig{Window: *window, Horizon: *horizon}
+	var err error
+	if *from != "" {
+		if cfg.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			logger.Fatalf("From must be an RFC 3339 time, got %q", *from)
+		}
+	}
+	if *to != "" {
+		if cfg.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			logger.Fatalf("To must be an RFC 3339 time, got %q", *to)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN(*dbDSN),
+		eventrecorder.WithAutoMigrate(*autoMigrate),
+		eventrecorder.WithSPLookupConcurrency(*spLookupConcurrency),
+	)
+	if err != nil {
+		logger.Fatalw("Failed to instantiate recorder", "err", err)
+	}
+	if err := recorder.Start(ctx); err != nil {
+		logger.Fatalw("Failed to start recorder", "err", err)
+	}
+	stats, err := recorder.BackfillAggregates(ctx, cfg)
+	recorder.Shutdown()
+	cancel()
+
+	fmt.Printf("windows: %d, recorded: %d, invalid: %d\n", stats.Windows, stats.Recorded, stats.Invalid)
+	if err != nil {
+		logger.Errorw("Backfill stopped early", "err", err)
+		os.Exit(1)
+	}
+}
@@ -7,10 +7,18 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/filecoin-project/lassie-event-recorder/anomaly"
 	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/filesink"
+	"github.com/filecoin-project/lassie-event-recorder/heartbeat"
+	"github.com/filecoin-project/lassie-event-recorder/hotcontent"
 	"github.com/filecoin-project/lassie-event-recorder/httpserver"
 	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/filecoin-project/lassie-event-recorder/webhook"
+	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-log/v2"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -18,16 +26,76 @@ import (
 var logger = log.Logger("lassie/event_recorder/cmd")
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "archive":
+			archive(os.Args[2:])
+			return
+		case "replay":
+			replayArchives(os.Args[2:])
+			return
+		case "backfill-aggregates":
+			backfillAggregates(os.Args[2:])
+			return
+		}
+	}
+	serve()
+}
+
+func serve() {
 	// TODO: add flags for all options eventually.
 	httpListenAddr := flag.String("httpListenAddr", "0.0.0.0:8080", "The HTTP server listen address in address:port format.")
-	dbDSN := flag.String("dbDSN", "", "The database Data Source Name. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
+	dbDSN := flag.String("dbDSN", "", "The database Data Source Name, either a postgres connection string or sqlite://<path> for a SQLite database file. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
 	logLevel := flag.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
 	metricsListenAddr := flag.String("metricsListenAddr", "0.0.0.0:7777", "The metrics server listen address in address:port format.")
 	mongoAddr := flag.String("mongo", "", "A Mongo endpoint to write to.")
 	mongoDB := flag.String("mongoDB", "", "The Mongo DB to write to.")
 	mongoCollection := flag.String("mongoCollection", "", "The Mongo Collection to write to.")
 	mongoPercent := flag.Float64("mongoPercent", 0.0, "Percentage chance that a write will push to mongo [0,1]")
+	mongoQueueSize := flag.Int("mongoQueueSize", 10_000, "The maximum number of reports waiting to be written to mongo. Reports are dropped while the queue is full.")
+	mongoBatchSize := flag.Int("mongoBatchSize", 500, "The maximum number of reports written to mongo at once.")
+	mongoFlushInterval := flag.Duration("mongoFlushInterval", time.Second, "The longest a report waits before being written to mongo.")
+	mongoWriteConcern := flag.String("mongoWriteConcern", "", "The mongo write concern; either majority or the number of nodes that must acknowledge writes. Uses the server default if unset.")
+	mongoTTL := flag.Duration("mongoTTL", 0, "How long to keep reports in mongo, based on their start time. Zero keeps reports forever.")
+	mongoRollupCollection := flag.String("mongoRollupCollection", "", "A Mongo Collection of daily per storage provider rollups, updated by every retrieval with a known Filecoin SP ID. Disabled if unset.")
+	mongoSamplingRules := flag.String("mongoSamplingRules", "", "A JSON file of rules deciding which retrievals are pushed to mongo. Its rate replaces mongoPercent.")
+	coalesceMaxBatch := flag.Int("coalesceMaxBatch", 0, "The maximum number of rows to buffer across requests before writing them to the database. Zero disables write coalescing.")
+	coalesceMaxDelay := flag.Duration("coalesceMaxDelay", 50*time.Millisecond, "The maximum time a row is buffered before being written to the database when write coalescing is enabled.")
+	partitionInterval := flag.String("partitionInterval", "", "The time range of each event table partition, either daily or weekly. The event tables are partitioned on first use, and are neither partitioned nor maintained if unset.")
+	partitionPremake := flag.Int("partitionPremake", 7, "The number of future partitions to create ahead of time.")
+	partitionRetention := flag.Duration("partitionRetention", 0, "How long to keep partitions after their time range has passed. Zero keeps partitions forever.")
+	partitionDetach := flag.Bool("partitionDetach", false, "Whether to detach expired partitions instead of dropping them.")
+	partitionArchiveDir := flag.String("partitionArchiveDir", "", "A directory to archive expired partitions to as gzipped CSV before they are removed.")
+	spLookupConcurrency := flag.Int("spLookupConcurrency", 16, "The number of concurrent storage provider ID lookups shared across all requests.")
+	autoMigrate := flag.Bool("autoMigrate", false, "Whether to apply pending database schema migrations on startup.")
+	fileSinkDir := flag.String("fileSinkDir", "", "A directory to archive every accepted event to as JSON lines files. Disabled if unset.")
+	fileSinkMaxSize := flag.Int64("fileSinkMaxSize", 128<<20, "The size in bytes after which an archive file is rotated. Zero disables size based rotation.")
+	fileSinkMaxAge := flag.Duration("fileSinkMaxAge", time.Hour, "The time after which an archive file is rotated. Zero disables time based rotation.")
+	fileSinkCompress := flag.Bool("fileSinkCompress", false, "Whether to gzip archive files once they are rotated.")
+	fileSinkRetain := flag.Int("fileSinkRetain", 0, "The number of rotated archive files to keep. Zero keeps every file.")
+	webhookConfig := flag.String("webhookConfig", "", "A JSON file of HTTP endpoints to forward aggregate events to. Disabled if unset.")
+	assembleEvents := flag.Bool("assembleEvents", false, "Whether to build aggregate events from the v1 events of Lassie instances that do not send aggregate events.")
+	assembleTimeout := flag.Duration("assembleTimeout", 5*time.Minute, "How long a retrieval being assembled from v1 events waits for its next event before it is recorded as failed.")
+	clockSkew := flag.Bool("clockSkew", false, "Whether to estimate the clock offset of each Lassie instance and report it as a metric.")
+	eventPhases := flag.String("eventPhases", "", "A comma separated list of the phases accepted in v1 events. Defaults to those of Lassie v0.5.")
+	eventCodes := flag.String("eventCodes", "", "A comma separated list of the event codes accepted in v1 events. Defaults to those of Lassie v0.5.")
+	unknownEvents := flag.String("unknownEvents", string(eventrecorder.RejectUnknownEvents), "What to do with v1 events of any other phase or event code: reject their batch, skip-metrics to store them without reporting them to metrics, or drop them.")
+	clockSkewMaxCorrection := flag.Duration("clockSkewMaxCorrection", 0, "The maximum correction applied to event times when storing corrected times alongside reported ones. Zero only estimates offsets.")
 
+	instanceRegistry := flag.String("instanceRegistry", "", "What to do with events of instances that are not registered or inactive: tag them as unregistered in metrics, or reject their batch. Instances are not checked if unset.")
+	adminToken := flag.String("adminToken", "", "The bearer token of the admin API, which manages the instance registry. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_ADMIN_TOKEN environment variable. The admin API is disabled if unset.")
+	heartbeatEnabled := flag.Bool("heartbeat", false, "Whether to track when each Lassie instance last reported and at what rate, served as JSON at /instances on the metrics server, and detect instances that go silent.")
+	silenceFactor := flag.Float64("silenceFactor", 10, "How many times its usual interval between batches an instance must go without reporting to be considered silent.")
+	minSilence := flag.Duration("minSilence", 5*time.Minute, "The shortest silence reported, however often an instance usually reports.")
+	anomalyConfig := flag.String("anomalyConfig", "", "A JSON file configuring the detection of storage provider degradations and the webhook alerts are sent to. Disabled if unset.")
+	hourlyRollups := flag.Duration("hourlyRollups", 0, "How often to roll up newly stored aggregate events into the hourly_rollups table. Zero disables rollups.")
+	digestWindow := flag.Duration("digestWindow", 0, "The sliding window over which quantiles of time to first byte and bandwidth are kept per storage provider and protocol, served as JSON at /v1/storage-providers/digests. Zero disables digests.")
+	digestTopN := flag.Int("digestTopN", 20, "The number of storage providers, by recent successful retrievals, whose quantiles are reported as metrics.")
+	hotContentPeriod := flag.Duration("hotContentPeriod", 0, "The period over which the most retrieved and most failed CIDs are counted, served as JSON at /v1/content/hot and stored in the database at the end of each period. Zero disables hot content tracking.")
+	hotContentTopK := flag.Int("hotContentTopK", 100, "The number of most retrieved and most failed CIDs tracked.")
 	flag.Parse()
 
 	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
@@ -42,6 +110,10 @@ func main() {
 		mongoAddr = &v
 	}
 
+	if v, set := os.LookupEnv("LASSIE_EVENT_RECORDER_ADMIN_TOKEN"); set {
+		adminToken = &v
+	}
+
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
 
@@ -56,11 +128,122 @@ func main() {
 	opts := []eventrecorder.Option{
 		eventrecorder.WithDatabaseDSN(*dbDSN),
 		eventrecorder.WithMetrics(metrics),
+		eventrecorder.WithWriteCoalescing(*coalesceMaxBatch, *coalesceMaxDelay),
+		eventrecorder.WithAutoMigrate(*autoMigrate),
+		eventrecorder.WithSPLookupConcurrency(*spLookupConcurrency),
+	}
+	if *partitionInterval != "" {
+		opts = append(opts, eventrecorder.WithPartitioning(eventrecorder.PartitionConfig{
+			Interval:   eventrecorder.PartitionInterval(*partitionInterval),
+			Premake:    *partitionPremake,
+			Retention:  *partitionRetention,
+			Detach:     *partitionDetach,
+			ArchiveDir: *partitionArchiveDir,
+		}))
+	}
+	if *assembleEvents {
+		opts = append(opts, eventrecorder.WithEventAssembly(*assembleTimeout))
+	}
+	if codes := parseEventCodes(*eventPhases, *eventCodes, *unknownEvents); codes != nil {
+		opts = append(opts, eventrecorder.WithEventCodes(*codes))
+	}
+	if *clockSkew {
+		opts = append(opts, eventrecorder.WithClockSkewDetection(*clockSkewMaxCorrection))
+	}
+	if *hourlyRollups > 0 {
+		opts = append(opts, eventrecorder.WithHourlyRollups(*hourlyRollups))
+	}
+	if *digestWindow > 0 {
+		opts = append(opts, eventrecorder.WithProviderDigests(eventrecorder.DigestConfig{
+			Window: *digestWindow,
+			TopN:   *digestTopN,
+		}))
+	}
+	if *hotContentPeriod > 0 {
+		tracker, err := hotcontent.New(hotcontent.Config{K: *hotContentTopK})
+		if err != nil {
+			logger.Fatalw("Failed to instantiate hot content tracker", "err", err)
+		}
+		opts = append(opts, eventrecorder.WithHotContent(tracker, *hotContentPeriod))
+	}
+	if *instanceRegistry != "" {
+		opts = append(opts, eventrecorder.WithInstanceRegistry(eventrecorder.UnregisteredInstancePolicy(*instanceRegistry)))
+	}
+	if *heartbeatEnabled {
+		monitor, err := heartbeat.New(heartbeat.Config{
+			SilenceFactor: *silenceFactor,
+			MinSilence:    *minSilence,
+			Metrics:       metrics,
+		})
+		if err != nil {
+			logger.Fatalw("Failed to instantiate heartbeat monitor", "err", err)
+		}
+		metricsMux.Handle("/instances", monitor)
+		opts = append(opts, eventrecorder.WithSinks(monitor))
+	}
+	if *fileSinkDir != "" {
+		sink, err := filesink.New(filesink.Config{
+			Dir:      *fileSinkDir,
+			MaxSize:  *fileSinkMaxSize,
+			MaxAge:   *fileSinkMaxAge,
+			Compress: *fileSinkCompress,
+			Retain:   *fileSinkRetain,
+		})
+		if err != nil {
+			logger.Fatalw("Failed to instantiate file sink", "err", err)
+		}
+		opts = append(opts, eventrecorder.WithSinks(sink))
+	}
+	// The recorder is created once its options are complete, before any event
+	// reaches the sinks that use it.
+	var recorder *eventrecorder.EventRecorder
+	if *webhookConfig != "" {
+		cfg, err := webhook.LoadConfig(*webhookConfig)
+		if err != nil {
+			logger.Fatalw("Failed to load webhook config", "err", err)
+		}
+		// Filters may select storage providers by Filecoin SP ID, resolved
+		// like those stored with events.
+		cfg.ResolveStorageProviders = func(ctx context.Context, ids []string) (map[string]string, error) {
+			return recorder.FilecoinSPIDs(ctx, ids)
+		}
+		sink, err := webhook.New(cfg)
+		if err != nil {
+			logger.Fatalw("Failed to instantiate webhook sink", "err", err)
+		}
+		opts = append(opts, eventrecorder.WithSinks(sink))
+	}
+	if *anomalyConfig != "" {
+		cfg, err := anomaly.LoadConfig(*anomalyConfig)
+		if err != nil {
+			logger.Fatalw("Failed to load anomaly detection config", "err", err)
+		}
+		analyzer, err := anomaly.New(cfg)
+		if err != nil {
+			logger.Fatalw("Failed to instantiate anomaly detection", "err", err)
+		}
+		opts = append(opts, eventrecorder.WithSinks(analyzer))
 	}
 	if *mongoAddr != "" {
 		logger.Info("Including mongo reporting")
 		mOpt := eventrecorder.WithMongoSubmissions(*mongoAddr, *mongoDB, *mongoCollection, float32(*mongoPercent))
-		opts = append(opts, mOpt)
+		opts = append(opts, mOpt, eventrecorder.WithMongoWriter(eventrecorder.MongoWriterConfig{
+			QueueSize:     *mongoQueueSize,
+			BatchSize:     *mongoBatchSize,
+			FlushInterval: *mongoFlushInterval,
+			WriteTimeout:  30 * time.Second,
+			WriteConcern:  *mongoWriteConcern,
+		}), eventrecorder.WithMongoTTL(*mongoTTL))
+		if *mongoSamplingRules != "" {
+			rules, err := eventrecorder.LoadSamplingRules(*mongoSamplingRules)
+			if err != nil {
+				logger.Fatalw("Failed to load mongo sampling rules", "err", err)
+			}
+			opts = append(opts, eventrecorder.WithMongoSampling(rules))
+		}
+		if *mongoRollupCollection != "" {
+			opts = append(opts, eventrecorder.WithMongoRollups(*mongoRollupCollection))
+		}
 	}
 	recorder, err := eventrecorder.New(opts...)
 	if err != nil {
@@ -68,7 +251,7 @@ func main() {
 	}
 
 	addr := httpserver.WithHttpServerListenAddr(*httpListenAddr)
-	server, err := httpserver.NewHttpServer(recorder, addr)
+	server, err := httpserver.NewHttpServer(recorder, addr, httpserver.WithAdminToken(*adminToken))
 	if err != nil {
 		logger.Fatalw("Failed to instantiate server", "err", err)
 	}
@@ -98,3 +281,27 @@ func main() {
 		logger.Info("Shut down server successfully")
 	}
 }
+
+// parseEventCodes returns the event codes set by the -eventPhases,
+// -eventCodes and -unknownEvents flags, or nil if they are left to their
+// defaults.
+func parseEventCodes(phases, codes, unknown string) *eventrecorder.EventCodes {
+	if phases == "" && codes == "" && unknown == string(eventrecorder.RejectUnknownEvents) {
+		return nil
+	}
+	eventCodes := eventrecorder.DefaultEventCodes()
+	if phases != "" {
+		eventCodes.Phases = nil
+		for _, phase := range strings.Split(phases, ",") {
+			eventCodes.Phases = append(eventCodes.Phases, types.Phase(strings.TrimSpace(phase)))
+		}
+	}
+	if codes != "" {
+		eventCodes.Codes = nil
+		for _, code := range strings.Split(codes, ",") {
+			eventCodes.Codes = append(eventCodes.Codes, types.EventCode(strings.TrimSpace(code)))
+		}
+	}
+	eventCodes.Unknown = eventrecorder.UnknownEventPolicy(unknown)
+	return &eventCodes
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/ipfs/go-log/v2"
+)
+
+const migrateUsage = `Usage: recorder migrate [flags] <up [N] | down [N] | status>
+
+  up [N]     Apply the next N pending migrations, or all of them if N is omitted.
+  down [N]   Revert the last N applied migrations. N defaults to 1.
+  status     List all migrations and whether they have been applied.
+
+Flags:
+`
+
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	dbDSN := fs.String("dbDSN", "", "The database Data Source Name, either a postgres connection string or sqlite://<path> for a SQLite database file. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
+	logLevel := fs.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
+	_ = fs.Parse(args)
+
+	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
+		_ = log.SetLogLevel("*", *logLevel)
+	}
+	if v, set := os.LookupEnv("LASSIE_EVENT_RECORDER_DB_DSN"); set {
+		dbDSN = &v
+	}
+	if *dbDSN == "" {
+		logger.Fatal("A database DSN must be specified")
+	}
+
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := fs.Arg(0)
+	var steps int
+	switch command {
+	case "up":
+	case "down":
+		steps = 1
+	case "status":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if fs.NArg() == 2 {
+		n, err := strconv.Atoi(fs.Arg(1))
+		if err != nil || n <= 0 {
+			logger.Fatalf("Number of migrations must be a positive integer, got %q", fs.Arg(1))
+		}
+		steps = n
+	}
+
+	migrator, db, err := eventrecorder.OpenMigrator(*dbDSN)
+	if err != nil {
+		logger.Fatalw("Failed to open database", "err", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx, steps)
+		for _, mig := range applied {
+			fmt.Printf("applied %d_%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			logger.Fatalw("Failed to apply migrations", "err", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		reverted, err := migrator.Down(ctx, steps)
+		for _, mig := range reverted {
+			fmt.Printf("reverted %d_%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			logger.Fatalw("Failed to revert migrations", "err", err)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no applied migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Fatalw("Failed to read migration status", "err", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		_ = tw.Flush()
+	}
+}
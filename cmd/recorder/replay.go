@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/replay"
+	"github.com/ipfs/go-log/v2"
+)
+
+const replayUsage = `Usage: recorder replay [flags] <file or directory>...
+
+  Record the events in archive files: JSON lines archives written with
+  -fileSinkDir (*.jsonl, *.jsonl.gz), CAR archives written by the archive
+  subcommand (*.car) and CSV dumps of retrieval_events (*.csv, *.csv.gz).
+  Directories are replayed file by file in name order, skipping dumps of
+  other tables such as those among partition archives. Invalid events are
+  skipped, and statistics are printed once every file has been replayed.
+
+Flags:
+`
+
+func replayArchives(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), replayUsage)
+		fs.PrintDefaults()
+	}
+	dbDSN := fs.String("dbDSN", "", "The database Data Source Name, either a postgres connection string or sqlite://<path> for a SQLite database file. Alternatively, it may be specified via LASSIE_EVENT_RECORDER_DB_DSN environment variable. If both are present, the environment variable takes precedence.")
+	autoMigrate := fs.Bool("autoMigrate", false, "Whether to apply pending database schema migrations before replaying.")
+	spLookupConcurrency := fs.Int("spLookupConcurrency", 16, "The number of concurrent storage provider ID lookups.")
+	from := fs.String("from", "", "Only replay events at or after this RFC 3339 time.")
+	to := fs.String("to", "", "Only replay events before this RFC 3339 time.")
+	rate := fs.Float64("rate", 0, "The maximum number of events replayed per second. Zero replays as fast as possible.")
+	batchSize := fs.Int("batchSize", 500, "The maximum number of events recorded at once.")
+	dryRun := fs.Bool("dryRun", false, "Only validate events and print statistics, without recording them.")
+	skipReporting := fs.Bool("skipReporting", false, "Only store events, without reporting them to metrics or rollups or forwarding them to sinks, for events that were reported when first received.")
+	eventPhases := fs.String("eventPhases", "", "A comma separated list of the phases accepted in v1 events, as passed to the recorder. Defaults to those of Lassie v0.5.")
+	eventCodes := fs.String("eventCodes", "", "A comma separated list of the event codes accepted in v1 events, as passed to the recorder. Defaults to those of Lassie v0.5.")
+	unknownEvents := fs.String("unknownEvents", string(eventrecorder.RejectUnknownEvents), "What to do with v1 events of any other phase or event code, as passed to the recorder: reject, skip-metrics or drop.")
+	logLevel := fs.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
+	_ = fs.Parse(args)
+
+	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
+		_ = log.SetLogLevel("*", *logLevel)
+	}
+	if v, set := os.LookupEnv("LASSIE_EVENT_RECORDER_DB_DSN"); set {
+		dbDSN = &v
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	codes := parseEventCodes(*eventPhases, *eventCodes, *unknownEvents)
+	cfg := replay.Config{Rate: *rate, BatchSize: *batchSize, DryRun: *dryRun, SkipReporting: *skipReporting, EventCodes: codes}
+	var err error
+	if *from != "" {
+		if cfg.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			logger.Fatalf("From must be an RFC 3339 time, got %q", *from)
+		}
+	}
+	if *to != "" {
+		if cfg.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			logger.Fatalf("To must be an RFC 3339 time, got %q", *to)
+		}
+	}
+	files, err := replay.Files(fs.Args())
+	if err != nil {
+		logger.Fatalw("Failed to list files", "err", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var recorder *eventrecorder.EventRecorder
+	var target replay.Recorder
+	if !*dryRun {
+		if *dbDSN == "" {
+			logger.Fatal("A database DSN must be specified unless replaying in dry run mode")
+		}
+		opts := []eventrecorder.Option{
+			eventrecorder.WithDatabaseDSN(*dbDSN),
+			eventrecorder.WithAutoMigrate(*autoMigrate),
+			eventrecorder.WithSPLookupConcurrency(*spLookupConcurrency),
+		}
+		if codes != nil {
+			opts = append(opts, eventrecorder.WithEventCodes(*codes))
+		}
+		recorder, err = eventrecorder.New(opts...)
+		if err != nil {
+			logger.Fatalw("Failed to instantiate recorder", "err", err)
+		}
+		if err := recorder.Start(ctx); err != nil {
+			logger.Fatalw("Failed to start recorder", "err", err)
+		}
+		target = recorder
+	}
+	replayer, err := replay.New(target, cfg)
+	if err != nil {
+		logger.Fatalw("Failed to instantiate replayer", "err", err)
+	}
+
+	for _, path := range files {
+		logger.Infow("Replaying file", "path", path)
+		if err = replayer.ReplayFile(ctx, path); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = replayer.Flush(ctx)
+	}
+	if recorder != nil {
+		recorder.Shutdown()
+	}
+	cancel()
+
+	stats := replayer.Stats()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tREAD\tSKIPPED\tINVALID\tRECORDED\tFAILED")
+	for _, row := range []struct {
+		kind   string
+		counts replay.Counts
+	}{{"events", stats.Events}, {"aggregate events", stats.AggregateEvents}} {
+		c := row.counts
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", row.kind, c.Read, c.Skipped, c.Invalid, c.Recorded, c.Failed)
+	}
+	_ = tw.Flush()
+
+	if err != nil {
+		logger.Errorw("Replay stopped early", "err", err)
+		os.Exit(1)
+	}
+	if stats.Events.Failed > 0 || stats.AggregateEvents.Failed > 0 {
+		os.Exit(1)
+	}
+}
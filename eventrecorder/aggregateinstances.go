@@ -0,0 +1,95 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// aggregateInstances holds the Lassie instances known to send aggregate
+// events. Their v1 events describe retrievals that their aggregate events
+// already record, so they are neither assembled into aggregate events nor
+// counted as hot content.
+//
+// Instances are stored in the database, when the recorder has one, so that
+// they are known again after a restart and to every recorder sharing it.
+type aggregateInstances struct {
+	// db is nil when the recorder has no database.
+	db *sql.DB
+
+	lk  sync.RWMutex
+	ids map[string]struct{}
+}
+
+func newAggregateInstances(db *sql.DB) *aggregateInstances {
+	return &aggregateInstances{
+		db:  db,
+		ids: make(map[string]struct{}),
+	}
+}
+
+// load reads the instances stored by any recorder.
+func (a *aggregateInstances) load(ctx context.Context) error {
+	if a.db == nil {
+		return nil
+	}
+	rows, err := a.db.QueryContext(ctx, `select instance_id from aggregate_instances`)
+	if err != nil {
+		return fmt.Errorf("failed to query instances sending aggregate events: %w", err)
+	}
+	defer rows.Close()
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan instance sending aggregate events: %w", err)
+		}
+		a.ids[id] = struct{}{}
+	}
+	return rows.Err()
+}
+
+// observe notes the instances of events, storing those not known yet.
+func (a *aggregateInstances) observe(ctx context.Context, events []AggregateEvent) {
+	var added []string
+	a.lk.Lock()
+	for _, event := range events {
+		if _, ok := a.ids[event.InstanceID]; !ok {
+			logger.Infow("Instance sends aggregate events; ignoring its v1 events for assembly and hot content", "instanceID", event.InstanceID)
+			a.ids[event.InstanceID] = struct{}{}
+			added = append(added, event.InstanceID)
+		}
+	}
+	a.lk.Unlock()
+	if a.db == nil {
+		return
+	}
+	now := time.Now().UTC()
+	for _, id := range added {
+		if _, err := a.db.ExecContext(ctx, `
+			insert into aggregate_instances(instance_id, first_seen)
+			values ($1, $2)
+			on conflict (instance_id) do nothing
+			`, id, now); err != nil {
+			logger.Warnw("Failed to store instance sending aggregate events", "instanceID", id, "err", err)
+		}
+	}
+}
+
+// remember notes an instance found in the database by another query.
+func (a *aggregateInstances) remember(id string) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	a.ids[id] = struct{}{}
+}
+
+// contains reports whether an instance is known to send aggregate events.
+func (a *aggregateInstances) contains(id string) bool {
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	_, ok := a.ids[id]
+	return ok
+}
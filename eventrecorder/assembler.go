@@ -0,0 +1,297 @@
+package eventrecorder
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/multiformats/go-multicodec"
+)
+
+// finishedRetrievalsSize is the number of recently assembled retrieval IDs
+// remembered so that events arriving after a retrieval finished are ignored.
+const finishedRetrievalsSize = 100_000
+
+// assembler builds aggregate events from the v1 events of Lassie instances
+// that do not send aggregate events themselves.
+//
+// Events are grouped by retrieval ID until the retrieval succeeds or fails
+// for good, or no event has been seen for the timeout, at which point an
+// aggregate event is built from everything seen so far and passed to emit.
+// Assembly only works if every event of a retrieval reaches the same
+// recorder.
+type assembler struct {
+	timeout time.Duration
+	emit    func([]AggregateEvent)
+	now     func() time.Time
+
+	// instances sending aggregate events are skipped.
+	instances *aggregateInstances
+
+	lk         sync.Mutex
+	retrievals map[types.RetrievalID]*pendingRetrieval
+	finished   *lru.Cache
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type pendingRetrieval struct {
+	event     AggregateEvent
+	lastEvent time.Time
+	// lastSeen is when the recorder last received an event of the retrieval,
+	// used for timeouts regardless of the instance's clock.
+	lastSeen        time.Time
+	firstByte       map[string]time.Time
+	attemptStarted  map[string]time.Time
+	firstCandidates time.Time
+}
+
+func newAssembler(timeout time.Duration, instances *aggregateInstances, emit func([]AggregateEvent)) *assembler {
+	finished, _ := lru.New(finishedRetrievalsSize)
+	a := &assembler{
+		timeout:    timeout,
+		emit:       emit,
+		now:        time.Now,
+		instances:  instances,
+		retrievals: make(map[types.RetrievalID]*pendingRetrieval),
+		finished:   finished,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// add folds events into their retrievals and returns the aggregate events of
+// the retrievals they finished.
+func (a *assembler) add(events []Event) []AggregateEvent {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	now := a.now()
+	var done []AggregateEvent
+	for _, event := range events {
+		if a.instances.contains(event.InstanceId) {
+			continue
+		}
+		if a.finished.Contains(event.RetrievalId) {
+			continue
+		}
+		p, ok := a.retrievals[event.RetrievalId]
+		if !ok {
+			p = newPendingRetrieval(event)
+			a.retrievals[event.RetrievalId] = p
+		}
+		p.lastSeen = now
+		if p.fold(event) {
+			done = append(done, a.finish(event.RetrievalId, p))
+		}
+	}
+	return done
+}
+
+func newPendingRetrieval(first Event) *pendingRetrieval {
+	return &pendingRetrieval{
+		event: AggregateEvent{
+			InstanceID:  first.InstanceId,
+			RetrievalID: first.RetrievalId.String(),
+			RootCid:     first.Cid,
+			StartTime:   first.PhaseStartTime,
+		},
+		firstByte:      make(map[string]time.Time),
+		attemptStarted: make(map[string]time.Time),
+	}
+}
+
+// fold records an event, reporting whether it finished the retrieval.
+func (p *pendingRetrieval) fold(event Event) bool {
+	if event.EventTime.After(p.lastEvent) {
+		p.lastEvent = event.EventTime
+	}
+	storageProviderID := event.StorageProviderId
+
+	switch event.Phase {
+	case types.IndexerPhase:
+		switch event.EventName {
+		case types.StartedCode:
+			// The indexer phase starts when the retrieval does.
+			p.event.StartTime = event.EventTime
+		case types.CandidatesFoundCode:
+			if count := detailInt(event.EventDetails, "candidateCount"); count > 0 {
+				if p.firstCandidates.IsZero() {
+					p.firstCandidates = event.EventTime
+				}
+				p.event.IndexerCandidatesReceived += count
+			}
+		case types.CandidatesFilteredCode:
+			p.event.IndexerCandidatesFiltered += detailInt(event.EventDetails, "candidateCount")
+		case types.FailedCode:
+			// Without candidates there is nothing left to retrieve from.
+			p.event.EndTime = event.EventTime
+			return true
+		}
+	case types.RetrievalPhase:
+		if storageProviderID == "" {
+			// A failure that is not attributed to a storage provider ends the
+			// whole retrieval.
+			if event.EventName == types.FailedCode {
+				p.event.EndTime = event.EventTime
+				return true
+			}
+			return false
+		}
+		attempt := p.attempt(storageProviderID)
+		switch event.EventName {
+		case types.StartedCode:
+			p.attemptStarted[storageProviderID] = event.EventTime
+		case types.FirstByteCode:
+			if _, ok := p.firstByte[storageProviderID]; !ok {
+				p.firstByte[storageProviderID] = event.EventTime
+				start, ok := p.attemptStarted[storageProviderID]
+				if !ok {
+					start = event.PhaseStartTime
+				}
+				attempt.TimeToFirstByte = event.EventTime.Sub(start).String()
+			}
+		case types.FailedCode:
+			attempt.Error = detailString(event.EventDetails, "error")
+		case types.SuccessCode:
+			received := uint64(detailInt(event.EventDetails, "receivedSize"))
+			attempt.BytesTransferred = received
+			p.event.Success = true
+			p.event.StorageProviderID = storageProviderID
+			p.event.ProtocolSucceeded = attempt.Protocol
+			p.event.BytesTransferred = received
+			p.event.EndTime = event.EventTime
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pendingRetrieval) attempt(storageProviderID string) *RetrievalAttempt {
+	if p.event.RetrievalAttempts == nil {
+		p.event.RetrievalAttempts = make(map[string]*RetrievalAttempt)
+	}
+	attempt, ok := p.event.RetrievalAttempts[storageProviderID]
+	if !ok {
+		// v1 events do not name their protocol; Lassie retrieved over bitswap
+		// under the Bitswap identifier and over graphsync from everyone else.
+		protocol := multicodec.TransportGraphsyncFilecoinv1
+		if storageProviderID == types.BitswapIndentifier {
+			protocol = multicodec.TransportBitswap
+		}
+		attempt = &RetrievalAttempt{Protocol: protocol.String()}
+		p.event.RetrievalAttempts[storageProviderID] = attempt
+	}
+	return attempt
+}
+
+// finish removes a retrieval and builds its aggregate event. a.lk must be
+// held.
+func (a *assembler) finish(id types.RetrievalID, p *pendingRetrieval) AggregateEvent {
+	delete(a.retrievals, id)
+	a.finished.Add(id, struct{}{})
+	return p.aggregate()
+}
+
+// aggregate builds the aggregate event of everything folded so far. A
+// retrieval that has not finished ends at its latest event.
+func (p *pendingRetrieval) aggregate() AggregateEvent {
+	event := p.event
+	if event.EndTime.IsZero() {
+		event.EndTime = p.lastEvent
+	}
+	if event.EndTime.Before(event.StartTime) {
+		event.EndTime = event.StartTime
+	}
+	if !p.firstCandidates.IsZero() {
+		event.TimeToFirstIndexerResult = p.firstCandidates.Sub(event.StartTime).String()
+	}
+	if event.Success {
+		if firstByte, ok := p.firstByte[event.StorageProviderID]; ok {
+			event.TimeToFirstByte = firstByte.Sub(event.StartTime).String()
+			if transfer := event.EndTime.Sub(firstByte).Seconds(); transfer > 0 {
+				event.Bandwidth = uint64(float64(event.BytesTransferred) / transfer)
+			}
+		}
+	}
+	protocols := make(map[string]struct{})
+	for _, attempt := range event.RetrievalAttempts {
+		protocols[attempt.Protocol] = struct{}{}
+	}
+	for protocol := range protocols {
+		event.ProtocolsAttempted = append(event.ProtocolsAttempted, protocol)
+	}
+	sort.Strings(event.ProtocolsAttempted)
+	return event
+}
+
+func (a *assembler) run() {
+	defer close(a.stopped)
+	interval := a.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if expired := a.expire(); len(expired) > 0 {
+				logger.Infow("Assembled timed out retrievals", "total", len(expired))
+				a.emit(expired)
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// expire finishes the retrievals that have not seen an event for the timeout.
+func (a *assembler) expire() []AggregateEvent {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	now := a.now()
+	var expired []AggregateEvent
+	for id, p := range a.retrievals {
+		if now.Sub(p.lastSeen) >= a.timeout {
+			expired = append(expired, a.finish(id, p))
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].StartTime.Before(expired[j].StartTime) })
+	return expired
+}
+
+// close stops expiring retrievals. Retrievals still in progress are
+// discarded, since they may yet finish.
+func (a *assembler) close() {
+	close(a.stop)
+	<-a.stopped
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if len(a.retrievals) > 0 {
+		logger.Warnw("Discarded retrievals in progress", "total", len(a.retrievals))
+	}
+}
+
+func detailInt(details any, key string) int {
+	if m, ok := details.(map[string]any); ok {
+		if v, ok := m[key].(float64); ok {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+func detailString(details any, key string) string {
+	if m, ok := details.(map[string]any); ok {
+		if v, ok := m[key].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
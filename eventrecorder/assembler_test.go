@@ -0,0 +1,212 @@
+package eventrecorder
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRootCid = "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4"
+	testPeerA   = "12D3KooWEqwTBN3GE4vT6DWZiKpq24UtSBmhhwM73vg7SfTjYWaF"
+	testPeerB   = "12D3KooWHHzSeKaY8xuZVzkLbKFfvNgPPeKhFBGrMbNzbm5akpqu"
+)
+
+var assemblerStart = time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func v1Event(id types.RetrievalID, phase types.Phase, code types.EventCode, storageProviderID string, after time.Duration, details any) Event {
+	return Event{
+		RetrievalId:       id,
+		InstanceId:        "test-instance",
+		Cid:               testRootCid,
+		StorageProviderId: storageProviderID,
+		Phase:             phase,
+		PhaseStartTime:    assemblerStart,
+		EventName:         code,
+		EventTime:         assemblerStart.Add(after),
+		EventDetails:      details,
+	}
+}
+
+func newTestAssembler(t *testing.T) (*assembler, *[]AggregateEvent) {
+	var emitted []AggregateEvent
+	a := newAssembler(time.Hour, newAggregateInstances(nil), func(events []AggregateEvent) { emitted = append(emitted, events...) })
+	t.Cleanup(a.close)
+	return a, &emitted
+}
+
+func TestAssembler_Success(t *testing.T) {
+	a, _ := newTestAssembler(t)
+	id, err := types.NewRetrievalID()
+	require.NoError(t, err)
+
+	// Events of a retrieval may arrive over several requests.
+	require.Empty(t, a.add([]Event{
+		v1Event(id, types.IndexerPhase, types.StartedCode, "", 0, nil),
+		v1Event(id, types.IndexerPhase, types.CandidatesFoundCode, "", 100*time.Millisecond, map[string]any{"candidateCount": float64(3)}),
+		v1Event(id, types.IndexerPhase, types.CandidatesFilteredCode, "", 110*time.Millisecond, map[string]any{"candidateCount": float64(2)}),
+		v1Event(id, types.RetrievalPhase, types.StartedCode, testPeerA, 200*time.Millisecond, nil),
+		v1Event(id, types.RetrievalPhase, types.StartedCode, types.BitswapIndentifier, 200*time.Millisecond, nil),
+	}))
+	done := a.add([]Event{
+		v1Event(id, types.RetrievalPhase, types.FailedCode, testPeerA, 300*time.Millisecond, map[string]any{"error": "failed to dial"}),
+		v1Event(id, types.RetrievalPhase, types.FirstByteCode, types.BitswapIndentifier, 500*time.Millisecond, nil),
+		v1Event(id, types.RetrievalPhase, types.SuccessCode, types.BitswapIndentifier, 1500*time.Millisecond, map[string]any{"receivedSize": float64(2000)}),
+	})
+	require.Equal(t, []AggregateEvent{{
+		InstanceID:                "test-instance",
+		RetrievalID:               id.String(),
+		StorageProviderID:         types.BitswapIndentifier,
+		RootCid:                   testRootCid,
+		TimeToFirstByte:           "500ms",
+		Bandwidth:                 2000,
+		BytesTransferred:          2000,
+		Success:                   true,
+		StartTime:                 assemblerStart,
+		EndTime:                   assemblerStart.Add(1500 * time.Millisecond),
+		TimeToFirstIndexerResult:  "100ms",
+		IndexerCandidatesReceived: 3,
+		IndexerCandidatesFiltered: 2,
+		ProtocolsAttempted:        []string{"transport-bitswap", "transport-graphsync-filecoinv1"},
+		ProtocolSucceeded:         "transport-bitswap",
+		RetrievalAttempts: map[string]*RetrievalAttempt{
+			testPeerA:                {Error: "failed to dial", Protocol: "transport-graphsync-filecoinv1"},
+			types.BitswapIndentifier: {TimeToFirstByte: "300ms", BytesTransferred: 2000, Protocol: "transport-bitswap"},
+		},
+	}}, done)
+
+	// Events arriving after the retrieval finished are ignored.
+	require.Empty(t, a.add([]Event{v1Event(id, types.RetrievalPhase, types.FailedCode, testPeerB, 2*time.Second, map[string]any{"error": "late"})}))
+	require.Empty(t, a.retrievals)
+}
+
+func TestAssembler_Failures(t *testing.T) {
+	tests := []struct {
+		name  string
+		final Event
+	}{
+		{name: "indexer failure", final: Event{Phase: types.IndexerPhase, EventName: types.FailedCode}},
+		{name: "retrieval failure", final: Event{Phase: types.RetrievalPhase, EventName: types.FailedCode}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAssembler(t)
+			id, err := types.NewRetrievalID()
+			require.NoError(t, err)
+			final := v1Event(id, tt.final.Phase, tt.final.EventName, "", time.Second, map[string]any{"error": "no candidates"})
+			done := a.add([]Event{v1Event(id, types.IndexerPhase, types.StartedCode, "", 0, nil), final})
+			require.Len(t, done, 1)
+			require.False(t, done[0].Success)
+			require.Equal(t, assemblerStart.Add(time.Second), done[0].EndTime)
+			require.NoError(t, done[0].Validate())
+		})
+	}
+}
+
+func TestAssembler_Timeout(t *testing.T) {
+	a, emitted := newTestAssembler(t)
+	now := assemblerStart
+	a.now = func() time.Time { return now }
+
+	id, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	require.Empty(t, a.add([]Event{
+		v1Event(id, types.IndexerPhase, types.StartedCode, "", 0, nil),
+		v1Event(id, types.RetrievalPhase, types.StartedCode, testPeerA, time.Second, nil),
+	}))
+
+	now = now.Add(59 * time.Minute)
+	require.Empty(t, a.expire())
+	now = now.Add(time.Minute)
+	expired := a.expire()
+	require.Len(t, expired, 1)
+	require.False(t, expired[0].Success)
+	require.Equal(t, assemblerStart.Add(time.Second), expired[0].EndTime)
+	require.Contains(t, expired[0].RetrievalAttempts, testPeerA)
+	require.Empty(t, *emitted)
+}
+
+func TestAssembler_SkipsInstancesSendingAggregateEvents(t *testing.T) {
+	a, _ := newTestAssembler(t)
+	a.instances.observe(context.Background(), []AggregateEvent{{InstanceID: "test-instance"}})
+	id, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	require.Empty(t, a.add([]Event{
+		v1Event(id, types.IndexerPhase, types.StartedCode, "", 0, nil),
+		v1Event(id, types.IndexerPhase, types.FailedCode, "", time.Second, nil),
+	}))
+	require.Empty(t, a.retrievals)
+}
+
+func TestAssembler_SkipsRecordedRetrievalsAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	start := func() *EventRecorder {
+		r, err := New(WithDatabaseDSN("sqlite://"+path), WithEventAssembly(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, r.Start(ctx))
+		return r
+	}
+	newID := func() types.RetrievalID {
+		id, err := types.NewRetrievalID()
+		require.NoError(t, err)
+		return id
+	}
+	aggregateEvent := func(id types.RetrievalID, instanceID string) AggregateEvent {
+		return AggregateEvent{
+			InstanceID:  instanceID,
+			RetrievalID: id.String(),
+			RootCid:     testRootCid,
+			StartTime:   assemblerStart,
+			EndTime:     assemblerStart.Add(time.Second),
+		}
+	}
+	failed := func(id types.RetrievalID, instanceID string) []Event {
+		events := []Event{
+			v1Event(id, types.IndexerPhase, types.StartedCode, "", 0, nil),
+			v1Event(id, types.IndexerPhase, types.FailedCode, "", time.Second, nil),
+		}
+		for i := range events {
+			events[i].InstanceId = instanceID
+		}
+		return events
+	}
+
+	r := start()
+	require.NoError(t, r.RecordAggregateEvents(ctx, []AggregateEvent{aggregateEvent(newID(), "test-instance")}))
+	r.Shutdown()
+
+	// The instance is still known to send aggregate events after a restart.
+	r = start()
+	defer r.Shutdown()
+	id := newID()
+	require.NoError(t, r.RecordEvents(ctx, failed(id, "test-instance")))
+	require.Empty(t, r.assembler.retrievals)
+
+	// A retrieval recorded by an aggregate event of an instance not known to
+	// send them is not recorded again, while its other retrievals are.
+	recordedID := newID()
+	require.NoError(t, r.recordAggregateEvents(ctx, []AggregateEvent{aggregateEvent(recordedID, "other-instance")}, false))
+	unrecorded := aggregateEvent(newID(), "other-instance")
+	events, err := r.unrecordedAssembled(ctx, []AggregateEvent{aggregateEvent(recordedID, "other-instance"), unrecorded})
+	require.NoError(t, err)
+	require.Equal(t, []AggregateEvent{unrecorded}, events)
+	require.NoError(t, r.RecordEvents(ctx, failed(recordedID, "other-instance")))
+	assembledID := newID()
+	require.NoError(t, r.RecordEvents(ctx, failed(assembledID, "other-instance")))
+
+	count := func(retrievalID string) int {
+		var n int
+		require.NoError(t, r.sqlite.QueryRowContext(ctx, `select count(*) from aggregate_retrieval_events where retrieval_id = $1`, retrievalID).Scan(&n))
+		return n
+	}
+	require.Zero(t, count(id.String()))
+	require.Equal(t, 1, count(recordedID.String()))
+	require.Equal(t, 1, count(assembledID.String()))
+}
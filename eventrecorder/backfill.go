@@ -0,0 +1,251 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+	"github.com/filecoin-project/lassie/pkg/types"
+)
+
+// aggregatesCheckpoint names the checkpoint of BackfillAggregates in the
+// backfill_checkpoints table.
+const aggregatesCheckpoint = "aggregates"
+
+// backfillEventsQuery selects the events of the retrievals whose indexer
+// started event is within [$1, $2) and that have no aggregate event yet,
+// reading events up to $3. Rows are ordered so that the events of a retrieval
+// are adjacent and in time order.
+const backfillEventsQuery = `
+	select
+		%s,
+		e.instance_id,
+		e.cid,
+		e.storage_provider_id,
+		e.phase,
+		e.phase_start_time,
+		e.event_name,
+		e.event_time,
+		e.event_details
+	from retrieval_events e
+	where e.retrieval_id in (
+		select s.retrieval_id from retrieval_events s
+		where s.phase = 'indexer' and s.event_name = 'started'
+		and s.event_time >= $1 and s.event_time < $2
+		and not exists (select 1 from aggregate_retrieval_events a where a.retrieval_id = s.retrieval_id)
+	)
+	and e.event_time >= $1 and e.event_time < $3
+	order by e.retrieval_id, e.event_time
+`
+
+type BackfillConfig struct {
+	// From is the start of the range of retrievals to backfill, by the time of
+	// their indexer started event. If zero, the backfill resumes from its
+	// checkpoint, or starts from the oldest event, and the checkpoint is
+	// advanced as windows complete. Explicit ranges leave the checkpoint
+	// alone.
+	From time.Time
+	// To is the end of the range. Defaults to Horizon before now, leaving
+	// retrievals that may still be in progress to live assembly.
+	To time.Time
+	// Window is the time range of retrievals assembled at once. Defaults to
+	// one hour.
+	Window time.Duration
+	// Horizon is how long after a retrieval started its events are read.
+	// Defaults to one hour.
+	Horizon time.Duration
+	// BatchSize is the maximum number of aggregate events written at once.
+	// Defaults to 500.
+	BatchSize int
+}
+
+type BackfillStats struct {
+	// Windows is the number of windows processed.
+	Windows int
+	// Recorded is the number of aggregate events recorded.
+	Recorded int64
+	// Invalid is the number of assembled aggregate events that failed
+	// validation and were skipped.
+	Invalid int64
+}
+
+// BackfillAggregates reconstructs aggregate events, with their retrieval
+// attempts, from the v1 events of retrievals that have none, and records them
+// without reporting them to metrics. Retrievals that have an aggregate event
+// are skipped, so a backfill is safe to re-run. The recorder must have been
+// started with a database.
+func (r *EventRecorder) BackfillAggregates(ctx context.Context, cfg BackfillConfig) (BackfillStats, error) {
+	var stats BackfillStats
+	if cfg.Window == 0 {
+		cfg.Window = time.Hour
+	}
+	if cfg.Horizon == 0 {
+		cfg.Horizon = time.Hour
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.Window < 0 || cfg.Horizon < 0 || cfg.BatchSize < 0 {
+		return stats, errors.New("backfill limits cannot be negative")
+	}
+
+	db, dialect, err := r.sqlDB()
+	if err != nil {
+		return stats, fmt.Errorf("backfilling requires a database: %w", err)
+	}
+
+	checkpoint := cfg.From.IsZero()
+	if checkpoint {
+		from, ok, err := backfillStart(ctx, db)
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			logger.Info("No events to backfill")
+			return stats, nil
+		}
+		cfg.From = from
+	}
+	if cfg.To.IsZero() {
+		cfg.To = time.Now().Add(-cfg.Horizon)
+	}
+
+	for start := cfg.From.UTC(); start.Before(cfg.To); {
+		end := start.Add(cfg.Window)
+		if end.After(cfg.To) {
+			end = cfg.To.UTC()
+		}
+		events, err := assembleWindow(ctx, db, dialect, start, end, end.Add(cfg.Horizon))
+		if err != nil {
+			return stats, err
+		}
+		valid := events[:0]
+		for _, event := range events {
+			if err := event.Validate(); err != nil {
+				stats.Invalid++
+				logger.Warnw("Skipped invalid backfilled event", "retrievalID", event.RetrievalID, "err", err)
+				continue
+			}
+			valid = append(valid, event)
+		}
+		for len(valid) > 0 {
+			n := cfg.BatchSize
+			if n > len(valid) {
+				n = len(valid)
+			}
+			if err := r.recordAggregateEvents(ctx, valid[:n], false); err != nil {
+				return stats, fmt.Errorf("failed to record backfilled events: %w", err)
+			}
+			stats.Recorded += int64(n)
+			valid = valid[n:]
+		}
+		if checkpoint {
+			if _, err := db.ExecContext(ctx, `
+				insert into backfill_checkpoints(name, position) values ($1, $2)
+				on conflict (name) do update set position = excluded.position, updated_at = current_timestamp
+				`, aggregatesCheckpoint, end); err != nil {
+				return stats, fmt.Errorf("failed to save backfill checkpoint: %w", err)
+			}
+		}
+		stats.Windows++
+		logger.Infow("Backfilled window", "from", start, "to", end, "total", len(events))
+		start = end
+	}
+	return stats, nil
+}
+
+// backfillStart returns the checkpoint of the aggregates backfill, or the time
+// of the oldest event if there is none.
+func backfillStart(ctx context.Context, db *sql.DB) (time.Time, bool, error) {
+	var position time.Time
+	err := db.QueryRowContext(ctx, `select position from backfill_checkpoints where name = $1`, aggregatesCheckpoint).Scan(&position)
+	if err == nil {
+		return position, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return position, false, fmt.Errorf("failed to read backfill checkpoint: %w", err)
+	}
+	err = db.QueryRowContext(ctx, `select event_time from retrieval_events order by event_time limit 1`).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return position, false, nil
+	}
+	if err != nil {
+		return position, false, fmt.Errorf("failed to find the oldest event: %w", err)
+	}
+	return position, true, nil
+}
+
+// assembleWindow reads and assembles the retrievals of a window. Events are
+// read in full before anything is written, since a SQLite database has a
+// single connection.
+func assembleWindow(ctx context.Context, db *sql.DB, dialect migrations.Dialect, from, to, until time.Time) ([]AggregateEvent, error) {
+	retrievalID := "e.retrieval_id"
+	if dialect == migrations.Postgres {
+		retrievalID = "e.retrieval_id::text"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(backfillEventsQuery, retrievalID), from.UTC(), to.UTC(), until.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	var aggregates []AggregateEvent
+	var pending *pendingRetrieval
+	var finished bool
+	for rows.Next() {
+		var (
+			event                           Event
+			retrievalID                     string
+			storageProviderID, eventDetails sql.NullString
+			phase, eventName                string
+		)
+		if err := rows.Scan(
+			&retrievalID,
+			&event.InstanceId,
+			&event.Cid,
+			&storageProviderID,
+			&phase,
+			&event.PhaseStartTime,
+			&eventName,
+			&event.EventTime,
+			&eventDetails,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan event: %w", err)
+		}
+		if err := event.RetrievalId.UnmarshalText([]byte(retrievalID)); err != nil {
+			return nil, fmt.Errorf("invalid retrieval ID %q: %w", retrievalID, err)
+		}
+		event.StorageProviderId = storageProviderID.String
+		event.Phase = types.Phase(phase)
+		event.EventName = types.EventCode(eventName)
+		if eventDetails.Valid && eventDetails.String != "" {
+			if err := json.Unmarshal([]byte(eventDetails.String), &event.EventDetails); err != nil {
+				return nil, fmt.Errorf("invalid details of event of retrieval %s: %w", retrievalID, err)
+			}
+		}
+
+		if pending == nil || pending.event.RetrievalID != event.RetrievalId.String() {
+			if pending != nil {
+				aggregates = append(aggregates, pending.aggregate())
+			}
+			pending = newPendingRetrieval(event)
+			finished = false
+		}
+		// Events after the one that finished the retrieval are ignored, as
+		// they are by live assembly.
+		if !finished {
+			finished = pending.fold(event)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	if pending != nil {
+		aggregates = append(aggregates, pending.aggregate())
+	}
+	return aggregates, nil
+}
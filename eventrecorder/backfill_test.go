@@ -0,0 +1,107 @@
+package eventrecorder_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/spmap"
+	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfillAggregates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+path),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start(ctx))
+	defer recorder.Shutdown()
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	event := func(id types.RetrievalID, phase types.Phase, code types.EventCode, storageProviderID string, at time.Duration, details any) eventrecorder.Event {
+		return eventrecorder.Event{
+			RetrievalId:       id,
+			InstanceId:        "test-instance",
+			Cid:               "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+			StorageProviderId: storageProviderID,
+			Phase:             phase,
+			PhaseStartTime:    start.Add(at),
+			EventName:         code,
+			EventTime:         start.Add(at),
+			EventDetails:      details,
+		}
+	}
+	succeeded, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	failed, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	later, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	require.NoError(t, recorder.RecordEvents(ctx, []eventrecorder.Event{
+		event(succeeded, types.IndexerPhase, types.StartedCode, "", 0, nil),
+		event(succeeded, types.IndexerPhase, types.CandidatesFoundCode, "", time.Second, map[string]any{"candidateCount": 1}),
+		event(succeeded, types.RetrievalPhase, types.StartedCode, types.BitswapIndentifier, 2*time.Second, nil),
+		event(succeeded, types.RetrievalPhase, types.FirstByteCode, types.BitswapIndentifier, 3*time.Second, nil),
+		event(succeeded, types.RetrievalPhase, types.SuccessCode, types.BitswapIndentifier, 5*time.Second, map[string]any{"receivedSize": 1000}),
+		event(failed, types.IndexerPhase, types.StartedCode, "", 30*time.Minute, nil),
+		event(failed, types.IndexerPhase, types.FailedCode, "", 31*time.Minute, map[string]any{"error": "no candidates"}),
+		event(later, types.IndexerPhase, types.StartedCode, "", 3*time.Hour, nil),
+		event(later, types.IndexerPhase, types.FailedCode, "", 3*time.Hour+time.Minute, nil),
+	}))
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+	count := func(table string) int {
+		var n int
+		require.NoError(t, db.QueryRow(`select count(*) from `+table).Scan(&n))
+		return n
+	}
+
+	// The first backfill starts from the oldest event and stops at To.
+	stats, err := recorder.BackfillAggregates(ctx, eventrecorder.BackfillConfig{To: start.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, eventrecorder.BackfillStats{Windows: 2, Recorded: 2}, stats)
+	require.Equal(t, 2, count("aggregate_retrieval_events"))
+	require.Equal(t, 1, count("retrieval_attempts"))
+
+	var success bool
+	var bytesTransferred int64
+	require.NoError(t, db.QueryRow(`
+		select success, bytes_transferred from aggregate_retrieval_events where retrieval_id = $1`,
+		succeeded.String(),
+	).Scan(&success, &bytesTransferred))
+	require.True(t, success)
+	require.Equal(t, int64(1000), bytesTransferred)
+
+	var position time.Time
+	require.NoError(t, db.QueryRow(`select position from backfill_checkpoints where name = 'aggregates'`).Scan(&position))
+	require.Equal(t, start.Add(2*time.Hour), position.UTC())
+
+	// The next backfill resumes from the checkpoint.
+	stats, err = recorder.BackfillAggregates(ctx, eventrecorder.BackfillConfig{To: start.Add(4 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, eventrecorder.BackfillStats{Windows: 2, Recorded: 1}, stats)
+	require.Equal(t, 3, count("aggregate_retrieval_events"))
+
+	// Backfilling a range again records nothing new.
+	stats, err = recorder.BackfillAggregates(ctx, eventrecorder.BackfillConfig{From: start, To: start.Add(4 * time.Hour)})
+	require.NoError(t, err)
+	require.Equal(t, eventrecorder.BackfillStats{Windows: 4}, stats)
+	require.Equal(t, 3, count("aggregate_retrieval_events"))
+	require.Equal(t, 1, count("retrieval_attempts"))
+}
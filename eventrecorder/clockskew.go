@@ -0,0 +1,124 @@
+package eventrecorder
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkewWindow is how long offset samples of an instance are kept.
+	clockSkewWindow = 10 * time.Minute
+	// clockSkewMaxSamples bounds the samples kept per instance.
+	clockSkewMaxSamples = 64
+	// clockSkewTolerance is the offset below which instances are not
+	// corrected: Lassie buffers events before sending them, so a few seconds
+	// of offset are indistinguishable from delivery delays.
+	clockSkewTolerance = 2 * time.Second
+)
+
+// clockSkew estimates the clock offset of each instance from the times of the
+// events it sends relative to when they arrive.
+//
+// An event cannot arrive before it happened, so the latest event time of a
+// batch minus its arrival time is a lower bound of the instance's clock
+// offset, short by however long the event waited to be sent. The estimate is
+// the largest of the recent bounds, which is the batch that waited least.
+type clockSkew struct {
+	maxCorrection time.Duration
+	now           func() time.Time
+
+	lk        sync.Mutex
+	instances map[string][]skewSample
+	// pruned is when instances that stopped sending events were last
+	// dropped.
+	pruned time.Time
+}
+
+type skewSample struct {
+	arrived time.Time
+	offset  time.Duration
+}
+
+func newClockSkew(maxCorrection time.Duration) *clockSkew {
+	return &clockSkew{
+		maxCorrection: maxCorrection,
+		now:           time.Now,
+		instances:     make(map[string][]skewSample),
+	}
+}
+
+// observe records that events of an instance up to latest arrived now, and
+// returns the instance's estimated offset.
+func (c *clockSkew) observe(instanceID string, latest time.Time) time.Duration {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	now := c.now()
+	if now.Sub(c.pruned) > clockSkewWindow {
+		for id, samples := range c.instances {
+			if now.Sub(samples[len(samples)-1].arrived) > clockSkewWindow {
+				delete(c.instances, id)
+			}
+		}
+		c.pruned = now
+	}
+	samples := c.instances[instanceID]
+	for len(samples) > 0 && (now.Sub(samples[0].arrived) > clockSkewWindow || len(samples) >= clockSkewMaxSamples) {
+		samples = samples[1:]
+	}
+	samples = append(samples, skewSample{arrived: now, offset: latest.Sub(now)})
+	c.instances[instanceID] = samples
+	return estimateOffset(samples)
+}
+
+// correction returns how much to subtract from the times reported by an
+// instance, limited to the maximum correction.
+func (c *clockSkew) correction(instanceID string) time.Duration {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	samples := c.instances[instanceID]
+	if len(samples) == 0 || c.now().Sub(samples[len(samples)-1].arrived) > clockSkewWindow {
+		return 0
+	}
+	offset := estimateOffset(samples)
+	switch {
+	case offset > -clockSkewTolerance && offset < clockSkewTolerance:
+		return 0
+	case offset > c.maxCorrection:
+		return c.maxCorrection
+	case offset < -c.maxCorrection:
+		return -c.maxCorrection
+	default:
+		return offset
+	}
+}
+
+func estimateOffset(samples []skewSample) time.Duration {
+	offset := samples[0].offset
+	for _, sample := range samples[1:] {
+		if sample.offset > offset {
+			offset = sample.offset
+		}
+	}
+	return offset
+}
+
+// observeClocks records the latest event time of each instance in a request
+// that just arrived, and reports the instances' estimated offsets.
+func (r *EventRecorder) observeClocks(ctx context.Context, latest map[string]time.Time) {
+	for instanceID, eventTime := range latest {
+		offset := r.clockSkew.observe(instanceID, eventTime)
+		if r.cfg.metrics != nil {
+			r.cfg.metrics.HandleClockOffset(ctx, instanceID, offset)
+		}
+	}
+}
+
+// correctedTime returns t corrected for the clock offset of the instance that
+// reported it, or nil if times are not corrected.
+func (r *EventRecorder) correctedTime(instanceID string, t time.Time) any {
+	if r.clockSkew == nil || r.clockSkew.maxCorrection == 0 {
+		return nil
+	}
+	return t.Add(-r.clockSkew.correction(instanceID))
+}
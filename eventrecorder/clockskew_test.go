@@ -0,0 +1,68 @@
+package eventrecorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkew(t *testing.T) {
+	tests := []struct {
+		name string
+		// delays are how long before arriving, by the recorder's clock, the
+		// latest event of each request happened.
+		delays         []time.Duration
+		offset         time.Duration
+		wantOffset     time.Duration
+		wantCorrection time.Duration
+	}{
+		{
+			name:       "in sync",
+			delays:     []time.Duration{3 * time.Second, 500 * time.Millisecond, 4 * time.Second},
+			wantOffset: -500 * time.Millisecond,
+		},
+		{
+			name:           "ahead",
+			delays:         []time.Duration{3 * time.Second, time.Second, 2 * time.Second},
+			offset:         time.Minute,
+			wantOffset:     59 * time.Second,
+			wantCorrection: 59 * time.Second,
+		},
+		{
+			name:           "behind",
+			delays:         []time.Duration{time.Second, 2 * time.Second},
+			offset:         -30 * time.Second,
+			wantOffset:     -31 * time.Second,
+			wantCorrection: -31 * time.Second,
+		},
+		{
+			name:           "correction limited",
+			delays:         []time.Duration{time.Second},
+			offset:         2 * time.Hour,
+			wantOffset:     2*time.Hour - time.Second,
+			wantCorrection: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClockSkew(time.Hour)
+			now := assemblerStart
+			c.now = func() time.Time { return now }
+			var offset time.Duration
+			for _, delay := range tt.delays {
+				now = now.Add(10 * time.Second)
+				offset = c.observe("test-instance", now.Add(tt.offset-delay))
+			}
+			require.Equal(t, tt.wantOffset, offset)
+			require.Equal(t, tt.wantCorrection, c.correction("test-instance"))
+			require.Zero(t, c.correction("other-instance"))
+
+			// Estimates are forgotten once an instance stops sending events.
+			now = now.Add(clockSkewWindow + time.Second)
+			require.Zero(t, c.correction("test-instance"))
+			c.observe("other-instance", now)
+			require.NotContains(t, c.instances, "test-instance")
+		})
+	}
+}
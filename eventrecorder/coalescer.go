@@ -0,0 +1,169 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var errCoalescerClosed = errors.New("write coalescer is closed")
+
+// pendingQuery is a single insert statement waiting to be sent to the database.
+// exec, if set, is called with the number of rows the statement affected.
+type pendingQuery struct {
+	sql  string
+	args []any
+	exec func(rowsAffected int64) error
+}
+
+func queueAll(batch *pgx.Batch, queries []pendingQuery) {
+	for _, q := range queries {
+		qq := batch.Queue(q.sql, q.args...)
+		if exec := q.exec; exec != nil {
+			qq.Exec(func(ct pgconn.CommandTag) error { return exec(ct.RowsAffected()) })
+		}
+	}
+}
+
+// writeRequest is the set of queries submitted by a single call to the
+// recorder. done receives the outcome once the queries are durable, or once
+// writing them has failed.
+type writeRequest struct {
+	queries []pendingQuery
+	done    chan error
+}
+
+// coalescer buffers queries across concurrent writeRequests and sends them to
+// the database as a single batch, either once maxSize queries are pending or
+// once interval has elapsed since the first pending request, whichever comes
+// first.
+type coalescer struct {
+	send     func(context.Context, *pgx.Batch) error
+	maxSize  int
+	interval time.Duration
+
+	requests chan writeRequest
+	closing  chan struct{}
+	closed   chan struct{}
+}
+
+func newCoalescer(send func(context.Context, *pgx.Batch) error, maxSize int, interval time.Duration) *coalescer {
+	c := &coalescer{
+		send:     send,
+		maxSize:  maxSize,
+		interval: interval,
+		requests: make(chan writeRequest),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// write submits queries and blocks until they have been written as part of a
+// coalesced batch. If ctx is cancelled before that happens, write returns the
+// context error; the queries may still be written afterwards.
+func (c *coalescer) write(ctx context.Context, queries []pendingQuery) error {
+	if len(queries) == 0 {
+		return nil
+	}
+	req := writeRequest{
+		queries: queries,
+		done:    make(chan error, 1),
+	}
+	select {
+	case c.requests <- req:
+	case <-c.closing:
+		return errCoalescerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *coalescer) run() {
+	defer close(c.closed)
+
+	var pending []writeRequest
+	var size int
+	timer := time.NewTimer(c.interval)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	flush := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		c.flush(pending)
+		pending = nil
+		size = 0
+	}
+
+	for {
+		select {
+		case req := <-c.requests:
+			if len(pending) == 0 {
+				timer.Reset(c.interval)
+			}
+			pending = append(pending, req)
+			size += len(req.queries)
+			if size >= c.maxSize {
+				flush()
+			}
+		case <-timer.C:
+			if len(pending) > 0 {
+				flush()
+			}
+		case <-c.closing:
+			if len(pending) > 0 {
+				flush()
+			}
+			return
+		}
+	}
+}
+
+// flush sends all pending requests as a single batch. A batch runs in an
+// implicit transaction, so if it fails each request is retried on its own;
+// that way a single bad request does not fail the requests it was coalesced
+// with.
+func (c *coalescer) flush(pending []writeRequest) {
+	ctx := context.Background()
+
+	var batch pgx.Batch
+	for _, req := range pending {
+		queueAll(&batch, req.queries)
+	}
+	err := c.send(ctx, &batch)
+	if err == nil || len(pending) == 1 {
+		for _, req := range pending {
+			req.done <- err
+		}
+		return
+	}
+
+	logger.Warnw("Coalesced batch insertion failed, retrying requests individually", "requests", len(pending), "queries", batch.Len(), "err", err)
+	for _, req := range pending {
+		var batch pgx.Batch
+		queueAll(&batch, req.queries)
+		req.done <- c.send(ctx, &batch)
+	}
+}
+
+// close flushes any pending requests and stops the coalescer.
+func (c *coalescer) close() {
+	close(c.closing)
+	<-c.closed
+}
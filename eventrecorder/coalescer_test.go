@@ -0,0 +1,121 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+type batchRecorder struct {
+	lk      sync.Mutex
+	batches []int
+	fail    func(*pgx.Batch) error
+}
+
+func (br *batchRecorder) send(_ context.Context, batch *pgx.Batch) error {
+	br.lk.Lock()
+	defer br.lk.Unlock()
+	br.batches = append(br.batches, batch.Len())
+	if br.fail != nil {
+		return br.fail(batch)
+	}
+	return nil
+}
+
+func queriesOf(n int) []pendingQuery {
+	queries := make([]pendingQuery, n)
+	for i := range queries {
+		queries[i] = pendingQuery{sql: "INSERT"}
+	}
+	return queries
+}
+
+func TestCoalescer_FlushesOnSize(t *testing.T) {
+	br := &batchRecorder{}
+	c := newCoalescer(br.send, 6, time.Hour)
+	defer c.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, c.write(context.Background(), queriesOf(2)))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, []int{6}, br.batches)
+}
+
+func TestCoalescer_FlushesOnInterval(t *testing.T) {
+	br := &batchRecorder{}
+	c := newCoalescer(br.send, 1000, 10*time.Millisecond)
+	defer c.close()
+
+	require.NoError(t, c.write(context.Background(), queriesOf(3)))
+	require.Equal(t, []int{3}, br.batches)
+}
+
+func TestCoalescer_FlushesOnClose(t *testing.T) {
+	br := &batchRecorder{}
+	c := newCoalescer(br.send, 1000, time.Hour)
+
+	done := make(chan error, 1)
+	go func() { done <- c.write(context.Background(), queriesOf(4)) }()
+	// Give the write a moment to be picked up before closing.
+	time.Sleep(20 * time.Millisecond)
+	c.close()
+
+	require.NoError(t, <-done)
+	require.Equal(t, []int{4}, br.batches)
+	require.ErrorIs(t, c.write(context.Background(), queriesOf(1)), errCoalescerClosed)
+}
+
+func TestCoalescer_IsolatesFailedRequests(t *testing.T) {
+	errBad := errors.New("bad row")
+	br := &batchRecorder{
+		// Any batch containing the odd-sized request fails.
+		fail: func(b *pgx.Batch) error {
+			if b.Len()%2 == 1 {
+				return errBad
+			}
+			return nil
+		},
+	}
+	c := newCoalescer(br.send, 5, time.Hour)
+	defer c.close()
+
+	var wg sync.WaitGroup
+	var goodErr, badErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		goodErr = c.write(context.Background(), queriesOf(2))
+	}()
+	go func() {
+		defer wg.Done()
+		badErr = c.write(context.Background(), queriesOf(3))
+	}()
+	wg.Wait()
+
+	require.NoError(t, goodErr)
+	require.ErrorIs(t, badErr, errBad)
+	require.Len(t, br.batches, 3)
+	require.Equal(t, 5, br.batches[0])
+	require.ElementsMatch(t, []int{2, 3}, br.batches[1:])
+}
+
+func TestCoalescer_WriteHonoursContext(t *testing.T) {
+	br := &batchRecorder{}
+	c := newCoalescer(br.send, 1000, time.Hour)
+	defer c.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.write(ctx, queriesOf(1)), context.DeadlineExceeded)
+}
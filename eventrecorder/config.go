@@ -3,48 +3,129 @@ package eventrecorder
 import (
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/filecoin-project/lassie-event-recorder/hotcontent"
 	"github.com/filecoin-project/lassie-event-recorder/spmap"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// defaultApplicationName is the application name of the recorder's postgres
+// sessions, unless the DSN sets another.
+const defaultApplicationName = "lassie-event-recorder"
+
 type (
 	config struct {
 		dbDSN string
 		// pgxPoolConfig is instantiated by parsing config.dbDSN.
 		pgxPoolConfig *pgxpool.Config
+		// sqlite is set when dbDSN names a SQLite database instead of postgres.
+		sqlite      bool
+		autoMigrate bool
+		partitions  *PartitionConfig
 
 		mongoEndpoint   string
 		mongoDB         string
 		mongoCollection string
-		mongoPercentile float32
+		mongoSampling   SamplingRules
+		mongoWriter     MongoWriterConfig
+		mongoTTL        time.Duration
+		// mongoRollupCollection is the collection of per storage provider
+		// daily rollups; rollups are disabled when it is empty.
+		mongoRollupCollection string
+
+		// coalesceMaxBatchSize and coalesceMaxDelay configure cross-request
+		// write coalescing; coalescing is disabled when the batch size is zero.
+		coalesceMaxBatchSize int
+		coalesceMaxDelay     time.Duration
 
 		mapcfg []spmap.Option
+		// spLookupConcurrency is the number of workers resolving storage
+		// provider IDs, shared across all requests.
+		spLookupConcurrency int
 
 		metrics Metrics
+		sinks   []Sink
+
+		// assembleTimeout enables building aggregate events from v1 events
+		// when positive.
+		assembleTimeout time.Duration
+
+		// clockSkew enables estimating the clock offset of each instance, and
+		// clockSkewMaxCorrection limits how far event times are corrected.
+		clockSkew              bool
+		clockSkewMaxCorrection time.Duration
+
+		// eventAllowlist holds the phases and event codes accepted in v1
+		// events.
+		eventAllowlist *eventAllowlist
+
+		// instancePolicy enables the instance registry at ingest when set.
+		instancePolicy UnregisteredInstancePolicy
+
+		// hourlyRollupsInterval enables hourly rollups of aggregate events
+		// when positive.
+		hourlyRollupsInterval time.Duration
+
+		// digests enables per storage provider quantile sketches when set.
+		digests *DigestConfig
+
+		// hotContent, when set, counts retrievals and failures by CID, and is
+		// rotated every hotContentPeriod.
+		hotContent       *hotcontent.Tracker
+		hotContentPeriod time.Duration
 	}
 	Option func(*config) error
 )
 
 func newConfig(opts []Option) (*config, error) {
-	cfg := &config{}
+	cfg := &config{
+		mongoWriter:         defaultMongoWriterConfig(),
+		spLookupConcurrency: 16,
+		eventAllowlist:      defaultAllowlist,
+	}
 	for _, opt := range opts {
 		if err := opt(cfg); err != nil {
 			return nil, err
 		}
 	}
-	if cfg.dbDSN != "" {
+	switch {
+	case isSQLiteDSN(cfg.dbDSN):
+		cfg.sqlite = true
+		if cfg.partitions != nil {
+			return nil, errors.New("partitioning is not supported by sqlite databases")
+		}
+		if cfg.coalesceMaxBatchSize > 0 {
+			return nil, errors.New("write coalescing is not supported by sqlite databases")
+		}
+	case cfg.dbDSN != "":
 		var err error
 		if cfg.pgxPoolConfig, err = pgxpool.ParseConfig(cfg.dbDSN); err != nil {
 			return nil, fmt.Errorf("unable to parse db URL: %w", err)
 		}
+		// Hourly rollups tell the recorder's sessions apart by their name.
+		if cfg.pgxPoolConfig.ConnConfig.RuntimeParams["application_name"] == "" {
+			cfg.pgxPoolConfig.ConnConfig.RuntimeParams["application_name"] = defaultApplicationName
+		}
+	}
+	if cfg.hourlyRollupsInterval > 0 && cfg.dbDSN == "" {
+		return nil, errors.New("hourly rollups require a database")
+	}
+	if cfg.instancePolicy != "" && cfg.dbDSN == "" {
+		return nil, errors.New("the instance registry requires a database")
 	}
-	if cfg.pgxPoolConfig == nil && cfg.metrics == nil && cfg.mongoEndpoint == "" {
-		return nil, errors.New("must set up at least one of: postgres, mongo, metrics")
+	if cfg.mongoRollupCollection != "" && cfg.mongoEndpoint == "" {
+		return nil, errors.New("mongo rollups require a mongo endpoint")
+	}
+	if cfg.pgxPoolConfig == nil && !cfg.sqlite && cfg.metrics == nil && cfg.mongoEndpoint == "" && len(cfg.sinks) == 0 {
+		return nil, errors.New("must set up at least one of: postgres, sqlite, mongo, metrics, sinks")
 	}
 	return cfg, nil
 }
 
+// WithDatabaseDSN stores events in the database named by url: either a
+// postgres connection string, or sqlite:// followed by the path of a SQLite
+// database file.
 func WithDatabaseDSN(url string) Option {
 	return func(cfg *config) error {
 		cfg.dbDSN = url
@@ -52,12 +133,99 @@ func WithDatabaseDSN(url string) Option {
 	}
 }
 
+// WithAutoMigrate applies any pending schema migrations to the database when
+// the recorder starts.
+func WithAutoMigrate(autoMigrate bool) Option {
+	return func(cfg *config) error {
+		cfg.autoMigrate = autoMigrate
+		return nil
+	}
+}
+
+// WithPartitioning maintains the time based partitions of the event tables,
+// partitioning them first if they are not: upcoming partitions are created
+// ahead of time and, if a retention is set, partitions older than the
+// retention are archived and removed along with the attempts of their
+// retrievals.
+func WithPartitioning(partitions PartitionConfig) Option {
+	return func(cfg *config) error {
+		switch partitions.Interval {
+		case PartitionDaily, PartitionWeekly:
+		default:
+			return fmt.Errorf("partition interval must be one of: [%s %s]", PartitionDaily, PartitionWeekly)
+		}
+		if partitions.Premake < 0 {
+			return errors.New("number of partitions to premake cannot be negative")
+		}
+		if partitions.Retention < 0 {
+			return errors.New("partition retention cannot be negative")
+		}
+		if partitions.CheckInterval <= 0 {
+			partitions.CheckInterval = time.Hour
+		}
+		cfg.partitions = &partitions
+		return nil
+	}
+}
+
+// WithMongoSubmissions reports a sample of aggregate events to the given Mongo
+// collection, sampling the given fraction of retrievals.
 func WithMongoSubmissions(endpoint, db, collection string, percentage float32) Option {
 	return func(c *config) error {
 		c.mongoEndpoint = endpoint
 		c.mongoDB = db
 		c.mongoCollection = collection
-		c.mongoPercentile = percentage
+		c.mongoSampling.Rate = float64(percentage)
+		return c.mongoSampling.Validate()
+	}
+}
+
+// WithMongoSampling replaces the rules deciding which aggregate events are
+// reported to Mongo, including the sampling rate set by WithMongoSubmissions.
+func WithMongoSampling(rules SamplingRules) Option {
+	return func(c *config) error {
+		if err := rules.Validate(); err != nil {
+			return err
+		}
+		c.mongoSampling = rules
+		return nil
+	}
+}
+
+// WithMongoWriter configures how sampled reports are queued and written to
+// Mongo.
+func WithMongoWriter(writer MongoWriterConfig) Option {
+	return func(c *config) error {
+		if err := writer.validate(); err != nil {
+			return err
+		}
+		c.mongoWriter = writer
+		return nil
+	}
+}
+
+// WithMongoTTL expires reports from Mongo once their start time is older than
+// ttl, using a TTL index. Zero keeps reports forever.
+func WithMongoTTL(ttl time.Duration) Option {
+	return func(c *config) error {
+		if ttl < 0 {
+			return errors.New("mongo TTL cannot be negative")
+		}
+		c.mongoTTL = ttl
+		return nil
+	}
+}
+
+// WithMongoRollups maintains one document per Filecoin storage provider per
+// day in the given collection of the Mongo database set by
+// WithMongoSubmissions. Every aggregate event whose storage provider resolves
+// to a Filecoin SP ID updates its rollup, regardless of sampling.
+func WithMongoRollups(collection string) Option {
+	return func(c *config) error {
+		if collection == "" {
+			return errors.New("mongo rollup collection must be set")
+		}
+		c.mongoRollupCollection = collection
 		return nil
 	}
 }
@@ -69,9 +237,158 @@ func WithMetrics(metrics Metrics) Option {
 	}
 }
 
+// WithSinks forwards every accepted batch of events to the given sinks, in
+// addition to any database. The recorder closes the sinks on shutdown.
+func WithSinks(sinks ...Sink) Option {
+	return func(cfg *config) error {
+		for _, sink := range sinks {
+			if sink == nil {
+				return errors.New("sink cannot be nil")
+			}
+		}
+		cfg.sinks = append(cfg.sinks, sinks...)
+		return nil
+	}
+}
+
 func WithSPMapOptions(opts ...spmap.Option) Option {
 	return func(cfg *config) error {
 		cfg.mapcfg = opts
 		return nil
 	}
 }
+
+// WithWriteCoalescing buffers database writes across requests and sends them
+// as a single batch once maxBatchSize rows are pending or maxDelay has passed,
+// whichever comes first. Each request still blocks until its own rows have
+// been written. A maxBatchSize of zero disables coalescing.
+func WithWriteCoalescing(maxBatchSize int, maxDelay time.Duration) Option {
+	return func(cfg *config) error {
+		if maxBatchSize < 0 {
+			return errors.New("coalescing batch size cannot be negative")
+		}
+		if maxBatchSize > 0 && maxDelay <= 0 {
+			return errors.New("coalescing delay must be positive")
+		}
+		cfg.coalesceMaxBatchSize = maxBatchSize
+		cfg.coalesceMaxDelay = maxDelay
+		return nil
+	}
+}
+
+// WithEventAssembly builds aggregate events from the v1 events of Lassie
+// instances that do not send aggregate events, and records them like any
+// other aggregate event. A retrieval is assembled once it succeeds or fails
+// for good, or once none of its events have been received for the timeout.
+// All events of a retrieval must reach the same recorder.
+func WithEventAssembly(timeout time.Duration) Option {
+	return func(cfg *config) error {
+		if timeout <= 0 {
+			return errors.New("event assembly timeout must be positive")
+		}
+		cfg.assembleTimeout = timeout
+		return nil
+	}
+}
+
+// WithClockSkewDetection estimates the clock offset of each instance from the
+// times of the events it sends relative to when they arrive, and reports it to
+// metrics. If maxCorrection is positive, event times corrected by the offset,
+// up to maxCorrection either way, are stored alongside the reported times.
+func WithClockSkewDetection(maxCorrection time.Duration) Option {
+	return func(cfg *config) error {
+		if maxCorrection < 0 {
+			return errors.New("maximum clock skew correction cannot be negative")
+		}
+		cfg.clockSkew = true
+		cfg.clockSkewMaxCorrection = maxCorrection
+		return nil
+	}
+}
+
+// WithEventCodes sets the phases and event codes accepted in v1 events, in
+// place of those of Lassie v0.5, and what happens to events with any other.
+func WithEventCodes(codes EventCodes) Option {
+	return func(cfg *config) error {
+		allowlist, err := newEventAllowlist(codes)
+		if err != nil {
+			return err
+		}
+		cfg.eventAllowlist = allowlist
+		return nil
+	}
+}
+
+// WithInstanceRegistry checks the instance of every batch of events against
+// the registered instances: events of unregistered or inactive instances are
+// either rejected or accepted and tagged as unregistered in metrics.
+func WithInstanceRegistry(policy UnregisteredInstancePolicy) Option {
+	return func(cfg *config) error {
+		switch policy {
+		case TagUnregisteredInstances, RejectUnregisteredInstances:
+		default:
+			return fmt.Errorf("unregistered instance policy must be one of: [%s %s]", TagUnregisteredInstances, RejectUnregisteredInstances)
+		}
+		cfg.instancePolicy = policy
+		return nil
+	}
+}
+
+// WithHourlyRollups keeps the hourly_rollups table up to date, rolling up the
+// aggregate events stored since the last run at every interval. Only one
+// recorder sharing a postgres database rolls up at a time.
+func WithHourlyRollups(interval time.Duration) Option {
+	return func(cfg *config) error {
+		if interval <= 0 {
+			return errors.New("hourly rollup interval must be positive")
+		}
+		cfg.hourlyRollupsInterval = interval
+		return nil
+	}
+}
+
+// WithProviderDigests keeps sketches of the time to first byte and bandwidth
+// of successful retrievals per Filecoin storage provider and protocol over a
+// sliding window, for quantiles to be queried through ProviderDigests and
+// reported to metrics for the busiest providers. Zero fields of cfg take
+// their defaults.
+func WithProviderDigests(cfg DigestConfig) Option {
+	return func(c *config) error {
+		cfg.applyDefaults()
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		c.digests = &cfg
+		return nil
+	}
+}
+
+// WithHotContent counts retrievals and failures by root CID, and by CID of v1
+// events, in tracker, along with the distinct CIDs retrieved by each
+// instance. The tracker is rotated every period, and the counts of each period
+// are stored in the database, if any.
+func WithHotContent(tracker *hotcontent.Tracker, period time.Duration) Option {
+	return func(cfg *config) error {
+		if tracker == nil {
+			return errors.New("hot content tracker cannot be nil")
+		}
+		if period <= 0 {
+			return errors.New("hot content period must be positive")
+		}
+		cfg.hotContent = tracker
+		cfg.hotContentPeriod = period
+		return nil
+	}
+}
+
+// WithSPLookupConcurrency sets the number of workers, shared across all
+// requests, that resolve Lassie storage provider IDs to Filecoin SP IDs.
+func WithSPLookupConcurrency(workers int) Option {
+	return func(cfg *config) error {
+		if workers <= 0 {
+			return errors.New("storage provider lookup concurrency must be positive")
+		}
+		cfg.spLookupConcurrency = workers
+		return nil
+	}
+}
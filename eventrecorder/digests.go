@@ -0,0 +1,287 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/filecoin-project/lassie-event-recorder/sketch"
+)
+
+// ErrDigestsDisabled is returned when querying provider digests of a recorder
+// that does not keep them.
+var ErrDigestsDisabled = errors.New("provider digests are not enabled")
+
+// DigestQuantiles are the quantiles reported for each storage provider.
+var DigestQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// DigestConfig configures the quantile sketches of time to first byte and
+// bandwidth kept for each storage provider and protocol.
+type DigestConfig struct {
+	// Window is the time span of the sliding window that quantiles are
+	// estimated over.
+	Window time.Duration
+	// Slices is the number of sketches the window is made of; the window
+	// slides by Window / Slices at a time.
+	Slices int
+	// RelativeAccuracy bounds the relative error of quantile estimates.
+	RelativeAccuracy float64
+	// TopN is the number of storage providers, by retrievals within the
+	// window, whose quantiles are reported to metrics.
+	TopN int
+}
+
+func (c *DigestConfig) applyDefaults() {
+	if c.Window == 0 {
+		c.Window = time.Hour
+	}
+	if c.Slices == 0 {
+		c.Slices = 12
+	}
+	if c.RelativeAccuracy == 0 {
+		c.RelativeAccuracy = 0.01
+	}
+	if c.TopN == 0 {
+		c.TopN = 20
+	}
+}
+
+func (c DigestConfig) validate() error {
+	if c.Window <= 0 || c.Slices <= 0 || c.TopN <= 0 {
+		return errors.New("digest window, slices and top providers must be positive")
+	}
+	if c.Window/time.Duration(c.Slices) < time.Second {
+		return errors.New("digest window slices must span at least a second")
+	}
+	if c.RelativeAccuracy <= 0 || c.RelativeAccuracy >= 1 {
+		return errors.New("digest relative accuracy must be within (0, 1)")
+	}
+	return nil
+}
+
+// Quantiles are estimates of the DigestQuantiles of a measure.
+type Quantiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// ProviderDigest summarizes the successful retrievals from a storage provider
+// over a protocol within the digest window.
+type ProviderDigest struct {
+	FilSPID    string `json:"filSpId"`
+	Protocol   string `json:"protocol"`
+	Retrievals uint64 `json:"retrievals"`
+	// TimeToFirstByte is in seconds, and only counts retrievals that
+	// reported one.
+	TimeToFirstByte Quantiles `json:"timeToFirstByte"`
+	// Bandwidth is in bytes per second.
+	Bandwidth Quantiles `json:"bandwidth"`
+}
+
+// DigestFilter selects provider digests; empty fields match any digest.
+type DigestFilter struct {
+	FilSPID  string
+	Protocol string
+}
+
+type providerKey struct {
+	filSPID  string
+	protocol string
+}
+
+// digestSlice holds the sketches of a slice of the window.
+type digestSlice struct {
+	start           time.Time
+	timeToFirstByte *sketch.Sketch
+	bandwidth       *sketch.Sketch
+}
+
+// digests keeps quantile sketches of successful retrievals per storage
+// provider and protocol, over a window made of a ring of slices.
+type digests struct {
+	cfg     DigestConfig
+	slice   time.Duration
+	metrics Metrics
+	now     func() time.Time
+
+	lk        sync.Mutex
+	providers map[providerKey][]*digestSlice
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newDigests(cfg DigestConfig, metrics Metrics) *digests {
+	return &digests{
+		cfg:       cfg,
+		slice:     cfg.Window / time.Duration(cfg.Slices),
+		metrics:   metrics,
+		now:       time.Now,
+		providers: make(map[providerKey][]*digestSlice),
+		closing:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+// observe counts a successful retrieval.
+func (d *digests) observe(filSPID, protocol string, timeToFirstByte time.Duration, bandwidth uint64) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	key := providerKey{filSPID: filSPID, protocol: protocol}
+	slices, ok := d.providers[key]
+	if !ok {
+		slices = make([]*digestSlice, d.cfg.Slices)
+		d.providers[key] = slices
+	}
+	start := d.now().Truncate(d.slice)
+	i := int(start.UnixNano()/int64(d.slice)) % len(slices)
+	s := slices[i]
+	if s == nil {
+		// The accuracy has been validated, so creating sketches cannot fail.
+		ttfb, _ := sketch.New(d.cfg.RelativeAccuracy)
+		bw, _ := sketch.New(d.cfg.RelativeAccuracy)
+		s = &digestSlice{timeToFirstByte: ttfb, bandwidth: bw}
+		slices[i] = s
+	}
+	if !s.start.Equal(start) {
+		s.start = start
+		s.timeToFirstByte.Reset()
+		s.bandwidth.Reset()
+	}
+	if timeToFirstByte > 0 {
+		s.timeToFirstByte.Add(timeToFirstByte.Seconds())
+	}
+	s.bandwidth.Add(float64(bandwidth))
+}
+
+// digest merges the slices of a provider within the window. It returns false
+// if none are.
+func (d *digests) digest(key providerKey, since time.Time) (ProviderDigest, bool) {
+	var ttfb, bw *sketch.Sketch
+	for _, s := range d.providers[key] {
+		if s == nil || !s.start.After(since) || s.bandwidth.Count() == 0 {
+			continue
+		}
+		if ttfb == nil {
+			ttfb, bw = s.timeToFirstByte.Clone(), s.bandwidth.Clone()
+			continue
+		}
+		// Sketches of a recorder all have the same accuracy.
+		_ = ttfb.Merge(s.timeToFirstByte)
+		_ = bw.Merge(s.bandwidth)
+	}
+	if bw == nil {
+		return ProviderDigest{}, false
+	}
+	return ProviderDigest{
+		FilSPID:         key.filSPID,
+		Protocol:        key.protocol,
+		Retrievals:      bw.Count(),
+		TimeToFirstByte: quantiles(ttfb),
+		Bandwidth:       quantiles(bw),
+	}, true
+}
+
+func quantiles(s *sketch.Sketch) Quantiles {
+	return Quantiles{
+		P50: s.Quantile(DigestQuantiles[0]),
+		P90: s.Quantile(DigestQuantiles[1]),
+		P95: s.Quantile(DigestQuantiles[2]),
+		P99: s.Quantile(DigestQuantiles[3]),
+	}
+}
+
+// values returns the estimates in the order of DigestQuantiles.
+func (q Quantiles) values() []float64 {
+	return []float64{q.P50, q.P90, q.P95, q.P99}
+}
+
+// list returns the digests matching filter, with the most retrievals first,
+// and forgets providers without retrievals in the window.
+func (d *digests) list(filter DigestFilter) []ProviderDigest {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	// The oldest slice is excluded once the current one has begun, so that
+	// the window spans Slices - 1 full slices and the current partial one.
+	since := d.now().Truncate(d.slice).Add(-d.cfg.Window)
+	list := []ProviderDigest{}
+	for key := range d.providers {
+		if (filter.FilSPID != "" && key.filSPID != filter.FilSPID) || (filter.Protocol != "" && key.protocol != filter.Protocol) {
+			continue
+		}
+		digest, ok := d.digest(key, since)
+		if !ok {
+			delete(d.providers, key)
+			continue
+		}
+		list = append(list, digest)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Retrievals != list[j].Retrievals {
+			return list[i].Retrievals > list[j].Retrievals
+		}
+		if list[i].FilSPID != list[j].FilSPID {
+			return list[i].FilSPID < list[j].FilSPID
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+	return list
+}
+
+func (d *digests) start() {
+	go d.run()
+}
+
+// run reports the quantiles of the top providers to metrics every slice.
+func (d *digests) run() {
+	defer close(d.closed)
+	ticker := time.NewTicker(d.slice)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-ticker.C:
+			top := d.list(DigestFilter{})
+			if len(top) > d.cfg.TopN {
+				top = top[:d.cfg.TopN]
+			}
+			if d.metrics == nil {
+				continue
+			}
+			var reported []metrics.ProviderQuantile
+			for _, digest := range top {
+				ttfb, bw := digest.TimeToFirstByte.values(), digest.Bandwidth.values()
+				for i, q := range DigestQuantiles {
+					reported = append(reported, metrics.ProviderQuantile{
+						FilSPID:         digest.FilSPID,
+						Protocol:        digest.Protocol,
+						Quantile:        q,
+						TimeToFirstByte: ttfb[i],
+						Bandwidth:       bw[i],
+					})
+				}
+			}
+			d.metrics.HandleProviderQuantiles(context.Background(), reported)
+		}
+	}
+}
+
+func (d *digests) close() {
+	close(d.closing)
+	<-d.closed
+}
+
+// ProviderDigests returns the quantiles of time to first byte and bandwidth of
+// the storage providers matching filter, with the most retrievals first.
+func (r *EventRecorder) ProviderDigests(filter DigestFilter) ([]ProviderDigest, error) {
+	if r.digests == nil {
+		return nil, ErrDigestsDisabled
+	}
+	return r.digests.list(filter), nil
+}
@@ -0,0 +1,70 @@
+package eventrecorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigests(t *testing.T) {
+	cfg := DigestConfig{Window: time.Hour, Slices: 4}
+	cfg.applyDefaults()
+	require.NoError(t, cfg.validate())
+	d := newDigests(cfg, nil)
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	const graphsync, http = "transport-graphsync-filecoinv1", "transport-ipfs-gateway-http"
+	for i := 1; i <= 100; i++ {
+		d.observe("f01234", graphsync, time.Duration(i)*10*time.Millisecond, uint64(i)*1000)
+	}
+	d.observe("f01234", http, 0, 5000)
+	now = now.Add(20 * time.Minute)
+	d.observe("f05678", graphsync, time.Second, 2000)
+
+	digests := d.list(DigestFilter{})
+	require.Len(t, digests, 3)
+	require.Equal(t, "f01234", digests[0].FilSPID)
+	require.Equal(t, graphsync, digests[0].Protocol)
+	require.Equal(t, uint64(100), digests[0].Retrievals)
+	require.InEpsilon(t, 0.5, digests[0].TimeToFirstByte.P50, 0.02)
+	require.InEpsilon(t, 0.99, digests[0].TimeToFirstByte.P99, 0.02)
+	require.InEpsilon(t, 90000, digests[0].Bandwidth.P90, 0.02)
+	// Retrievals without a time to first byte only count towards bandwidth.
+	require.Equal(t, "f01234", digests[1].FilSPID)
+	require.Equal(t, http, digests[1].Protocol)
+	require.Zero(t, digests[1].TimeToFirstByte.P50)
+	require.InEpsilon(t, 5000, digests[1].Bandwidth.P50, 0.02)
+	require.Equal(t, "f05678", digests[2].FilSPID)
+
+	require.Equal(t, []ProviderDigest{digests[0]}, d.list(DigestFilter{FilSPID: "f01234", Protocol: graphsync}))
+	require.Len(t, d.list(DigestFilter{Protocol: graphsync}), 2)
+
+	// Retrievals slide out of the window a slice at a time.
+	now = now.Add(45 * time.Minute)
+	digests = d.list(DigestFilter{})
+	require.Len(t, digests, 1)
+	require.Equal(t, "f05678", digests[0].FilSPID)
+	require.Len(t, d.providers, 1)
+
+	// A slice reused by the ring starts afresh.
+	now = now.Add(15 * time.Minute)
+	d.observe("f05678", graphsync, 2*time.Second, 4000)
+	digests = d.list(DigestFilter{})
+	require.Len(t, digests, 1)
+	require.Equal(t, uint64(1), digests[0].Retrievals)
+	require.InEpsilon(t, 2, digests[0].TimeToFirstByte.P50, 0.02)
+	now = now.Add(time.Hour)
+	require.Empty(t, d.list(DigestFilter{}))
+	require.Empty(t, d.providers)
+}
+
+func TestDigestConfig(t *testing.T) {
+	cfg := DigestConfig{Window: time.Minute, Slices: 120}
+	cfg.applyDefaults()
+	require.ErrorContains(t, cfg.validate(), "at least a second")
+	cfg = DigestConfig{RelativeAccuracy: 2}
+	cfg.applyDefaults()
+	require.ErrorContains(t, cfg.validate(), "relative accuracy")
+}
@@ -6,35 +6,14 @@ import (
 	"time"
 
 	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
 )
 
-var (
-	errInvalidPhase     = fmt.Errorf("phase must be one of: [%s %s %s]", types.IndexerPhase, types.QueryPhase, types.RetrievalPhase)
-	errInvalidEventCode error
-	emptyRetrievalID    types.RetrievalID
-	eventCodes          = map[types.EventCode]any{
-		types.CandidatesFoundCode:    nil,
-		types.CandidatesFilteredCode: nil,
-		types.StartedCode:            nil,
-		types.ConnectedCode:          nil,
-		types.QueryAskedCode:         nil,
-		types.QueryAskedFilteredCode: nil,
-		types.ProposedCode:           nil,
-		types.AcceptedCode:           nil,
-		types.FirstByteCode:          nil,
-		types.FailedCode:             nil,
-		types.SuccessCode:            nil,
-	}
-)
-
-func init() {
-	codes := make([]types.EventCode, 0, len(eventCodes))
-	for code := range eventCodes {
-		codes = append(codes, code)
-	}
-	errInvalidEventCode = fmt.Errorf("eventName must be one of: %v", codes)
-}
+var emptyRetrievalID types.RetrievalID
 
 type Event struct {
 	RetrievalId       types.RetrievalID `json:"retrievalId"`
@@ -48,7 +27,13 @@ type Event struct {
 	EventDetails      any               `json:"eventDetails,omitempty"`
 }
 
+// Validate validates the event, accepting the phases and event codes of
+// Lassie v0.5 only.
 func (e Event) Validate() error {
+	return e.validate(defaultAllowlist)
+}
+
+func (e Event) validate(allowlist *eventAllowlist) error {
 	switch {
 	case e.RetrievalId == emptyRetrievalID:
 		return errors.New("property retrievalId is required")
@@ -58,21 +43,20 @@ func (e Event) Validate() error {
 		return errors.New("property cid is required")
 	case e.Phase == "":
 		return errors.New("property phase is required")
-	case !validPhase(e.Phase):
-		return errInvalidPhase
 	case e.PhaseStartTime.IsZero():
 		return errors.New("property phaseStartTime is required")
 	case e.PhaseStartTime.After(time.Now().Add(24 * time.Hour)):
 		return errors.New("property phaseStartTime cannot be in the future")
 	case e.EventName == "":
 		return errors.New("property eventName is required")
-	case !validEventCode(e.EventName):
-		return errInvalidEventCode
 	case e.EventTime.IsZero():
 		return errors.New("property eventTime is required")
 	case e.EventTime.After(time.Now().Add(24 * time.Hour)):
 		return errors.New("property eventTime cannot be in the future")
 	default:
+		if err := allowlist.check(e); err != nil {
+			return err
+		}
 		_, err := cid.Decode(e.Cid)
 		if err != nil {
 			return fmt.Errorf("cid must be valid: %w", err)
@@ -90,30 +74,22 @@ func (e Event) Validate() error {
 	}
 }
 
-func validPhase(phase types.Phase) bool {
-	switch phase {
-	case types.IndexerPhase, types.QueryPhase, types.RetrievalPhase:
-		return true
-	default:
-		return false
-	}
-}
-
-func validEventCode(code types.EventCode) bool {
-	_, ok := eventCodes[code]
-	return ok
-}
-
 type EventBatch struct {
 	Events []Event `json:"events"`
 }
 
+// Validate validates every event in the batch, accepting the phases and event
+// codes of Lassie v0.5 only.
 func (e EventBatch) Validate() error {
+	return e.validate(defaultAllowlist)
+}
+
+func (e EventBatch) validate(allowlist *eventAllowlist) error {
 	if len(e.Events) == 0 {
 		return errors.New("property events is required")
 	}
 	for _, event := range e.Events {
-		if err := event.Validate(); err != nil {
+		if err := event.validate(allowlist); err != nil {
 			return err
 		}
 	}
@@ -127,6 +103,55 @@ type RetrievalAttempt struct {
 	Protocol         string `json:"protocol,omitempty"`
 }
 
+// Attempt is a single attempt to retrieve from a storage provider. Events
+// posted to /v3/retrieval-events list their attempts in the order they
+// started, so a storage provider may be attempted several times, over
+// different protocols or as retries.
+type Attempt struct {
+	StorageProviderID string    `json:"storageProviderId"`          // The peer ID of the storage provider, or Bitswap
+	Protocol          string    `json:"protocol"`                   // The transport multicodec of the attempt
+	Endpoint          string    `json:"endpoint,omitempty"`         // The multiaddr of the storage provider the attempt connected to
+	StartTime         time.Time `json:"startTime"`                  // The time the attempt started
+	EndTime           time.Time `json:"endTime"`                    // The time the attempt ended
+	TimeToFirstByte   string    `json:"timeToFirstByte,omitempty"`  // The time from the start of the attempt to its first byte
+	BytesTransferred  uint64    `json:"bytesTransferred,omitempty"` // The bytes received by the attempt
+	Blocks            uint64    `json:"blocks,omitempty"`           // The blocks received by the attempt
+	Error             string    `json:"error,omitempty"`            // Why the attempt failed, if it did
+}
+
+func (a Attempt) validate(i int) error {
+	switch {
+	case a.StorageProviderID == "":
+		return fmt.Errorf("property attempts[%d].storageProviderId is required", i)
+	case a.Protocol == "":
+		return fmt.Errorf("property attempts[%d].protocol is required", i)
+	case !validTransport(a.Protocol):
+		return fmt.Errorf("property attempts[%d].protocol is an unknown transport %q", i, a.Protocol)
+	case a.StartTime.IsZero():
+		return fmt.Errorf("property attempts[%d].startTime is required", i)
+	case a.EndTime.IsZero():
+		return fmt.Errorf("property attempts[%d].endTime is required", i)
+	case a.EndTime.Before(a.StartTime):
+		return fmt.Errorf("property attempts[%d].endTime cannot be before startTime", i)
+	}
+	if a.StorageProviderID != types.BitswapIndentifier {
+		if _, err := peer.Decode(a.StorageProviderID); err != nil {
+			return fmt.Errorf("property attempts[%d].storageProviderId must be a peer ID or %s: %w", i, types.BitswapIndentifier, err)
+		}
+	}
+	if a.Endpoint != "" {
+		if _, err := multiaddr.NewMultiaddr(a.Endpoint); err != nil {
+			return fmt.Errorf("property attempts[%d].endpoint must be a multiaddr: %w", i, err)
+		}
+	}
+	if a.TimeToFirstByte != "" {
+		if _, err := time.ParseDuration(a.TimeToFirstByte); err != nil {
+			return fmt.Errorf("property attempts[%d].timeToFirstByte must be a duration: %w", i, err)
+		}
+	}
+	return nil
+}
+
 type AggregateEvent struct {
 	InstanceID        string    `json:"instanceId"`                  // The ID of the Lassie instance generating the event
 	RetrievalID       string    `json:"retrievalId"`                 // The unique ID of the retrieval
@@ -147,6 +172,7 @@ type AggregateEvent struct {
 	ProtocolsAttempted        []string                     `json:"protocolsAttempted,omitempty"`       // The protocols that were used to attempt this retrieval
 	ProtocolSucceeded         string                       `json:"protocolSucceeded,omitempty"`        // The protocol used for a successful event
 	RetrievalAttempts         map[string]*RetrievalAttempt `json:"retrievalAttempts,omitempty"`        // All of the retrieval attempts, indexed by their SP ID
+	Attempts                  []Attempt                    `json:"attempts,omitempty"`                 // All of the retrieval attempts in order, as posted to /v3/retrieval-events
 }
 
 func (e AggregateEvent) Validate() error {
@@ -162,6 +188,33 @@ func (e AggregateEvent) Validate() error {
 	case e.EndTime.Before(e.StartTime):
 		return errors.New("property endTime cannot be before startTime")
 	default:
+		// uuid.Parse also accepts the urn:uuid: and braced forms, which
+		// postgres does not store, so only the canonical form is accepted.
+		id, err := uuid.Parse(e.RetrievalID)
+		if err != nil {
+			return fmt.Errorf("property retrievalId must be a UUID: %w", err)
+		}
+		if id.String() != e.RetrievalID {
+			return fmt.Errorf("property retrievalId must be a UUID in its canonical lowercase form, such as %s", id)
+		}
+		if e.RootCid != "" {
+			if _, err := cid.Decode(e.RootCid); err != nil {
+				return fmt.Errorf("property rootCid must be a valid CID: %w", err)
+			}
+		}
+		for _, protocol := range e.ProtocolsAllowed {
+			if !validTransport(protocol) {
+				return fmt.Errorf("property protocolsAllowed contains unknown transport %q", protocol)
+			}
+		}
+		for _, protocol := range e.ProtocolsAttempted {
+			if !validTransport(protocol) {
+				return fmt.Errorf("property protocolsAttempted contains unknown transport %q", protocol)
+			}
+		}
+		if e.ProtocolSucceeded != "" && !validTransport(e.ProtocolSucceeded) {
+			return fmt.Errorf("property protocolSucceeded is an unknown transport %q", e.ProtocolSucceeded)
+		}
 		if e.TimeToFirstByte != "" {
 			_, err := time.ParseDuration(e.TimeToFirstByte)
 			if err != nil {
@@ -174,7 +227,12 @@ func (e AggregateEvent) Validate() error {
 				return err
 			}
 		}
-		for _, retrievalAttempt := range e.RetrievalAttempts {
+		for storageProviderID, retrievalAttempt := range e.RetrievalAttempts {
+			if storageProviderID != types.BitswapIndentifier {
+				if _, err := peer.Decode(storageProviderID); err != nil {
+					return fmt.Errorf("property retrievalAttempts key %q must be a peer ID or %s: %w", storageProviderID, types.BitswapIndentifier, err)
+				}
+			}
 			if retrievalAttempt == nil {
 				return errors.New("all retrieval attempts should have values")
 			}
@@ -185,19 +243,78 @@ func (e AggregateEvent) Validate() error {
 				}
 			}
 		}
+		for i, attempt := range e.Attempts {
+			if err := attempt.validate(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// summarizeAttempts returns the attempts of each storage provider in the
+// ordered attempts of e summarized as v2 retrieval attempts: the protocol and
+// error of its latest attempt, the time to first byte of its first attempt
+// that received any, and the total bytes transferred.
+func (e AggregateEvent) summarizeAttempts() map[string]*RetrievalAttempt {
+	if len(e.Attempts) == 0 {
 		return nil
 	}
+	summaries := make(map[string]*RetrievalAttempt)
+	for _, attempt := range e.Attempts {
+		summary, ok := summaries[attempt.StorageProviderID]
+		if !ok {
+			summary = &RetrievalAttempt{}
+			summaries[attempt.StorageProviderID] = summary
+		}
+		summary.Protocol = attempt.Protocol
+		summary.Error = attempt.Error
+		summary.BytesTransferred += attempt.BytesTransferred
+		if summary.TimeToFirstByte == "" {
+			summary.TimeToFirstByte = attempt.TimeToFirstByte
+		}
+	}
+	return summaries
+}
+
+// validTransport reports whether protocol is the name of a transport
+// multicodec, such as transport-bitswap.
+func validTransport(protocol string) bool {
+	var code multicodec.Code
+	return code.Set(protocol) == nil && code.Tag() == "transport"
 }
 
 type AggregateEventBatch struct {
 	Events []AggregateEvent `json:"events"`
 }
 
+// Validate validates a batch posted to /v2/retrieval-events, whose events
+// index their retrieval attempts by storage provider.
 func (e AggregateEventBatch) Validate() error {
 	if len(e.Events) == 0 {
 		return errors.New("property events is required")
 	}
 	for _, event := range e.Events {
+		if len(event.Attempts) > 0 {
+			return errors.New("property attempts is only supported by /v3/retrieval-events")
+		}
+		if err := event.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateV3 validates a batch posted to /v3/retrieval-events, whose events
+// list their retrieval attempts in order.
+func (e AggregateEventBatch) ValidateV3() error {
+	if len(e.Events) == 0 {
+		return errors.New("property events is required")
+	}
+	for _, event := range e.Events {
+		if len(event.RetrievalAttempts) > 0 {
+			return errors.New("property retrievalAttempts is not supported by /v3/retrieval-events, use attempts instead")
+		}
 		if err := event.Validate(); err != nil {
 			return err
 		}
@@ -5,7 +5,9 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -134,3 +136,170 @@ func Test_EventValidate(t *testing.T) {
 	}
 
 }
+
+func Test_AggregateEventValidate(t *testing.T) {
+	valid := func() AggregateEvent {
+		start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		return AggregateEvent{
+			InstanceID:         "test-instance",
+			RetrievalID:        "c8490080-b86f-4306-a657-a0b88ac43832",
+			RootCid:            testRootCid,
+			StartTime:          start,
+			EndTime:            start.Add(time.Second),
+			ProtocolsAllowed:   []string{"transport-bitswap", "transport-graphsync-filecoinv1", "transport-ipfs-gateway-http"},
+			ProtocolsAttempted: []string{"transport-bitswap", "transport-graphsync-filecoinv1"},
+			ProtocolSucceeded:  "transport-bitswap",
+			RetrievalAttempts: map[string]*RetrievalAttempt{
+				testPeerA:                {Error: "failed to dial", Protocol: "transport-graphsync-filecoinv1"},
+				types.BitswapIndentifier: {TimeToFirstByte: "10ms", Protocol: "transport-bitswap"},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(*AggregateEvent)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(*AggregateEvent) {},
+		},
+		{
+			name:    "retrieval ID not a UUID",
+			modify:  func(e *AggregateEvent) { e.RetrievalID = "not-a-uuid" },
+			wantErr: "property retrievalId must be a UUID",
+		},
+		{
+			name:    "retrieval ID as a URN",
+			modify:  func(e *AggregateEvent) { e.RetrievalID = "urn:uuid:c8490080-b86f-4306-a657-a0b88ac43832" },
+			wantErr: "canonical lowercase form",
+		},
+		{
+			name:    "retrieval ID in braces",
+			modify:  func(e *AggregateEvent) { e.RetrievalID = "{c8490080-b86f-4306-a657-a0b88ac43832}" },
+			wantErr: "canonical lowercase form",
+		},
+		{
+			name:    "retrieval ID in uppercase",
+			modify:  func(e *AggregateEvent) { e.RetrievalID = "C8490080-B86F-4306-A657-A0B88AC43832" },
+			wantErr: "canonical lowercase form",
+		},
+		{
+			name:   "missing root CID",
+			modify: func(e *AggregateEvent) { e.RootCid = "" },
+		},
+		{
+			name:    "invalid root CID",
+			modify:  func(e *AggregateEvent) { e.RootCid = "fish" },
+			wantErr: "property rootCid must be a valid CID",
+		},
+		{
+			name:    "unknown allowed protocol",
+			modify:  func(e *AggregateEvent) { e.ProtocolsAllowed = append(e.ProtocolsAllowed, "carrier-pigeon") },
+			wantErr: `property protocolsAllowed contains unknown transport "carrier-pigeon"`,
+		},
+		{
+			name:    "attempted protocol that is not a transport",
+			modify:  func(e *AggregateEvent) { e.ProtocolsAttempted = []string{"dag-cbor"} },
+			wantErr: `property protocolsAttempted contains unknown transport "dag-cbor"`,
+		},
+		{
+			name:    "unknown succeeded protocol",
+			modify:  func(e *AggregateEvent) { e.ProtocolSucceeded = "http" },
+			wantErr: `property protocolSucceeded is an unknown transport "http"`,
+		},
+		{
+			name: "retrieval attempt key not a peer ID",
+			modify: func(e *AggregateEvent) {
+				e.RetrievalAttempts["f01228000"] = &RetrievalAttempt{Protocol: "transport-graphsync-filecoinv1"}
+			},
+			wantErr: `property retrievalAttempts key "f01228000" must be a peer ID or Bitswap`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := valid()
+			test.modify(&event)
+			err := event.Validate()
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func Test_AggregateEventValidateAttempts(t *testing.T) {
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	valid := func() Attempt {
+		return Attempt{
+			StorageProviderID: testPeerA,
+			Protocol:          "transport-ipfs-gateway-http",
+			Endpoint:          "/dns4/sp.example.com/tcp/443/https",
+			StartTime:         start,
+			EndTime:           start.Add(time.Second),
+			TimeToFirstByte:   "100ms",
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(*Attempt)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(*Attempt) {},
+		},
+		{
+			name:    "storage provider not a peer ID",
+			modify:  func(a *Attempt) { a.StorageProviderID = "f01228000" },
+			wantErr: "property attempts[1].storageProviderId must be a peer ID or Bitswap",
+		},
+		{
+			name:    "unknown protocol",
+			modify:  func(a *Attempt) { a.Protocol = "http" },
+			wantErr: `property attempts[1].protocol is an unknown transport "http"`,
+		},
+		{
+			name:    "missing start time",
+			modify:  func(a *Attempt) { a.StartTime = time.Time{} },
+			wantErr: "property attempts[1].startTime is required",
+		},
+		{
+			name:    "ends before it starts",
+			modify:  func(a *Attempt) { a.EndTime = a.StartTime.Add(-time.Second) },
+			wantErr: "property attempts[1].endTime cannot be before startTime",
+		},
+		{
+			name:    "endpoint not a multiaddr",
+			modify:  func(a *Attempt) { a.Endpoint = "https://sp.example.com" },
+			wantErr: "property attempts[1].endpoint must be a multiaddr",
+		},
+		{
+			name:    "invalid time to first byte",
+			modify:  func(a *Attempt) { a.TimeToFirstByte = "soon" },
+			wantErr: "property attempts[1].timeToFirstByte must be a duration",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			second := valid()
+			test.modify(&second)
+			event := AggregateEvent{
+				InstanceID:  "test-instance",
+				RetrievalID: "c8490080-b86f-4306-a657-a0b88ac43832",
+				RootCid:     testRootCid,
+				StartTime:   start,
+				EndTime:     start.Add(time.Second),
+				Attempts:    []Attempt{valid(), second},
+			}
+			err := AggregateEventBatch{Events: []AggregateEvent{event}}.ValidateV3()
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
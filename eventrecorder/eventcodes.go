@@ -0,0 +1,137 @@
+package eventrecorder
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+)
+
+// UnknownEventPolicy decides what happens to v1 events whose phase or event
+// code is not in the configured EventCodes.
+type UnknownEventPolicy string
+
+const (
+	// RejectUnknownEvents rejects the whole batch of an unknown event.
+	RejectUnknownEvents UnknownEventPolicy = "reject"
+	// SkipUnknownEventMetrics stores unknown events but does not report them
+	// to metrics.
+	SkipUnknownEventMetrics UnknownEventPolicy = "skip-metrics"
+	// DropUnknownEvents accepts batches with unknown events but neither
+	// stores nor forwards the unknown events.
+	DropUnknownEvents UnknownEventPolicy = "drop"
+)
+
+// EventCodes is the set of phases and event codes accepted in v1 events.
+type EventCodes struct {
+	Phases  []types.Phase
+	Codes   []types.EventCode
+	Unknown UnknownEventPolicy
+}
+
+// DefaultEventCodes returns the phases and event codes of Lassie v0.5,
+// rejecting any other.
+func DefaultEventCodes() EventCodes {
+	return EventCodes{
+		Phases: []types.Phase{types.IndexerPhase, types.QueryPhase, types.RetrievalPhase},
+		Codes: []types.EventCode{
+			types.CandidatesFoundCode,
+			types.CandidatesFilteredCode,
+			types.StartedCode,
+			types.ConnectedCode,
+			types.QueryAskedCode,
+			types.QueryAskedFilteredCode,
+			types.ProposedCode,
+			types.AcceptedCode,
+			types.FirstByteCode,
+			types.FailedCode,
+			types.SuccessCode,
+		},
+		Unknown: RejectUnknownEvents,
+	}
+}
+
+// EventValidator validates v1 events against a set of accepted phases and
+// event codes, as a recorder configured with them does.
+type EventValidator struct {
+	allowlist *eventAllowlist
+}
+
+// NewEventValidator returns a validator of v1 events accepting codes.
+func NewEventValidator(codes EventCodes) (*EventValidator, error) {
+	allowlist, err := newEventAllowlist(codes)
+	if err != nil {
+		return nil, err
+	}
+	return &EventValidator{allowlist: allowlist}, nil
+}
+
+// Validate validates an event.
+func (v *EventValidator) Validate(event Event) error {
+	return event.validate(v.allowlist)
+}
+
+// eventAllowlist is the lookup form of EventCodes.
+type eventAllowlist struct {
+	phases  map[types.Phase]struct{}
+	codes   map[types.EventCode]struct{}
+	unknown UnknownEventPolicy
+
+	errInvalidPhase     error
+	errInvalidEventCode error
+}
+
+var defaultAllowlist, _ = newEventAllowlist(DefaultEventCodes())
+
+func newEventAllowlist(codes EventCodes) (*eventAllowlist, error) {
+	switch codes.Unknown {
+	case RejectUnknownEvents, SkipUnknownEventMetrics, DropUnknownEvents:
+	default:
+		return nil, fmt.Errorf("unknown event policy must be one of: [%s %s %s]", RejectUnknownEvents, SkipUnknownEventMetrics, DropUnknownEvents)
+	}
+	if len(codes.Phases) == 0 || len(codes.Codes) == 0 {
+		return nil, errors.New("at least one phase and event code must be accepted")
+	}
+	a := &eventAllowlist{
+		phases:  make(map[types.Phase]struct{}, len(codes.Phases)),
+		codes:   make(map[types.EventCode]struct{}, len(codes.Codes)),
+		unknown: codes.Unknown,
+	}
+	for _, phase := range codes.Phases {
+		a.phases[phase] = struct{}{}
+	}
+	for _, code := range codes.Codes {
+		a.codes[code] = struct{}{}
+	}
+	phases := append([]types.Phase(nil), codes.Phases...)
+	sort.Slice(phases, func(i, j int) bool { return phases[i] < phases[j] })
+	a.errInvalidPhase = fmt.Errorf("phase must be one of: %v", phases)
+	eventCodes := append([]types.EventCode(nil), codes.Codes...)
+	sort.Slice(eventCodes, func(i, j int) bool { return eventCodes[i] < eventCodes[j] })
+	a.errInvalidEventCode = fmt.Errorf("eventName must be one of: %v", eventCodes)
+	return a, nil
+}
+
+// known reports whether both the phase and event code of an event are
+// accepted.
+func (a *eventAllowlist) known(event Event) bool {
+	_, knownPhase := a.phases[event.Phase]
+	_, knownCode := a.codes[event.EventName]
+	return knownPhase && knownCode
+}
+
+// check returns an error for an unknown phase or event code if unknown events
+// are rejected.
+func (a *eventAllowlist) check(event Event) error {
+	if a.unknown != RejectUnknownEvents {
+		return nil
+	}
+	if _, ok := a.phases[event.Phase]; !ok {
+		return a.errInvalidPhase
+	}
+	if _, ok := a.codes[event.EventName]; !ok {
+		return a.errInvalidEventCode
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package eventrecorder_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type eventCodeMetrics struct {
+	nopMetrics
+	started int
+	unknown []types.Phase
+}
+
+func (m *eventCodeMetrics) HandleStartedEvent(context.Context, types.RetrievalID, types.Phase, time.Time, string) {
+	m.started++
+}
+
+func (m *eventCodeMetrics) HandleUnknownEvent(_ context.Context, phase types.Phase, _ types.EventCode) {
+	m.unknown = append(m.unknown, phase)
+}
+
+func TestUnknownEventPolicies(t *testing.T) {
+	tests := []struct {
+		policy      eventrecorder.UnknownEventPolicy
+		wantErr     bool
+		wantStored  int
+		wantStarted int
+	}{
+		{policy: eventrecorder.RejectUnknownEvents, wantErr: true},
+		{policy: eventrecorder.SkipUnknownEventMetrics, wantStored: 2, wantStarted: 1},
+		{policy: eventrecorder.DropUnknownEvents, wantStored: 1, wantStarted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			codes := eventrecorder.DefaultEventCodes()
+			codes.Unknown = tt.policy
+			m := &eventCodeMetrics{}
+			path := filepath.Join(t.TempDir(), "recorder.db")
+			recorder, err := eventrecorder.New(
+				eventrecorder.WithDatabaseDSN("sqlite://"+path),
+				eventrecorder.WithMetrics(m),
+				eventrecorder.WithEventCodes(codes),
+			)
+			require.NoError(t, err)
+			require.NoError(t, recorder.Start(ctx))
+			defer recorder.Shutdown()
+
+			id, err := types.NewRetrievalID()
+			require.NoError(t, err)
+			now := time.Now()
+			event := func(phase types.Phase) eventrecorder.Event {
+				return eventrecorder.Event{
+					RetrievalId:    id,
+					InstanceId:     "test-instance",
+					Cid:            "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+					Phase:          phase,
+					PhaseStartTime: now,
+					EventName:      types.StartedCode,
+					EventTime:      now,
+				}
+			}
+			// A phase from a newer Lassie, with a known event code.
+			batch := eventrecorder.EventBatch{Events: []eventrecorder.Event{event(types.IndexerPhase), event("extraction")}}
+
+			err = recorder.ValidateEvents(ctx, batch)
+			require.Equal(t, []types.Phase{"extraction"}, m.unknown)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "phase must be one of")
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, recorder.RecordEvents(ctx, batch.Events))
+
+			db, err := sql.Open("sqlite", path)
+			require.NoError(t, err)
+			defer db.Close()
+			var stored int
+			require.NoError(t, db.QueryRow(`select count(*) from retrieval_events`).Scan(&stored))
+			require.Equal(t, tt.wantStored, stored)
+			require.Equal(t, tt.wantStarted, m.started)
+		})
+	}
+}
+
+func TestWithEventCodes(t *testing.T) {
+	codes := eventrecorder.DefaultEventCodes()
+	codes.Codes = append(codes.Codes, "block-received")
+	_, err := eventrecorder.New(eventrecorder.WithMetrics(nopMetrics{}), eventrecorder.WithEventCodes(codes))
+	require.NoError(t, err)
+
+	codes.Unknown = "ignore"
+	_, err = eventrecorder.New(eventrecorder.WithMetrics(nopMetrics{}), eventrecorder.WithEventCodes(codes))
+	require.ErrorContains(t, err, "unknown event policy must be one of")
+
+	_, err = eventrecorder.New(eventrecorder.WithMetrics(nopMetrics{}), eventrecorder.WithEventCodes(eventrecorder.EventCodes{Unknown: eventrecorder.DropUnknownEvents}))
+	require.ErrorContains(t, err, "at least one phase and event code must be accepted")
+}
@@ -0,0 +1,159 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/hotcontent"
+	"github.com/filecoin-project/lassie/pkg/types"
+)
+
+// ErrHotContentDisabled is returned when querying hot content of a recorder
+// that does not track it.
+var ErrHotContentDisabled = errors.New("hot content tracking is not enabled")
+
+// hotContentKinds name the counts of a snapshot in the hot_content table.
+const (
+	hotContentRetrieved = "retrieved"
+	hotContentFailed    = "failed"
+)
+
+// hotContentSnapshots rotates the hot content tracker every period, storing the
+// counts of each period ended in the database, if any.
+type hotContentSnapshots struct {
+	tracker *hotcontent.Tracker
+	period  time.Duration
+	// db is nil when the recorder has no database.
+	db *sql.DB
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newHotContentSnapshots(tracker *hotcontent.Tracker, period time.Duration, db *sql.DB) *hotContentSnapshots {
+	return &hotContentSnapshots{
+		tracker: tracker,
+		period:  period,
+		db:      db,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (h *hotContentSnapshots) start() {
+	go h.run()
+}
+
+func (h *hotContentSnapshots) run() {
+	defer close(h.closed)
+	ticker := time.NewTicker(h.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.closing:
+			// The period cut short by shutdown is stored too, so that its
+			// counts are not lost.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			h.rotate(ctx)
+			cancel()
+			return
+		case <-ticker.C:
+			h.rotate(context.Background())
+		}
+	}
+}
+
+func (h *hotContentSnapshots) rotate(ctx context.Context) {
+	snapshot := h.tracker.Rotate()
+	if h.db == nil {
+		return
+	}
+	if err := h.store(ctx, snapshot); err != nil {
+		logger.Errorw("Failed to store hot content snapshot", "start", snapshot.Start, "err", err)
+		return
+	}
+	logger.Infow("Stored hot content snapshot", "start", snapshot.Start, "end", snapshot.End,
+		"retrieved", len(snapshot.TopRetrieved), "failed", len(snapshot.TopFailed), "instances", len(snapshot.UniqueCIDs))
+}
+
+// store writes a snapshot in a single transaction.
+func (h *hotContentSnapshots) store(ctx context.Context, snapshot hotcontent.Snapshot) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin snapshot transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	start, end := snapshot.Start.UTC(), snapshot.End.UTC()
+	for kind, counts := range map[string][]hotcontent.Count{
+		hotContentRetrieved: snapshot.TopRetrieved,
+		hotContentFailed:    snapshot.TopFailed,
+	} {
+		for _, count := range counts {
+			if _, err := tx.ExecContext(ctx, `
+				insert into hot_content(period_start, period_end, kind, cid, count)
+				values ($1, $2, $3, $4, $5)
+				`, start, end, kind, count.CID, count.Count); err != nil {
+				return fmt.Errorf("failed to store %s count of %s: %w", kind, count.CID, err)
+			}
+		}
+	}
+	for instanceID, unique := range snapshot.UniqueCIDs {
+		if _, err := tx.ExecContext(ctx, `
+			insert into instance_unique_cids(period_start, period_end, instance_id, unique_cids)
+			values ($1, $2, $3, $4)
+			`, start, end, instanceID, unique); err != nil {
+			return fmt.Errorf("failed to store unique CIDs of %s: %w", instanceID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit snapshot: %w", err)
+	}
+	return nil
+}
+
+func (h *hotContentSnapshots) close() {
+	close(h.closing)
+	<-h.closed
+}
+
+// observeHotContent counts the retrievals and failures of v1 events: a
+// retrieval starts with the indexer phase, and fails when the indexer phase
+// does, or when the retrieval phase does without a storage provider. Events of
+// instances sending aggregate events are not counted, since their retrievals
+// are counted from their aggregate events.
+func (r *EventRecorder) observeHotContent(events []Event) {
+	for _, event := range events {
+		if !r.cfg.eventAllowlist.known(event) || r.aggregateInstances.contains(event.InstanceId) {
+			continue
+		}
+		switch {
+		case event.Phase == types.IndexerPhase && event.EventName == types.StartedCode:
+			r.cfg.hotContent.Retrieved(event.InstanceId, event.Cid)
+		case event.EventName == types.FailedCode && (event.Phase == types.IndexerPhase ||
+			(event.Phase == types.RetrievalPhase && event.StorageProviderId == "")):
+			r.cfg.hotContent.Failed(event.Cid)
+		}
+	}
+}
+
+// HotContent returns the counts of the current hot content period so far.
+func (r *EventRecorder) HotContent() (hotcontent.Snapshot, error) {
+	if r.cfg.hotContent == nil {
+		return hotcontent.Snapshot{}, ErrHotContentDisabled
+	}
+	return r.cfg.hotContent.Snapshot(), nil
+}
+
+// HotContentCounts returns the estimated number of retrievals and failures of
+// cid within the current hot content period.
+func (r *EventRecorder) HotContentCounts(cid string) (retrieved, failed uint64, err error) {
+	if r.cfg.hotContent == nil {
+		return 0, 0, ErrHotContentDisabled
+	}
+	retrieved, failed = r.cfg.hotContent.Counts(cid)
+	return retrieved, failed, nil
+}
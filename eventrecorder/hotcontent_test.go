@@ -0,0 +1,161 @@
+package eventrecorder_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/hotcontent"
+	"github.com/filecoin-project/lassie-event-recorder/httpserver"
+	"github.com/filecoin-project/lassie-event-recorder/spmap"
+	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotContent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	tracker, err := hotcontent.New(hotcontent.Config{K: 10})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+path),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+		eventrecorder.WithHotContent(tracker, time.Hour),
+	)
+	require.NoError(t, err)
+
+	handler := httpserver.NewHttpHandler(recorder)
+	evtts := httptest.NewServer(handler.Handler())
+	defer evtts.Close()
+	require.NoError(t, handler.Start(ctx))
+
+	post := func(path, file string) {
+		body, err := os.ReadFile(file)
+		require.NoError(t, err)
+		resp, err := http.Post(evtts.URL+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	get := func(path string, v any) {
+		resp, err := http.Get(evtts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	post("/v1/retrieval-events", "../testdata/good.json")
+	post("/v2/retrieval-events", "../testdata/aggregategood.json")
+
+	const v1Cid = "bafybeic4jpi2detp5n3q6rjo7ckulebtr7dsvt2tbrtcqlnnzqmi3bzz2y"
+	const rootCid = "QmTTA2daxGqo5denp6SwLzzkLJm3fuisYEi9CoWsuHpzfb"
+	var snapshot hotcontent.Snapshot
+	get("/v1/content/hot", &snapshot)
+	require.Equal(t, uint64(4), snapshot.Retrievals)
+	require.Equal(t, uint64(1), snapshot.Failures)
+	require.Equal(t, []hotcontent.Count{{CID: rootCid, Count: 3}, {CID: v1Cid, Count: 1}}, snapshot.TopRetrieved)
+	require.Equal(t, []hotcontent.Count{{CID: rootCid, Count: 1}}, snapshot.TopFailed)
+	require.Equal(t, map[string]uint64{"test-instance": 1, "test-instance-id": 1}, snapshot.UniqueCIDs)
+
+	var counts struct {
+		Retrieved uint64 `json:"retrieved"`
+		Failed    uint64 `json:"failed"`
+	}
+	get("/v1/content/hot?cid="+rootCid, &counts)
+	require.Equal(t, uint64(3), counts.Retrieved)
+	require.Equal(t, uint64(1), counts.Failed)
+
+	// The period cut short by shutdown is stored.
+	handler.Shutdown()
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+	got := make(map[string]int64)
+	rows, err := db.Query(`select kind, cid, count from hot_content`)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var kind, cid string
+		var count int64
+		require.NoError(t, rows.Scan(&kind, &cid, &count))
+		got[kind+" "+cid] = count
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, map[string]int64{
+		"retrieved " + rootCid: 3,
+		"retrieved " + v1Cid:   1,
+		"failed " + rootCid:    1,
+	}, got)
+	var instances int
+	require.NoError(t, db.QueryRow(`select count(*) from instance_unique_cids where unique_cids = 1`).Scan(&instances))
+	require.Equal(t, 2, instances)
+}
+
+func TestHotContent_InstanceSendingBothStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	// The v1 events of the aggregate events' instance.
+	var v1 struct {
+		Events []eventrecorder.Event `json:"events"`
+	}
+	body, err := os.ReadFile("../testdata/good.json")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &v1))
+	for i := range v1.Events {
+		v1.Events[i].InstanceId = "test-instance"
+	}
+	var aggregate struct {
+		Events []eventrecorder.AggregateEvent `json:"events"`
+	}
+	body, err = os.ReadFile("../testdata/aggregategood.json")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &aggregate))
+
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	start := func() (*eventrecorder.EventRecorder, *hotcontent.Tracker) {
+		tracker, err := hotcontent.New(hotcontent.Config{K: 10})
+		require.NoError(t, err)
+		recorder, err := eventrecorder.New(
+			eventrecorder.WithDatabaseDSN("sqlite://"+path),
+			eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+			eventrecorder.WithHotContent(tracker, time.Hour),
+		)
+		require.NoError(t, err)
+		require.NoError(t, recorder.Start(ctx))
+		return recorder, tracker
+	}
+
+	// Retrievals are counted from the aggregate events only.
+	recorder, tracker := start()
+	require.NoError(t, recorder.RecordAggregateEvents(ctx, aggregate.Events))
+	require.NoError(t, recorder.RecordEvents(ctx, v1.Events))
+	snapshot := tracker.Snapshot()
+	require.Equal(t, uint64(3), snapshot.Retrievals)
+	require.Equal(t, uint64(1), snapshot.Failures)
+	require.Equal(t, map[string]uint64{"test-instance": 1}, snapshot.UniqueCIDs)
+	recorder.Shutdown()
+
+	// The instance is still known to send aggregate events after a restart.
+	recorder, tracker = start()
+	defer recorder.Shutdown()
+	require.NoError(t, recorder.RecordEvents(ctx, v1.Events))
+	snapshot = tracker.Snapshot()
+	require.Zero(t, snapshot.Retrievals)
+	require.Zero(t, snapshot.Failures)
+}
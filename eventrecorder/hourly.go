@@ -0,0 +1,379 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+)
+
+const (
+	// hourlyRollupsCheckpoint is the backfill checkpoint holding the time up
+	// to which stored aggregate events have been rolled up.
+	hourlyRollupsCheckpoint = "hourly_rollups"
+	// hourlyRollupsInitialCheckpoint is the backfill checkpoint holding the
+	// next hour to roll up by the first run, which rolls up every stored
+	// event. It is removed once the first run completes.
+	hourlyRollupsInitialCheckpoint = "hourly_rollups_initial"
+	// hourlyRollupsLock is the postgres advisory lock held while rolling up,
+	// so that a single recorder sharing the database does so at a time.
+	hourlyRollupsLock int64 = 0x6c61737369650001
+	// hourlyRollupsLag is how far behind the present rollups stay, so that
+	// events being inserted as the rollups run are not skipped.
+	hourlyRollupsLag = time.Minute
+)
+
+// hourFormat is the format of the hours selected by hourlyRollupsHoursQuery.
+const hourFormat = "2006-01-02 15:04:05"
+
+var (
+	hourlyRollupsHoursQuery = map[migrations.Dialect]string{
+		migrations.Postgres: `
+			select distinct to_char(date_trunc('hour', start_time at time zone 'UTC'), 'YYYY-MM-DD HH24:00:00')
+			from aggregate_retrieval_events
+			where inserted_at > $1 and inserted_at <= $2`,
+		migrations.SQLite: `
+			select distinct strftime('%Y-%m-%d %H:00:00', start_time)
+			from aggregate_retrieval_events
+			where inserted_at > $1 and inserted_at <= $2`,
+	}
+	hourlyRollupsAllHoursQuery = map[migrations.Dialect]string{
+		migrations.Postgres: `
+			select distinct to_char(date_trunc('hour', start_time at time zone 'UTC'), 'YYYY-MM-DD HH24:00:00')
+			from aggregate_retrieval_events
+			where start_time >= $1
+			order by 1`,
+		migrations.SQLite: `
+			select distinct strftime('%Y-%m-%d %H:00:00', start_time)
+			from aggregate_retrieval_events
+			where start_time >= $1
+			order by 1`,
+	}
+)
+
+// hourlyRollupQuery rolls up the attempts of the aggregate events that started
+// within an hour, by the Filecoin SP ID and protocol of each attempt, so that
+// storage providers that failed are counted alongside those that succeeded.
+// Retrievals are counted once per storage provider and protocol whatever their
+// number of attempts, and succeed with an attempt without error. Retrievals
+// without attempts are counted with an empty storage provider and protocol.
+// Durations are stored as nanoseconds. Postgres cannot infer the type of
+// parameters in the select list, so they are formatted with a cast.
+const hourlyRollupQuery = `
+	insert into hourly_rollups(
+		hour,
+		instance_id,
+		filecoin_storage_provider_id,
+		protocol,
+		retrievals,
+		successes,
+		bytes_transferred,
+		ttfb_under_100ms,
+		ttfb_under_500ms,
+		ttfb_under_1s,
+		ttfb_under_5s,
+		ttfb_under_30s,
+		ttfb_over_30s,
+		updated_at
+	)
+	select
+		$1%[1]s,
+		e.instance_id,
+		coalesce(a.filecoin_storage_provider_id, ''),
+		coalesce(a.protocol, ''),
+		count(distinct e.retrieval_id),
+		count(distinct case when a.retrieval_id is not null and coalesce(a.error, '') = '' then e.retrieval_id end),
+		coalesce(sum(a.bytes_transferred), 0),
+		sum(case when a.time_to_first_byte > 0 and a.time_to_first_byte < 100000000 then 1 else 0 end),
+		sum(case when a.time_to_first_byte >= 100000000 and a.time_to_first_byte < 500000000 then 1 else 0 end),
+		sum(case when a.time_to_first_byte >= 500000000 and a.time_to_first_byte < 1000000000 then 1 else 0 end),
+		sum(case when a.time_to_first_byte >= 1000000000 and a.time_to_first_byte < 5000000000 then 1 else 0 end),
+		sum(case when a.time_to_first_byte >= 5000000000 and a.time_to_first_byte < 30000000000 then 1 else 0 end),
+		sum(case when a.time_to_first_byte >= 30000000000 then 1 else 0 end),
+		$3%[1]s
+	from aggregate_retrieval_events e
+	left join retrieval_attempts a on a.retrieval_id = e.retrieval_id
+	where e.start_time >= $1 and e.start_time < $2
+	group by e.instance_id, coalesce(a.filecoin_storage_provider_id, ''), coalesce(a.protocol, '')
+	`
+
+// hourlyRollups periodically rolls up the aggregate events stored since its
+// last run, recomputing every hour those events started in.
+type hourlyRollups struct {
+	db       *sql.DB
+	dialect  migrations.Dialect
+	interval time.Duration
+	now      func() time.Time
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newHourlyRollups(db *sql.DB, dialect migrations.Dialect, interval time.Duration) *hourlyRollups {
+	return &hourlyRollups{
+		db:       db,
+		dialect:  dialect,
+		interval: interval,
+		now:      time.Now,
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (h *hourlyRollups) start() {
+	go h.run()
+}
+
+func (h *hourlyRollups) run() {
+	defer close(h.closed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := h.rollup(ctx); err != nil && ctx.Err() == nil {
+			logger.Errorw("Failed to roll up hours", "err", err)
+		}
+		select {
+		case <-h.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollup recomputes the rollups of every hour with events stored since the
+// last run, returning the number of hours recomputed. Every hour is committed
+// in its own transaction, so that rolling up many hours does not hold a long
+// transaction open. Nothing is done if another recorder is rolling up.
+func (h *hourlyRollups) rollup(ctx context.Context) (int, error) {
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rollup connection: %w", err)
+	}
+	defer conn.Close()
+
+	if h.dialect == migrations.Postgres {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, hourlyRollupsLock).Scan(&locked); err != nil {
+			return 0, fmt.Errorf("failed to take rollup lock: %w", err)
+		}
+		if !locked {
+			logger.Debug("Skipped rollups already running elsewhere")
+			return 0, nil
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, hourlyRollupsLock); err != nil {
+				// Discard the connection rather than return it to the pool
+				// with the lock held.
+				logger.Warnw("Failed to release rollup lock", "err", err)
+				_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+			}
+		}()
+	}
+
+	now := h.now().UTC()
+	until := now.Add(-hourlyRollupsLag)
+	if h.dialect == migrations.Postgres {
+		// Rows are stamped with the start time of the transaction inserting
+		// them, which may run for longer than the lag. Stay behind the oldest
+		// transaction open in a session of a recorder, by its role and
+		// application name, so that its rows are not skipped once committed.
+		// Other sessions, such as autovacuum or dashboards, never insert
+		// events and are ignored.
+		var oldest sql.NullTime
+		if err := conn.QueryRowContext(ctx, `
+			select min(xact_start) from pg_stat_activity
+			where datname = current_database()
+			and pid <> pg_backend_pid()
+			and backend_type = 'client backend'
+			and usename = current_user
+			and application_name = current_setting('application_name')
+			and state in ('active', 'idle in transaction')
+			`).Scan(&oldest); err != nil {
+			return 0, fmt.Errorf("failed to find oldest open transaction: %w", err)
+		}
+		if oldest.Valid && !oldest.Time.After(until) {
+			until = oldest.Time.UTC().Add(-time.Microsecond)
+		}
+	}
+
+	position, checkpointed, err := h.checkpoint(ctx, conn, hourlyRollupsCheckpoint)
+	if err != nil {
+		return 0, err
+	}
+	if !checkpointed {
+		// The first run rolls up every hour, including those of events stored
+		// before rollups existed, tracking its progress under its own
+		// checkpoint so that it resumes where it stopped. Events stored from
+		// now on are rolled up by the following runs.
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to begin rollup transaction: %w", err)
+		}
+		defer tx.Rollback()
+		if err := saveCheckpoint(ctx, tx, hourlyRollupsCheckpoint, until); err != nil {
+			return 0, err
+		}
+		if err := saveCheckpoint(ctx, tx, hourlyRollupsInitialCheckpoint, time.Unix(0, 0).UTC()); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("failed to commit rollup checkpoints: %w", err)
+		}
+		position = until
+	}
+
+	var rolled int
+	next, pending, err := h.checkpoint(ctx, conn, hourlyRollupsInitialCheckpoint)
+	if err != nil {
+		return 0, err
+	}
+	if pending {
+		hours, err := h.hours(ctx, conn, hourlyRollupsAllHoursQuery[h.dialect], next.UTC())
+		if err != nil {
+			return 0, err
+		}
+		n, err := h.rollupHours(ctx, conn, hours, now, func(tx *sql.Tx, hour time.Time) error {
+			return saveCheckpoint(ctx, tx, hourlyRollupsInitialCheckpoint, hour.Add(time.Hour))
+		})
+		rolled += n
+		if err != nil {
+			return rolled, err
+		}
+		if _, err := conn.ExecContext(ctx, `delete from backfill_checkpoints where name = $1`, hourlyRollupsInitialCheckpoint); err != nil {
+			return rolled, fmt.Errorf("failed to clear initial rollup checkpoint: %w", err)
+		}
+		logger.Infow("Rolled up hours of events stored before rollups", "total", n)
+	}
+
+	if until.After(position) {
+		hours, err := h.hours(ctx, conn, hourlyRollupsHoursQuery[h.dialect], position.UTC(), until)
+		if err != nil {
+			return rolled, err
+		}
+		// The checkpoint only advances once every hour is rolled up: events
+		// are found by when they were stored, not by the hour they started in.
+		n, err := h.rollupHours(ctx, conn, hours, now, nil)
+		rolled += n
+		if err != nil {
+			return rolled, err
+		}
+		if err := saveCheckpoint(ctx, conn, hourlyRollupsCheckpoint, until); err != nil {
+			return rolled, err
+		}
+		if n > 0 {
+			logger.Infow("Rolled up hours", "total", n, "until", until)
+		}
+	}
+	return rolled, nil
+}
+
+// queryer is satisfied by both connections and transactions.
+type queryer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+func (h *hourlyRollups) checkpoint(ctx context.Context, q queryer, name string) (time.Time, bool, error) {
+	var position time.Time
+	err := q.QueryRowContext(ctx, `select position from backfill_checkpoints where name = $1`, name).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to read rollup checkpoint %s: %w", name, err)
+	}
+	return position, true, nil
+}
+
+func saveCheckpoint(ctx context.Context, q queryer, name string, position time.Time) error {
+	if _, err := q.ExecContext(ctx, `
+		insert into backfill_checkpoints(name, position) values ($1, $2)
+		on conflict (name) do update set position = excluded.position, updated_at = current_timestamp
+		`, name, position); err != nil {
+		return fmt.Errorf("failed to save rollup checkpoint %s: %w", name, err)
+	}
+	return nil
+}
+
+// hours returns the hours selected by query, in order.
+func (h *hourlyRollups) hours(ctx context.Context, q queryer, query string, args ...any) ([]time.Time, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find hours to roll up: %w", err)
+	}
+	defer rows.Close()
+	var hours []time.Time
+	for rows.Next() {
+		var formatted string
+		if err := rows.Scan(&formatted); err != nil {
+			return nil, fmt.Errorf("failed to read hour to roll up: %w", err)
+		}
+		hour, err := time.Parse(hourFormat, formatted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hour %q: %w", formatted, err)
+		}
+		hours = append(hours, hour)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find hours to roll up: %w", err)
+	}
+	return hours, nil
+}
+
+// rollupHours recomputes the rollups of hours, each in its own transaction,
+// calling done, if set, within the transaction of every hour. It returns the
+// number of hours committed.
+func (h *hourlyRollups) rollupHours(ctx context.Context, conn *sql.Conn, hours []time.Time, now time.Time, done func(*sql.Tx, time.Time) error) (int, error) {
+	var cast string
+	if h.dialect == migrations.Postgres {
+		cast = "::timestamp with time zone"
+	}
+	rollupQuery := fmt.Sprintf(hourlyRollupQuery, cast)
+	for i, hour := range hours {
+		if err := func() error {
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("failed to begin rollup transaction: %w", err)
+			}
+			defer tx.Rollback()
+			if _, err := tx.ExecContext(ctx, `delete from hourly_rollups where hour = $1`, hour); err != nil {
+				return fmt.Errorf("failed to clear rollups of %s: %w", hour, err)
+			}
+			if _, err := tx.ExecContext(ctx, rollupQuery, hour, hour.Add(time.Hour), now); err != nil {
+				return fmt.Errorf("failed to roll up %s: %w", hour, err)
+			}
+			if done != nil {
+				if err := done(tx, hour); err != nil {
+					return err
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("failed to commit rollups of %s: %w", hour, err)
+			}
+			return nil
+		}(); err != nil {
+			return i, err
+		}
+	}
+	return len(hours), nil
+}
+
+func (h *hourlyRollups) close() {
+	close(h.closing)
+	<-h.closed
+}
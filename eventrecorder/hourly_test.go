@@ -0,0 +1,162 @@
+package eventrecorder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHourlyRollups(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := New(WithDatabaseDSN("sqlite://" + filepath.Join(t.TempDir(), "recorder.db")))
+	require.NoError(t, err)
+	require.NoError(t, r.Start(ctx))
+	defer r.Shutdown()
+
+	const graphsync, http = "transport-graphsync-filecoinv1", "transport-ipfs-gateway-http"
+	type attempt struct {
+		spID, protocol, err string
+		timeToFirstByte     time.Duration
+		bytes               int
+	}
+	hour := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	insert := func(retrievalID string, start time.Time, attempts ...attempt) {
+		_, err := r.sqlite.ExecContext(ctx, `
+			insert into aggregate_retrieval_events(retrieval_id, instance_id, success, start_time, end_time)
+			values ($1, 'test-instance', $2, $3, $4)
+			`, retrievalID, len(attempts) > 0 && attempts[len(attempts)-1].err == "", start, start.Add(time.Second))
+		require.NoError(t, err)
+		for _, a := range attempts {
+			_, err := r.sqlite.ExecContext(ctx, `
+				insert into retrieval_attempts(retrieval_id, storage_provider_id, filecoin_storage_provider_id, time_to_first_byte,
+					bytes_transferred, error, protocol)
+				values ($1, $2, $2, $3, $4, $5, $6)
+				`, retrievalID, a.spID, a.timeToFirstByte, a.bytes, a.err, a.protocol)
+			require.NoError(t, err)
+		}
+	}
+	type key struct {
+		hour           time.Time
+		spID, protocol string
+	}
+	type rollup struct {
+		retrievals, successes, bytes int64
+		ttfb                         [6]int64
+	}
+	rollups := func() map[key]rollup {
+		rows, err := r.sqlite.QueryContext(ctx, `
+			select hour, filecoin_storage_provider_id, protocol, retrievals, successes, bytes_transferred, ttfb_under_100ms,
+				ttfb_under_500ms, ttfb_under_1s, ttfb_under_5s, ttfb_under_30s, ttfb_over_30s
+			from hourly_rollups where instance_id = 'test-instance'`)
+		require.NoError(t, err)
+		defer rows.Close()
+		got := make(map[key]rollup)
+		for rows.Next() {
+			var k key
+			var r rollup
+			require.NoError(t, rows.Scan(&k.hour, &k.spID, &k.protocol, &r.retrievals, &r.successes, &r.bytes, &r.ttfb[0], &r.ttfb[1], &r.ttfb[2], &r.ttfb[3], &r.ttfb[4], &r.ttfb[5]))
+			k.hour = k.hour.UTC()
+			got[k] = r
+		}
+		require.NoError(t, rows.Err())
+		return got
+	}
+
+	// f01234 fails over graphsync before f05678 serves the first retrieval,
+	// then serves the third itself. The second retrieval has no attempts.
+	insert("retrieval-1", hour.Add(5*time.Minute),
+		attempt{spID: "f01234", protocol: graphsync, err: "timeout"},
+		attempt{spID: "f05678", protocol: http, timeToFirstByte: 50 * time.Millisecond, bytes: 100})
+	insert("retrieval-2", hour.Add(59*time.Minute))
+	insert("retrieval-3", hour.Add(time.Hour), attempt{spID: "f01234", protocol: graphsync, timeToFirstByte: 2 * time.Second, bytes: 300})
+
+	h := newHourlyRollups(r.sqlite, migrations.SQLite, time.Hour)
+	// Rollups stay behind the present to leave time for in flight inserts.
+	h.now = func() time.Time { return time.Now().Add(hourlyRollupsLag) }
+	rolled, err := h.rollup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, rolled)
+	require.Equal(t, map[key]rollup{
+		{hour, "f01234", graphsync}:                {retrievals: 1},
+		{hour, "f05678", http}:                     {retrievals: 1, successes: 1, bytes: 100, ttfb: [6]int64{1, 0, 0, 0, 0, 0}},
+		{hour, "", ""}:                             {retrievals: 1},
+		{hour.Add(time.Hour), "f01234", graphsync}: {retrievals: 1, successes: 1, bytes: 300, ttfb: [6]int64{0, 0, 0, 1, 0, 0}},
+	}, rollups())
+
+	rolled, err = h.rollup(ctx)
+	require.NoError(t, err)
+	require.Zero(t, rolled)
+
+	// An event arriving late for an hour already rolled up recomputes it.
+	// Retrievals are counted once however many times a storage provider is
+	// attempted.
+	time.Sleep(5 * time.Millisecond)
+	insert("retrieval-4", hour.Add(30*time.Minute),
+		attempt{spID: "f01234", protocol: graphsync, err: "timeout"},
+		attempt{spID: "f01234", protocol: graphsync, timeToFirstByte: 45 * time.Second, bytes: 50})
+	rolled, err = h.rollup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, rolled)
+	require.Equal(t, rollup{retrievals: 2, successes: 1, bytes: 50, ttfb: [6]int64{0, 0, 0, 0, 0, 1}}, rollups()[key{hour, "f01234", graphsync}])
+}
+
+func TestHourlyRollups_ResumesFirstRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := New(WithDatabaseDSN("sqlite://" + filepath.Join(t.TempDir(), "recorder.db")))
+	require.NoError(t, err)
+	require.NoError(t, r.Start(ctx))
+	defer r.Shutdown()
+
+	hour := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		_, err := r.sqlite.ExecContext(ctx, `
+			insert into aggregate_retrieval_events(retrieval_id, instance_id, success, start_time, end_time)
+			values ($1, 'test-instance', true, $2, $2)
+			`, fmt.Sprintf("retrieval-%d", i), hour.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, err)
+	}
+
+	// A first run stopped after rolling up the first hour.
+	h := newHourlyRollups(r.sqlite, migrations.SQLite, time.Hour)
+	require.NoError(t, saveCheckpoint(ctx, r.sqlite, hourlyRollupsCheckpoint, time.Now().Add(time.Hour)))
+	require.NoError(t, saveCheckpoint(ctx, r.sqlite, hourlyRollupsInitialCheckpoint, hour.Add(time.Hour)))
+	rolled, err := h.rollup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, rolled)
+
+	var hours []time.Time
+	rows, err := r.sqlite.QueryContext(ctx, `select hour from hourly_rollups where instance_id = 'test-instance' order by hour`)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var hour time.Time
+		require.NoError(t, rows.Scan(&hour))
+		hours = append(hours, hour.UTC())
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []time.Time{hour.Add(time.Hour), hour.Add(2 * time.Hour)}, hours)
+
+	_, pending, err := h.checkpoint(ctx, r.sqlite, hourlyRollupsInitialCheckpoint)
+	require.NoError(t, err)
+	require.False(t, pending)
+}
+
+func TestHourlyRollups_ApplicationName(t *testing.T) {
+	// Rollups only wait for transactions of sessions with the recorder's
+	// application name, which the DSN may override.
+	cfg, err := newConfig([]Option{WithDatabaseDSN("postgres://user@localhost:5432/events")})
+	require.NoError(t, err)
+	require.Equal(t, defaultApplicationName, cfg.pgxPoolConfig.ConnConfig.RuntimeParams["application_name"])
+	cfg, err = newConfig([]Option{WithDatabaseDSN("postgres://user@localhost:5432/events?application_name=recorder-eu")})
+	require.NoError(t, err)
+	require.Equal(t, "recorder-eu", cfg.pgxPoolConfig.ConnConfig.RuntimeParams["application_name"])
+}
@@ -0,0 +1,329 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+)
+
+// instanceRefreshInterval is how often the registered instances are reloaded,
+// picking up changes made through other recorders sharing the database.
+const instanceRefreshInterval = time.Minute
+
+var (
+	// ErrUnregisteredInstance is returned when events are rejected because
+	// their instance is not registered, or its registration is inactive.
+	ErrUnregisteredInstance = errors.New("instance is not registered")
+	// ErrInstanceNotFound is returned when looking up or removing an instance
+	// that is not registered.
+	ErrInstanceNotFound = errors.New("instance not found")
+	// ErrInvalidInstance is returned when registering an instance with an
+	// invalid ID.
+	ErrInvalidInstance = errors.New("invalid instance")
+)
+
+// UnregisteredInstancePolicy decides what happens to events sent by instances
+// that are not registered, or whose registration is inactive.
+type UnregisteredInstancePolicy string
+
+const (
+	// TagUnregisteredInstances accepts their events, reporting them to
+	// metrics as unregistered.
+	TagUnregisteredInstances UnregisteredInstancePolicy = "tag"
+	// RejectUnregisteredInstances rejects their batches.
+	RejectUnregisteredInstances UnregisteredInstancePolicy = "reject"
+)
+
+// Instance is a registered Lassie instance.
+type Instance struct {
+	ID            string    `json:"instanceId"`
+	Operator      string    `json:"operator,omitempty"`
+	Region        string    `json:"region,omitempty"`
+	Environment   string    `json:"environment,omitempty"`
+	LassieVersion string    `json:"lassieVersion,omitempty"`
+	Active        bool      `json:"active"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// InstanceFilter selects registered instances; empty fields match any
+// instance.
+type InstanceFilter struct {
+	Operator      string
+	Region        string
+	Environment   string
+	LassieVersion string
+	Active        *bool
+}
+
+func (i Instance) validate() error {
+	if i.ID == "" {
+		return fmt.Errorf("%w: ID must not be empty", ErrInvalidInstance)
+	}
+	// Instance IDs are stored as character varying(64) in postgres.
+	if len(i.ID) > 64 {
+		return fmt.Errorf("%w: ID must be at most 64 characters long", ErrInvalidInstance)
+	}
+	return nil
+}
+
+// RegisterInstance registers an instance, replacing the metadata of an
+// already registered instance with the same ID, and returns it as stored.
+func (r *EventRecorder) RegisterInstance(ctx context.Context, instance Instance) (Instance, error) {
+	if err := instance.validate(); err != nil {
+		return Instance{}, err
+	}
+	db, _, err := r.sqlDB()
+	if err != nil {
+		return Instance{}, err
+	}
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		insert into instances(instance_id, operator, region, environment, lassie_version, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $7)
+		on conflict (instance_id) do update set
+			operator = excluded.operator,
+			region = excluded.region,
+			environment = excluded.environment,
+			lassie_version = excluded.lassie_version,
+			active = excluded.active,
+			updated_at = excluded.updated_at
+		`, instance.ID, instance.Operator, instance.Region, instance.Environment, instance.LassieVersion, instance.Active, now); err != nil {
+		return Instance{}, fmt.Errorf("failed to register instance: %w", err)
+	}
+	stored, err := r.Instance(ctx, instance.ID)
+	if err != nil {
+		return Instance{}, err
+	}
+	if r.instances != nil {
+		r.instances.put(stored)
+	}
+	logger.Infow("Registered instance", "instance", stored)
+	return stored, nil
+}
+
+// DeregisterInstance removes a registered instance.
+func (r *EventRecorder) DeregisterInstance(ctx context.Context, instanceID string) error {
+	db, _, err := r.sqlDB()
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `delete from instances where instance_id = $1`, instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to deregister instance: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to deregister instance: %w", err)
+	} else if deleted == 0 {
+		return ErrInstanceNotFound
+	}
+	if r.instances != nil {
+		r.instances.remove(instanceID)
+	}
+	logger.Infow("Deregistered instance", "instanceID", instanceID)
+	return nil
+}
+
+// Instance returns a registered instance.
+func (r *EventRecorder) Instance(ctx context.Context, instanceID string) (Instance, error) {
+	db, _, err := r.sqlDB()
+	if err != nil {
+		return Instance{}, err
+	}
+	instances, err := queryInstances(ctx, db, `where instance_id = $1`, instanceID)
+	if err != nil {
+		return Instance{}, err
+	}
+	if len(instances) == 0 {
+		return Instance{}, ErrInstanceNotFound
+	}
+	return instances[0], nil
+}
+
+// Instances returns the registered instances matching filter, ordered by ID.
+func (r *EventRecorder) Instances(ctx context.Context, filter InstanceFilter) ([]Instance, error) {
+	db, _, err := r.sqlDB()
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []any
+	for _, match := range []struct {
+		column string
+		value  string
+	}{
+		{"operator", filter.Operator},
+		{"region", filter.Region},
+		{"environment", filter.Environment},
+		{"lassie_version", filter.LassieVersion},
+	} {
+		if match.value != "" {
+			args = append(args, match.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", match.column, len(args)))
+		}
+	}
+	if filter.Active != nil {
+		args = append(args, *filter.Active)
+		conditions = append(conditions, fmt.Sprintf("active = $%d", len(args)))
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = "where " + strings.Join(conditions, " and ")
+	}
+	return queryInstances(ctx, db, where, args...)
+}
+
+func queryInstances(ctx context.Context, db *sql.DB, where string, args ...any) ([]Instance, error) {
+	rows, err := db.QueryContext(ctx, `
+		select instance_id, coalesce(operator, ''), coalesce(region, ''), coalesce(environment, ''), coalesce(lassie_version, ''),
+			active, created_at, updated_at
+		from instances `+where+`
+		order by instance_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instances: %w", err)
+	}
+	defer rows.Close()
+	var instances []Instance
+	for rows.Next() {
+		var i Instance
+		if err := rows.Scan(&i.ID, &i.Operator, &i.Region, &i.Environment, &i.LassieVersion, &i.Active, &i.CreatedAt, &i.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read instance: %w", err)
+		}
+		instances = append(instances, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query instances: %w", err)
+	}
+	return instances, nil
+}
+
+// checkInstances reports the number of events sent by each instance to
+// metrics, tagged with what the registry knows about the instance, and
+// rejects them if an instance is unregistered and such instances are
+// rejected.
+func (r *EventRecorder) checkInstances(ctx context.Context, counts map[string]int) error {
+	if r.instances == nil {
+		return nil
+	}
+	instanceIDs := make([]string, 0, len(counts))
+	for instanceID := range counts {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	sort.Strings(instanceIDs)
+	var rejected error
+	for _, instanceID := range instanceIDs {
+		instance, registered := r.instances.get(instanceID)
+		registered = registered && instance.Active
+		if r.cfg.metrics != nil {
+			r.cfg.metrics.HandleInstanceEvents(ctx, metrics.Instance{
+				Registered:    registered,
+				Operator:      instance.Operator,
+				Region:        instance.Region,
+				Environment:   instance.Environment,
+				LassieVersion: instance.LassieVersion,
+			}, counts[instanceID])
+		}
+		if !registered && r.cfg.instancePolicy == RejectUnregisteredInstances && rejected == nil {
+			rejected = fmt.Errorf("%w: %s", ErrUnregisteredInstance, instanceID)
+		}
+	}
+	if rejected != nil {
+		logger.Warnw("Rejected events of unregistered instance", "err", rejected)
+	}
+	return rejected
+}
+
+// instanceRegistry holds the registered instances in memory so that events
+// are checked without querying the database.
+type instanceRegistry struct {
+	load func(context.Context) ([]Instance, error)
+
+	lk        sync.RWMutex
+	instances map[string]Instance
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newInstanceRegistry(load func(context.Context) ([]Instance, error)) *instanceRegistry {
+	return &instanceRegistry{
+		load:      load,
+		instances: make(map[string]Instance),
+		closing:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+// start loads the registered instances and then reloads them periodically.
+func (ir *instanceRegistry) start(ctx context.Context) error {
+	if err := ir.refresh(ctx); err != nil {
+		return err
+	}
+	go ir.run()
+	return nil
+}
+
+func (ir *instanceRegistry) run() {
+	defer close(ir.closed)
+	ticker := time.NewTicker(instanceRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ir.closing:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := ir.refresh(ctx); err != nil {
+				logger.Warnw("Failed to reload registered instances", "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+func (ir *instanceRegistry) refresh(ctx context.Context) error {
+	loaded, err := ir.load(ctx)
+	if err != nil {
+		return err
+	}
+	instances := make(map[string]Instance, len(loaded))
+	for _, instance := range loaded {
+		instances[instance.ID] = instance
+	}
+	ir.lk.Lock()
+	ir.instances = instances
+	ir.lk.Unlock()
+	logger.Debugw("Loaded registered instances", "total", len(instances))
+	return nil
+}
+
+func (ir *instanceRegistry) get(instanceID string) (Instance, bool) {
+	ir.lk.RLock()
+	defer ir.lk.RUnlock()
+	instance, ok := ir.instances[instanceID]
+	return instance, ok
+}
+
+func (ir *instanceRegistry) put(instance Instance) {
+	ir.lk.Lock()
+	defer ir.lk.Unlock()
+	ir.instances[instance.ID] = instance
+}
+
+func (ir *instanceRegistry) remove(instanceID string) {
+	ir.lk.Lock()
+	defer ir.lk.Unlock()
+	delete(ir.instances, instanceID)
+}
+
+func (ir *instanceRegistry) close() {
+	close(ir.closing)
+	<-ir.closed
+}
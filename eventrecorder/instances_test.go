@@ -0,0 +1,102 @@
+package eventrecorder_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/httpserver"
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+type instanceMetrics struct {
+	nopMetrics
+	instances []metrics.Instance
+}
+
+func (m *instanceMetrics) HandleInstanceEvents(_ context.Context, instance metrics.Instance, _ int) {
+	m.instances = append(m.instances, instance)
+}
+
+func TestInstanceRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := &instanceMetrics{}
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+filepath.Join(t.TempDir(), "recorder.db")),
+		eventrecorder.WithMetrics(m),
+		eventrecorder.WithInstanceRegistry(eventrecorder.RejectUnregisteredInstances),
+	)
+	require.NoError(t, err)
+
+	handler := httpserver.NewHttpHandler(recorder)
+	evtts := httptest.NewServer(handler.Handler())
+	defer evtts.Close()
+	admints := httptest.NewServer(httpserver.NewAdminHandler(recorder, "secret").Handler())
+	defer admints.Close()
+	require.NoError(t, handler.Start(ctx))
+	defer handler.Shutdown()
+
+	admin := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, admints.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	postEvents := func() int {
+		body, err := os.ReadFile("../testdata/aggregategood.json")
+		require.NoError(t, err)
+		resp, err := http.Post(evtts.URL+"/v2/retrieval-events", "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/instances", "wrong", "").StatusCode)
+	require.Equal(t, http.StatusForbidden, postEvents())
+
+	resp := admin(http.MethodPost, "/admin/instances", "secret", `{"instanceId":"test-instance","operator":"pl","region":"us-east","environment":"prod","lassieVersion":"v0.5.0"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var registered eventrecorder.Instance
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	require.True(t, registered.Active)
+	require.Equal(t, "us-east", registered.Region)
+	require.False(t, registered.CreatedAt.IsZero())
+	require.Equal(t, http.StatusBadRequest, admin(http.MethodPost, "/admin/instances", "secret", `{"region":"us-east"}`).StatusCode)
+	require.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/instances", "secret", `{"instanceId":"other-instance","environment":"staging","active":false}`).StatusCode)
+
+	require.Equal(t, http.StatusOK, postEvents())
+	require.Equal(t, []metrics.Instance{
+		{Registered: false},
+		{Registered: true, Operator: "pl", Region: "us-east", Environment: "prod", LassieVersion: "v0.5.0"},
+	}, m.instances)
+
+	var instances []eventrecorder.Instance
+	resp = admin(http.MethodGet, "/admin/instances?environment=prod&active=true", "secret", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&instances))
+	require.Len(t, instances, 1)
+	require.Equal(t, "test-instance", instances[0].ID)
+	resp = admin(http.MethodGet, "/admin/instances?active=false", "secret", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&instances))
+	require.Len(t, instances, 1)
+	require.Equal(t, "other-instance", instances[0].ID)
+
+	require.Equal(t, http.StatusNoContent, admin(http.MethodDelete, "/admin/instances/test-instance", "secret", "").StatusCode)
+	require.Equal(t, http.StatusNotFound, admin(http.MethodGet, "/admin/instances/test-instance", "secret", "").StatusCode)
+	require.Equal(t, http.StatusForbidden, postEvents())
+}
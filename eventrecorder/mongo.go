@@ -0,0 +1,129 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RetrievalReportSchemaVersion is the version of the RetrievalReport document
+// schema. Documents written before versioning was introduced have no
+// schema_version field and are considered version 1.
+const RetrievalReportSchemaVersion = 2
+
+// Mongo server error codes returned when an index already exists with
+// different options.
+const (
+	mongoIndexOptionsConflict  = 85
+	mongoIndexKeySpecsConflict = 86
+)
+
+// RetrievalReport is the document written to Mongo for a sampled retrieval.
+type RetrievalReport struct {
+	SchemaVersion      int                      `bson:"schema_version"`
+	RetrievalID        string                   `bson:"retrieval_id"`
+	InstanceID         string                   `bson:"instance_id"`
+	StorageProviderID  string                   `bson:"storage_provider_id"` // Lassie Peer ID
+	SPID               string                   `bson:"sp_id"`               // Heyfil Filecoin SP ID
+	RootCid            string                   `bson:"root_cid"`
+	URLPath            string                   `bson:"url_path"`
+	TTFB               int64                    `bson:"time_to_first_byte_ms"`
+	Bandwidth          int64                    `bson:"bandwidth_bytes_sec"`
+	BytesTransferred   int64                    `bson:"bytes_transferred"`
+	Success            bool                     `bson:"success"`
+	StartTime          time.Time                `bson:"start_time"`
+	EndTime            time.Time                `bson:"end_time"`
+	ProtocolsAttempted []string                 `bson:"protocols_attempted,omitempty"`
+	ProtocolSucceeded  string                   `bson:"protocol_succeeded,omitempty"`
+	Attempts           []RetrievalReportAttempt `bson:"attempts,omitempty"`
+}
+
+// RetrievalReportAttempt is the outcome of a single retrieval attempt against
+// a storage provider.
+type RetrievalReportAttempt struct {
+	StorageProviderID string `bson:"storage_provider_id"` // Lassie Peer ID, or Bitswap
+	SPID              string `bson:"sp_id,omitempty"`     // Heyfil Filecoin SP ID
+	Protocol          string `bson:"protocol,omitempty"`
+	TTFB              int64  `bson:"time_to_first_byte_ms,omitempty"`
+	BytesTransferred  int64  `bson:"bytes_transferred,omitempty"`
+	Success           bool   `bson:"success"`
+	Error             string `bson:"error,omitempty"`
+}
+
+func newRetrievalReport(event AggregateEvent, filSPID string, timeToFirstByte time.Duration, attempts map[string]metrics.Attempt) RetrievalReport {
+	report := RetrievalReport{
+		SchemaVersion:      RetrievalReportSchemaVersion,
+		RetrievalID:        event.RetrievalID,
+		InstanceID:         event.InstanceID,
+		StorageProviderID:  event.StorageProviderID,
+		SPID:               filSPID,
+		RootCid:            event.RootCid,
+		URLPath:            event.URLPath,
+		TTFB:               timeToFirstByte.Milliseconds(),
+		Bandwidth:          int64(event.Bandwidth),
+		BytesTransferred:   int64(event.BytesTransferred),
+		Success:            event.Success,
+		StartTime:          event.StartTime,
+		EndTime:            event.EndTime,
+		ProtocolsAttempted: event.ProtocolsAttempted,
+		ProtocolSucceeded:  event.ProtocolSucceeded,
+	}
+	for _, storageProviderID := range sortedAttemptIDs(event.RetrievalAttempts) {
+		attempt, ok := attempts[storageProviderID]
+		if !ok {
+			continue
+		}
+		report.Attempts = append(report.Attempts, RetrievalReportAttempt{
+			StorageProviderID: storageProviderID,
+			SPID:              attempt.FilSPID,
+			Protocol:          attempt.Protocol,
+			TTFB:              attempt.TimeToFirstByte.Milliseconds(),
+			BytesTransferred:  int64(attempt.BytesTransferred),
+			Success:           attempt.Error == "",
+			Error:             attempt.Error,
+		})
+	}
+	return report
+}
+
+// ensureMongoIndexes creates the indexes needed to query reports. If ttl is
+// positive, reports expire once their start time is older than ttl.
+func ensureMongoIndexes(ctx context.Context, c *mongo.Collection, ttl time.Duration) error {
+	if _, err := c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "retrieval_id", Value: 1}}},
+		{Keys: bson.D{{Key: "sp_id", Value: 1}, {Key: "start_time", Value: 1}}},
+		{Keys: bson.D{{Key: "instance_id", Value: 1}, {Key: "start_time", Value: 1}}},
+		{Keys: bson.D{{Key: "attempts.sp_id", Value: 1}, {Key: "start_time", Value: 1}}},
+	}); err != nil {
+		return err
+	}
+
+	startTime := mongo.IndexModel{Keys: bson.D{{Key: "start_time", Value: 1}}}
+	if ttl > 0 {
+		startTime.Options = options.Index().SetExpireAfterSeconds(int32(ttl.Seconds()))
+	}
+	_, err := c.Indexes().CreateOne(ctx, startTime)
+	var cmdErr mongo.CommandError
+	if err == nil || !errors.As(err, &cmdErr) || (cmdErr.Code != mongoIndexOptionsConflict && cmdErr.Code != mongoIndexKeySpecsConflict) {
+		return err
+	}
+
+	// The start_time index already exists with a different expiry.
+	if ttl <= 0 {
+		logger.Warnw("Mongo start_time index has an expiry but no TTL is configured; reports will keep expiring until the index is dropped", "collection", c.Name())
+		return nil
+	}
+	logger.Infow("Updating expiry of mongo start_time index", "collection", c.Name(), "ttl", ttl)
+	return c.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: c.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "keyPattern", Value: bson.D{{Key: "start_time", Value: 1}}},
+			{Key: "expireAfterSeconds", Value: int64(ttl.Seconds())},
+		}},
+	}).Err()
+}
@@ -0,0 +1,84 @@
+package eventrecorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNewRetrievalReport(t *testing.T) {
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	event := AggregateEvent{
+		InstanceID:         "test-instance",
+		RetrievalID:        "c8490080-b86f-4306-a657-a0b88ac43832",
+		StorageProviderID:  "12D3KooWEqwTBN3GE4vT6DWZiKpq2MapEvHPaGb7QKsVVRaKzPSZ",
+		RootCid:            "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+		URLPath:            "/birb.mp4?dag-scope=entity",
+		Bandwidth:          200,
+		BytesTransferred:   10000,
+		Success:            true,
+		StartTime:          start,
+		EndTime:            start.Add(time.Minute),
+		ProtocolsAttempted: []string{"transport-graphsync-filecoinv1", "transport-bitswap"},
+		ProtocolSucceeded:  "transport-graphsync-filecoinv1",
+		RetrievalAttempts: map[string]*RetrievalAttempt{
+			"Bitswap": {Error: "not found", Protocol: "transport-bitswap"},
+			"12D3KooWEqwTBN3GE4vT6DWZiKpq2MapEvHPaGb7QKsVVRaKzPSZ": {TimeToFirstByte: "50ms", Protocol: "transport-graphsync-filecoinv1"},
+		},
+	}
+	attempts := map[string]metrics.Attempt{
+		"Bitswap": {Error: "not found", Protocol: "transport-bitswap"},
+		"12D3KooWEqwTBN3GE4vT6DWZiKpq2MapEvHPaGb7QKsVVRaKzPSZ": {FilSPID: "f01228000", Protocol: "transport-graphsync-filecoinv1", TimeToFirstByte: 50 * time.Millisecond, BytesTransferred: 10000},
+	}
+
+	report := newRetrievalReport(event, "f01228000", 50*time.Millisecond, attempts)
+	require.Equal(t, RetrievalReport{
+		SchemaVersion:      RetrievalReportSchemaVersion,
+		RetrievalID:        event.RetrievalID,
+		InstanceID:         event.InstanceID,
+		StorageProviderID:  event.StorageProviderID,
+		SPID:               "f01228000",
+		RootCid:            event.RootCid,
+		URLPath:            event.URLPath,
+		TTFB:               50,
+		Bandwidth:          200,
+		BytesTransferred:   10000,
+		Success:            true,
+		StartTime:          start,
+		EndTime:            start.Add(time.Minute),
+		ProtocolsAttempted: event.ProtocolsAttempted,
+		ProtocolSucceeded:  event.ProtocolSucceeded,
+		Attempts: []RetrievalReportAttempt{
+			{
+				StorageProviderID: "12D3KooWEqwTBN3GE4vT6DWZiKpq2MapEvHPaGb7QKsVVRaKzPSZ",
+				SPID:              "f01228000",
+				Protocol:          "transport-graphsync-filecoinv1",
+				TTFB:              50,
+				BytesTransferred:  10000,
+				Success:           true,
+			},
+			{
+				StorageProviderID: "Bitswap",
+				Protocol:          "transport-bitswap",
+				Error:             "not found",
+			},
+		},
+	}, report)
+
+	// Field names are part of the contract with downstream consumers.
+	raw, err := bson.Marshal(report)
+	require.NoError(t, err)
+	var doc bson.M
+	require.NoError(t, bson.Unmarshal(raw, &doc))
+	for _, field := range []string{
+		"schema_version", "retrieval_id", "instance_id", "storage_provider_id", "sp_id", "root_cid", "url_path",
+		"time_to_first_byte_ms", "bandwidth_bytes_sec", "bytes_transferred", "success", "start_time", "end_time",
+		"protocols_attempted", "protocol_succeeded", "attempts",
+	} {
+		require.Contains(t, doc, field)
+	}
+	require.EqualValues(t, RetrievalReportSchemaVersion, doc["schema_version"])
+}
@@ -0,0 +1,230 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MongoWriterConfig configures how sampled reports are written to Mongo.
+type MongoWriterConfig struct {
+	// QueueSize is the maximum number of reports waiting to be written.
+	// Reports submitted while the queue is full are dropped.
+	QueueSize int
+	// BatchSize is the maximum number of reports written by a single insert.
+	BatchSize int
+	// FlushInterval is the longest a report waits in the queue before being
+	// written.
+	FlushInterval time.Duration
+	// WriteTimeout bounds each insert.
+	WriteTimeout time.Duration
+	// WriteConcern is either "majority" or the number of nodes that must
+	// acknowledge each write. Empty uses the server default.
+	WriteConcern string
+	// Journal requires writes to be journaled before being acknowledged.
+	Journal bool
+}
+
+func defaultMongoWriterConfig() MongoWriterConfig {
+	return MongoWriterConfig{
+		QueueSize:     10_000,
+		BatchSize:     500,
+		FlushInterval: time.Second,
+		WriteTimeout:  30 * time.Second,
+	}
+}
+
+func (c MongoWriterConfig) validate() error {
+	switch {
+	case c.QueueSize <= 0:
+		return errors.New("mongo queue size must be positive")
+	case c.BatchSize <= 0:
+		return errors.New("mongo batch size must be positive")
+	case c.FlushInterval <= 0:
+		return errors.New("mongo flush interval must be positive")
+	case c.WriteTimeout <= 0:
+		return errors.New("mongo write timeout must be positive")
+	}
+	_, err := c.writeConcern()
+	return err
+}
+
+func (c MongoWriterConfig) writeConcern() (*writeconcern.WriteConcern, error) {
+	var opts []writeconcern.Option
+	switch c.WriteConcern {
+	case "":
+	case "majority":
+		opts = append(opts, writeconcern.WMajority())
+	default:
+		w, err := strconv.Atoi(c.WriteConcern)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("mongo write concern must be \"majority\" or a non-negative number of nodes, got %q", c.WriteConcern)
+		}
+		opts = append(opts, writeconcern.W(w))
+	}
+	if c.Journal {
+		opts = append(opts, writeconcern.J(true))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return writeconcern.New(opts...), nil
+}
+
+func (c MongoWriterConfig) collectionOptions() *options.CollectionOptions {
+	opts := options.Collection()
+	// The write concern has already been validated.
+	if wc, _ := c.writeConcern(); wc != nil {
+		opts.SetWriteConcern(wc)
+	}
+	return opts
+}
+
+type mongoWriterMetrics interface {
+	HandleMongoReportsWritten(context.Context, int)
+	HandleMongoReportsFailed(context.Context, int)
+	HandleMongoReportsDropped(context.Context, int)
+}
+
+// mongoWriter writes documents to Mongo in batches from a bounded queue, so
+// that reporting never blocks or grows without bound under load.
+type mongoWriter struct {
+	cfg MongoWriterConfig
+	// kind names the documents written in logs, such as "reports".
+	kind    string
+	insert  func(context.Context, []any) error
+	metrics mongoWriterMetrics
+
+	// dropped counts the documents dropped since last logged, so that a full
+	// queue is logged once per flush interval rather than once per document.
+	dropped atomic.Int64
+	queue   chan any
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newMongoWriter(cfg MongoWriterConfig, kind string, insert func(context.Context, []any) error, metrics mongoWriterMetrics) *mongoWriter {
+	w := &mongoWriter{
+		cfg:     cfg,
+		kind:    kind,
+		insert:  insert,
+		metrics: metrics,
+		queue:   make(chan any, cfg.QueueSize),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// insertMany returns an insert function writing to a collection without
+// stopping at the first failed document.
+func insertMany(c *mongo.Collection) func(context.Context, []any) error {
+	return func(ctx context.Context, docs []any) error {
+		_, err := c.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		return err
+	}
+}
+
+// enqueue submits a document to be written, dropping it if the queue is full
+// or the writer is closed.
+func (w *mongoWriter) enqueue(ctx context.Context, doc any) {
+	select {
+	case <-w.closing:
+	default:
+		select {
+		case w.queue <- doc:
+			return
+		default:
+		}
+	}
+	w.dropped.Add(1)
+	if w.metrics != nil {
+		w.metrics.HandleMongoReportsDropped(ctx, 1)
+	}
+}
+
+func (w *mongoWriter) run() {
+	defer close(w.closed)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]any, 0, w.cfg.BatchSize)
+	for {
+		select {
+		case doc := <-w.queue:
+			batch = append(batch, doc)
+			if len(batch) >= w.cfg.BatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+			w.logDropped()
+		case <-w.closing:
+			for {
+				select {
+				case doc := <-w.queue:
+					batch = append(batch, doc)
+					if len(batch) >= w.cfg.BatchSize {
+						w.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						w.flush(batch)
+					}
+					w.logDropped()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *mongoWriter) flush(batch []any) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.WriteTimeout)
+	defer cancel()
+
+	err := w.insert(ctx, batch)
+	failed := 0
+	if err != nil {
+		failed = len(batch)
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+			failed = len(bulkErr.WriteErrors)
+		}
+		logger.Errorw("Failed to write to mongo", "kind", w.kind, "total", len(batch), "failed", failed, "err", err)
+	}
+	if w.metrics != nil {
+		if written := len(batch) - failed; written > 0 {
+			w.metrics.HandleMongoReportsWritten(ctx, written)
+		}
+		if failed > 0 {
+			w.metrics.HandleMongoReportsFailed(ctx, failed)
+		}
+	}
+}
+
+// logDropped logs the documents dropped since last logged, if any.
+func (w *mongoWriter) logDropped() {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		logger.Warnw("Dropped documents because the mongo write queue is full", "kind", w.kind, "total", dropped)
+	}
+}
+
+// close writes any queued documents and stops the writer.
+func (w *mongoWriter) close() {
+	close(w.closing)
+	<-w.closed
+}
@@ -0,0 +1,166 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type recordingInserter struct {
+	lk      sync.Mutex
+	batches [][]any
+	err     error
+	block   chan struct{}
+}
+
+func (ri *recordingInserter) insert(_ context.Context, docs []any) error {
+	if ri.block != nil {
+		<-ri.block
+	}
+	ri.lk.Lock()
+	defer ri.lk.Unlock()
+	ri.batches = append(ri.batches, append([]any(nil), docs...))
+	return ri.err
+}
+
+func (ri *recordingInserter) sizes() []int {
+	ri.lk.Lock()
+	defer ri.lk.Unlock()
+	var sizes []int
+	for _, batch := range ri.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+type mongoWriterCounts struct {
+	lk                       sync.Mutex
+	written, failed, dropped int
+}
+
+func (c *mongoWriterCounts) HandleMongoReportsWritten(_ context.Context, n int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.written += n
+}
+
+func (c *mongoWriterCounts) HandleMongoReportsFailed(_ context.Context, n int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.failed += n
+}
+
+func (c *mongoWriterCounts) HandleMongoReportsDropped(_ context.Context, n int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.dropped += n
+}
+
+func testMongoWriterConfig() MongoWriterConfig {
+	cfg := defaultMongoWriterConfig()
+	cfg.BatchSize = 3
+	cfg.FlushInterval = time.Hour
+	return cfg
+}
+
+func TestMongoWriter_BatchesAndFlushesOnClose(t *testing.T) {
+	ri := &recordingInserter{}
+	counts := &mongoWriterCounts{}
+	w := newMongoWriter(testMongoWriterConfig(), "reports", ri.insert, counts)
+	for i := 0; i < 7; i++ {
+		w.enqueue(context.Background(), i)
+	}
+	w.close()
+
+	require.Equal(t, []int{3, 3, 1}, ri.sizes())
+	require.Equal(t, 7, counts.written)
+	require.Zero(t, counts.failed)
+	require.Zero(t, counts.dropped)
+
+	// Reports submitted after close are dropped.
+	w.enqueue(context.Background(), 8)
+	require.Equal(t, 1, counts.dropped)
+}
+
+func TestMongoWriter_FlushesOnInterval(t *testing.T) {
+	ri := &recordingInserter{}
+	cfg := testMongoWriterConfig()
+	cfg.FlushInterval = 10 * time.Millisecond
+	w := newMongoWriter(cfg, "reports", ri.insert, nil)
+	defer w.close()
+
+	w.enqueue(context.Background(), 1)
+	require.Eventually(t, func() bool { return len(ri.sizes()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestMongoWriter_DropsWhenFull(t *testing.T) {
+	ri := &recordingInserter{block: make(chan struct{})}
+	counts := &mongoWriterCounts{}
+	cfg := testMongoWriterConfig()
+	cfg.QueueSize = 2
+	cfg.BatchSize = 1
+	w := newMongoWriter(cfg, "reports", ri.insert, counts)
+
+	// The first report is picked up and blocks the writer, the next two fill
+	// the queue and the rest are dropped.
+	w.enqueue(context.Background(), 0)
+	require.Eventually(t, func() bool { return len(w.queue) == 0 }, time.Second, time.Millisecond)
+	for i := 1; i < 6; i++ {
+		w.enqueue(context.Background(), i)
+	}
+	close(ri.block)
+	w.close()
+
+	require.Equal(t, 3, counts.written)
+	require.Equal(t, 3, counts.dropped)
+	// Drops are logged in one line, once the writer flushes.
+	require.Zero(t, w.dropped.Load())
+}
+
+func TestMongoWriter_CountsFailures(t *testing.T) {
+	counts := &mongoWriterCounts{}
+
+	ri := &recordingInserter{err: errors.New("connection refused")}
+	w := newMongoWriter(testMongoWriterConfig(), "reports", ri.insert, counts)
+	w.enqueue(context.Background(), 1)
+	w.enqueue(context.Background(), 2)
+	w.close()
+	require.Equal(t, 2, counts.failed)
+	require.Zero(t, counts.written)
+
+	// Only the documents that failed in a partially failed batch are counted.
+	ri = &recordingInserter{err: mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{}}}}
+	w = newMongoWriter(testMongoWriterConfig(), "reports", ri.insert, counts)
+	w.enqueue(context.Background(), 1)
+	w.enqueue(context.Background(), 2)
+	w.close()
+	require.Equal(t, 3, counts.failed)
+	require.Equal(t, 1, counts.written)
+}
+
+func TestMongoWriterConfig_WriteConcern(t *testing.T) {
+	cfg := defaultMongoWriterConfig()
+	wc, err := cfg.writeConcern()
+	require.NoError(t, err)
+	require.Nil(t, wc)
+
+	cfg.WriteConcern = "majority"
+	wc, err = cfg.writeConcern()
+	require.NoError(t, err)
+	require.Equal(t, "majority", wc.GetW())
+
+	cfg.WriteConcern = "2"
+	cfg.Journal = true
+	wc, err = cfg.writeConcern()
+	require.NoError(t, err)
+	require.Equal(t, 2, wc.GetW())
+	require.True(t, wc.GetJ())
+
+	cfg.WriteConcern = "most"
+	require.Error(t, cfg.validate())
+}
@@ -0,0 +1,533 @@
+package eventrecorder
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PartitionInterval string
+
+const (
+	PartitionDaily  PartitionInterval = "daily"
+	PartitionWeekly PartitionInterval = "weekly"
+
+	// partitionLockID is the postgres advisory lock held while partitions are
+	// maintained so that only one recorder replica does so at a time.
+	partitionLockID = 0x1a55_1e01
+)
+
+// PartitionConfig configures the time based partitions of the
+// retrieval_events, aggregate_retrieval_events and retrieval_attempts tables.
+type PartitionConfig struct {
+	// Interval is the time range covered by each partition.
+	Interval PartitionInterval
+	// Premake is the number of future partitions to create ahead of time.
+	Premake int
+	// Retention is how long partitions are kept after their time range has
+	// passed. Zero keeps partitions forever.
+	Retention time.Duration
+	// Detach detaches expired partitions rather than dropping them, leaving
+	// them as standalone tables.
+	Detach bool
+	// ArchiveDir, if set, is where expired partitions are written as gzipped
+	// CSV before they are dropped or detached.
+	ArchiveDir string
+	// CheckInterval is how often partitions are maintained.
+	CheckInterval time.Duration
+}
+
+// partitionedTable is a table partitioned by range on a timestamp column.
+type partitionedTable struct {
+	name   string
+	column string
+	// indexes are created on the table when it is partitioned.
+	indexes []partitionIndex
+	// attemptsKey is whether the table is either end of the foreign key of
+	// retrieval_attempts to aggregate_retrieval_events, which is dropped when
+	// the table is partitioned.
+	attemptsKey bool
+	// follows, if set, is the table whose rows this table's rows belong to.
+	// Its legacy partition covers the same range as that of the followed
+	// table, which is partitioned first, so that partitions of both tables
+	// expire together.
+	follows string
+}
+
+// partitionIndex is a statement indexing a partitioned table, formatted with
+// the table name. A named index replaces the index of the same name of the
+// unpartitioned table, which is renamed out of the way.
+type partitionIndex struct {
+	name string
+	sql  string
+}
+
+var partitionedTables = []partitionedTable{
+	{
+		name:   "retrieval_events",
+		column: "event_time",
+		indexes: []partitionIndex{
+			{name: "retrieval_events_event_time_idx", sql: `create index retrieval_events_event_time_idx on %s (event_time)`},
+			{name: "retrieval_events_retrieval_id_idx", sql: `create index retrieval_events_retrieval_id_idx on %s (retrieval_id)`},
+		},
+	},
+	{
+		name:   "aggregate_retrieval_events",
+		column: "start_time",
+		indexes: []partitionIndex{
+			// Unique constraints on partitioned tables must include the
+			// partition key.
+			{sql: `alter table %s add unique (retrieval_id, start_time)`},
+			{name: "aggregate_retrieval_events_inserted_at_idx", sql: `create index aggregate_retrieval_events_inserted_at_idx on %s (inserted_at)`},
+		},
+		attemptsKey: true,
+	},
+	{
+		// Attempts are partitioned by the start time of their retrieval.
+		// Those stored before the column was added have a start time of
+		// -infinity and are kept in the legacy partition.
+		name:   "retrieval_attempts",
+		column: "retrieval_start_time",
+		indexes: []partitionIndex{
+			{name: "retrieval_attempts_retrieval_id_idx", sql: `create index retrieval_attempts_retrieval_id_idx on %s (retrieval_id)`},
+		},
+		attemptsKey: true,
+		follows:     "aggregate_retrieval_events",
+	},
+}
+
+// partition is an existing partition of a partitionedTable. A zero from means
+// the partition is unbounded below.
+type partition struct {
+	name string
+	from time.Time
+	to   time.Time
+}
+
+type partitionRange struct {
+	from time.Time
+	to   time.Time
+}
+
+type partitionManager struct {
+	db  *pgxpool.Pool
+	cfg PartitionConfig
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newPartitionManager(db *pgxpool.Pool, cfg PartitionConfig) *partitionManager {
+	return &partitionManager{
+		db:      db,
+		cfg:     cfg,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (pm *partitionManager) start() {
+	go pm.run()
+}
+
+func (pm *partitionManager) run() {
+	defer close(pm.closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-pm.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(pm.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := pm.maintain(ctx, time.Now()); err != nil {
+			logger.Errorw("Failed to maintain partitions", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-pm.closing:
+			return
+		}
+	}
+}
+
+func (pm *partitionManager) close() {
+	close(pm.closing)
+	<-pm.closed
+}
+
+// maintain creates upcoming partitions and expires old ones for every
+// partitioned table, provided no other replica is already doing so.
+func (pm *partitionManager) maintain(ctx context.Context, now time.Time) error {
+	conn, err := pm.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `select pg_try_advisory_lock($1)`, partitionLockID).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to acquire partition lock: %w", err)
+	}
+	if !locked {
+		logger.Debug("Partitions are being maintained by another replica")
+		return nil
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, partitionLockID); err != nil {
+			logger.Warnw("Failed to release partition lock", "err", err)
+		}
+	}()
+
+	var errs []error
+	for _, table := range partitionedTables {
+		if err := pm.maintainTable(ctx, conn.Conn(), table, now); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", table.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (pm *partitionManager) maintainTable(ctx context.Context, conn *pgx.Conn, table partitionedTable, now time.Time) error {
+	var isPartitioned bool
+	if err := conn.QueryRow(ctx, `select coalesce((select relkind = 'p' from pg_class where oid = to_regclass($1)), false)`, table.name).Scan(&isPartitioned); err != nil {
+		return err
+	}
+	if !isPartitioned {
+		if err := partitionTable(ctx, conn, table, now); err != nil {
+			return fmt.Errorf("failed to partition table: %w", err)
+		}
+		logger.Infow("Partitioned table", "table", table.name, "column", table.column)
+	}
+
+	partitions, err := listPartitions(ctx, conn, table.name)
+	if err != nil {
+		return fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	for _, r := range missingPartitions(partitions, pm.cfg.Interval, pm.cfg.Premake, now) {
+		name := partitionName(table.name, r.from)
+		if err := createPartition(ctx, conn, table, name, r); err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+		logger.Infow("Created partition", "table", table.name, "partition", name, "from", r.from, "to", r.to)
+	}
+
+	if pm.cfg.Retention <= 0 {
+		return nil
+	}
+	for _, p := range expiredPartitions(partitions, pm.cfg.Retention, now) {
+		child := pgx.Identifier{p.name}.Sanitize()
+		if pm.cfg.ArchiveDir != "" {
+			path, err := archiveQuery(ctx, conn, pm.cfg.ArchiveDir, p.name, child)
+			if err != nil {
+				return fmt.Errorf("failed to archive partition %s: %w", p.name, err)
+			}
+			logger.Infow("Archived partition", "table", table.name, "partition", p.name, "path", path)
+		}
+		if pm.cfg.Detach {
+			_, err = conn.Exec(ctx, fmt.Sprintf(`alter table %s detach partition %s`, pgx.Identifier{table.name}.Sanitize(), child))
+		} else {
+			_, err = conn.Exec(ctx, fmt.Sprintf(`drop table %s`, child))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to expire partition %s: %w", p.name, err)
+		}
+		logger.Infow("Expired partition", "table", table.name, "partition", p.name, "to", p.to, "detached", pm.cfg.Detach)
+	}
+	return nil
+}
+
+// partitionTable converts an unpartitioned table into one range partitioned on
+// its time column. Existing rows are kept in a legacy partition covering
+// everything up to the end of the day of the latest row, and rows that fall
+// outside of any managed partition land in a default partition.
+func partitionTable(ctx context.Context, conn *pgx.Conn, table partitionedTable, now time.Time) error {
+	parent := pgx.Identifier{table.name}.Sanitize()
+	legacy := pgx.Identifier{table.name + "_legacy"}.Sanitize()
+	column := pgx.Identifier{table.column}.Sanitize()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if table.attemptsKey {
+		// Foreign keys cannot reference a partitioned table by retrieval_id
+		// alone, since its unique constraint must include the partition key.
+		if _, err := tx.Exec(ctx, `alter table retrieval_attempts drop constraint if exists retrieval_attempts_retrieval_id_fkey`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`alter table %s rename to %s`, parent, legacy)); err != nil {
+		return err
+	}
+	for _, index := range table.indexes {
+		if index.name == "" {
+			continue
+		}
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`alter index if exists %s rename to %s`,
+			pgx.Identifier{index.name}.Sanitize(), pgx.Identifier{index.name + "_legacy"}.Sanitize())); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`create table %s (like %s including defaults) partition by range (%s)`, parent, legacy, column)); err != nil {
+		return err
+	}
+	for _, index := range table.indexes {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(index.sql, parent)); err != nil {
+			return err
+		}
+	}
+
+	var latest *time.Time
+	if err := tx.QueryRow(ctx, fmt.Sprintf(`select max(%s) from %s where %s > '-infinity'`, column, legacy, column)).Scan(&latest); err != nil {
+		return err
+	}
+	upper := intervalStart(PartitionDaily, now)
+	if latest != nil {
+		upper = nextIntervalStart(PartitionDaily, *latest)
+	}
+	if table.follows != "" {
+		followed, err := listPartitions(ctx, tx.Conn(), table.follows)
+		if err != nil {
+			return err
+		}
+		for _, p := range followed {
+			if p.from.IsZero() && p.to.After(upper) {
+				upper = p.to
+			}
+		}
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`alter table %s attach partition %s for values from (minvalue) to (%s)`,
+		parent, legacy, formatPartitionTime(upper))); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`create table %s partition of %s default`, pgx.Identifier{table.name + "_default"}.Sanitize(), parent)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+var partitionBoundPattern = regexp.MustCompile(`^FOR VALUES FROM \((MINVALUE|'[^']*')\) TO \((MAXVALUE|'[^']*')\)$`)
+
+func listPartitions(ctx context.Context, conn *pgx.Conn, table string) ([]partition, error) {
+	rows, err := conn.Query(ctx, `
+		select c.relname, pg_get_expr(c.relpartbound, c.oid)
+		from pg_inherits i
+		join pg_class c on c.oid = i.inhrelid
+		where i.inhparent = to_regclass($1)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []partition
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		if bound == "DEFAULT" {
+			continue
+		}
+		p, err := parsePartitionBound(name, bound)
+		if err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].to.Before(partitions[j].to) })
+	return partitions, nil
+}
+
+func parsePartitionBound(name, bound string) (partition, error) {
+	m := partitionBoundPattern.FindStringSubmatch(bound)
+	if m == nil || m[2] == "MAXVALUE" {
+		return partition{}, fmt.Errorf("unsupported bound for partition %s: %s", name, bound)
+	}
+	p := partition{name: name}
+	var err error
+	if m[1] != "MINVALUE" {
+		if p.from, err = parsePartitionTime(m[1]); err != nil {
+			return partition{}, fmt.Errorf("unsupported bound for partition %s: %w", name, err)
+		}
+	}
+	if p.to, err = parsePartitionTime(m[2]); err != nil {
+		return partition{}, fmt.Errorf("unsupported bound for partition %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// parsePartitionTime parses a quoted timestamptz literal as rendered by
+// postgres in the session time zone.
+func parsePartitionTime(quoted string) (time.Time, error) {
+	value := quoted[1 : len(quoted)-1]
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999Z07", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07:00:00"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %s", quoted)
+}
+
+// intervalStart returns the start of the partition interval containing t.
+// Weekly partitions start on Mondays.
+func intervalStart(interval PartitionInterval, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == PartitionWeekly {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func nextIntervalStart(interval PartitionInterval, t time.Time) time.Time {
+	if interval == PartitionWeekly {
+		return intervalStart(interval, t).AddDate(0, 0, 7)
+	}
+	return intervalStart(interval, t).AddDate(0, 0, 1)
+}
+
+// missingPartitions returns the ranges that need partitions so that every
+// instant from the start of the current interval until premake intervals from
+// now is covered. Ranges are cut short where they would overlap an existing
+// partition, so gaps are filled even if the interval has changed over time.
+func missingPartitions(existing []partition, interval PartitionInterval, premake int, now time.Time) []partitionRange {
+	horizon := intervalStart(interval, now)
+	for i := 0; i <= premake; i++ {
+		horizon = nextIntervalStart(interval, horizon)
+	}
+
+	var missing []partitionRange
+	t := intervalStart(interval, now)
+	for t.Before(horizon) {
+		covered := false
+		next := nextIntervalStart(interval, t)
+		for _, p := range existing {
+			if !t.Before(p.from) && t.Before(p.to) {
+				t = p.to
+				covered = true
+				break
+			}
+			if p.from.After(t) && p.from.Before(next) {
+				next = p.from
+			}
+		}
+		if covered {
+			continue
+		}
+		missing = append(missing, partitionRange{from: t, to: next})
+		t = next
+	}
+	return missing
+}
+
+// expiredPartitions returns the partitions whose entire range ended more than
+// retention ago.
+func expiredPartitions(existing []partition, retention time.Duration, now time.Time) []partition {
+	cutoff := now.Add(-retention)
+	var expired []partition
+	for _, p := range existing {
+		if !p.to.After(cutoff) {
+			expired = append(expired, p)
+		}
+	}
+	return expired
+}
+
+func partitionName(table string, from time.Time) string {
+	return fmt.Sprintf("%s_p%s", table, from.UTC().Format("20060102"))
+}
+
+func formatPartitionTime(t time.Time) string {
+	return "'" + t.UTC().Format("2006-01-02 15:04:05Z07:00") + "'"
+}
+
+// createPartition creates and attaches a new partition, moving into it any
+// rows for its range that have already landed in the default partition.
+func createPartition(ctx context.Context, conn *pgx.Conn, table partitionedTable, name string, r partitionRange) error {
+	parent := pgx.Identifier{table.name}.Sanitize()
+	child := pgx.Identifier{name}.Sanitize()
+	def := pgx.Identifier{table.name + "_default"}.Sanitize()
+	column := pgx.Identifier{table.column}.Sanitize()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`create table %s (like %s including defaults)`, child, parent)); err != nil {
+		return err
+	}
+	var hasDefault bool
+	if err := tx.QueryRow(ctx, `select to_regclass($1) is not null`, table.name+"_default").Scan(&hasDefault); err != nil {
+		return err
+	}
+	if hasDefault {
+		moved, err := tx.Exec(ctx, fmt.Sprintf(`
+			with moved as (delete from %s where %s >= $1 and %s < $2 returning *)
+			insert into %s select * from moved`, def, column, column, child), r.from, r.to)
+		if err != nil {
+			return err
+		}
+		if moved.RowsAffected() > 0 {
+			logger.Infow("Moved rows out of default partition", "table", table.name, "partition", name, "rows", moved.RowsAffected())
+		}
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`alter table %s attach partition %s for values from (%s) to (%s)`,
+		parent, child, formatPartitionTime(r.from), formatPartitionTime(r.to))); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// archiveQuery writes the rows of source, a table or parenthesized query, to
+// a gzipped CSV file named after name in dir, returning the path of the file.
+func archiveQuery(ctx context.Context, conn *pgx.Conn, dir, name, source string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".csv.gz")
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	if _, err := conn.PgConn().CopyTo(ctx, gz, fmt.Sprintf(`copy %s to stdout with (format csv, header)`, source)); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
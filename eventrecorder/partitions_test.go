@@ -0,0 +1,159 @@
+package eventrecorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParsePartitionBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		bound   string
+		want    partition
+		wantErr bool
+	}{
+		{
+			name:  "utc",
+			bound: "FOR VALUES FROM ('2023-10-18 00:00:00+00') TO ('2023-10-19 00:00:00+00')",
+			want:  partition{name: "utc", from: day("2023-10-18"), to: day("2023-10-19")},
+		},
+		{
+			name:  "offset",
+			bound: "FOR VALUES FROM ('2023-10-18 10:00:00+10') TO ('2023-10-19 05:30:00+05:30')",
+			want:  partition{name: "offset", from: day("2023-10-18"), to: day("2023-10-19")},
+		},
+		{
+			name:  "minvalue",
+			bound: "FOR VALUES FROM (MINVALUE) TO ('2023-10-19 00:00:00+00')",
+			want:  partition{name: "minvalue", to: day("2023-10-19")},
+		},
+		{
+			name:    "maxvalue",
+			bound:   "FOR VALUES FROM ('2023-10-18 00:00:00+00') TO (MAXVALUE)",
+			wantErr: true,
+		},
+		{
+			name:    "list",
+			bound:   "FOR VALUES IN ('a')",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePartitionBound(tt.name, tt.bound)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want.name, got.name)
+			require.True(t, tt.want.from.Equal(got.from), "from: %s", got.from)
+			require.True(t, tt.want.to.Equal(got.to), "to: %s", got.to)
+		})
+	}
+}
+
+func TestMissingPartitions(t *testing.T) {
+	// 2023-10-18 is a Wednesday.
+	now := day("2023-10-18").Add(13 * time.Hour)
+	tests := []struct {
+		name     string
+		existing []partition
+		interval PartitionInterval
+		premake  int
+		want     []partitionRange
+	}{
+		{
+			name:     "daily from scratch",
+			interval: PartitionDaily,
+			premake:  2,
+			want: []partitionRange{
+				{day("2023-10-18"), day("2023-10-19")},
+				{day("2023-10-19"), day("2023-10-20")},
+				{day("2023-10-20"), day("2023-10-21")},
+			},
+		},
+		{
+			name:     "weekly from scratch",
+			interval: PartitionWeekly,
+			premake:  1,
+			want: []partitionRange{
+				{day("2023-10-16"), day("2023-10-23")},
+				{day("2023-10-23"), day("2023-10-30")},
+			},
+		},
+		{
+			name:     "legacy partition covers today",
+			interval: PartitionDaily,
+			premake:  1,
+			existing: []partition{{name: "legacy", to: day("2023-10-19")}},
+			want: []partitionRange{
+				{day("2023-10-19"), day("2023-10-20")},
+			},
+		},
+		{
+			name:     "weekly after legacy ending mid week",
+			interval: PartitionWeekly,
+			premake:  0,
+			existing: []partition{{name: "legacy", to: day("2023-10-19")}},
+			want: []partitionRange{
+				{day("2023-10-19"), day("2023-10-23")},
+			},
+		},
+		{
+			name:     "gap before existing partition",
+			interval: PartitionWeekly,
+			premake:  1,
+			existing: []partition{{name: "p", from: day("2023-10-20"), to: day("2023-10-21")}},
+			want: []partitionRange{
+				{day("2023-10-16"), day("2023-10-20")},
+				{day("2023-10-21"), day("2023-10-23")},
+				{day("2023-10-23"), day("2023-10-30")},
+			},
+		},
+		{
+			name:     "fully covered",
+			interval: PartitionDaily,
+			premake:  1,
+			existing: []partition{
+				{name: "a", from: day("2023-10-18"), to: day("2023-10-19")},
+				{name: "b", from: day("2023-10-19"), to: day("2023-10-20")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, missingPartitions(tt.existing, tt.interval, tt.premake, now))
+		})
+	}
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	now := day("2023-10-18").Add(13 * time.Hour)
+	existing := []partition{
+		{name: "legacy", to: day("2023-10-01")},
+		{name: "a", from: day("2023-10-01"), to: day("2023-10-10")},
+		{name: "b", from: day("2023-10-10"), to: day("2023-10-11")},
+		{name: "c", from: day("2023-10-11"), to: day("2023-10-12")},
+	}
+	expired := expiredPartitions(existing, 7*24*time.Hour, now)
+	var names []string
+	for _, p := range expired {
+		names = append(names, p.name)
+	}
+	require.Equal(t, []string{"legacy", "a", "b"}, names)
+}
+
+func TestPartitionName(t *testing.T) {
+	require.Equal(t, "retrieval_events_p20231018", partitionName("retrieval_events", day("2023-10-18").Add(time.Hour)))
+}
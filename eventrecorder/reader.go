@@ -0,0 +1,210 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+)
+
+// aggregateEventsQuery selects the aggregate events started within a time
+// range along with their retrieval attempts, one row per attempt, ordered so
+// that the rows of an event are adjacent and ordered attempts are in order.
+// Protocol lists are selected as JSON text in every dialect.
+const aggregateEventsQuery = `
+	select
+		%s,
+		e.instance_id,
+		e.storage_provider_id,
+		e.root_cid,
+		e.url_path,
+		e.time_to_first_byte,
+		e.bandwidth_bytes_sec,
+		e.bytes_transferred,
+		e.success,
+		e.start_time,
+		e.end_time,
+		e.time_to_first_indexer_result,
+		e.indexer_candidates_received,
+		e.indexer_candidates_filtered,
+		%s,
+		%s,
+		e.protocol_succeeded,
+		a.storage_provider_id,
+		a.time_to_first_byte,
+		a.bytes_transferred,
+		a.error,
+		a.protocol,
+		a.attempt_index,
+		a.start_time,
+		a.end_time,
+		a.blocks,
+		a.endpoint
+	from aggregate_retrieval_events e
+	left join retrieval_attempts a on a.retrieval_id = e.retrieval_id
+	where e.start_time >= $1 and e.start_time < $2
+	order by e.start_time, e.retrieval_id, a.attempt_index
+`
+
+// ReadAggregateEvents calls fn with every aggregate event stored in db that
+// started within [from, to), oldest first. Durations are restored from their
+// stored nanoseconds, so a missing duration reads as empty. Events whose
+// attempts were posted in order read with both their ordered attempts and
+// their summary by storage provider.
+func ReadAggregateEvents(ctx context.Context, db *sql.DB, dialect migrations.Dialect, from, to time.Time, fn func(AggregateEvent) error) error {
+	var query string
+	switch dialect {
+	case migrations.Postgres:
+		query = fmt.Sprintf(aggregateEventsQuery, "e.retrieval_id::text", "array_to_json(e.protocols_allowed)::text", "array_to_json(e.protocols_attempted)::text")
+	case migrations.SQLite:
+		query = fmt.Sprintf(aggregateEventsQuery, "e.retrieval_id", "e.protocols_allowed", "e.protocols_attempted")
+	default:
+		return fmt.Errorf("unknown database dialect %q", dialect)
+	}
+	rows, err := db.QueryContext(ctx, query, from.UTC(), to.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to query aggregate events: %w", err)
+	}
+	defer rows.Close()
+
+	var event *AggregateEvent
+	for rows.Next() {
+		var (
+			retrievalID, instanceID                                string
+			storageProviderID, rootCid, urlPath, protocolSucceeded sql.NullString
+			protocolsAllowed, protocolsAttempted                   sql.NullString
+			timeToFirstByte, bandwidth, bytesTransferred           sql.NullInt64
+			timeToFirstIndexerResult                               sql.NullInt64
+			candidatesReceived, candidatesFiltered                 sql.NullInt64
+			success                                                bool
+			startTime, endTime                                     time.Time
+			attemptSPID, attemptError, attemptProtocol             sql.NullString
+			attemptTimeToFirstByte, attemptBytesTransferred        sql.NullInt64
+			attemptIndex, attemptBlocks                            sql.NullInt64
+			attemptStartTime, attemptEndTime                       sql.NullTime
+			attemptEndpoint                                        sql.NullString
+		)
+		if err := rows.Scan(
+			&retrievalID,
+			&instanceID,
+			&storageProviderID,
+			&rootCid,
+			&urlPath,
+			&timeToFirstByte,
+			&bandwidth,
+			&bytesTransferred,
+			&success,
+			&startTime,
+			&endTime,
+			&timeToFirstIndexerResult,
+			&candidatesReceived,
+			&candidatesFiltered,
+			&protocolsAllowed,
+			&protocolsAttempted,
+			&protocolSucceeded,
+			&attemptSPID,
+			&attemptTimeToFirstByte,
+			&attemptBytesTransferred,
+			&attemptError,
+			&attemptProtocol,
+			&attemptIndex,
+			&attemptStartTime,
+			&attemptEndTime,
+			&attemptBlocks,
+			&attemptEndpoint,
+		); err != nil {
+			return fmt.Errorf("failed to scan aggregate event: %w", err)
+		}
+
+		if event == nil || event.RetrievalID != retrievalID {
+			if event != nil {
+				if err := fn(event.withSummary()); err != nil {
+					return err
+				}
+			}
+			event = &AggregateEvent{
+				InstanceID:                instanceID,
+				RetrievalID:               retrievalID,
+				StorageProviderID:         storageProviderID.String,
+				RootCid:                   rootCid.String,
+				URLPath:                   urlPath.String,
+				TimeToFirstByte:           durationString(timeToFirstByte),
+				Bandwidth:                 uint64(bandwidth.Int64),
+				BytesTransferred:          uint64(bytesTransferred.Int64),
+				Success:                   success,
+				StartTime:                 startTime.UTC(),
+				EndTime:                   endTime.UTC(),
+				TimeToFirstIndexerResult:  durationString(timeToFirstIndexerResult),
+				IndexerCandidatesReceived: int(candidatesReceived.Int64),
+				IndexerCandidatesFiltered: int(candidatesFiltered.Int64),
+				ProtocolSucceeded:         protocolSucceeded.String,
+			}
+			if err := decodeProtocols(protocolsAllowed, &event.ProtocolsAllowed); err != nil {
+				return err
+			}
+			if err := decodeProtocols(protocolsAttempted, &event.ProtocolsAttempted); err != nil {
+				return err
+			}
+		}
+		switch {
+		case attemptIndex.Valid:
+			event.Attempts = append(event.Attempts, Attempt{
+				StorageProviderID: attemptSPID.String,
+				Protocol:          attemptProtocol.String,
+				Endpoint:          attemptEndpoint.String,
+				StartTime:         attemptStartTime.Time.UTC(),
+				EndTime:           attemptEndTime.Time.UTC(),
+				TimeToFirstByte:   durationString(attemptTimeToFirstByte),
+				BytesTransferred:  uint64(attemptBytesTransferred.Int64),
+				Blocks:            uint64(attemptBlocks.Int64),
+				Error:             attemptError.String,
+			})
+		case attemptSPID.Valid:
+			if event.RetrievalAttempts == nil {
+				event.RetrievalAttempts = make(map[string]*RetrievalAttempt)
+			}
+			event.RetrievalAttempts[attemptSPID.String] = &RetrievalAttempt{
+				Error:            attemptError.String,
+				TimeToFirstByte:  durationString(attemptTimeToFirstByte),
+				BytesTransferred: uint64(attemptBytesTransferred.Int64),
+				Protocol:         attemptProtocol.String,
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read aggregate events: %w", err)
+	}
+	if event != nil {
+		return fn(event.withSummary())
+	}
+	return nil
+}
+
+// withSummary returns the event with the summary of its ordered attempts, if
+// it has any.
+func (e *AggregateEvent) withSummary() AggregateEvent {
+	if len(e.Attempts) > 0 {
+		e.RetrievalAttempts = e.summarizeAttempts()
+	}
+	return *e
+}
+
+func durationString(ns sql.NullInt64) string {
+	if !ns.Valid || ns.Int64 == 0 {
+		return ""
+	}
+	return time.Duration(ns.Int64).String()
+}
+
+func decodeProtocols(encoded sql.NullString, protocols *[]string) error {
+	if !encoded.Valid || encoded.String == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(encoded.String), protocols); err != nil {
+		return fmt.Errorf("failed to decode protocols: %w", err)
+	}
+	return nil
+}
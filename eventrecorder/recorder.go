@@ -2,18 +2,20 @@ package eventrecorder
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"math/rand"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
 	"github.com/filecoin-project/lassie-event-recorder/spmap"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-log/v2"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -45,16 +47,61 @@ type Metrics interface {
 		attempts map[string]metrics.Attempt,
 		protocolSucceeded string,
 	)
+
+	HandleMongoReportsWritten(ctx context.Context, count int)
+	HandleMongoReportsFailed(ctx context.Context, count int)
+	HandleMongoReportsDropped(ctx context.Context, count int)
+	HandleMongoRollupsWritten(ctx context.Context, count int)
+	HandleMongoRollupsFailed(ctx context.Context, count int)
+	HandleMongoRollupsDropped(ctx context.Context, count int)
+
+	HandleClockOffset(ctx context.Context, instanceID string, offset time.Duration)
+	HandleRetrievalAttempt(ctx context.Context, storageProviderID string, attempt metrics.Attempt)
+	HandleUnknownEvent(ctx context.Context, phase types.Phase, code types.EventCode)
+	HandleInstanceEvents(ctx context.Context, instance metrics.Instance, count int)
+	HandleProviderQuantiles(ctx context.Context, quantiles []metrics.ProviderQuantile)
 }
 
 type EventRecorder struct {
 	cfg *config
 	db  *pgxpool.Pool
+	// sqlite is used in place of db when the DSN names a SQLite database.
+	sqlite *sql.DB
+	// pgsql is the postgres database through database/sql, for queries
+	// shared with SQLite.
+	pgsql *sql.DB
 
-	mongo *mongo.Client
-	mc    *mongo.Collection
+	mongo       *mongo.Client
+	mc          *mongo.Collection
+	mongoWriter *mongoWriter
+	// rollupWriter, when set, updates per storage provider daily rollups.
+	rollupWriter *mongoWriter
 
-	pmap *spmap.SPMap
+	pmap     *spmap.SPMap
+	resolver *spResolver
+
+	// coalescer, when set, buffers database writes across requests.
+	coalescer *coalescer
+	// partitions, when set, maintains the time based table partitions.
+	partitions *partitionManager
+	// assembler, when set, builds aggregate events from v1 events.
+	assembler *assembler
+	// aggregateInstances, when set, holds the instances known to send
+	// aggregate events.
+	aggregateInstances *aggregateInstances
+	// clockSkew, when set, estimates the clock offset of each instance.
+	clockSkew *clockSkew
+	// instances, when set, holds the registered instances events are checked
+	// against.
+	instances *instanceRegistry
+	// hourlyRollups, when set, maintains the hourly rollups of aggregate
+	// events.
+	hourlyRollups *hourlyRollups
+	// digests, when set, keeps quantile sketches per storage provider.
+	digests *digests
+	// hotContent, when set, rotates the hot content tracker and stores its
+	// snapshots.
+	hotContent *hotContentSnapshots
 }
 
 func New(opts ...Option) (*EventRecorder, error) {
@@ -66,17 +113,93 @@ func New(opts ...Option) (*EventRecorder, error) {
 	var recorder EventRecorder
 	recorder.cfg = cfg
 	recorder.pmap = spmap.NewSPMap(cfg.mapcfg...)
+	recorder.resolver = newSPResolver(cfg.spLookupConcurrency, recorder.lassieSPIDToFilecoinSPID)
+	if cfg.clockSkew {
+		recorder.clockSkew = newClockSkew(cfg.clockSkewMaxCorrection)
+	}
 	return &recorder, nil
 }
 
+// ValidateEvents validates a batch of events against the accepted phases and
+// event codes, reporting any unknown ones to metrics.
+func (r *EventRecorder) ValidateEvents(ctx context.Context, batch EventBatch) error {
+	allowlist := r.cfg.eventAllowlist
+	for _, event := range batch.Events {
+		if !allowlist.known(event) && r.cfg.metrics != nil {
+			r.cfg.metrics.HandleUnknownEvent(ctx, event.Phase, event.EventName)
+		}
+	}
+	return batch.validate(allowlist)
+}
+
+// RecordEvents stores a batch of events and forwards it to any sinks. Events
+// with an unknown phase or event code are dropped if so configured.
 func (r *EventRecorder) RecordEvents(ctx context.Context, events []Event) error {
-	if r.db == nil {
+	if r.cfg.eventAllowlist.unknown == DropUnknownEvents {
+		known := make([]Event, 0, len(events))
+		for _, event := range events {
+			if r.cfg.eventAllowlist.known(event) {
+				known = append(known, event)
+			}
+		}
+		if len(known) < len(events) {
+			logger.Debugw("Dropped events with unknown event codes", "total", len(events)-len(known))
+		}
+		if len(known) == 0 {
+			return nil
+		}
+		events = known
+	}
+	if r.instances != nil {
+		counts := make(map[string]int)
+		for _, event := range events {
+			counts[event.InstanceId]++
+		}
+		if err := r.checkInstances(ctx, counts); err != nil {
+			return err
+		}
+	}
+	if r.clockSkew != nil {
+		latest := make(map[string]time.Time)
+		for _, event := range events {
+			if event.EventTime.After(latest[event.InstanceId]) {
+				latest[event.InstanceId] = event.EventTime
+			}
+		}
+		r.observeClocks(ctx, latest)
+	}
+	if err := r.recordEvents(ctx, events, true); err != nil {
+		return err
+	}
+	if r.cfg.hotContent != nil {
+		r.observeHotContent(events)
+	}
+	r.forwardEvents(ctx, events)
+	if r.assembler != nil {
+		if assembled := r.assembler.add(events); len(assembled) > 0 {
+			r.recordAssembled(ctx, assembled)
+		}
+	}
+	return nil
+}
+
+// StoreEvents stores events without reporting them to metrics or hot content,
+// forwarding them to sinks or assembling them, for example when re-ingesting
+// events from an archive that were reported when first received.
+func (r *EventRecorder) StoreEvents(ctx context.Context, events []Event) error {
+	return r.recordEvents(ctx, events, false)
+}
+
+// recordEvents stores events, reporting them to metrics unless reportMetrics
+// is false.
+func (r *EventRecorder) recordEvents(ctx context.Context, events []Event, reportMetrics bool) error {
+	if !r.hasDatabase() {
 		return nil
 	}
 
 	totalLogger := logger.With("total", len(events))
 
-	var batchQuery pgx.Batch
+	queries := make([]pendingQuery, 0, len(events))
 	for _, event := range events {
 		// Create the insert query
 		query := `
@@ -89,33 +212,41 @@ func (r *EventRecorder) RecordEvents(ctx context.Context, events []Event) error
 			phase_start_time,
 			event_name,
 			event_time,
-			event_details
+			event_details,
+			corrected_phase_start_time,
+			corrected_event_time
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		`
-		batchQuery.Queue(query,
-			event.RetrievalId.String(),
-			event.InstanceId,
-			event.Cid,
-			event.StorageProviderId,
-			event.Phase,
-			event.PhaseStartTime,
-			event.EventName,
-			event.EventTime,
-			event.EventDetails,
-		).Exec(func(ct pgconn.CommandTag) error {
-			rowsAffected := ct.RowsAffected()
-			switch rowsAffected {
-			case 0:
-				totalLogger.Warnw("Retrieval event insertion did not affect any rows", "event", event, "rowsAffected", rowsAffected)
-			default:
-				totalLogger.Debugw("Inserted event successfully", "event", event, "rowsAffected", rowsAffected)
-			}
-			return nil
+		event := event
+		queries = append(queries, pendingQuery{
+			sql: query,
+			args: []any{
+				event.RetrievalId.String(),
+				event.InstanceId,
+				event.Cid,
+				event.StorageProviderId,
+				event.Phase,
+				event.PhaseStartTime,
+				event.EventName,
+				event.EventTime,
+				event.EventDetails,
+				r.correctedTime(event.InstanceId, event.PhaseStartTime),
+				r.correctedTime(event.InstanceId, event.EventTime),
+			},
+			exec: func(rowsAffected int64) error {
+				switch rowsAffected {
+				case 0:
+					totalLogger.Warnw("Retrieval event insertion did not affect any rows", "event", event, "rowsAffected", rowsAffected)
+				default:
+					totalLogger.Debugw("Inserted event successfully", "event", event, "rowsAffected", rowsAffected)
+				}
+				return nil
+			},
 		})
 
 		// Emit a metric
-		if r.cfg.metrics != nil {
+		if r.cfg.metrics != nil && reportMetrics && r.cfg.eventAllowlist.known(event) {
 			switch event.EventName {
 			case types.StartedCode:
 				r.cfg.metrics.HandleStartedEvent(ctx, event.RetrievalId, event.Phase, event.EventTime, event.StorageProviderId)
@@ -134,9 +265,7 @@ func (r *EventRecorder) RecordEvents(ctx context.Context, events []Event) error
 	}
 
 	// Execute the batch
-	batchResult := r.db.SendBatch(ctx, &batchQuery)
-	err := batchResult.Close()
-	if err != nil {
+	if err := r.write(ctx, queries); err != nil {
 		totalLogger.Errorw("At least one retrieval event insertion failed", "err", err)
 		return err
 	}
@@ -145,12 +274,73 @@ func (r *EventRecorder) RecordEvents(ctx context.Context, events []Event) error
 	return nil
 }
 
+// RecordAggregateEvents stores a batch of aggregated events, reports them to
+// metrics and Mongo, and forwards them to any sinks.
 func (r *EventRecorder) RecordAggregateEvents(ctx context.Context, events []AggregateEvent) error {
+	if r.instances != nil {
+		counts := make(map[string]int)
+		for _, event := range events {
+			counts[event.InstanceID]++
+		}
+		if err := r.checkInstances(ctx, counts); err != nil {
+			return err
+		}
+	}
+	events = withAttemptSummaries(events)
+	if r.aggregateInstances != nil {
+		r.aggregateInstances.observe(ctx, events)
+	}
+	if r.clockSkew != nil {
+		latest := make(map[string]time.Time)
+		for _, event := range events {
+			if event.EndTime.After(latest[event.InstanceID]) {
+				latest[event.InstanceID] = event.EndTime
+			}
+		}
+		r.observeClocks(ctx, latest)
+	}
+	if err := r.recordAggregateEvents(ctx, events, true); err != nil {
+		return err
+	}
+	r.forwardAggregateEvents(ctx, events)
+	return nil
+}
+
+// StoreAggregateEvents stores aggregate events without reporting them to
+// metrics, digests, hot content or Mongo rollups, or forwarding them to sinks,
+// for example when re-ingesting events from an archive that were reported when
+// first received.
+func (r *EventRecorder) StoreAggregateEvents(ctx context.Context, events []AggregateEvent) error {
+	return r.recordAggregateEvents(ctx, withAttemptSummaries(events), false)
+}
+
+// recordAggregateEvents stores aggregated events, reporting them to metrics,
+// digests, hot content and Mongo rollups unless reportMetrics is false.
+func (r *EventRecorder) recordAggregateEvents(ctx context.Context, events []AggregateEvent, reportMetrics bool) error {
 	totalLogger := logger.With("total", len(events))
 
-	var batchQuery pgx.Batch
-	var batchRetrievalAttempts pgx.Batch
+	// Resolve the Filecoin SP IDs of all storage providers in the request up
+	// front; lookups may block on Heyfil for unknown SP IDs.
+	var storageProviderIDs []string
+	for _, event := range events {
+		storageProviderIDs = append(storageProviderIDs, event.StorageProviderID)
+		for storageProviderID := range event.RetrievalAttempts {
+			storageProviderIDs = append(storageProviderIDs, storageProviderID)
+		}
+		for _, attempt := range event.Attempts {
+			storageProviderIDs = append(storageProviderIDs, attempt.StorageProviderID)
+		}
+	}
+	filSPIDs, err := r.resolver.resolve(ctx, storageProviderIDs)
+	if err != nil {
+		totalLogger.Warnw("Abandoned aggregated event recording while resolving storage provider IDs", "err", err)
+		return err
+	}
+
+	var eventQueries []pendingQuery
+	var attemptQueries []pendingQuery
 	for _, event := range events {
+		event := event
 		var timeToFirstByte time.Duration
 		if event.TimeToFirstByte != "" {
 			timeToFirstByte, _ = time.ParseDuration(event.TimeToFirstByte)
@@ -159,7 +349,7 @@ func (r *EventRecorder) RecordAggregateEvents(ctx context.Context, events []Aggr
 		if event.TimeToFirstIndexerResult != "" {
 			timeToFirstIndexerResult, _ = time.ParseDuration(event.TimeToFirstIndexerResult)
 		}
-		filSPID := r.lassieSPIDToFilecoinSPID(ctx, event.StorageProviderID)
+		filSPID := filSPIDs[event.StorageProviderID]
 
 		query := `
 		INSERT INTO aggregate_retrieval_events(
@@ -180,98 +370,160 @@ func (r *EventRecorder) RecordAggregateEvents(ctx context.Context, events []Aggr
 			indexer_candidates_filtered,
 			protocols_allowed,
 			protocols_attempted,
-			protocol_succeeded
+			protocol_succeeded,
+			corrected_start_time,
+			corrected_end_time
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
 		`
-		batchQuery.Queue(query,
-			event.InstanceID,
-			event.RetrievalID,
-			event.RootCid,
-			event.URLPath,
-			event.StorageProviderID,
-			filSPID,
-			timeToFirstByte,
-			event.Bandwidth,
-			event.BytesTransferred,
-			event.Success,
-			event.StartTime,
-			event.EndTime,
-			timeToFirstIndexerResult,
-			event.IndexerCandidatesReceived,
-			event.IndexerCandidatesFiltered,
-			event.ProtocolsAllowed,
-			event.ProtocolsAttempted,
-			event.ProtocolSucceeded,
-		).Exec(func(ct pgconn.CommandTag) error {
-			rowsAffected := ct.RowsAffected()
-			switch rowsAffected {
-			case 0:
-				totalLogger.Warnw("Aggregated event insertion did not affect any rows", "event", event, "rowsAffected", rowsAffected)
-			default:
-				totalLogger.Debugw("Inserted aggregated event successfully", "event", event, "rowsAffected", rowsAffected)
-			}
-			return nil
+		eventQueries = append(eventQueries, pendingQuery{
+			sql: query,
+			args: []any{
+				event.InstanceID,
+				event.RetrievalID,
+				event.RootCid,
+				event.URLPath,
+				event.StorageProviderID,
+				filSPID,
+				timeToFirstByte,
+				event.Bandwidth,
+				event.BytesTransferred,
+				event.Success,
+				event.StartTime,
+				event.EndTime,
+				timeToFirstIndexerResult,
+				event.IndexerCandidatesReceived,
+				event.IndexerCandidatesFiltered,
+				event.ProtocolsAllowed,
+				event.ProtocolsAttempted,
+				event.ProtocolSucceeded,
+				r.correctedTime(event.InstanceID, event.StartTime),
+				r.correctedTime(event.InstanceID, event.EndTime),
+			},
+			exec: func(rowsAffected int64) error {
+				switch rowsAffected {
+				case 0:
+					totalLogger.Warnw("Aggregated event insertion did not affect any rows", "event", event, "rowsAffected", rowsAffected)
+				default:
+					totalLogger.Debugw("Inserted aggregated event successfully", "event", event, "rowsAffected", rowsAffected)
+				}
+				return nil
+			},
 		})
 
 		attempts := make(map[string]metrics.Attempt, len(event.RetrievalAttempts))
-		var wg sync.WaitGroup
-		var lk sync.Mutex
 		for storageProviderID, retrievalAttempt := range event.RetrievalAttempts {
-			wg.Add(1)
-			go func(storageProviderID string, retrievalAttempt *RetrievalAttempt) {
-				defer wg.Done()
+			var timeToFirstByte time.Duration
+			if retrievalAttempt.TimeToFirstByte != "" {
+				timeToFirstByte, _ = time.ParseDuration(retrievalAttempt.TimeToFirstByte)
+			}
+			attempts[storageProviderID] = metrics.Attempt{
+				FilSPID:          filSPIDs[storageProviderID],
+				Error:            retrievalAttempt.Error,
+				Protocol:         retrievalAttempt.Protocol,
+				TimeToFirstByte:  timeToFirstByte,
+				BytesTransferred: retrievalAttempt.BytesTransferred,
+			}
+		}
 
+		// Ordered attempts are stored as they are; otherwise attempts are
+		// queued in storage provider ID order so that insertion order is
+		// deterministic.
+		if len(event.Attempts) > 0 {
+			for i, attempt := range event.Attempts {
+				i, attempt := i, attempt
 				var timeToFirstByte time.Duration
-				if retrievalAttempt.TimeToFirstByte != "" {
-					timeToFirstByte, _ = time.ParseDuration(retrievalAttempt.TimeToFirstByte)
-				}
-				filSPID := r.lassieSPIDToFilecoinSPID(ctx, storageProviderID) // call to Heyfil, may block if unknown SPID
-
-				lk.Lock()
-				defer lk.Unlock()
-				attempts[storageProviderID] = metrics.Attempt{
-					FilSPID:          filSPID,
-					Error:            retrievalAttempt.Error,
-					Protocol:         retrievalAttempt.Protocol,
-					TimeToFirstByte:  timeToFirstByte,
-					BytesTransferred: retrievalAttempt.BytesTransferred,
+				if attempt.TimeToFirstByte != "" {
+					timeToFirstByte, _ = time.ParseDuration(attempt.TimeToFirstByte)
 				}
+				attemptQueries = append(attemptQueries, pendingQuery{
+					sql: `
+					INSERT INTO retrieval_attempts(
+						retrieval_id,
+						storage_provider_id,
+						filecoin_storage_provider_id,
+						time_to_first_byte,
+						bytes_transferred,
+						error,
+						protocol,
+						attempt_index,
+						start_time,
+						end_time,
+						blocks,
+						endpoint,
+						retrieval_start_time
+					)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+					`,
+					args: []any{
+						event.RetrievalID,
+						attempt.StorageProviderID,
+						filSPIDs[attempt.StorageProviderID],
+						timeToFirstByte,
+						attempt.BytesTransferred,
+						attempt.Error,
+						attempt.Protocol,
+						i,
+						attempt.StartTime,
+						attempt.EndTime,
+						attempt.Blocks,
+						attempt.Endpoint,
+						event.StartTime,
+					},
+					exec: func(rowsAffected int64) error {
+						switch rowsAffected {
+						case 0:
+							totalLogger.Warnw("Retrieval attempt insertion did not affect any rows", "retrievalID", event.RetrievalID, "attempt", attempt, "rowsAffected", rowsAffected)
+						default:
+							totalLogger.Debugw("Inserted retrieval attempt successfully", "retrievalID", event.RetrievalID, "attempt", attempt, "rowsAffected", rowsAffected)
+						}
+						return nil
+					},
+				})
+			}
+		} else {
+			for _, storageProviderID := range sortedAttemptIDs(event.RetrievalAttempts) {
+				storageProviderID := storageProviderID
+				retrievalAttempt := event.RetrievalAttempts[storageProviderID]
 				query := `
-			  INSERT INTO retrieval_attempts(
-				  retrieval_id,
-				  storage_provider_id,
-				  filecoin_storage_provider_id,
-				  time_to_first_byte,
-				  bytes_transferred,
-				  error,
-				  protocol
-			  )
-			  VALUES ($1, $2, $3, $4, $5, $6, $7)
-			  `
-				batchRetrievalAttempts.Queue(query,
-					event.RetrievalID,
-					storageProviderID,
-					filSPID,
-					timeToFirstByte,
-					retrievalAttempt.BytesTransferred,
-					retrievalAttempt.Error,
-					retrievalAttempt.Protocol,
-				).Exec(func(ct pgconn.CommandTag) error {
-					rowsAffected := ct.RowsAffected()
-					switch rowsAffected {
-					case 0:
-						totalLogger.Warnw("Retrieval attempt insertion did not affect any rows", "retrievalID", event.RetrievalID, "retrievalAttempt", retrievalAttempt, "storageProviderID", storageProviderID, "rowsAffected", rowsAffected)
-					default:
-						totalLogger.Debugw("Inserted retrieval attempt successfully", "retrievalID", event.RetrievalID, "retrievalAttempt", retrievalAttempt, "storageProviderID", storageProviderID, "rowsAffected", rowsAffected)
-					}
-					return nil
+				INSERT INTO retrieval_attempts(
+					retrieval_id,
+					storage_provider_id,
+					filecoin_storage_provider_id,
+					time_to_first_byte,
+					bytes_transferred,
+					error,
+					protocol,
+					retrieval_start_time
+				)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				`
+				attemptQueries = append(attemptQueries, pendingQuery{
+					sql: query,
+					args: []any{
+						event.RetrievalID,
+						storageProviderID,
+						filSPIDs[storageProviderID],
+						attempts[storageProviderID].TimeToFirstByte,
+						retrievalAttempt.BytesTransferred,
+						retrievalAttempt.Error,
+						retrievalAttempt.Protocol,
+						event.StartTime,
+					},
+					exec: func(rowsAffected int64) error {
+						switch rowsAffected {
+						case 0:
+							totalLogger.Warnw("Retrieval attempt insertion did not affect any rows", "retrievalID", event.RetrievalID, "retrievalAttempt", retrievalAttempt, "storageProviderID", storageProviderID, "rowsAffected", rowsAffected)
+						default:
+							totalLogger.Debugw("Inserted retrieval attempt successfully", "retrievalID", event.RetrievalID, "retrievalAttempt", retrievalAttempt, "storageProviderID", storageProviderID, "rowsAffected", rowsAffected)
+						}
+						return nil
+					},
 				})
-			}(storageProviderID, retrievalAttempt)
+			}
 		}
-		wg.Wait()
 
-		if r.cfg.metrics != nil {
+		if r.cfg.metrics != nil && reportMetrics {
 			r.cfg.metrics.HandleAggregatedEvent(
 				ctx,
 				timeToFirstIndexerResult,
@@ -288,41 +540,50 @@ func (r *EventRecorder) RecordAggregateEvents(ctx context.Context, events []Aggr
 				attempts,
 				event.ProtocolSucceeded,
 			)
+			for _, attempt := range event.Attempts {
+				var timeToFirstByte time.Duration
+				if attempt.TimeToFirstByte != "" {
+					timeToFirstByte, _ = time.ParseDuration(attempt.TimeToFirstByte)
+				}
+				r.cfg.metrics.HandleRetrievalAttempt(ctx, attempt.StorageProviderID, metrics.Attempt{
+					FilSPID:          filSPIDs[attempt.StorageProviderID],
+					Error:            attempt.Error,
+					Protocol:         attempt.Protocol,
+					TimeToFirstByte:  timeToFirstByte,
+					BytesTransferred: attempt.BytesTransferred,
+					Duration:         attempt.EndTime.Sub(attempt.StartTime),
+				})
+			}
 		}
 
-		if r.mc != nil && filSPID != "" && rand.Float32() < r.cfg.mongoPercentile {
-			report := RetrievalReport{
-				RetrievalID:       event.RetrievalID,
-				InstanceID:        event.InstanceID,
-				StorageProviderID: event.StorageProviderID, // Lassie Peer ID
-				SPID:              filSPID,                 // Heyfil Filecoin SP ID
-				TTFB:              timeToFirstByte.Milliseconds(),
-				Bandwidth:         int64(event.Bandwidth),
-				Success:           event.Success,
-				StartTime:         event.StartTime,
-				EndTime:           event.EndTime,
+		// Like metrics, digests only count aggregate events as instances
+		// submit them, and not backfilled or assembled ones.
+		if r.digests != nil && reportMetrics && event.Success && filSPID != "" {
+			r.digests.observe(filSPID, event.ProtocolSucceeded, timeToFirstByte, event.Bandwidth)
+		}
+		if r.cfg.hotContent != nil && reportMetrics && event.RootCid != "" {
+			r.cfg.hotContent.Retrieved(event.InstanceID, event.RootCid)
+			if !event.Success {
+				r.cfg.hotContent.Failed(event.RootCid)
 			}
-			go func(reportData RetrievalReport) {
-				mongoReportCtx, cncl := context.WithTimeout(context.Background(), 30*time.Second)
-				defer cncl()
-				if _, err := r.mc.InsertOne(mongoReportCtx, reportData); err != nil {
-					logger.Infof("failed to report to mongo: %w", err)
-				}
-			}(report)
 		}
-	}
 
-	if r.db != nil {
-		batchResult := r.db.SendBatch(ctx, &batchQuery)
-		err := batchResult.Close()
-		if err != nil {
-			totalLogger.Errorw("At least one aggregated event insertion failed", "err", err)
-			return err
+		if r.shouldReportToMongo(event, filSPID) {
+			r.mongoWriter.enqueue(ctx, newRetrievalReport(event, filSPID, timeToFirstByte, attempts))
 		}
-		batchResult = r.db.SendBatch(ctx, &batchRetrievalAttempts)
-		err = batchResult.Close()
-		if err != nil {
-			totalLogger.Errorw("At least one retrieval attempt insertion failed", "err", err)
+		// Like metrics, rollups only count aggregate events as instances
+		// submit them, so that replaying an archive does not count its events
+		// twice.
+		if r.rollupWriter != nil && reportMetrics && filSPID != "" {
+			r.rollupWriter.enqueue(ctx, newSPDailyRollup(event, filSPID, timeToFirstByte))
+		}
+	}
+
+	if r.hasDatabase() {
+		// Attempts reference their aggregated event, so they are queued after
+		// all of the events in the batch.
+		if err := r.write(ctx, append(eventQueries, attemptQueries...)); err != nil {
+			totalLogger.Errorw("At least one aggregated event or retrieval attempt insertion failed", "err", err)
 			return err
 		}
 		totalLogger.Info("Successfully submitted batch event insertion")
@@ -331,8 +592,92 @@ func (r *EventRecorder) RecordAggregateEvents(ctx context.Context, events []Aggr
 	return nil
 }
 
+func (r *EventRecorder) hasDatabase() bool {
+	return r.db != nil || r.sqlite != nil
+}
+
+// sqlDB returns the database through database/sql, along with its dialect.
+func (r *EventRecorder) sqlDB() (*sql.DB, migrations.Dialect, error) {
+	switch {
+	case r.sqlite != nil:
+		return r.sqlite, migrations.SQLite, nil
+	case r.pgsql != nil:
+		return r.pgsql, migrations.Postgres, nil
+	default:
+		return nil, "", errors.New("no database is configured")
+	}
+}
+
+// write sends queries to the database, either through the write coalescer if
+// one is configured or directly as a single batch.
+func (r *EventRecorder) write(ctx context.Context, queries []pendingQuery) error {
+	if r.sqlite != nil {
+		return r.writeSQLite(ctx, queries)
+	}
+	if r.coalescer != nil {
+		return r.coalescer.write(ctx, queries)
+	}
+	var batch pgx.Batch
+	queueAll(&batch, queries)
+	return r.sendBatch(ctx, &batch)
+}
+
+func (r *EventRecorder) sendBatch(ctx context.Context, batch *pgx.Batch) error {
+	return r.db.SendBatch(ctx, batch).Close()
+}
+
+// shouldReportToMongo decides whether an aggregate event is sampled for Mongo.
+// Only retrievals served by a known Filecoin SP are reported, unless failures
+// are always sampled.
+func (r *EventRecorder) shouldReportToMongo(event AggregateEvent, filSPID string) bool {
+	if r.mc == nil {
+		return false
+	}
+	rules := r.cfg.mongoSampling
+	if filSPID == "" && (event.Success || !rules.AlwaysSampleFailures) {
+		return false
+	}
+	return rules.Sample(event.RetrievalID, event.Success, event.InstanceID, filSPID)
+}
+
+// withAttemptSummaries fills in the retrieval attempts of events that only
+// list ordered attempts, for metrics, Mongo and sinks that expect attempts
+// indexed by storage provider. events is copied rather than modified.
+func withAttemptSummaries(events []AggregateEvent) []AggregateEvent {
+	var summarized []AggregateEvent
+	for i, event := range events {
+		if len(event.Attempts) == 0 || event.RetrievalAttempts != nil {
+			continue
+		}
+		if summarized == nil {
+			summarized = append([]AggregateEvent(nil), events...)
+		}
+		summarized[i].RetrievalAttempts = event.summarizeAttempts()
+	}
+	if summarized == nil {
+		return events
+	}
+	return summarized
+}
+
+func sortedAttemptIDs(attempts map[string]*RetrievalAttempt) []string {
+	ids := make([]string, 0, len(attempts))
+	for id := range attempts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// FilecoinSPIDs returns the Filecoin SP IDs of storage provider peer IDs,
+// keyed by peer ID, as stored with events. IDs that do not resolve map to an
+// empty string.
+func (r *EventRecorder) FilecoinSPIDs(ctx context.Context, storageProviderIDs []string) (map[string]string, error) {
+	return r.resolver.resolve(ctx, storageProviderIDs)
+}
+
 func (r *EventRecorder) lassieSPIDToFilecoinSPID(ctx context.Context, lassieSPID string) string {
-	if lassieSPID == "" || lassieSPID == "Bitswap" {
+	if !needsSPLookup(lassieSPID) {
 		return ""
 	}
 	var pid peer.ID
@@ -343,25 +688,40 @@ func (r *EventRecorder) lassieSPIDToFilecoinSPID(ctx context.Context, lassieSPID
 	return <-r.pmap.Get(ctx, pid)
 }
 
-type RetrievalReport struct {
-	RetrievalID       string    `bson:"retrieval_id"`
-	InstanceID        string    `bson:"instance_id"`
-	StorageProviderID string    `bson:"storage_provider_id"` // Lassie Peer ID
-	SPID              string    `bson:"sp_id"`               // Heyfil Filecoin SP ID
-	TTFB              int64     `bson:"time_to_first_byte_ms"`
-	Bandwidth         int64     `bson:"bandwidth_bytes_sec"`
-	Success           bool      `bson:"success"`
-	StartTime         time.Time `bson:"start_time"`
-	EndTime           time.Time `bson:"end_time"`
-}
-
 func (r *EventRecorder) Start(ctx context.Context) error {
 	var err error
+	if r.cfg.pgxPoolConfig != nil && r.cfg.autoMigrate {
+		db := stdlib.OpenDB(*r.cfg.pgxPoolConfig.ConnConfig)
+		err := migrateDatabase(ctx, db, migrations.Postgres)
+		db.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if r.cfg.sqlite {
+		if r.sqlite, err = openSQLite(r.cfg.dbDSN); err != nil {
+			return fmt.Errorf("failed to open sqlite database: %w", err)
+		}
+		// A SQLite database belongs to a single recorder, so its schema is
+		// always brought up to date.
+		if err := migrateDatabase(ctx, r.sqlite, migrations.SQLite); err != nil {
+			return err
+		}
+	}
 	if r.cfg.pgxPoolConfig != nil {
 		r.db, err = pgxpool.NewWithConfig(ctx, r.cfg.pgxPoolConfig)
 		if err != nil {
 			return fmt.Errorf("failed to instantiate database connection: %w", err)
 		}
+		// Connections are only opened once a query needs one.
+		r.pgsql = stdlib.OpenDB(*r.cfg.pgxPoolConfig.ConnConfig)
+		if r.cfg.coalesceMaxBatchSize > 0 {
+			r.coalescer = newCoalescer(r.sendBatch, r.cfg.coalesceMaxBatchSize, r.cfg.coalesceMaxDelay)
+		}
+		if r.cfg.partitions != nil {
+			r.partitions = newPartitionManager(r.db, *r.cfg.partitions)
+			r.partitions.start()
+		}
 	}
 
 	if r.cfg.mongoEndpoint != "" {
@@ -375,17 +735,194 @@ func (r *EventRecorder) Start(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to connect to mongo: %w", err)
 		}
-		r.mc = r.mongo.Database(r.cfg.mongoDB).Collection(r.cfg.mongoCollection)
+		r.mc = r.mongo.Database(r.cfg.mongoDB).Collection(r.cfg.mongoCollection, r.cfg.mongoWriter.collectionOptions())
+		var writerMetrics mongoWriterMetrics
+		if r.cfg.metrics != nil {
+			writerMetrics = r.cfg.metrics
+		}
+		r.mongoWriter = newMongoWriter(r.cfg.mongoWriter, "reports", insertMany(r.mc), writerMetrics)
+		if err := ensureMongoIndexes(ctx, r.mc, r.cfg.mongoTTL); err != nil {
+			return fmt.Errorf("failed to create mongo indexes: %w", err)
+		}
+		if r.cfg.mongoRollupCollection != "" {
+			rollups := r.mongo.Database(r.cfg.mongoDB).Collection(r.cfg.mongoRollupCollection, r.cfg.mongoWriter.collectionOptions())
+			if err := ensureRollupIndexes(ctx, rollups); err != nil {
+				return fmt.Errorf("failed to create mongo rollup indexes: %w", err)
+			}
+			// Rollup updates are not reports, so they are counted apart from
+			// the report metrics.
+			var rollupMetrics mongoWriterMetrics
+			if r.cfg.metrics != nil {
+				rollupMetrics = rollupWriterMetrics{r.cfg.metrics}
+			}
+			r.rollupWriter = newMongoWriter(r.cfg.mongoWriter, "rollups", upsertRollups(rollups), rollupMetrics)
+		}
+	}
+	if r.cfg.instancePolicy != "" {
+		instances := newInstanceRegistry(func(ctx context.Context) ([]Instance, error) {
+			return r.Instances(ctx, InstanceFilter{})
+		})
+		if err := instances.start(ctx); err != nil {
+			return fmt.Errorf("failed to load registered instances: %w", err)
+		}
+		r.instances = instances
+	}
+	if r.cfg.hourlyRollupsInterval > 0 {
+		db, dialect, err := r.sqlDB()
+		if err != nil {
+			return err
+		}
+		r.hourlyRollups = newHourlyRollups(db, dialect, r.cfg.hourlyRollupsInterval)
+		r.hourlyRollups.start()
 	}
+	if r.cfg.digests != nil {
+		r.digests = newDigests(*r.cfg.digests, r.cfg.metrics)
+		r.digests.start()
+	}
+	var db *sql.DB
+	if r.hasDatabase() {
+		if db, _, err = r.sqlDB(); err != nil {
+			return err
+		}
+	}
+	if r.cfg.assembleTimeout > 0 || r.cfg.hotContent != nil {
+		r.aggregateInstances = newAggregateInstances(db)
+		if err := r.aggregateInstances.load(ctx); err != nil {
+			return fmt.Errorf("failed to load instances sending aggregate events: %w", err)
+		}
+	}
+	if r.cfg.hotContent != nil {
+		r.hotContent = newHotContentSnapshots(r.cfg.hotContent, r.cfg.hotContentPeriod, db)
+		r.hotContent.start()
+	}
+	if r.cfg.assembleTimeout > 0 {
+		r.assembler = newAssembler(r.cfg.assembleTimeout, r.aggregateInstances, func(events []AggregateEvent) {
+			r.recordAssembled(context.Background(), events)
+		})
+	}
+	return nil
+}
+
+// recordAssembled records aggregate events built from v1 events. Their v1
+// events have already been reported to metrics, so they are not reported
+// again, and failures are logged since no request is waiting on them.
+func (r *EventRecorder) recordAssembled(ctx context.Context, events []AggregateEvent) {
+	valid := events[:0]
+	for _, event := range events {
+		if err := event.Validate(); err != nil {
+			logger.Warnw("Discarded invalid assembled event", "retrievalID", event.RetrievalID, "err", err)
+			continue
+		}
+		valid = append(valid, event)
+	}
+	valid, err := r.unrecordedAssembled(ctx, valid)
+	if err != nil {
+		logger.Errorw("Failed to check assembled events against recorded aggregate events", "err", err)
+		return
+	}
+	if len(valid) == 0 {
+		return
+	}
+	if err := r.recordAggregateEvents(ctx, valid, false); err != nil {
+		logger.Errorw("Failed to record assembled events", "total", len(valid), "err", err)
+		return
+	}
+	r.forwardAggregateEvents(ctx, valid)
+}
+
+// unrecordedAssembled drops the assembled events of retrievals that already
+// have an aggregate event, and of instances that another recorder sharing the
+// database knows to send aggregate events.
+func (r *EventRecorder) unrecordedAssembled(ctx context.Context, events []AggregateEvent) ([]AggregateEvent, error) {
+	if !r.hasDatabase() || len(events) == 0 {
+		return events, nil
+	}
+	db, _, err := r.sqlDB()
+	if err != nil {
+		return nil, err
+	}
+	unrecorded := events[:0]
+	for _, event := range events {
+		var recorded, aggregateInstance bool
+		if err := db.QueryRowContext(ctx, `
+			select
+				exists (select 1 from aggregate_retrieval_events where retrieval_id = $1),
+				exists (select 1 from aggregate_instances where instance_id = $2)
+			`, event.RetrievalID, event.InstanceID).Scan(&recorded, &aggregateInstance); err != nil {
+			return nil, fmt.Errorf("failed to look up retrieval %s: %w", event.RetrievalID, err)
+		}
+		if aggregateInstance {
+			r.aggregateInstances.remember(event.InstanceID)
+		}
+		if recorded || aggregateInstance {
+			logger.Debugw("Discarded assembled event of a retrieval with an aggregate event", "retrievalID", event.RetrievalID, "instanceID", event.InstanceID)
+			continue
+		}
+		unrecorded = append(unrecorded, event)
+	}
+	return unrecorded, nil
+}
+
+func migrateDatabase(ctx context.Context, db *sql.DB, dialect migrations.Dialect) error {
+	migrator, err := migrations.NewForDialect(db, dialect)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	applied, err := migrator.Up(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+	logger.Infow("Database schema is up to date", "applied", len(applied))
 	return nil
 }
 
 func (r *EventRecorder) Shutdown() {
+	if r.assembler != nil {
+		r.assembler.close()
+	}
+	if r.coalescer != nil {
+		logger.Info("Flushing pending database writes...")
+		r.coalescer.close()
+	}
+	if r.partitions != nil {
+		r.partitions.close()
+	}
+	if r.instances != nil {
+		r.instances.close()
+	}
+	if r.hourlyRollups != nil {
+		r.hourlyRollups.close()
+	}
+	if r.digests != nil {
+		r.digests.close()
+	}
+	if r.hotContent != nil {
+		r.hotContent.close()
+	}
+	if r.pgsql != nil {
+		if err := r.pgsql.Close(); err != nil {
+			logger.Warnw("Failed to close database", "err", err)
+		}
+	}
 	if r.db != nil {
 		logger.Info("Closing database connection...")
 		r.db.Close()
 	}
+	if r.sqlite != nil {
+		logger.Info("Closing sqlite database...")
+		if err := r.sqlite.Close(); err != nil {
+			logger.Warnw("Failed to close sqlite database", "err", err)
+		}
+	}
 	logger.Info("Database connection closed successfully.")
+	if r.mongoWriter != nil {
+		logger.Info("Flushing pending mongo reports...")
+		r.mongoWriter.close()
+	}
+	if r.rollupWriter != nil {
+		logger.Info("Flushing pending mongo rollups...")
+		r.rollupWriter.close()
+	}
 	if r.mongo != nil {
 		timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -394,5 +931,7 @@ func (r *EventRecorder) Shutdown() {
 			logger.Warn("failed to close mongo connection: %v", err)
 		}
 	}
+	r.closeSinks()
+	r.resolver.close()
 	r.pmap.Close()
 }
@@ -3,11 +3,13 @@ package eventrecorder_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -18,6 +20,7 @@ import (
 	"github.com/filecoin-project/lassie-event-recorder/spmap"
 	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
 	"github.com/filecoin-project/lassie/pkg/types"
+	libp2ptest "github.com/libp2p/go-libp2p/core/test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -228,6 +231,18 @@ func (mm *mockMetrics) HandleAggregatedEvent(
 	})
 }
 
+func (mm *mockMetrics) HandleMongoReportsWritten(context.Context, int)                      {}
+func (mm *mockMetrics) HandleMongoReportsFailed(context.Context, int)                       {}
+func (mm *mockMetrics) HandleMongoReportsDropped(context.Context, int)                      {}
+func (mm *mockMetrics) HandleMongoRollupsWritten(context.Context, int)                      {}
+func (mm *mockMetrics) HandleMongoRollupsFailed(context.Context, int)                       {}
+func (mm *mockMetrics) HandleMongoRollupsDropped(context.Context, int)                      {}
+func (mm *mockMetrics) HandleClockOffset(context.Context, string, time.Duration)            {}
+func (mm *mockMetrics) HandleRetrievalAttempt(context.Context, string, metrics.Attempt)     {}
+func (mm *mockMetrics) HandleUnknownEvent(context.Context, types.Phase, types.EventCode)    {}
+func (mm *mockMetrics) HandleInstanceEvents(context.Context, metrics.Instance, int)         {}
+func (mm *mockMetrics) HandleProviderQuantiles(context.Context, []metrics.ProviderQuantile) {}
+
 type ae struct {
 	timeToFirstIndexerResult time.Duration
 	timeToFirstByte          time.Duration
@@ -279,3 +294,102 @@ func (a ae) String() string {
 		a.protocolSucceeded,
 	)
 }
+
+func BenchmarkRecordAggregateEvents_SlowHeyfil(b *testing.B) {
+	heyfil := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		fmt.Fprintf(w, `["%s"]`, spmaptestutil.TestSPID)
+	}))
+	defer heyfil.Close()
+
+	for _, workers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			recorder, err := eventrecorder.New(
+				eventrecorder.WithMetrics(nopMetrics{}),
+				eventrecorder.WithSPMapOptions(spmap.WithHeyFil(heyfil.URL)),
+				eventrecorder.WithSPLookupConcurrency(workers),
+			)
+			require.NoError(b, err)
+			defer recorder.Shutdown()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// Fresh peer IDs every time so that lookups miss the cache.
+					event := eventrecorder.AggregateEvent{
+						InstanceID:        "bench",
+						RetrievalID:       "c8490080-b86f-4306-a657-a0b88ac43832",
+						StorageProviderID: libp2ptest.RandPeerIDFatal(b).String(),
+						StartTime:         time.Now(),
+						EndTime:           time.Now(),
+						RetrievalAttempts: make(map[string]*eventrecorder.RetrievalAttempt),
+					}
+					for i := 0; i < 20; i++ {
+						event.RetrievalAttempts[libp2ptest.RandPeerIDFatal(b).String()] = &eventrecorder.RetrievalAttempt{Protocol: "transport-graphsync-filecoinv1"}
+					}
+					if err := recorder.RecordAggregateEvents(context.Background(), []eventrecorder.AggregateEvent{event}); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) HandleStartedEvent(context.Context, types.RetrievalID, types.Phase, time.Time, string) {
+}
+func (nopMetrics) HandleCandidatesFoundEvent(context.Context, types.RetrievalID, time.Time, any) {}
+func (nopMetrics) HandleCandidatesFilteredEvent(context.Context, types.RetrievalID, any)         {}
+func (nopMetrics) HandleFailureEvent(context.Context, types.RetrievalID, types.Phase, string, any) {
+}
+func (nopMetrics) HandleTimeToFirstByteEvent(context.Context, types.RetrievalID, string, time.Time) {
+}
+func (nopMetrics) HandleSuccessEvent(context.Context, types.RetrievalID, time.Time, string, any) {}
+func (nopMetrics) HandleMongoReportsWritten(context.Context, int)                                {}
+func (nopMetrics) HandleMongoReportsFailed(context.Context, int)                                 {}
+func (nopMetrics) HandleMongoReportsDropped(context.Context, int)                                {}
+func (nopMetrics) HandleMongoRollupsWritten(context.Context, int)                                {}
+func (nopMetrics) HandleMongoRollupsFailed(context.Context, int)                                 {}
+func (nopMetrics) HandleMongoRollupsDropped(context.Context, int)                                {}
+func (nopMetrics) HandleClockOffset(context.Context, string, time.Duration)                      {}
+func (nopMetrics) HandleRetrievalAttempt(context.Context, string, metrics.Attempt)               {}
+func (nopMetrics) HandleUnknownEvent(context.Context, types.Phase, types.EventCode)              {}
+func (nopMetrics) HandleInstanceEvents(context.Context, metrics.Instance, int)                   {}
+func (nopMetrics) HandleProviderQuantiles(context.Context, []metrics.ProviderQuantile)           {}
+func (nopMetrics) HandleAggregatedEvent(context.Context, time.Duration, time.Duration, bool, string, string, time.Time, time.Time, int64, int64, int64, int64, map[string]metrics.Attempt, string) {
+}
+
+func TestRecorderStoreEvents_SkipsMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	// Any v1 metric call fails the test.
+	mm := &mockMetrics{t: t}
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+filepath.Join(t.TempDir(), "recorder.db")),
+		eventrecorder.WithMetrics(mm),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start(ctx))
+	defer recorder.Shutdown()
+
+	var events eventrecorder.EventBatch
+	body, err := os.ReadFile("../testdata/good.json")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &events))
+	var aggregateEvents eventrecorder.AggregateEventBatch
+	body, err = os.ReadFile("../testdata/aggregategood.json")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &aggregateEvents))
+
+	require.NoError(t, recorder.StoreEvents(ctx, events.Events))
+	require.NoError(t, recorder.StoreAggregateEvents(ctx, aggregateEvents.Events))
+	require.Empty(t, mm.aggregatedEvents)
+}
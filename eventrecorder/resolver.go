@@ -0,0 +1,121 @@
+package eventrecorder
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errResolverClosed = errors.New("storage provider resolver is closed")
+
+// spResolver maps Lassie storage provider IDs to Filecoin SP IDs using a fixed
+// number of workers shared by all requests, so that the number of concurrent
+// lookups is bounded no matter how many attempts an event carries.
+type spResolver struct {
+	lookup  func(context.Context, string) string
+	jobs    chan resolveJob
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type resolveJob struct {
+	ctx    context.Context
+	id     string
+	result *string
+	done   *sync.WaitGroup
+}
+
+func newSPResolver(workers int, lookup func(context.Context, string) string) *spResolver {
+	r := &spResolver{
+		lookup:  lookup,
+		jobs:    make(chan resolveJob),
+		closing: make(chan struct{}),
+	}
+	r.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+func (r *spResolver) work() {
+	defer r.wg.Done()
+	for {
+		select {
+		case job := <-r.jobs:
+			// Skip lookups for requests that have already gone away.
+			if job.ctx.Err() == nil {
+				*job.result = r.lookup(job.ctx, job.id)
+			}
+			job.done.Done()
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// resolve looks up the Filecoin SP ID of every given storage provider ID,
+// returning them keyed by storage provider ID. Each distinct ID is looked up
+// once. If ctx is cancelled before all lookups complete, resolve returns the
+// context error, and if the resolver is closed before all lookups are queued,
+// it returns errResolverClosed.
+func (r *spResolver) resolve(ctx context.Context, ids []string) (map[string]string, error) {
+	results := make(map[string]*string, len(ids))
+	for _, id := range ids {
+		if _, ok := results[id]; !ok {
+			results[id] = new(string)
+		}
+	}
+
+	var pending sync.WaitGroup
+	var queueErr error
+queue:
+	for id, result := range results {
+		if !needsSPLookup(id) {
+			continue
+		}
+		pending.Add(1)
+		select {
+		case r.jobs <- resolveJob{ctx: ctx, id: id, result: result, done: &pending}:
+		case <-r.closing:
+			pending.Done()
+			queueErr = errResolverClosed
+			break queue
+		case <-ctx.Done():
+			pending.Done()
+			queueErr = ctx.Err()
+			break queue
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if queueErr != nil {
+		return nil, queueErr
+	}
+
+	resolved := make(map[string]string, len(results))
+	for id, result := range results {
+		resolved[id] = *result
+	}
+	return resolved, nil
+}
+
+// close stops the workers once the lookups they are running have completed.
+// Lookups requested after close fail with errResolverClosed.
+func (r *spResolver) close() {
+	close(r.closing)
+	r.wg.Wait()
+}
+
+func needsSPLookup(lassieSPID string) bool {
+	return lassieSPID != "" && lassieSPID != "Bitswap"
+}
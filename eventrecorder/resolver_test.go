@@ -0,0 +1,103 @@
+package eventrecorder
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSPResolver_BoundsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, calls int32
+	lookup := func(_ context.Context, id string) string {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return "f0" + id
+	}
+	r := newSPResolver(3, lookup)
+	defer r.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := r.resolve(context.Background(), []string{"1", "2", "3", "2", "Bitswap", ""})
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"1": "f01", "2": "f02", "3": "f03", "Bitswap": "", "": ""}, got)
+		}()
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+	// Duplicate and non-peer IDs are never looked up.
+	require.Equal(t, int32(4*3), atomic.LoadInt32(&calls))
+}
+
+func TestSPResolver_Cancellation(t *testing.T) {
+	release := make(chan struct{})
+	lookup := func(ctx context.Context, id string) string {
+		<-release
+		return "f0" + id
+	}
+	r := newSPResolver(1, lookup)
+	defer r.close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := r.resolve(ctx, []string{"1", "2", "3"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestSPResolver_ResolveAfterClose(t *testing.T) {
+	r := newSPResolver(2, func(_ context.Context, id string) string { return "f0" + id })
+	r.close()
+	// Requests still in flight when the recorder shuts down fail rather than
+	// panic.
+	_, err := r.resolve(context.Background(), []string{"1"})
+	require.ErrorIs(t, err, errResolverClosed)
+	got, err := r.resolve(context.Background(), []string{"Bitswap"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"Bitswap": ""}, got)
+}
+
+func BenchmarkSPResolver_SlowLookup(b *testing.B) {
+	lookup := func(context.Context, string) string {
+		time.Sleep(time.Millisecond)
+		return "f01228000"
+	}
+	for _, workers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			r := newSPResolver(workers, lookup)
+			defer r.close()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ids := make([]string, 20)
+				var n int
+				for pb.Next() {
+					for i := range ids {
+						n++
+						ids[i] = strconv.Itoa(n)
+					}
+					if _, err := r.resolve(context.Background(), ids); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
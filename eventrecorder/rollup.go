@@ -0,0 +1,224 @@
+package eventrecorder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/sketch"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RollupDigestAccuracy is the relative accuracy of the time to first byte
+// digest embedded in SPDailyRollup documents.
+const RollupDigestAccuracy = 0.01
+
+// SPDailyRollup is the document summarising one day of retrievals served by a
+// Filecoin storage provider. Days start at midnight UTC.
+type SPDailyRollup struct {
+	SPID             string    `bson:"sp_id"`
+	Day              time.Time `bson:"day"`
+	Retrievals       int64     `bson:"retrievals"`
+	Successes        int64     `bson:"successes"`
+	BytesTransferred int64     `bson:"bytes_transferred"`
+	TTFBCount        int64     `bson:"ttfb_count"`
+	TTFBSum          int64     `bson:"ttfb_sum_ms"`
+	TTFBMin          int64     `bson:"ttfb_min_ms,omitempty"`
+	TTFBMax          int64     `bson:"ttfb_max_ms,omitempty"`
+	FirstEvent       time.Time `bson:"first_event"`
+	LastEvent        time.Time `bson:"last_event"`
+	// TTFBDigest holds the bin counts of a sketch of time to first byte in
+	// milliseconds, keyed by digestKey.
+	TTFBDigest map[string]uint64 `bson:"ttfb_digest,omitempty"`
+}
+
+// TTFBQuantile estimates the q-quantile of time to first byte from the
+// embedded digest.
+func (r SPDailyRollup) TTFBQuantile(q float64) (time.Duration, error) {
+	var zero uint64
+	bins := make(map[int]uint64, len(r.TTFBDigest))
+	for key, n := range r.TTFBDigest {
+		if key == digestZeroKey {
+			zero = n
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(key, "b"))
+		if err != nil || !strings.HasPrefix(key, "b") {
+			return 0, fmt.Errorf("invalid digest bin %q", key)
+		}
+		bins[index] = n
+	}
+	s, err := sketch.FromBins(RollupDigestAccuracy, zero, bins)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(s.Quantile(q) * float64(time.Millisecond)), nil
+}
+
+const digestZeroKey = "zero"
+
+func digestKey(index int) string {
+	return "b" + strconv.Itoa(index)
+}
+
+// spDailyRollup accumulates the changes to a single rollup document.
+type spDailyRollup struct {
+	SPDailyRollup
+	digest *sketch.Sketch
+}
+
+func newSPDailyRollup(event AggregateEvent, filSPID string, timeToFirstByte time.Duration) *spDailyRollup {
+	// The accuracy is a valid constant.
+	digest, _ := sketch.New(RollupDigestAccuracy)
+	r := &spDailyRollup{
+		SPDailyRollup: SPDailyRollup{
+			SPID:             filSPID,
+			Day:              event.StartTime.UTC().Truncate(24 * time.Hour),
+			Retrievals:       1,
+			BytesTransferred: int64(event.BytesTransferred),
+			FirstEvent:       event.StartTime,
+			LastEvent:        event.EndTime,
+		},
+		digest: digest,
+	}
+	if event.Success {
+		r.Successes = 1
+	}
+	if timeToFirstByte > 0 {
+		ms := timeToFirstByte.Milliseconds()
+		r.TTFBCount = 1
+		r.TTFBSum = ms
+		r.TTFBMin = ms
+		r.TTFBMax = ms
+		r.digest.Add(float64(timeToFirstByte) / float64(time.Millisecond))
+	}
+	return r
+}
+
+func (r *spDailyRollup) key() string {
+	return r.SPID + "/" + r.Day.Format(time.DateOnly)
+}
+
+func (r *spDailyRollup) merge(other *spDailyRollup) {
+	r.Retrievals += other.Retrievals
+	r.Successes += other.Successes
+	r.BytesTransferred += other.BytesTransferred
+	if other.TTFBCount > 0 {
+		if r.TTFBCount == 0 || other.TTFBMin < r.TTFBMin {
+			r.TTFBMin = other.TTFBMin
+		}
+		if other.TTFBMax > r.TTFBMax {
+			r.TTFBMax = other.TTFBMax
+		}
+		r.TTFBCount += other.TTFBCount
+		r.TTFBSum += other.TTFBSum
+	}
+	if other.FirstEvent.Before(r.FirstEvent) {
+		r.FirstEvent = other.FirstEvent
+	}
+	if other.LastEvent.After(r.LastEvent) {
+		r.LastEvent = other.LastEvent
+	}
+	// Both digests share the same accuracy.
+	_ = r.digest.Merge(other.digest)
+}
+
+// update returns the upsert applying the accumulated changes to the rollup
+// document.
+func (r *spDailyRollup) update() mongo.WriteModel {
+	inc := bson.D{
+		{Key: "retrievals", Value: r.Retrievals},
+		{Key: "successes", Value: r.Successes},
+		{Key: "bytes_transferred", Value: r.BytesTransferred},
+		{Key: "ttfb_count", Value: r.TTFBCount},
+		{Key: "ttfb_sum_ms", Value: r.TTFBSum},
+	}
+	zero, bins := r.digest.Bins()
+	if zero > 0 {
+		inc = append(inc, bson.E{Key: "ttfb_digest." + digestZeroKey, Value: int64(zero)})
+	}
+	indexes := make([]int, 0, len(bins))
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		inc = append(inc, bson.E{Key: "ttfb_digest." + digestKey(index), Value: int64(bins[index])})
+	}
+	minFields := bson.D{{Key: "first_event", Value: r.FirstEvent}}
+	maxFields := bson.D{{Key: "last_event", Value: r.LastEvent}}
+	if r.TTFBCount > 0 {
+		minFields = append(minFields, bson.E{Key: "ttfb_min_ms", Value: r.TTFBMin})
+		maxFields = append(maxFields, bson.E{Key: "ttfb_max_ms", Value: r.TTFBMax})
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{Key: "sp_id", Value: r.SPID}, {Key: "day", Value: r.Day}}).
+		SetUpdate(bson.D{
+			{Key: "$inc", Value: inc},
+			{Key: "$min", Value: minFields},
+			{Key: "$max", Value: maxFields},
+		}).
+		SetUpsert(true)
+}
+
+// mergeRollups combines rollups for the same storage provider and day,
+// preserving the order in which each document was first seen.
+func mergeRollups(docs []any) []*spDailyRollup {
+	merged := make([]*spDailyRollup, 0, len(docs))
+	byKey := make(map[string]*spDailyRollup, len(docs))
+	for _, doc := range docs {
+		rollup := doc.(*spDailyRollup)
+		if existing, ok := byKey[rollup.key()]; ok {
+			existing.merge(rollup)
+			continue
+		}
+		byKey[rollup.key()] = rollup
+		merged = append(merged, rollup)
+	}
+	return merged
+}
+
+// rollupWriterMetrics counts the rollup updates of a mongoWriter apart from
+// the reports.
+type rollupWriterMetrics struct {
+	metrics Metrics
+}
+
+func (m rollupWriterMetrics) HandleMongoReportsWritten(ctx context.Context, count int) {
+	m.metrics.HandleMongoRollupsWritten(ctx, count)
+}
+
+func (m rollupWriterMetrics) HandleMongoReportsFailed(ctx context.Context, count int) {
+	m.metrics.HandleMongoRollupsFailed(ctx, count)
+}
+
+func (m rollupWriterMetrics) HandleMongoReportsDropped(ctx context.Context, count int) {
+	m.metrics.HandleMongoRollupsDropped(ctx, count)
+}
+
+// upsertRollups returns an insert function for a mongoWriter that merges
+// queued rollups and applies them to a collection with a single bulk write.
+func upsertRollups(c *mongo.Collection) func(context.Context, []any) error {
+	return func(ctx context.Context, docs []any) error {
+		rollups := mergeRollups(docs)
+		models := make([]mongo.WriteModel, 0, len(rollups))
+		for _, rollup := range rollups {
+			models = append(models, rollup.update())
+		}
+		_, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		return err
+	}
+}
+
+func ensureRollupIndexes(ctx context.Context, c *mongo.Collection) error {
+	_, err := c.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sp_id", Value: 1}, {Key: "day", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "day", Value: 1}}},
+	})
+	return err
+}
@@ -0,0 +1,123 @@
+package eventrecorder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/spmap"
+	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMergeRollups(t *testing.T) {
+	day := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	event := func(start time.Time, success bool, bytes uint64) AggregateEvent {
+		return AggregateEvent{StartTime: start, EndTime: start.Add(time.Second), Success: success, BytesTransferred: bytes}
+	}
+
+	rollups := mergeRollups([]any{
+		newSPDailyRollup(event(day.Add(12*time.Hour), true, 100), "f01", 20*time.Millisecond),
+		newSPDailyRollup(event(day.Add(13*time.Hour), true, 200), "f02", 50*time.Millisecond),
+		newSPDailyRollup(event(day.Add(2*time.Hour), false, 0), "f01", 0),
+		newSPDailyRollup(event(day.Add(14*time.Hour), true, 300), "f01", 40*time.Millisecond),
+		newSPDailyRollup(event(day.Add(25*time.Hour), true, 400), "f01", 10*time.Millisecond),
+	})
+	require.Len(t, rollups, 3)
+
+	first := rollups[0]
+	require.Equal(t, "f01", first.SPID)
+	require.Equal(t, day, first.Day)
+	require.Equal(t, int64(3), first.Retrievals)
+	require.Equal(t, int64(2), first.Successes)
+	require.Equal(t, int64(400), first.BytesTransferred)
+	require.Equal(t, int64(2), first.TTFBCount)
+	require.Equal(t, int64(60), first.TTFBSum)
+	require.Equal(t, int64(20), first.TTFBMin)
+	require.Equal(t, int64(40), first.TTFBMax)
+	require.Equal(t, day.Add(2*time.Hour), first.FirstEvent)
+	require.Equal(t, day.Add(14*time.Hour+time.Second), first.LastEvent)
+	require.Equal(t, uint64(2), first.digest.Count())
+
+	require.Equal(t, "f02", rollups[1].SPID)
+	require.Equal(t, "f01", rollups[2].SPID)
+	require.Equal(t, day.Add(24*time.Hour), rollups[2].Day)
+
+	update := first.update().(*mongo.UpdateOneModel)
+	require.True(t, *update.Upsert)
+	require.Equal(t, bson.D{{Key: "sp_id", Value: "f01"}, {Key: "day", Value: day}}, update.Filter)
+	inc := update.Update.(bson.D)[0].Value.(bson.D).Map()
+	require.Equal(t, int64(3), inc["retrievals"])
+	require.Equal(t, int64(2), inc["successes"])
+	require.Equal(t, int64(1), inc["ttfb_digest."+digestKey(first.digest.Index(20))])
+	require.Equal(t, int64(1), inc["ttfb_digest."+digestKey(first.digest.Index(40))])
+}
+
+func TestSPDailyRollup_TTFBQuantile(t *testing.T) {
+	var rollups []any
+	for i := 1; i <= 100; i++ {
+		rollups = append(rollups, newSPDailyRollup(AggregateEvent{}, "f01", time.Duration(i)*time.Millisecond))
+	}
+	merged := mergeRollups(rollups)
+	require.Len(t, merged, 1)
+
+	// Round trip the digest through the fields written by the update.
+	doc := SPDailyRollup{TTFBDigest: map[string]uint64{}}
+	for _, e := range merged[0].update().(*mongo.UpdateOneModel).Update.(bson.D)[0].Value.(bson.D) {
+		if key, ok := strings.CutPrefix(e.Key, "ttfb_digest."); ok {
+			doc.TTFBDigest[key] = uint64(e.Value.(int64))
+		}
+	}
+	p50, err := doc.TTFBQuantile(0.5)
+	require.NoError(t, err)
+	require.InEpsilon(t, 50*time.Millisecond, p50, RollupDigestAccuracy*2)
+	p99, err := doc.TTFBQuantile(0.99)
+	require.NoError(t, err)
+	require.InEpsilon(t, 99*time.Millisecond, p99, RollupDigestAccuracy*2)
+
+	doc.TTFBDigest["nope"] = 1
+	_, err = doc.TTFBQuantile(0.5)
+	require.Error(t, err)
+}
+
+func TestStoreAggregateEvents_SkipsRollups(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	var batch struct {
+		Events []AggregateEvent `json:"events"`
+	}
+	body, err := os.ReadFile("../testdata/aggregategood.json")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &batch))
+
+	rollups := func(record func(*EventRecorder) error) int {
+		r, err := New(
+			WithDatabaseDSN("sqlite://"+filepath.Join(t.TempDir(), "recorder.db")),
+			WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+		)
+		require.NoError(t, err)
+		require.NoError(t, r.Start(ctx))
+		ri := &recordingInserter{}
+		r.rollupWriter = newMongoWriter(testMongoWriterConfig(), "rollups", ri.insert, nil)
+		require.NoError(t, record(r))
+		r.Shutdown()
+		var total int
+		for _, size := range ri.sizes() {
+			total += size
+		}
+		return total
+	}
+	require.NotZero(t, rollups(func(r *EventRecorder) error { return r.RecordAggregateEvents(ctx, batch.Events) }))
+	require.Zero(t, rollups(func(r *EventRecorder) error { return r.StoreAggregateEvents(ctx, batch.Events) }))
+}
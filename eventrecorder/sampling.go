@@ -0,0 +1,99 @@
+package eventrecorder
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SamplingRules decides which aggregate events are reported to Mongo.
+//
+// Sampling is keyed on the retrieval ID rather than being random, so the same
+// retrieval is always either sampled or not, and other systems can reproduce
+// the decision with SamplePoint.
+type SamplingRules struct {
+	// Rate is the fraction of retrievals sampled when no other rule applies,
+	// in the range [0, 1].
+	Rate float64 `json:"rate"`
+	// AlwaysSampleFailures samples every failed retrieval, including those
+	// that were not served by any storage provider.
+	AlwaysSampleFailures bool `json:"alwaysSampleFailures,omitempty"`
+	// StorageProviders overrides Rate for retrievals served by the given
+	// Filecoin SP IDs.
+	StorageProviders map[string]float64 `json:"storageProviders,omitempty"`
+	// Instances overrides Rate for retrievals recorded by the given Lassie
+	// instance IDs. Storage provider rules take precedence over these.
+	Instances map[string]float64 `json:"instances,omitempty"`
+}
+
+// LoadSamplingRules reads SamplingRules from a JSON file.
+func LoadSamplingRules(path string) (SamplingRules, error) {
+	var rules SamplingRules
+	f, err := os.Open(path)
+	if err != nil {
+		return rules, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return rules, fmt.Errorf("failed to decode sampling rules: %w", err)
+	}
+	return rules, rules.Validate()
+}
+
+func (s SamplingRules) Validate() error {
+	if !validRate(s.Rate) {
+		return fmt.Errorf("sampling rate must be within [0, 1], got %v", s.Rate)
+	}
+	for spID, rate := range s.StorageProviders {
+		if !validRate(rate) {
+			return fmt.Errorf("sampling rate for storage provider %s must be within [0, 1], got %v", spID, rate)
+		}
+	}
+	for instanceID, rate := range s.Instances {
+		if !validRate(rate) {
+			return fmt.Errorf("sampling rate for instance %s must be within [0, 1], got %v", instanceID, rate)
+		}
+	}
+	return nil
+}
+
+func validRate(rate float64) bool {
+	return rate >= 0 && rate <= 1
+}
+
+// rate returns the sampling rate that applies to a retrieval.
+func (s SamplingRules) rate(success bool, instanceID, filSPID string) float64 {
+	if !success && s.AlwaysSampleFailures {
+		return 1
+	}
+	if rate, ok := s.StorageProviders[filSPID]; ok && filSPID != "" {
+		return rate
+	}
+	if rate, ok := s.Instances[instanceID]; ok {
+		return rate
+	}
+	return s.Rate
+}
+
+// Sample reports whether a retrieval should be sampled.
+func (s SamplingRules) Sample(retrievalID string, success bool, instanceID, filSPID string) bool {
+	rate := s.rate(success, instanceID, filSPID)
+	if rate <= 0 {
+		return false
+	}
+	return SamplePoint(retrievalID) < rate
+}
+
+// SamplePoint maps a retrieval ID to a point in [0, 1). A retrieval is sampled
+// at rate r if its point is less than r. The point is the top 53 bits of the
+// first 8 bytes of the SHA-256 digest of the lower-cased retrieval ID, read as
+// a big-endian unsigned integer, divided by 2^53.
+func SamplePoint(retrievalID string) float64 {
+	digest := sha256.Sum256([]byte(strings.ToLower(retrievalID)))
+	return float64(binary.BigEndian.Uint64(digest[:8])>>11) / (1 << 53)
+}
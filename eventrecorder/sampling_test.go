@@ -0,0 +1,83 @@
+package eventrecorder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplePoint(t *testing.T) {
+	// The sample point is part of the contract with downstream consumers, so
+	// it must never change for a given retrieval ID.
+	require.Equal(t, SamplePoint("c8490080-b86f-4306-a657-a0b88ac43832"), SamplePoint("C8490080-B86F-4306-A657-A0B88AC43832"))
+	require.Equal(t, 0.022286527757046204, SamplePoint("c8490080-b86f-4306-a657-a0b88ac43832"))
+
+	var sampled int
+	const n = 20000
+	rules := SamplingRules{Rate: 0.1}
+	for i := 0; i < n; i++ {
+		if rules.Sample(uuid.NewString(), true, "instance", "f01") {
+			sampled++
+		}
+	}
+	require.InDelta(t, 0.1, float64(sampled)/n, 0.01)
+}
+
+func TestSamplingRules(t *testing.T) {
+	rules := SamplingRules{
+		Rate:                 0.25,
+		AlwaysSampleFailures: true,
+		StorageProviders:     map[string]float64{"f01": 1, "f02": 0},
+		Instances:            map[string]float64{"always": 1, "never": 0},
+	}
+	tests := []struct {
+		name       string
+		success    bool
+		instanceID string
+		filSPID    string
+		want       float64
+	}{
+		{name: "default", success: true, instanceID: "other", filSPID: "f03", want: 0.25},
+		{name: "failure", success: false, instanceID: "never", filSPID: "f02", want: 1},
+		{name: "storage provider", success: true, instanceID: "other", filSPID: "f01", want: 1},
+		{name: "storage provider over instance", success: true, instanceID: "always", filSPID: "f02", want: 0},
+		{name: "instance", success: true, instanceID: "never", filSPID: "f03", want: 0},
+		{name: "instance without storage provider", success: true, instanceID: "always", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, rules.rate(tt.success, tt.instanceID, tt.filSPID))
+		})
+	}
+
+	id := uuid.NewString()
+	require.True(t, rules.Sample(id, true, "always", ""))
+	require.False(t, rules.Sample(id, true, "never", ""))
+	first := rules.Sample(id, true, "other", "")
+	for i := 0; i < 10; i++ {
+		require.Equal(t, first, rules.Sample(id, true, "other", ""))
+	}
+}
+
+func TestLoadSamplingRules(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.json")
+	require.NoError(t, os.WriteFile(good, []byte(`{"rate":0.1,"alwaysSampleFailures":true,"storageProviders":{"f01":1}}`), 0o644))
+	rules, err := LoadSamplingRules(good)
+	require.NoError(t, err)
+	require.Equal(t, SamplingRules{Rate: 0.1, AlwaysSampleFailures: true, StorageProviders: map[string]float64{"f01": 1}}, rules)
+
+	badRate := filepath.Join(dir, "bad-rate.json")
+	require.NoError(t, os.WriteFile(badRate, []byte(`{"rate":0.1,"instances":{"a":2}}`), 0o644))
+	_, err = LoadSamplingRules(badRate)
+	require.Error(t, err)
+
+	unknownField := filepath.Join(dir, "unknown-field.json")
+	require.NoError(t, os.WriteFile(unknownField, []byte(`{"percent":0.1}`), 0o644))
+	_, err = LoadSamplingRules(unknownField)
+	require.Error(t, err)
+}
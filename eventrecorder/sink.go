@@ -0,0 +1,48 @@
+package eventrecorder
+
+import (
+	"context"
+	"fmt"
+)
+
+// Sink receives every batch of events accepted by the recorder, once they
+// have been written to the database.
+//
+// Sinks are called in the order they were configured, on the goroutine
+// recording the batch. A sink that fails does not fail the request, since the
+// events have already been stored; its error is logged instead.
+type Sink interface {
+	RecordEvents(context.Context, []Event) error
+	RecordAggregateEvents(context.Context, []AggregateEvent) error
+	// Close flushes any buffered events and releases the sink's resources.
+	Close() error
+}
+
+func (r *EventRecorder) forwardEvents(ctx context.Context, events []Event) {
+	for _, sink := range r.cfg.sinks {
+		if err := sink.RecordEvents(ctx, events); err != nil {
+			logger.Errorw("Sink failed to record events", "sink", sinkName(sink), "total", len(events), "err", err)
+		}
+	}
+}
+
+func (r *EventRecorder) forwardAggregateEvents(ctx context.Context, events []AggregateEvent) {
+	for _, sink := range r.cfg.sinks {
+		if err := sink.RecordAggregateEvents(ctx, events); err != nil {
+			logger.Errorw("Sink failed to record aggregated events", "sink", sinkName(sink), "total", len(events), "err", err)
+		}
+	}
+}
+
+func (r *EventRecorder) closeSinks() {
+	for _, sink := range r.cfg.sinks {
+		if err := sink.Close(); err != nil {
+			logger.Warnw("Failed to close sink", "sink", sinkName(sink), "err", err)
+		}
+	}
+}
+
+// sinkName identifies a sink in logs by its type.
+func sinkName(sink Sink) string {
+	return fmt.Sprintf("%T", sink)
+}
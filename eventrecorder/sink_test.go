@@ -0,0 +1,67 @@
+package eventrecorder_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	lk              sync.Mutex
+	err             error
+	events          []eventrecorder.Event
+	aggregateEvents []eventrecorder.AggregateEvent
+	closed          bool
+}
+
+func (s *recordingSink) RecordEvents(_ context.Context, events []eventrecorder.Event) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.events = append(s.events, events...)
+	return s.err
+}
+
+func (s *recordingSink) RecordAggregateEvents(_ context.Context, events []eventrecorder.AggregateEvent) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.aggregateEvents = append(s.aggregateEvents, events...)
+	return s.err
+}
+
+func (s *recordingSink) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.closed = true
+	return s.err
+}
+
+func TestRecorderSinks(t *testing.T) {
+	ctx := context.Background()
+	failing := &recordingSink{err: errors.New("boom")}
+	sink := &recordingSink{}
+	recorder, err := eventrecorder.New(eventrecorder.WithSinks(failing, sink))
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start(ctx))
+
+	events := []eventrecorder.Event{{InstanceId: "a"}, {InstanceId: "b"}}
+	aggregateEvents := []eventrecorder.AggregateEvent{{InstanceID: "a", RetrievalID: "c8490080-b86f-4306-a657-a0b88ac43832"}}
+
+	// A failing sink neither fails the request nor stops later sinks.
+	require.NoError(t, recorder.RecordEvents(ctx, events))
+	require.NoError(t, recorder.RecordAggregateEvents(ctx, aggregateEvents))
+	for _, s := range []*recordingSink{failing, sink} {
+		require.Equal(t, events, s.events)
+		require.Equal(t, aggregateEvents, s.aggregateEvents)
+	}
+
+	recorder.Shutdown()
+	require.True(t, failing.closed)
+	require.True(t, sink.closed)
+
+	_, err = eventrecorder.New(eventrecorder.WithSinks(nil))
+	require.Error(t, err)
+}
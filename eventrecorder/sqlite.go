@@ -0,0 +1,139 @@
+package eventrecorder
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDSNPrefix selects a SQLite database in place of postgres. The rest of
+// the DSN is the path to the database file, optionally followed by query
+// parameters understood by the driver.
+const sqliteDSNPrefix = "sqlite://"
+
+func isSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, sqliteDSNPrefix)
+}
+
+// openSQLite opens the database file named by a sqlite:// DSN, creating it if
+// it does not exist.
+func openSQLite(dsn string) (*sql.DB, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, sqliteDSNPrefix), "?")
+	if path == "" {
+		return nil, errors.New("sqlite DSN must include a database path")
+	}
+	params := "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite"
+	if query != "" {
+		params += "&" + query
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer at a time; serialising connections avoids
+	// busy errors between concurrent requests.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// OpenDatabase opens the database named by a DSN accepted by
+// WithDatabaseDSN, returning its dialect. The caller must close the returned
+// database.
+func OpenDatabase(dsn string) (*sql.DB, migrations.Dialect, error) {
+	var db *sql.DB
+	var dialect migrations.Dialect
+	var err error
+	if isSQLiteDSN(dsn) {
+		db, err = openSQLite(dsn)
+		dialect = migrations.SQLite
+	} else {
+		db, err = sql.Open("pgx", dsn)
+		dialect = migrations.Postgres
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open database: %w", err)
+	}
+	return db, dialect, nil
+}
+
+// OpenMigrator opens the database named by a DSN accepted by WithDatabaseDSN
+// and returns a Migrator for it. The caller must close the returned database.
+func OpenMigrator(dsn string) (*migrations.Migrator, *sql.DB, error) {
+	db, dialect, err := OpenDatabase(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := migrations.NewForDialect(db, dialect)
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("failed to load migrations: %w", err), db.Close())
+	}
+	return migrator, db, nil
+}
+
+// writeSQLite executes queries in a single transaction, mirroring the implicit
+// transaction of a postgres batch.
+func (r *EventRecorder) writeSQLite(ctx context.Context, queries []pendingQuery) error {
+	tx, err := r.sqlite.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, q := range queries {
+		args := make([]any, len(q.args))
+		for i, arg := range q.args {
+			if args[i], err = sqliteArg(arg); err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
+		}
+		result, err := tx.ExecContext(ctx, q.sql, args...)
+		if err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+		if q.exec != nil {
+			rowsAffected, err := result.RowsAffected()
+			if err == nil {
+				err = q.exec(rowsAffected)
+			}
+			if err != nil {
+				return errors.Join(err, tx.Rollback())
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteArg converts a query argument to a value SQLite can store. Times are
+// stored in UTC so that they compare correctly as text, durations as
+// nanoseconds, and values SQLite has no type for, such as arrays and event
+// details, as JSON.
+func sqliteArg(arg any) (any, error) {
+	switch v := arg.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		return v.UTC(), nil
+	case time.Duration:
+		return int64(v), nil
+	case []string:
+		if v == nil {
+			return nil, nil
+		}
+	default:
+		if value, err := driver.DefaultParameterConverter.ConvertValue(arg); err == nil {
+			return value, nil
+		}
+	}
+	encoded, err := json.Marshal(arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T for sqlite: %w", arg, err)
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,153 @@
+package eventrecorder_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/httpserver"
+	"github.com/filecoin-project/lassie-event-recorder/migrations"
+	"github.com/filecoin-project/lassie-event-recorder/spmap"
+	spmaptestutil "github.com/filecoin-project/lassie-event-recorder/spmap/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderSQLite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+path),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+	)
+	require.NoError(t, err)
+
+	handler := httpserver.NewHttpHandler(recorder)
+	evtts := httptest.NewServer(handler.Handler())
+	defer evtts.Close()
+	require.NoError(t, handler.Start(ctx))
+	defer handler.Shutdown()
+
+	post := func(path, file string) {
+		body, err := os.ReadFile(file)
+		require.NoError(t, err)
+		resp, err := http.Post(evtts.URL+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	post("/v1/retrieval-events", "../testdata/good.json")
+	post("/v2/retrieval-events", "../testdata/aggregategood.json")
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	encEventBatch, err := os.ReadFile("../testdata/good.json")
+	require.NoError(t, err)
+	var wantEventBatch eventrecorder.EventBatch
+	require.NoError(t, json.Unmarshal(encEventBatch, &wantEventBatch))
+
+	rows, err := db.Query(`select retrieval_id, instance_id, cid, phase, event_name, event_time from retrieval_events order by rowid`)
+	require.NoError(t, err)
+	defer rows.Close()
+	for _, want := range wantEventBatch.Events {
+		require.True(t, rows.Next())
+		var retrievalID, instanceID, cid, phase, eventName string
+		var eventTime time.Time
+		require.NoError(t, rows.Scan(&retrievalID, &instanceID, &cid, &phase, &eventName, &eventTime))
+		require.Equal(t, want.RetrievalId.String(), retrievalID)
+		require.Equal(t, want.InstanceId, instanceID)
+		require.Equal(t, want.Cid, cid)
+		require.Equal(t, string(want.Phase), phase)
+		require.Equal(t, string(want.EventName), eventName)
+		require.Equal(t, want.EventTime.UnixMicro(), eventTime.UnixMicro())
+	}
+	require.False(t, rows.Next())
+
+	var filSPID, protocolsAttempted string
+	var timeToFirstByte int64
+	var startTime time.Time
+	require.NoError(t, db.QueryRow(`
+		select filecoin_storage_provider_id, protocols_attempted, time_to_first_byte, start_time
+		from aggregate_retrieval_events where retrieval_id = $1`,
+		"c8490080-b86f-4306-a657-a0b88ac43834",
+	).Scan(&filSPID, &protocolsAttempted, &timeToFirstByte, &startTime))
+	require.Equal(t, "f01228000", filSPID)
+	require.JSONEq(t, `["transport-ipfs-gateway-http","transport-graphsync-filecoinv1","transport-bitswap"]`, protocolsAttempted)
+	require.Equal(t, int64(80*time.Millisecond), timeToFirstByte)
+	require.Equal(t, time.Unix(0, 0).Add(20*time.Millisecond).UTC(), startTime.UTC())
+
+	var attempts int
+	require.NoError(t, db.QueryRow(`select count(*) from retrieval_attempts`).Scan(&attempts))
+	require.Equal(t, 6, attempts)
+}
+
+func TestRecorderSQLite_V3(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spmapts := httptest.NewServer(spmaptestutil.MockHeyfilHandler)
+	defer spmapts.Close()
+
+	path := filepath.Join(t.TempDir(), "recorder.db")
+	recorder, err := eventrecorder.New(
+		eventrecorder.WithDatabaseDSN("sqlite://"+path),
+		eventrecorder.WithSPMapOptions(spmap.WithHeyFil(spmapts.URL)),
+	)
+	require.NoError(t, err)
+
+	handler := httpserver.NewHttpHandler(recorder)
+	evtts := httptest.NewServer(handler.Handler())
+	defer evtts.Close()
+	require.NoError(t, handler.Start(ctx))
+	defer handler.Shutdown()
+
+	post := func(path, file string) int {
+		body, err := os.ReadFile(file)
+		require.NoError(t, err)
+		resp, err := http.Post(evtts.URL+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	// Each version only accepts its own representation of attempts.
+	require.Equal(t, http.StatusBadRequest, post("/v3/retrieval-events", "../testdata/aggregategood.json"))
+	require.Equal(t, http.StatusBadRequest, post("/v2/retrieval-events", "../testdata/aggregategood-v3.json"))
+	require.Equal(t, http.StatusOK, post("/v3/retrieval-events", "../testdata/aggregategood-v3.json"))
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	encBatch, err := os.ReadFile("../testdata/aggregategood-v3.json")
+	require.NoError(t, err)
+	var want eventrecorder.AggregateEventBatch
+	require.NoError(t, json.Unmarshal(encBatch, &want))
+
+	var got []eventrecorder.AggregateEvent
+	require.NoError(t, eventrecorder.ReadAggregateEvents(ctx, db, migrations.SQLite, want.Events[0].StartTime, want.Events[0].EndTime, func(event eventrecorder.AggregateEvent) error {
+		got = append(got, event)
+		return nil
+	}))
+	require.Len(t, got, 1)
+	require.Equal(t, want.Events[0].Attempts, got[0].Attempts)
+	// Attempts are also summarized by storage provider for v2 consumers.
+	require.Equal(t, map[string]*eventrecorder.RetrievalAttempt{
+		"12D3KooWEqwTBN3GE4vT6DWZiKpq24UtSBmhhwM73vg7SfTjYWaF": {
+			Protocol:         "transport-ipfs-gateway-http",
+			TimeToFirstByte:  "100ms",
+			BytesTransferred: 10000,
+		},
+	}, got[0].RetrievalAttempts)
+}
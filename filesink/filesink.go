@@ -0,0 +1,402 @@
+// Package filesink archives events accepted by the recorder as JSON lines in
+// rotating files.
+//
+// Every event is written as a Record on its own line, independently of any
+// database schema, so that the archive can later be replayed or used to
+// backfill derived tables. Files are rotated once they reach a maximum size or
+// age, may be gzipped once closed, and only a configured number of closed
+// files is retained.
+package filesink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/ipfs/go-log/v2"
+)
+
+var logger = log.Logger("lassie/filesink")
+
+const (
+	fileExt       = ".jsonl"
+	compressedExt = ".jsonl.gz"
+	timeLayout    = "20060102T150405.000000000Z"
+)
+
+var _ eventrecorder.Sink = (*Sink)(nil)
+
+// Record is a single line of an archive file. Exactly one of Event and
+// AggregateEvent is set.
+type Record struct {
+	// ReceivedAt is when the recorder accepted the event.
+	ReceivedAt     time.Time                     `json:"receivedAt"`
+	Event          *eventrecorder.Event          `json:"event,omitempty"`
+	AggregateEvent *eventrecorder.AggregateEvent `json:"aggregateEvent,omitempty"`
+}
+
+type Config struct {
+	// Dir is the directory files are written to. It is created if needed.
+	Dir string
+	// Prefix starts the name of every file, followed by the time the file was
+	// opened. Defaults to "events".
+	Prefix string
+	// MaxSize is the size in bytes after which a file is rotated. Zero
+	// disables size based rotation.
+	MaxSize int64
+	// MaxAge is the time after which a file is rotated. Zero disables time
+	// based rotation.
+	MaxAge time.Duration
+	// Compress gzips files once they are rotated.
+	Compress bool
+	// Retain is the number of rotated files kept; older files are deleted.
+	// Zero keeps every file.
+	Retain int
+}
+
+// Sink writes events to rotating JSON lines files.
+type Sink struct {
+	cfg Config
+	now func() time.Time
+
+	lk       sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// finishLk serialises compressing and pruning rotated files.
+	finishLk sync.Mutex
+	finishWg sync.WaitGroup
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func New(cfg Config) (*Sink, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("file sink directory must be set")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "events"
+	}
+	if strings.ContainsRune(cfg.Prefix, filepath.Separator) {
+		return nil, errors.New("file sink prefix cannot contain a path separator")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.Retain < 0 {
+		return nil, errors.New("file sink limits cannot be negative")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create file sink directory: %w", err)
+	}
+
+	s := &Sink{
+		cfg:     cfg,
+		now:     time.Now,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// Files left behind by a previous run were never finished.
+	leftover, err := Files(cfg.Dir, cfg.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	for _, path := range leftover {
+		s.finish(path)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) RecordEvents(_ context.Context, events []eventrecorder.Event) error {
+	now := s.now().UTC()
+	records := make([]Record, len(events))
+	for i := range events {
+		records[i] = Record{ReceivedAt: now, Event: &events[i]}
+	}
+	return s.write(records)
+}
+
+func (s *Sink) RecordAggregateEvents(_ context.Context, events []eventrecorder.AggregateEvent) error {
+	now := s.now().UTC()
+	records := make([]Record, len(events))
+	for i := range events {
+		records[i] = Record{ReceivedAt: now, AggregateEvent: &events[i]}
+	}
+	return s.write(records)
+}
+
+// write appends records to the current file, rotating first if the file has
+// reached its limits. A batch is never split across files.
+func (s *Sink) write(records []Record) error {
+	var lines []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+	if s.cfg.MaxSize > 0 && s.size > 0 && s.size+int64(len(lines)) > s.cfg.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.buf.Write(lines)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.buf.Flush()
+}
+
+func (s *Sink) run() {
+	defer close(s.stopped)
+	if s.cfg.MaxAge == 0 {
+		<-s.stop
+		return
+	}
+	interval := s.cfg.MaxAge
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.lk.Lock()
+			if !s.closed && s.size > 0 && s.now().Sub(s.openedAt) >= s.cfg.MaxAge {
+				if err := s.rotate(); err != nil {
+					logger.Errorw("Failed to rotate file", "err", err)
+				}
+			}
+			s.lk.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// open starts a new file. s.lk must be held, or s not yet shared.
+func (s *Sink) open() error {
+	s.openedAt = s.now()
+	path := filepath.Join(s.cfg.Dir, s.cfg.Prefix+"-"+s.openedAt.UTC().Format(timeLayout)+fileExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	s.file = f
+	s.buf = bufio.NewWriter(f)
+	s.size = 0
+	logger.Debugw("Opened file", "path", path)
+	return nil
+}
+
+// closeFile flushes and closes the current file, returning its path. s.lk
+// must be held.
+func (s *Sink) closeFile() (string, error) {
+	path := s.file.Name()
+	err := s.buf.Flush()
+	if syncErr := s.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
+
+// rotate closes the current file, finishing it in the background, and opens
+// the next one. s.lk must be held.
+func (s *Sink) rotate() error {
+	path, err := s.closeFile()
+	if err != nil {
+		return fmt.Errorf("failed to close file %s: %w", path, err)
+	}
+	s.finish(path)
+	return s.open()
+}
+
+// finish compresses a closed file if configured and prunes old files.
+func (s *Sink) finish(path string) {
+	s.finishWg.Add(1)
+	go func() {
+		defer s.finishWg.Done()
+		s.finishLk.Lock()
+		defer s.finishLk.Unlock()
+		if s.cfg.Compress && strings.HasSuffix(path, fileExt) {
+			if err := compress(path); err != nil {
+				logger.Errorw("Failed to compress file", "path", path, "err", err)
+			}
+		}
+		if err := s.prune(); err != nil {
+			logger.Errorw("Failed to remove old files", "err", err)
+		}
+	}()
+}
+
+// prune deletes the oldest rotated files beyond the retention count.
+func (s *Sink) prune() error {
+	if s.cfg.Retain == 0 {
+		return nil
+	}
+	files, err := Files(s.cfg.Dir, s.cfg.Prefix)
+	if err != nil {
+		return err
+	}
+	s.lk.Lock()
+	var current string
+	if s.file != nil && !s.closed {
+		current = s.file.Name()
+	}
+	s.lk.Unlock()
+
+	rotated := files[:0]
+	for _, path := range files {
+		if path != current {
+			rotated = append(rotated, path)
+		}
+	}
+	for len(rotated) > s.cfg.Retain {
+		if err := os.Remove(rotated[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		logger.Debugw("Removed old file", "path", rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close writes any buffered records, closes the current file and waits for
+// rotated files to be compressed and pruned.
+func (s *Sink) Close() error {
+	s.lk.Lock()
+	if s.closed {
+		s.lk.Unlock()
+		return nil
+	}
+	path, err := s.closeFile()
+	empty := s.size == 0
+	s.closed = true
+	s.lk.Unlock()
+
+	close(s.stop)
+	<-s.stopped
+	switch {
+	case err != nil:
+	case empty:
+		err = os.Remove(path)
+	default:
+		s.finish(path)
+	}
+	s.finishWg.Wait()
+	return err
+}
+
+// compress replaces a file with its gzipped equivalent.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	target := strings.TrimSuffix(path, fileExt) + compressedExt
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if _, err := io.Copy(zw, src); err != nil {
+		return errors.Join(err, tmp.Close())
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Join(err, tmp.Close())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Files returns the archive files in dir whose names start with prefix,
+// oldest first.
+func Files(dir, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix+"-") {
+			continue
+		}
+		if strings.HasSuffix(name, fileExt) || strings.HasSuffix(name, compressedExt) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// Names embed the time the file was opened, so they sort chronologically.
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadFile calls fn with every record in an archive file, in order. Gzipped
+// files are decompressed transparently.
+func ReadFile(path string, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var record Record
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to decode record %d of %s: %w", line, path, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package filesink
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent(t *testing.T) eventrecorder.Event {
+	id, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	return eventrecorder.Event{
+		RetrievalId:    id,
+		InstanceId:     "test-instance",
+		Cid:            "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+		Phase:          types.RetrievalPhase,
+		PhaseStartTime: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+		EventName:      types.StartedCode,
+		EventTime:      time.Date(2023, 5, 1, 12, 0, 1, 0, time.UTC),
+	}
+}
+
+func testAggregateEvent() eventrecorder.AggregateEvent {
+	return eventrecorder.AggregateEvent{
+		InstanceID:  "test-instance",
+		RetrievalID: uuid.NewString(),
+		RootCid:     "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+		Success:     true,
+		StartTime:   time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC),
+		EndTime:     time.Date(2023, 5, 1, 12, 0, 2, 0, time.UTC),
+		RetrievalAttempts: map[string]*eventrecorder.RetrievalAttempt{
+			"Bitswap": {Protocol: "transport-bitswap", TimeToFirstByte: "20ms"},
+		},
+	}
+}
+
+func readAll(t *testing.T, dir string) []Record {
+	files, err := Files(dir, "events")
+	require.NoError(t, err)
+	var records []Record
+	for _, path := range files {
+		require.NoError(t, ReadFile(path, func(r Record) error {
+			records = append(records, r)
+			return nil
+		}))
+	}
+	return records
+}
+
+func TestSink_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+
+	event := testEvent(t)
+	aggregate := testAggregateEvent()
+	require.NoError(t, s.RecordEvents(ctx, []eventrecorder.Event{event}))
+	require.NoError(t, s.RecordAggregateEvents(ctx, []eventrecorder.AggregateEvent{aggregate}))
+	require.NoError(t, s.Close())
+	require.Error(t, s.RecordEvents(ctx, []eventrecorder.Event{event}))
+
+	records := readAll(t, dir)
+	require.Len(t, records, 2)
+	require.Equal(t, &event, records[0].Event)
+	require.Nil(t, records[0].AggregateEvent)
+	require.False(t, records[0].ReceivedAt.IsZero())
+	require.Equal(t, &aggregate, records[1].AggregateEvent)
+	require.Nil(t, records[1].Event)
+}
+
+func TestSink_RotatesBySizeAndCompresses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := New(Config{Dir: dir, MaxSize: 1, Compress: true, Retain: 3})
+	require.NoError(t, err)
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		event := testAggregateEvent()
+		want = append(want, event.RetrievalID)
+		require.NoError(t, s.RecordAggregateEvents(ctx, []eventrecorder.AggregateEvent{event}))
+	}
+	require.NoError(t, s.Close())
+
+	// Every batch went to its own file; only the newest three were retained
+	// and all of them were compressed.
+	files, err := Files(dir, "events")
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, path := range files {
+		require.True(t, strings.HasSuffix(path, ".jsonl.gz"), path)
+	}
+	var got []string
+	for _, r := range readAll(t, dir) {
+		got = append(got, r.AggregateEvent.RetrievalID)
+	}
+	require.Equal(t, want[2:], got)
+}
+
+func TestSink_RotatesByAge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := New(Config{Dir: dir, MaxAge: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.RecordEvents(ctx, []eventrecorder.Event{testEvent(t)}))
+	require.Eventually(t, func() bool {
+		files, err := Files(dir, "events")
+		require.NoError(t, err)
+		return len(files) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Idle files are not rotated.
+	time.Sleep(50 * time.Millisecond)
+	files, err := Files(dir, "events")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestNew_FinishesLeftoverFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.RecordEvents(context.Background(), []eventrecorder.Event{testEvent(t)}))
+	// Simulate a crash by not closing the sink.
+	require.NoError(t, s.buf.Flush())
+
+	s2, err := New(Config{Dir: dir, Compress: true})
+	require.NoError(t, err)
+	require.NoError(t, s2.Close())
+
+	// The leftover file was compressed, and the second sink's empty file was
+	// removed on close.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, strings.HasSuffix(entries[0].Name(), ".jsonl.gz"), entries[0].Name())
+	require.Len(t, readAll(t, dir), 1)
+}
@@ -0,0 +1,301 @@
+// Package heartbeat tracks when each Lassie instance last reported events, and
+// at what rate, to detect instances that have gone silent.
+//
+// A Monitor is a recorder sink, so it sees every batch of events accepted by
+// the recorder. An instance that has reported regularly is considered silent
+// once it has not reported for much longer than its usual interval between
+// batches.
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/metrics"
+	"github.com/ipfs/go-log/v2"
+)
+
+var logger = log.Logger("lassie/heartbeat")
+
+var _ eventrecorder.Sink = (*Monitor)(nil)
+
+// rateWindow is the time constant of the event rate and usual interval
+// averages; older batches weigh exponentially less.
+const rateWindow = 15 * time.Minute
+
+type Config struct {
+	// SilenceFactor is how many times its usual interval between batches an
+	// instance must go without reporting to be considered silent.
+	SilenceFactor float64
+	// MinSilence is the shortest silence that is reported, however often an
+	// instance usually reports.
+	MinSilence time.Duration
+	// MinBatches is the number of batches an instance must have sent before
+	// its usual interval is trusted enough to detect silences.
+	MinBatches int
+	// CheckInterval is how often instances are checked for silences.
+	CheckInterval time.Duration
+	// Forget is how long after its last report an instance is no longer
+	// tracked.
+	Forget time.Duration
+	// Metrics, if set, receives the status of every instance after each
+	// check.
+	Metrics Metrics
+}
+
+type Metrics interface {
+	HandleInstanceStatuses(context.Context, []metrics.InstanceStatus)
+}
+
+func (c *Config) applyDefaults() {
+	if c.SilenceFactor == 0 {
+		c.SilenceFactor = 10
+	}
+	if c.MinSilence == 0 {
+		c.MinSilence = 5 * time.Minute
+	}
+	if c.MinBatches == 0 {
+		c.MinBatches = 10
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = time.Minute
+	}
+	if c.Forget == 0 {
+		c.Forget = 7 * 24 * time.Hour
+	}
+}
+
+// Status is what is known about the reporting of an instance.
+type Status struct {
+	InstanceID string    `json:"instanceId"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Batches    int64     `json:"batches"`
+	Events     int64     `json:"events"`
+	// EventRate is the recent average number of events per second.
+	EventRate float64 `json:"eventRate"`
+	// UsualInterval is the recent average interval between batches, once
+	// known.
+	UsualInterval time.Duration `json:"usualInterval,omitempty"`
+	// Silent is set once the instance has gone quiet for longer than usual.
+	Silent bool `json:"silent"`
+}
+
+// MarshalJSON encodes UsualInterval as a string such as "1m30s".
+func (s Status) MarshalJSON() ([]byte, error) {
+	type status Status
+	var usualInterval string
+	if s.UsualInterval > 0 {
+		usualInterval = s.UsualInterval.String()
+	}
+	return json.Marshal(struct {
+		status
+		UsualInterval string `json:"usualInterval,omitempty"`
+	}{status(s), usualInterval})
+}
+
+type instance struct {
+	Status
+	// rateUpdated is when EventRate was last brought up to date.
+	rateUpdated time.Time
+}
+
+// Monitor tracks the reporting of instances.
+type Monitor struct {
+	cfg Config
+	now func() time.Time
+
+	lk        sync.Mutex
+	instances map[string]*instance
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func New(cfg Config) (*Monitor, error) {
+	cfg.applyDefaults()
+	if cfg.SilenceFactor < 1 {
+		return nil, errors.New("silence factor must be at least 1")
+	}
+	if cfg.MinSilence < 0 || cfg.MinBatches < 0 || cfg.CheckInterval < 0 || cfg.Forget < 0 {
+		return nil, errors.New("heartbeat limits cannot be negative")
+	}
+	m := &Monitor{
+		cfg:       cfg,
+		now:       time.Now,
+		instances: make(map[string]*instance),
+		closing:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+func (m *Monitor) RecordEvents(_ context.Context, events []eventrecorder.Event) error {
+	counts := make(map[string]int64)
+	for _, event := range events {
+		counts[event.InstanceId]++
+	}
+	m.observe(counts)
+	return nil
+}
+
+func (m *Monitor) RecordAggregateEvents(_ context.Context, events []eventrecorder.AggregateEvent) error {
+	counts := make(map[string]int64)
+	for _, event := range events {
+		counts[event.InstanceID]++
+	}
+	m.observe(counts)
+	return nil
+}
+
+func (m *Monitor) observe(counts map[string]int64) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	now := m.now()
+	for instanceID, count := range counts {
+		i, ok := m.instances[instanceID]
+		if !ok {
+			i = &instance{Status: Status{InstanceID: instanceID, FirstSeen: now}, rateUpdated: now}
+			m.instances[instanceID] = i
+		} else {
+			interval := now.Sub(i.LastSeen)
+			if i.UsualInterval == 0 {
+				i.UsualInterval = interval
+			} else {
+				i.UsualInterval += time.Duration(decay(interval) * float64(interval-i.UsualInterval))
+			}
+		}
+		if i.Silent {
+			logger.Infow("Silent instance resumed reporting", "instanceID", instanceID, "silence", now.Sub(i.LastSeen))
+			i.Silent = false
+		}
+		i.updateRate(now, count)
+		i.LastSeen = now
+		i.Batches++
+		i.Events += count
+	}
+}
+
+// updateRate decays the event rate to now, then adds count events.
+func (i *instance) updateRate(now time.Time, count int64) {
+	elapsed := now.Sub(i.rateUpdated)
+	i.EventRate *= 1 - decay(elapsed)
+	i.EventRate += float64(count) / rateWindow.Seconds()
+	i.rateUpdated = now
+}
+
+// decay is the weight of the latest sample in an exponential moving average
+// over rateWindow, elapsed after the previous sample.
+func decay(elapsed time.Duration) float64 {
+	return 1 - math.Exp(-elapsed.Seconds()/rateWindow.Seconds())
+}
+
+// silence is how long an instance must go without reporting to be silent, or
+// zero if it has not reported regularly enough to tell.
+func (m *Monitor) silence(i *instance) time.Duration {
+	if i.Batches < int64(m.cfg.MinBatches) || i.UsualInterval == 0 {
+		return 0
+	}
+	silence := time.Duration(m.cfg.SilenceFactor * float64(i.UsualInterval))
+	if silence < m.cfg.MinSilence {
+		silence = m.cfg.MinSilence
+	}
+	return silence
+}
+
+func (m *Monitor) run() {
+	defer close(m.closed)
+	ticker := time.NewTicker(m.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closing:
+			return
+		case <-ticker.C:
+			statuses := m.check()
+			if m.cfg.Metrics != nil {
+				m.cfg.Metrics.HandleInstanceStatuses(context.Background(), statuses)
+			}
+		}
+	}
+}
+
+// check flags instances that have gone silent, forgets those that stopped
+// reporting long ago, and returns the status of the remaining instances.
+func (m *Monitor) check() []metrics.InstanceStatus {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	now := m.now()
+	statuses := make([]metrics.InstanceStatus, 0, len(m.instances))
+	for instanceID, i := range m.instances {
+		quiet := now.Sub(i.LastSeen)
+		if quiet > m.cfg.Forget {
+			delete(m.instances, instanceID)
+			continue
+		}
+		i.updateRate(now, 0)
+		if silence := m.silence(i); !i.Silent && silence > 0 && quiet > silence {
+			i.Silent = true
+			logger.Warnw("Instance went silent", "instanceID", instanceID, "lastSeen", i.LastSeen, "usualInterval", i.UsualInterval)
+		}
+		statuses = append(statuses, metrics.InstanceStatus{
+			InstanceID: instanceID,
+			LastSeen:   i.LastSeen,
+			EventRate:  i.EventRate,
+			Silent:     i.Silent,
+		})
+	}
+	return statuses
+}
+
+// Statuses returns the status of every tracked instance, ordered by instance
+// ID.
+func (m *Monitor) Statuses() []Status {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	statuses := make([]Status, 0, len(m.instances))
+	for _, i := range m.instances {
+		statuses = append(statuses, i.Status)
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].InstanceID < statuses[b].InstanceID })
+	return statuses
+}
+
+// ServeHTTP responds to GET requests with the status of every tracked
+// instance as JSON. Only silent instances are listed if the silent query
+// parameter is true.
+func (m *Monitor) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Add("Allow", http.MethodGet)
+		http.Error(res, "", http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := m.Statuses()
+	if req.URL.Query().Get("silent") == "true" {
+		silent := statuses[:0]
+		for _, status := range statuses {
+			if status.Silent {
+				silent = append(silent, status)
+			}
+		}
+		statuses = silent
+	}
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(statuses); err != nil {
+		logger.Warnw("Failed to write instance statuses", "err", err)
+	}
+}
+
+func (m *Monitor) Close() error {
+	close(m.closing)
+	<-m.closed
+	return nil
+}
@@ -0,0 +1,81 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitor(t *testing.T) {
+	m, err := New(Config{MinBatches: 3, MinSilence: time.Minute, CheckInterval: time.Hour, Forget: 24 * time.Hour})
+	require.NoError(t, err)
+	defer m.Close()
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	report := func(instanceID string, events int) {
+		batch := make([]eventrecorder.AggregateEvent, events)
+		for i := range batch {
+			batch[i].InstanceID = instanceID
+		}
+		require.NoError(t, m.RecordAggregateEvents(context.Background(), batch))
+	}
+	silent := func(instanceID string) bool {
+		m.check()
+		for _, status := range m.Statuses() {
+			if status.InstanceID == instanceID {
+				return status.Silent
+			}
+		}
+		t.Fatalf("instance %s is not tracked", instanceID)
+		return false
+	}
+
+	// regular reports every 30 seconds; sporadic has only reported twice, so
+	// its usual interval is not yet trusted.
+	for i := 0; i < 5; i++ {
+		report("regular", 2)
+		if i < 2 {
+			report("sporadic", 1)
+		}
+		now = now.Add(30 * time.Second)
+	}
+	statuses := m.Statuses()
+	require.Len(t, statuses, 2)
+	require.Equal(t, "regular", statuses[0].InstanceID)
+	require.Equal(t, int64(5), statuses[0].Batches)
+	require.Equal(t, int64(10), statuses[0].Events)
+	require.Equal(t, 30*time.Second, statuses[0].UsualInterval)
+	require.Greater(t, statuses[0].EventRate, 0.0)
+
+	// Silences are relative to the usual interval, but never shorter than
+	// MinSilence.
+	now = now.Add(2 * time.Minute)
+	require.False(t, silent("regular"))
+	now = now.Add(3 * time.Minute)
+	require.True(t, silent("regular"))
+	require.False(t, silent("sporadic"))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/instances?silent=true", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var listed []map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	require.Equal(t, "regular", listed[0]["instanceId"])
+	require.Equal(t, "30s", listed[0]["usualInterval"])
+
+	report("regular", 1)
+	require.False(t, silent("regular"))
+
+	// Instances are forgotten once they have been quiet for long enough.
+	now = now.Add(25 * time.Hour)
+	m.check()
+	require.Empty(t, m.Statuses())
+}
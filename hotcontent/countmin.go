@@ -0,0 +1,84 @@
+package hotcontent
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// hash returns a well mixed 64 bit hash of s: FNV-1a followed by the
+// splitmix64 finalizer, since FNV alone spreads short keys poorly across high
+// bits.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// CountMin is a count-min sketch: it estimates how many times each key was
+// added in fixed memory, never underestimating, and overestimating by at most
+// e / width of the total count with probability 1 - e^-depth.
+type CountMin struct {
+	width uint64
+	rows  [][]uint64
+	total uint64
+}
+
+// NewCountMin returns an empty sketch of depth rows of width counters.
+func NewCountMin(width, depth int) *CountMin {
+	rows := make([][]uint64, depth)
+	for i := range rows {
+		rows[i] = make([]uint64, width)
+	}
+	return &CountMin{width: uint64(width), rows: rows}
+}
+
+// Add counts key n times and returns its updated estimate.
+func (c *CountMin) Add(key string, n uint64) uint64 {
+	h := hash(key)
+	// Rows are indexed by double hashing the two halves of the hash.
+	h1, h2 := h&math.MaxUint32, h>>32
+	estimate := uint64(math.MaxUint64)
+	for i, row := range c.rows {
+		j := (h1 + uint64(i)*h2) % c.width
+		row[j] += n
+		if row[j] < estimate {
+			estimate = row[j]
+		}
+	}
+	c.total += n
+	return estimate
+}
+
+// Count returns the estimated number of times key was added.
+func (c *CountMin) Count(key string) uint64 {
+	h := hash(key)
+	h1, h2 := h&math.MaxUint32, h>>32
+	estimate := uint64(math.MaxUint64)
+	for i, row := range c.rows {
+		if n := row[(h1+uint64(i)*h2)%c.width]; n < estimate {
+			estimate = n
+		}
+	}
+	return estimate
+}
+
+// Total returns the number of times any key was added.
+func (c *CountMin) Total() uint64 {
+	return c.total
+}
+
+// Reset empties the sketch.
+func (c *CountMin) Reset() {
+	for _, row := range c.rows {
+		for j := range row {
+			row[j] = 0
+		}
+	}
+	c.total = 0
+}
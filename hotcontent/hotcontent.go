@@ -0,0 +1,157 @@
+// Package hotcontent tracks which CIDs are retrieved and fail most, and how
+// many distinct CIDs each instance retrieves, in fixed memory.
+//
+// Counts are estimated by count-min sketches, which never underestimate, with
+// the most counted CIDs kept in a top-K heap, and distinct CIDs are estimated
+// by a HyperLogLog per instance. Counts cover a period, at the end of which
+// the tracker is rotated and starts afresh.
+package hotcontent
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Config configures a Tracker; zero fields take their defaults.
+type Config struct {
+	// Width is the number of counters in each row of the count-min sketches.
+	// Counts are overestimated by at most e / Width of all counts.
+	Width int
+	// Depth is the number of rows of the count-min sketches.
+	Depth int
+	// K is the number of most retrieved and most failed CIDs tracked.
+	K int
+	// Precision sets the number of registers of each HyperLogLog to
+	// 2^Precision, within [4, 18].
+	Precision uint8
+}
+
+func (c *Config) applyDefaults() {
+	if c.Width == 0 {
+		c.Width = 1 << 16
+	}
+	if c.Depth == 0 {
+		c.Depth = 4
+	}
+	if c.K == 0 {
+		c.K = 100
+	}
+	if c.Precision == 0 {
+		c.Precision = 14
+	}
+}
+
+func (c Config) validate() error {
+	if c.Width <= 0 || c.Depth <= 0 || c.K <= 0 {
+		return errors.New("width, depth and k must be positive")
+	}
+	if c.Precision < 4 || c.Precision > 18 {
+		return errors.New("precision must be within [4, 18]")
+	}
+	return nil
+}
+
+// Snapshot holds the counts of a period.
+type Snapshot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Retrievals and Failures count all retrievals and failures, of any CID.
+	Retrievals   uint64  `json:"retrievals"`
+	Failures     uint64  `json:"failures"`
+	TopRetrieved []Count `json:"topRetrieved"`
+	TopFailed    []Count `json:"topFailed"`
+	// UniqueCIDs is the estimated number of distinct CIDs retrieved by each
+	// instance.
+	UniqueCIDs map[string]uint64 `json:"uniqueCids"`
+}
+
+// Tracker counts retrievals and failures by CID over a period.
+type Tracker struct {
+	cfg Config
+
+	lk        sync.Mutex
+	start     time.Time
+	retrieved *TopK
+	failed    *TopK
+	instances map[string]*HyperLogLog
+}
+
+// New returns a tracker whose first period starts now.
+func New(cfg Config) (*Tracker, error) {
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &Tracker{
+		cfg:       cfg,
+		start:     time.Now(),
+		retrieved: NewTopK(cfg.K, NewCountMin(cfg.Width, cfg.Depth)),
+		failed:    NewTopK(cfg.K, NewCountMin(cfg.Width, cfg.Depth)),
+		instances: make(map[string]*HyperLogLog),
+	}, nil
+}
+
+// Retrieved counts a retrieval of cid by an instance.
+func (t *Tracker) Retrieved(instanceID, cid string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.retrieved.Add(cid)
+	hll, ok := t.instances[instanceID]
+	if !ok {
+		hll = NewHyperLogLog(t.cfg.Precision)
+		t.instances[instanceID] = hll
+	}
+	hll.Add(cid)
+}
+
+// Failed counts a failed retrieval of cid.
+func (t *Tracker) Failed(cid string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.failed.Add(cid)
+}
+
+// Counts returns the estimated number of retrievals and failures of cid
+// within the current period.
+func (t *Tracker) Counts(cid string) (retrieved, failed uint64) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.retrieved.counts.Count(cid), t.failed.counts.Count(cid)
+}
+
+// Snapshot returns the counts of the current period so far.
+func (t *Tracker) Snapshot() Snapshot {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.snapshot(time.Now())
+}
+
+// Rotate ends the current period, returning its counts, and starts a new one.
+func (t *Tracker) Rotate() Snapshot {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	now := time.Now()
+	snapshot := t.snapshot(now)
+	t.start = now
+	t.retrieved.Reset()
+	t.failed.Reset()
+	t.instances = make(map[string]*HyperLogLog)
+	return snapshot
+}
+
+func (t *Tracker) snapshot(end time.Time) Snapshot {
+	unique := make(map[string]uint64, len(t.instances))
+	for instanceID, hll := range t.instances {
+		unique[instanceID] = hll.Estimate()
+	}
+	return Snapshot{
+		Start:        t.start,
+		End:          end,
+		Retrievals:   t.retrieved.counts.Total(),
+		Failures:     t.failed.counts.Total(),
+		TopRetrieved: t.retrieved.Top(),
+		TopFailed:    t.failed.Top(),
+		UniqueCIDs:   unique,
+	}
+}
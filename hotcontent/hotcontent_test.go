@@ -0,0 +1,81 @@
+package hotcontent_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/lassie-event-recorder/hotcontent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	tracker, err := hotcontent.New(hotcontent.Config{Width: 1024, K: 3})
+	require.NoError(t, err)
+
+	// A few popular CIDs among a long tail retrieved once each.
+	for i := 0; i < 2000; i++ {
+		tracker.Retrieved("instance-a", fmt.Sprintf("tail-%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		tracker.Retrieved("instance-b", "popular-1")
+		if i < 80 {
+			tracker.Retrieved("instance-b", "popular-2")
+		}
+		if i < 60 {
+			tracker.Retrieved("instance-b", "popular-3")
+			tracker.Failed("popular-3")
+		}
+	}
+
+	snapshot := tracker.Snapshot()
+	require.Equal(t, uint64(2240), snapshot.Retrievals)
+	require.Equal(t, uint64(60), snapshot.Failures)
+	require.Len(t, snapshot.TopRetrieved, 3)
+	for i, want := range []struct {
+		cid   string
+		count uint64
+	}{{"popular-1", 100}, {"popular-2", 80}, {"popular-3", 60}} {
+		require.Equal(t, want.cid, snapshot.TopRetrieved[i].CID)
+		// Counts are never underestimated, and overestimated by a little.
+		require.GreaterOrEqual(t, snapshot.TopRetrieved[i].Count, want.count)
+		require.LessOrEqual(t, snapshot.TopRetrieved[i].Count, want.count+10)
+	}
+	require.Equal(t, []hotcontent.Count{{CID: "popular-3", Count: 60}}, snapshot.TopFailed)
+	require.InEpsilon(t, 2000, snapshot.UniqueCIDs["instance-a"], 0.05)
+	require.Equal(t, uint64(3), snapshot.UniqueCIDs["instance-b"])
+
+	retrieved, failed := tracker.Counts("popular-3")
+	require.GreaterOrEqual(t, retrieved, uint64(60))
+	require.Equal(t, uint64(60), failed)
+
+	// Rotating returns the counts of the period ended and starts afresh.
+	ended := tracker.Rotate()
+	require.Equal(t, snapshot.Start, ended.Start)
+	require.Equal(t, snapshot.TopRetrieved, ended.TopRetrieved)
+	current := tracker.Snapshot()
+	require.Equal(t, ended.End, current.Start)
+	require.Zero(t, current.Retrievals)
+	require.Empty(t, current.TopRetrieved)
+	require.Empty(t, current.UniqueCIDs)
+	retrieved, _ = tracker.Counts("popular-1")
+	require.Zero(t, retrieved)
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		hll := hotcontent.NewHyperLogLog(14)
+		for i := 0; i < n; i++ {
+			// Duplicates do not count.
+			hll.Add(fmt.Sprintf("cid-%d", i))
+			hll.Add(fmt.Sprintf("cid-%d", i))
+		}
+		require.InEpsilon(t, n, hll.Estimate(), 0.03, "cardinality %d", n)
+	}
+}
+
+func TestNewTracker(t *testing.T) {
+	_, err := hotcontent.New(hotcontent.Config{K: -1})
+	require.ErrorContains(t, err, "must be positive")
+	_, err = hotcontent.New(hotcontent.Config{Precision: 20})
+	require.ErrorContains(t, err, "precision")
+}
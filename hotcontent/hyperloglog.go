@@ -0,0 +1,50 @@
+package hotcontent
+
+import (
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct keys added to it in 2^precision
+// bytes, with a standard error of about 1.04 / sqrt(2^precision).
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty estimator; precision must be within [4, 18].
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// Add counts key.
+func (h *HyperLogLog) Add(key string) {
+	x := hash(key)
+	i := x >> (64 - h.precision)
+	// The rank is the position of the first set bit of the remaining bits,
+	// which are followed by a sentinel bit so that it is bounded.
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct keys added.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Small cardinalities are estimated more accurately by linear counting.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
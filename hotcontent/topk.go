@@ -0,0 +1,98 @@
+package hotcontent
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Count is the estimated number of times a CID was counted.
+type Count struct {
+	CID   string `json:"cid"`
+	Count uint64 `json:"count"`
+}
+
+// TopK tracks the k keys with the highest counts estimated by a count-min
+// sketch, in a min-heap so that the least counted key is replaced first.
+type TopK struct {
+	k       int
+	counts  *CountMin
+	heap    countHeap
+	indexes map[string]int
+}
+
+// NewTopK returns an empty tracker of the k most counted keys.
+func NewTopK(k int, counts *CountMin) *TopK {
+	t := &TopK{k: k, counts: counts, indexes: make(map[string]int)}
+	t.heap.indexes = t.indexes
+	return t
+}
+
+// Add counts key once.
+func (t *TopK) Add(key string) {
+	count := t.counts.Add(key, 1)
+	if i, ok := t.indexes[key]; ok {
+		t.heap.counts[i].Count = count
+		heap.Fix(&t.heap, i)
+		return
+	}
+	if len(t.heap.counts) < t.k {
+		heap.Push(&t.heap, Count{CID: key, Count: count})
+		return
+	}
+	if t.k > 0 && count > t.heap.counts[0].Count {
+		delete(t.indexes, t.heap.counts[0].CID)
+		t.heap.counts[0] = Count{CID: key, Count: count}
+		t.indexes[key] = 0
+		heap.Fix(&t.heap, 0)
+	}
+}
+
+// Top returns the tracked keys, most counted first.
+func (t *TopK) Top() []Count {
+	top := make([]Count, len(t.heap.counts))
+	copy(top, t.heap.counts)
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].CID < top[j].CID
+	})
+	return top
+}
+
+// Reset empties the tracker and its sketch.
+func (t *TopK) Reset() {
+	t.counts.Reset()
+	t.heap.counts = t.heap.counts[:0]
+	for key := range t.indexes {
+		delete(t.indexes, key)
+	}
+}
+
+// countHeap is a min-heap of counts that keeps the index of each key up to
+// date as it moves.
+type countHeap struct {
+	counts  []Count
+	indexes map[string]int
+}
+
+func (h countHeap) Len() int           { return len(h.counts) }
+func (h countHeap) Less(i, j int) bool { return h.counts[i].Count < h.counts[j].Count }
+func (h countHeap) Swap(i, j int) {
+	h.counts[i], h.counts[j] = h.counts[j], h.counts[i]
+	h.indexes[h.counts[i].CID] = i
+	h.indexes[h.counts[j].CID] = j
+}
+
+func (h *countHeap) Push(x any) {
+	count := x.(Count)
+	h.indexes[count.CID] = len(h.counts)
+	h.counts = append(h.counts, count)
+}
+
+func (h *countHeap) Pop() any {
+	last := h.counts[len(h.counts)-1]
+	h.counts = h.counts[:len(h.counts)-1]
+	delete(h.indexes, last.CID)
+	return last
+}
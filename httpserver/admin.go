@@ -0,0 +1,156 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+)
+
+// AdminHandler serves the admin API, which manages the instance registry.
+// Every request must carry the admin token as a bearer token.
+type AdminHandler struct {
+	recorder *eventrecorder.EventRecorder
+	token    string
+}
+
+func NewAdminHandler(recorder *eventrecorder.EventRecorder, token string) *AdminHandler {
+	return &AdminHandler{recorder: recorder, token: token}
+}
+
+func (ah *AdminHandler) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/instances", ah.authorized(ah.handleInstances))
+	mux.HandleFunc("/admin/instances/", ah.authorized(ah.handleInstance))
+	return mux
+}
+
+func (ah *AdminHandler) authorized(handle http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ah.token)) != 1 {
+			http.Error(res, "", http.StatusUnauthorized)
+			logger.Warnw("Rejected unauthorized admin request", "method", req.Method, "path", req.URL.Path)
+			return
+		}
+		handle(res, req)
+	}
+}
+
+// handleInstances lists the registered instances, filtered by the operator,
+// region, environment, lassieVersion and active query parameters, or registers
+// an instance.
+func (ah *AdminHandler) handleInstances(res http.ResponseWriter, req *http.Request) {
+	logger := logger.With("method", req.Method, "path", req.URL.Path)
+	switch req.Method {
+	case http.MethodGet:
+		query := req.URL.Query()
+		filter := eventrecorder.InstanceFilter{
+			Operator:      query.Get("operator"),
+			Region:        query.Get("region"),
+			Environment:   query.Get("environment"),
+			LassieVersion: query.Get("lassieVersion"),
+		}
+		if v := query.Get("active"); v != "" {
+			active, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(res, "active must be true or false", http.StatusBadRequest)
+				return
+			}
+			filter.Active = &active
+		}
+		instances, err := ah.recorder.Instances(req.Context(), filter)
+		if err != nil {
+			http.Error(res, "", http.StatusInternalServerError)
+			logger.Errorw("Failed to list instances", "err", err)
+			return
+		}
+		if instances == nil {
+			instances = []eventrecorder.Instance{}
+		}
+		writeJSON(res, instances)
+	case http.MethodPost:
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			http.Error(res, "Not an acceptable content type. Content type must be application/json.", http.StatusBadRequest)
+			logger.Warn("Rejected bad request with non-json content type")
+			return
+		}
+		// Instances are active unless registered otherwise.
+		var body struct {
+			eventrecorder.Instance
+			Active *bool `json:"active"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			logger.Warn("Rejected bad request with undecodable json body")
+			return
+		}
+		instance := body.Instance
+		instance.Active = body.Active == nil || *body.Active
+		stored, err := ah.recorder.RegisterInstance(req.Context(), instance)
+		if errors.Is(err, eventrecorder.ErrInvalidInstance) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(res, "", http.StatusInternalServerError)
+			logger.Errorw("Failed to register instance", "err", err)
+			return
+		}
+		writeJSON(res, stored)
+	default:
+		res.Header().Add("Allow", http.MethodGet)
+		res.Header().Add("Allow", http.MethodPost)
+		http.Error(res, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInstance returns or deregisters the instance named by the last path
+// segment.
+func (ah *AdminHandler) handleInstance(res http.ResponseWriter, req *http.Request) {
+	logger := logger.With("method", req.Method, "path", req.URL.Path)
+	instanceID := strings.TrimPrefix(req.URL.Path, "/admin/instances/")
+	if instanceID == "" || strings.Contains(instanceID, "/") {
+		http.NotFound(res, req)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		instance, err := ah.recorder.Instance(req.Context(), instanceID)
+		switch {
+		case errors.Is(err, eventrecorder.ErrInstanceNotFound):
+			http.NotFound(res, req)
+		case err != nil:
+			http.Error(res, "", http.StatusInternalServerError)
+			logger.Errorw("Failed to get instance", "err", err)
+		default:
+			writeJSON(res, instance)
+		}
+	case http.MethodDelete:
+		err := ah.recorder.DeregisterInstance(req.Context(), instanceID)
+		switch {
+		case errors.Is(err, eventrecorder.ErrInstanceNotFound):
+			http.NotFound(res, req)
+		case err != nil:
+			http.Error(res, "", http.StatusInternalServerError)
+			logger.Errorw("Failed to deregister instance", "err", err)
+		default:
+			res.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		res.Header().Add("Allow", http.MethodGet)
+		res.Header().Add("Allow", http.MethodDelete)
+		http.Error(res, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(res http.ResponseWriter, v any) {
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		logger.Warnw("Failed to write response", "err", err)
+	}
+}
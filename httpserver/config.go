@@ -12,6 +12,8 @@ type (
 		httpServerWriteTimeout      time.Duration
 		httpServerIdleTimeout       time.Duration
 		httpServerMaxHeaderBytes    int
+		// adminToken enables the admin API when set.
+		adminToken string
 	}
 	option func(*config) error
 )
@@ -40,3 +42,12 @@ func WithHttpServerListenAddr(addr string) option {
 		return nil
 	}
 }
+
+// WithAdminToken serves the admin API under /admin/, to requests carrying
+// token as a bearer token. The admin API is disabled by default.
+func WithAdminToken(token string) option {
+	return func(cfg *config) error {
+		cfg.adminToken = token
+		return nil
+	}
+}
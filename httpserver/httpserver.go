@@ -3,6 +3,7 @@ package httpserver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -29,9 +30,16 @@ func NewHttpServer(recorder *eventrecorder.EventRecorder, opts ...option) (*Http
 	var httpServer HttpServer
 	httpServer.cfg = cfg
 	httpServer.handler = NewHttpHandler(recorder)
+	handler := httpServer.handler.Handler()
+	if cfg.adminToken != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		mux.Handle("/admin/", NewAdminHandler(recorder, cfg.adminToken).Handler())
+		handler = mux
+	}
 	httpServer.server = &http.Server{
 		Addr:              httpServer.cfg.httpServerListenAddr,
-		Handler:           httpServer.handler.Handler(),
+		Handler:           handler,
 		ReadTimeout:       httpServer.cfg.httpServerReadTimeout,
 		ReadHeaderTimeout: httpServer.cfg.httpServerReadHeaderTimeout,
 		WriteTimeout:      httpServer.cfg.httpServerWriteTimeout,
@@ -87,6 +95,9 @@ func (hh *HttpHandler) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/retrieval-events", hh.handleRetrievalEvents)
 	mux.HandleFunc("/v2/retrieval-events", hh.handleRetrievalEventsV2)
+	mux.HandleFunc("/v3/retrieval-events", hh.handleRetrievalEventsV3)
+	mux.HandleFunc("/v1/storage-providers/digests", hh.handleProviderDigests)
+	mux.HandleFunc("/v1/content/hot", hh.handleHotContent)
 	mux.HandleFunc("/ready", hh.handleReady)
 	return mux
 }
@@ -117,13 +128,17 @@ func (hh *HttpHandler) handleRetrievalEvents(res http.ResponseWriter, req *http.
 	}
 
 	// Validate JSON
-	if err := batch.Validate(); err != nil {
+	if err := hh.recorder.ValidateEvents(req.Context(), batch); err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		logger.Warnf("Rejected bad request with invalid event: %s", err.Error())
 		return
 	}
 
 	err := hh.recorder.RecordEvents(req.Context(), batch.Events)
+	if errors.Is(err, eventrecorder.ErrUnregisteredInstance) {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(res, "", http.StatusInternalServerError)
 		return
@@ -131,6 +146,16 @@ func (hh *HttpHandler) handleRetrievalEvents(res http.ResponseWriter, req *http.
 }
 
 func (hh *HttpHandler) handleRetrievalEventsV2(res http.ResponseWriter, req *http.Request) {
+	hh.handleAggregateEvents(res, req, eventrecorder.AggregateEventBatch.Validate)
+}
+
+// handleRetrievalEventsV3 accepts aggregate events that list their retrieval
+// attempts in order, with their timings, rather than by storage provider.
+func (hh *HttpHandler) handleRetrievalEventsV3(res http.ResponseWriter, req *http.Request) {
+	hh.handleAggregateEvents(res, req, eventrecorder.AggregateEventBatch.ValidateV3)
+}
+
+func (hh *HttpHandler) handleAggregateEvents(res http.ResponseWriter, req *http.Request, validate func(eventrecorder.AggregateEventBatch) error) {
 	logger := logger.With("method", req.Method, "path", req.URL.Path)
 	if req.Method != http.MethodPost {
 		res.Header().Add("Allow", http.MethodPost)
@@ -156,17 +181,84 @@ func (hh *HttpHandler) handleRetrievalEventsV2(res http.ResponseWriter, req *htt
 	}
 
 	// Validate JSON
-	if err := batch.Validate(); err != nil {
+	if err := validate(batch); err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		logger.Warnf("Rejected bad request with invalid event: %s", err.Error())
 		return
 	}
 
 	err := hh.recorder.RecordAggregateEvents(req.Context(), batch.Events)
+	if errors.Is(err, eventrecorder.ErrUnregisteredInstance) {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(res, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleProviderDigests serves the quantiles of time to first byte and
+// bandwidth of recent successful retrievals per storage provider and protocol,
+// optionally filtered by the filSpId and protocol query parameters.
+func (hh *HttpHandler) handleProviderDigests(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Add("Allow", http.MethodGet)
+		http.Error(res, "", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	digests, err := hh.recorder.ProviderDigests(eventrecorder.DigestFilter{
+		FilSPID:  query.Get("filSpId"),
+		Protocol: query.Get("protocol"),
+	})
+	if errors.Is(err, eventrecorder.ErrDigestsDisabled) {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(res, "", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, digests)
+}
+
+// handleHotContent serves the most retrieved and most failed CIDs of the current
+// hot content period, or the counts of a single CID given by the cid query
+// parameter.
+func (hh *HttpHandler) handleHotContent(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		res.Header().Add("Allow", http.MethodGet)
+		http.Error(res, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if c := req.URL.Query().Get("cid"); c != "" {
+		retrieved, failed, err := hh.recorder.HotContentCounts(c)
+		if errors.Is(err, eventrecorder.ErrHotContentDisabled) {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(res, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(res, struct {
+			CID       string `json:"cid"`
+			Retrieved uint64 `json:"retrieved"`
+			Failed    uint64 `json:"failed"`
+		}{CID: c, Retrieved: retrieved, Failed: failed})
+		return
+	}
+	snapshot, err := hh.recorder.HotContent()
+	if errors.Is(err, eventrecorder.ErrHotContentDisabled) {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(res, "", http.StatusInternalServerError)
 		return
 	}
+	writeJSON(res, snapshot)
 }
 
 func (hh *HttpHandler) handleReady(res http.ResponseWriter, req *http.Request) {
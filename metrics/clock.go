@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+// clockOffsetTTL is how long the clock offset of an instance is reported
+// after its last event arrived.
+const clockOffsetTTL = 10 * time.Minute
+
+// clockOffsets holds the latest estimated clock offset of each instance.
+type clockOffsets struct {
+	lk      sync.Mutex
+	offsets map[string]clockOffset
+}
+
+type clockOffset struct {
+	offset  time.Duration
+	updated time.Time
+}
+
+// HandleClockOffset is called with the estimated clock offset of an instance
+// each time its events arrive.
+func (m *Metrics) HandleClockOffset(_ context.Context, instanceID string, offset time.Duration) {
+	m.clockOffsets.lk.Lock()
+	defer m.clockOffsets.lk.Unlock()
+	m.clockOffsets.offsets[instanceID] = clockOffset{offset: offset, updated: time.Now()}
+}
+
+func (c *clockOffsets) observe(_ context.Context, observer instrument.Float64Observer) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	now := time.Now()
+	for instanceID, offset := range c.offsets {
+		if now.Sub(offset.updated) > clockOffsetTTL {
+			delete(c.offsets, instanceID)
+			continue
+		}
+		observer.Observe(offset.offset.Seconds(), attribute.String("instance_id", instanceID))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+// ProviderQuantile is a quantile of the time to first byte and bandwidth of
+// the successful retrievals from a storage provider over a protocol.
+type ProviderQuantile struct {
+	FilSPID  string
+	Protocol string
+	Quantile float64
+	// TimeToFirstByte is in seconds.
+	TimeToFirstByte float64
+	// Bandwidth is in bytes per second.
+	Bandwidth float64
+}
+
+// providerQuantiles holds the latest quantiles of the top storage providers.
+type providerQuantiles struct {
+	lk        sync.Mutex
+	quantiles []ProviderQuantile
+}
+
+// HandleProviderQuantiles is called with the quantiles of the top storage
+// providers each time the recorder's digests slide, replacing the previous
+// ones.
+func (m *Metrics) HandleProviderQuantiles(_ context.Context, quantiles []ProviderQuantile) {
+	m.providerQuantiles.lk.Lock()
+	defer m.providerQuantiles.lk.Unlock()
+	m.providerQuantiles.quantiles = quantiles
+}
+
+func (q ProviderQuantile) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("fil_sp_id", q.FilSPID),
+		attribute.String("protocol", q.Protocol),
+		attribute.String("quantile", strconv.FormatFloat(q.Quantile, 'f', -1, 64)),
+	}
+}
+
+func (p *providerQuantiles) observeTimeToFirstByte(_ context.Context, observer instrument.Float64Observer) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, q := range p.quantiles {
+		observer.Observe(q.TimeToFirstByte, q.attributes()...)
+	}
+	return nil
+}
+
+func (p *providerQuantiles) observeBandwidth(_ context.Context, observer instrument.Float64Observer) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, q := range p.quantiles {
+		observer.Observe(q.Bandwidth, q.attributes()...)
+	}
+	return nil
+}
@@ -151,6 +151,8 @@ type Attempt struct {
 	Protocol         string
 	TimeToFirstByte  time.Duration
 	BytesTransferred uint64
+	// Duration is only known for attempts posted to /v3/retrieval-events.
+	Duration time.Duration
 }
 
 func (m *Metrics) HandleAggregatedEvent(ctx context.Context,
@@ -245,40 +247,139 @@ func (m *Metrics) HandleAggregatedEvent(ctx context.Context,
 	}
 }
 
-func (m *Metrics) getMatchingErrorMetric(ctx context.Context, msg string) (instrument.Int64Counter, bool) {
-	errorMetricMatches := []struct {
-		substr string
-		metric instrument.Int64Counter
-	}{
-		{"response rejected", m.retrievalErrorRejectedCount},
-		{"Too many retrieval deals received", m.retrievalErrorTooManyCount},
-		{"Access Control", m.retrievalErrorACLCount},
-		{"Under maintenance, retry later", m.retrievalErrorMaintenanceCount},
-		{"miner is not accepting online retrieval deals", m.retrievalErrorNoOnlineCount},
-		{"unconfirmed block transfer", m.retrievalErrorUnconfirmedCount},
-		{"timeout after ", m.retrievalErrorTimeoutCount},
-		{"retrieval timed out after ", m.retrievalErrorTimeoutCount},
-		{"there is no unsealed piece containing payload cid", m.retrievalErrorNoUnsealedCount},
-		{"getting pieces for cid", m.retrievalErrorDAGStoreCount},
-		{"graphsync request failed to complete: request failed - unknown reason", m.retrievalErrorGraphsyncCount},
-		{"failed to dial", m.retrievalErrorFailedToDialCount},
-		{"HTTP request failed, remote response code: 404", m.retrievalErrorHTTPRemoteRequestNotFound},
-		{"HTTP request failed, remote response code: 410", m.retrievalErrorHTTPRemoteRequestGone},
-		{"HTTP request failed, remote response code:", m.retrievalErrorHTTPRemoteRequestFailed},
-		{"extraneous block in CAR", m.retrievalErrorHTTPExtraneousBlock},
-		{"unexpected block in CAR", m.retrievalErrorHTTPUnexpectedBlock},
-		{"missing block in CAR", m.retrievalErrorHTTPMissingBlock},
-		{"malformed CAR", m.retrievalErrorHTTPMalformedCar},
-		{"data transfer failed: datatransfer error: data transfer channel ", m.retrievalErrorDatatransferCount},
+// HandleRetrievalAttempt is called for each attempt of retrievals that list
+// their attempts in order, with their timings.
+func (m *Metrics) HandleRetrievalAttempt(ctx context.Context, storageProviderID string, attempt Attempt) {
+	protocol := protocolFromMulticodecString(attempt.Protocol)
+	success := attempt.Error == ""
+	m.retrievalAttemptCount.Add(ctx, 1, attribute.String("protocol", protocol), attribute.Bool("success", success))
+	m.retrievalAttemptDuration.Record(ctx, attempt.Duration.Seconds(), attribute.String("protocol", protocol), attribute.Bool("success", success))
+	if attempt.TimeToFirstByte > 0 {
+		m.retrievalAttemptTimeToFirstByte.Record(ctx, attempt.TimeToFirstByte.Seconds(), attribute.String("protocol", protocol))
 	}
+}
+
+// HandleUnknownEvent is called for each v1 event whose phase or event code
+// the recorder does not accept. Phases and event codes that do not look like
+// one, and any beyond the first hundred distinct ones, are counted as "other".
+func (m *Metrics) HandleUnknownEvent(ctx context.Context, phase types.Phase, code types.EventCode) {
+	m.unknownEventCount.Add(ctx, 1,
+		attribute.String("phase", m.unknownEventPhases.value(string(phase))),
+		attribute.String("event_name", m.unknownEventNames.value(string(code))))
+}
+
+// Instance is what the instance registry knows about the Lassie instance that
+// sent a batch of events.
+type Instance struct {
+	Registered    bool
+	Operator      string
+	Region        string
+	Environment   string
+	LassieVersion string
+}
+
+// HandleInstanceEvents is called with the number of events in each batch sent
+// by an instance, when the instance registry is enabled.
+func (m *Metrics) HandleInstanceEvents(ctx context.Context, instance Instance, count int) {
+	m.instanceEventCount.Add(ctx, int64(count),
+		attribute.Bool("registered", instance.Registered),
+		attribute.String("operator", instance.Operator),
+		attribute.String("region", instance.Region),
+		attribute.String("environment", instance.Environment),
+		attribute.String("lassie_version", instance.LassieVersion),
+	)
+}
+
+func (m *Metrics) HandleMongoReportsWritten(ctx context.Context, count int) {
+	m.mongoReportsWrittenCount.Add(ctx, int64(count))
+}
+
+func (m *Metrics) HandleMongoReportsFailed(ctx context.Context, count int) {
+	m.mongoReportsFailedCount.Add(ctx, int64(count))
+}
+
+func (m *Metrics) HandleMongoReportsDropped(ctx context.Context, count int) {
+	m.mongoReportsDroppedCount.Add(ctx, int64(count))
+}
+
+func (m *Metrics) HandleMongoRollupsWritten(ctx context.Context, count int) {
+	m.mongoRollupsWrittenCount.Add(ctx, int64(count))
+}
+
+func (m *Metrics) HandleMongoRollupsFailed(ctx context.Context, count int) {
+	m.mongoRollupsFailedCount.Add(ctx, int64(count))
+}
+
+func (m *Metrics) HandleMongoRollupsDropped(ctx context.Context, count int) {
+	m.mongoRollupsDroppedCount.Add(ctx, int64(count))
+}
 
-	for _, match := range errorMetricMatches {
+// errorCategories are the categories of retrieval errors, by a substring of
+// their message, in the order they are matched.
+var errorCategories = []struct {
+	substr   string
+	category string
+}{
+	{"response rejected", "rejected"},
+	{"Too many retrieval deals received", "too_many"},
+	{"Access Control", "acl"},
+	{"Under maintenance, retry later", "maintenance"},
+	{"miner is not accepting online retrieval deals", "no_online"},
+	{"unconfirmed block transfer", "unconfirmed"},
+	{"timeout after ", "timeout"},
+	{"retrieval timed out after ", "timeout"},
+	{"there is no unsealed piece containing payload cid", "no_unsealed"},
+	{"getting pieces for cid", "dagstore"},
+	{"graphsync request failed to complete: request failed - unknown reason", "graphsync"},
+	{"failed to dial", "failed_to_dial"},
+	{"HTTP request failed, remote response code: 404", "http_not_found"},
+	{"HTTP request failed, remote response code: 410", "http_gone"},
+	{"HTTP request failed, remote response code:", "http_failed"},
+	{"extraneous block in CAR", "http_extraneous_block"},
+	{"unexpected block in CAR", "http_unexpected_block"},
+	{"missing block in CAR", "http_missing_block"},
+	{"malformed CAR", "http_malformed_car"},
+	{"data transfer failed: datatransfer error: data transfer channel ", "datatransfer"},
+}
+
+// ErrorOther is the category of retrieval errors that match no other.
+const ErrorOther = "other"
+
+// ErrorCategory returns the category of a retrieval error message, or
+// ErrorOther if it is not recognized.
+func ErrorCategory(msg string) string {
+	for _, match := range errorCategories {
 		if strings.Contains(msg, match.substr) {
-			return match.metric, true
+			return match.category
 		}
 	}
+	return ErrorOther
+}
 
-	return nil, false
+func (m *Metrics) getMatchingErrorMetric(ctx context.Context, msg string) (instrument.Int64Counter, bool) {
+	errorMetrics := map[string]instrument.Int64Counter{
+		"rejected":              m.retrievalErrorRejectedCount,
+		"too_many":              m.retrievalErrorTooManyCount,
+		"acl":                   m.retrievalErrorACLCount,
+		"maintenance":           m.retrievalErrorMaintenanceCount,
+		"no_online":             m.retrievalErrorNoOnlineCount,
+		"unconfirmed":           m.retrievalErrorUnconfirmedCount,
+		"timeout":               m.retrievalErrorTimeoutCount,
+		"no_unsealed":           m.retrievalErrorNoUnsealedCount,
+		"dagstore":              m.retrievalErrorDAGStoreCount,
+		"graphsync":             m.retrievalErrorGraphsyncCount,
+		"failed_to_dial":        m.retrievalErrorFailedToDialCount,
+		"http_not_found":        m.retrievalErrorHTTPRemoteRequestNotFound,
+		"http_gone":             m.retrievalErrorHTTPRemoteRequestGone,
+		"http_failed":           m.retrievalErrorHTTPRemoteRequestFailed,
+		"http_extraneous_block": m.retrievalErrorHTTPExtraneousBlock,
+		"http_unexpected_block": m.retrievalErrorHTTPUnexpectedBlock,
+		"http_missing_block":    m.retrievalErrorHTTPMissingBlock,
+		"http_malformed_car":    m.retrievalErrorHTTPMalformedCar,
+		"datatransfer":          m.retrievalErrorDatatransferCount,
+	}
+	metric, ok := errorMetrics[ErrorCategory(msg)]
+	return metric, ok
 }
 
 func protocolFromSpID(storageProviderId string) string {
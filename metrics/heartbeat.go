@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+// InstanceStatus is the reporting status of an instance, as tracked by the
+// heartbeat monitor.
+type InstanceStatus struct {
+	InstanceID string
+	LastSeen   time.Time
+	EventRate  float64
+	Silent     bool
+}
+
+// instanceStatuses holds the latest status of every tracked instance.
+type instanceStatuses struct {
+	lk       sync.Mutex
+	statuses []InstanceStatus
+}
+
+// HandleInstanceStatuses is called with the status of every tracked instance
+// each time the heartbeat monitor checks them, replacing the previous ones.
+func (m *Metrics) HandleInstanceStatuses(_ context.Context, statuses []InstanceStatus) {
+	m.instanceStatuses.lk.Lock()
+	defer m.instanceStatuses.lk.Unlock()
+	m.instanceStatuses.statuses = statuses
+}
+
+func (s *instanceStatuses) observeLastSeen(_ context.Context, observer instrument.Float64Observer) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, status := range s.statuses {
+		observer.Observe(float64(status.LastSeen.UnixMilli())/1000, attribute.String("instance_id", status.InstanceID))
+	}
+	return nil
+}
+
+func (s *instanceStatuses) observeEventRate(_ context.Context, observer instrument.Float64Observer) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, status := range s.statuses {
+		observer.Observe(status.EventRate, attribute.String("instance_id", status.InstanceID))
+	}
+	return nil
+}
+
+func (s *instanceStatuses) observeSilent(_ context.Context, observer instrument.Int64Observer) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, status := range s.statuses {
+		var silent int64
+		if status.Silent {
+			silent = 1
+		}
+		observer.Observe(silent, attribute.String("instance_id", status.InstanceID))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"regexp"
+	"sync"
+)
+
+const (
+	// maxLabelValues is the number of distinct values of a label taken from
+	// client input that are reported as they are.
+	maxLabelValues = 100
+	// otherLabelValue is reported instead of values that do not look like an
+	// event code or phase, and of any beyond maxLabelValues.
+	otherLabelValue = "other"
+)
+
+var labelValuePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,63}$`)
+
+// boundedLabel bounds the values of a label taken from client input, so that
+// clients sending junk cannot create any number of metric series. The zero
+// value is ready to use.
+type boundedLabel struct {
+	lk     sync.Mutex
+	values map[string]struct{}
+}
+
+func (b *boundedLabel) value(v string) string {
+	if !labelValuePattern.MatchString(v) {
+		return otherLabelValue
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if _, ok := b.values[v]; ok {
+		return v
+	}
+	if len(b.values) >= maxLabelValues {
+		return otherLabelValue
+	}
+	if b.values == nil {
+		b.values = make(map[string]struct{})
+	}
+	b.values[v] = struct{}{}
+	return v
+}
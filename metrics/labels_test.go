@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoundedLabel(t *testing.T) {
+	var label boundedLabel
+	require.Equal(t, "candidates-found", label.value("candidates-found"))
+	for _, junk := range []string{"", "Started", "DROP TABLE", "é", strings.Repeat("a", 65)} {
+		require.Equal(t, otherLabelValue, label.value(junk), junk)
+	}
+	for i := 0; len(label.values) < maxLabelValues; i++ {
+		require.Equal(t, fmt.Sprintf("code-%d", i), label.value(fmt.Sprintf("code-%d", i)))
+	}
+	require.Equal(t, otherLabelValue, label.value("one-too-many"))
+	require.Equal(t, "candidates-found", label.value("candidates-found"))
+}
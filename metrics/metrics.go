@@ -15,12 +15,25 @@ var log = logging.Logger("metrics")
 
 type Metrics struct {
 	stats
-	tempDataMap *tempdata.TempDataMap
+	tempDataMap  *tempdata.TempDataMap
+	clockOffsets *clockOffsets
+	// instanceStatuses holds the statuses reported by the heartbeat monitor.
+	instanceStatuses *instanceStatuses
+	// providerQuantiles holds the quantiles reported by the recorder's
+	// provider digests.
+	providerQuantiles *providerQuantiles
+	// unknownEventPhases and unknownEventNames bound the labels of unknown
+	// events, which clients choose.
+	unknownEventPhases boundedLabel
+	unknownEventNames  boundedLabel
 }
 
 func New() *Metrics {
 	return &Metrics{
-		tempDataMap: tempdata.NewTempDataMap(),
+		tempDataMap:       tempdata.NewTempDataMap(),
+		clockOffsets:      &clockOffsets{offsets: make(map[string]clockOffset)},
+		instanceStatuses:  &instanceStatuses{},
+		providerQuantiles: &providerQuantiles{},
 	}
 }
 
@@ -91,6 +104,28 @@ func (m *Metrics) Start() error {
 					},
 				},
 			),
+			metric.NewView(
+				metric.Instrument{
+					Name:  meterName + "/retrieval_attempt_duration_seconds",
+					Scope: instrumentation.Scope{Name: meterName},
+				},
+				metric.Stream{
+					Aggregation: aggregation.ExplicitBucketHistogram{
+						Boundaries: []float64{0, 0.04, 0.2, 1, 5, 25, 125, 625},
+					},
+				},
+			),
+			metric.NewView(
+				metric.Instrument{
+					Name:  meterName + "/retrieval_attempt_time_to_first_byte",
+					Scope: instrumentation.Scope{Name: meterName},
+				},
+				metric.Stream{
+					Aggregation: aggregation.ExplicitBucketHistogram{
+						Boundaries: []float64{0, 0.01, 0.05, 0.25, 0.5, 1, 5, 25, 75},
+					},
+				},
+			),
 			metric.NewView(
 				metric.Instrument{
 					Name:  meterName + "/time_to_first_indexer_result",
@@ -235,6 +270,24 @@ func (m *Metrics) Start() error {
 		return err
 	}
 
+	if m.retrievalAttemptCount, err = meter.Int64Counter(meterName+"/retrieval_attempts_total",
+		instrument.WithDescription("The number of retrieval attempts of retrievals that report each attempt"),
+	); err != nil {
+		return err
+	}
+	if m.retrievalAttemptDuration, err = meter.Float64Histogram(meterName+"/retrieval_attempt_duration_seconds",
+		instrument.WithDescription("The duration in seconds of a retrieval attempt"),
+		instrument.WithUnit("seconds"),
+	); err != nil {
+		return err
+	}
+	if m.retrievalAttemptTimeToFirstByte, err = meter.Float64Histogram(meterName+"/retrieval_attempt_time_to_first_byte",
+		instrument.WithDescription("The time to first byte in seconds from the start of a retrieval attempt"),
+		instrument.WithUnit("seconds"),
+	); err != nil {
+		return err
+	}
+
 	if m.graphsyncRetrievalFailureCount, err = meter.Int64Counter(meterName+"/graphsync__retrieval_failure_total",
 		instrument.WithDescription("The graphsync requests that completed with a failure status"),
 	); err != nil {
@@ -352,6 +405,88 @@ func (m *Metrics) Start() error {
 	); err != nil {
 		return err
 	}
+	if m.unknownEventCount, err = meter.Int64Counter(meterName+"/unknown_events_total",
+		instrument.WithDescription("The number of events received with a phase or event code the recorder does not accept"),
+	); err != nil {
+		return err
+	}
+	if m.instanceEventCount, err = meter.Int64Counter(meterName+"/instance_events_total",
+		instrument.WithDescription("The number of events received, by the registered operator, region, environment and Lassie version of the sending instance"),
+	); err != nil {
+		return err
+	}
+	// reporting
+	if m.mongoReportsWrittenCount, err = meter.Int64Counter(meterName+"/mongo_reports_written_total",
+		instrument.WithDescription("The number of sampled retrieval reports written to mongo"),
+	); err != nil {
+		return err
+	}
+	if m.mongoReportsFailedCount, err = meter.Int64Counter(meterName+"/mongo_reports_failed_total",
+		instrument.WithDescription("The number of sampled retrieval reports that failed to be written to mongo"),
+	); err != nil {
+		return err
+	}
+	if m.mongoReportsDroppedCount, err = meter.Int64Counter(meterName+"/mongo_reports_dropped_total",
+		instrument.WithDescription("The number of sampled retrieval reports dropped because the mongo write queue was full"),
+	); err != nil {
+		return err
+	}
+	if m.mongoRollupsWrittenCount, err = meter.Int64Counter(meterName+"/mongo_rollups_written_total",
+		instrument.WithDescription("The number of daily rollup updates written to mongo"),
+	); err != nil {
+		return err
+	}
+	if m.mongoRollupsFailedCount, err = meter.Int64Counter(meterName+"/mongo_rollups_failed_total",
+		instrument.WithDescription("The number of daily rollup updates that failed to be written to mongo"),
+	); err != nil {
+		return err
+	}
+	if m.mongoRollupsDroppedCount, err = meter.Int64Counter(meterName+"/mongo_rollups_dropped_total",
+		instrument.WithDescription("The number of daily rollup updates dropped because the mongo write queue was full"),
+	); err != nil {
+		return err
+	}
+
+	if m.clockOffset, err = meter.Float64ObservableGauge(meterName+"/clock_offset_seconds",
+		instrument.WithDescription("The estimated clock offset of each Lassie instance, positive when its clock is ahead"),
+		instrument.WithUnit("seconds"),
+		instrument.WithFloat64Callback(m.clockOffsets.observe),
+	); err != nil {
+		return err
+	}
+	if m.instanceLastSeen, err = meter.Float64ObservableGauge(meterName+"/instance_last_seen_timestamp_seconds",
+		instrument.WithDescription("The Unix time at which each Lassie instance last reported events"),
+		instrument.WithUnit("seconds"),
+		instrument.WithFloat64Callback(m.instanceStatuses.observeLastSeen),
+	); err != nil {
+		return err
+	}
+	if m.instanceEventRate, err = meter.Float64ObservableGauge(meterName+"/instance_event_rate",
+		instrument.WithDescription("The recent average number of events per second reported by each Lassie instance"),
+		instrument.WithFloat64Callback(m.instanceStatuses.observeEventRate),
+	); err != nil {
+		return err
+	}
+	if m.instanceSilent, err = meter.Int64ObservableGauge(meterName+"/instance_silent",
+		instrument.WithDescription("Whether each Lassie instance has gone quiet for much longer than it usually does, 1 if so"),
+		instrument.WithInt64Callback(m.instanceStatuses.observeSilent),
+	); err != nil {
+		return err
+	}
+	if m.providerTimeToFirstByte, err = meter.Float64ObservableGauge(meterName+"/provider_time_to_first_byte_seconds",
+		instrument.WithDescription("Quantiles of the time to first byte of recent successful retrievals from the busiest storage providers"),
+		instrument.WithUnit("seconds"),
+		instrument.WithFloat64Callback(m.providerQuantiles.observeTimeToFirstByte),
+	); err != nil {
+		return err
+	}
+	if m.providerBandwidth, err = meter.Float64ObservableGauge(meterName+"/provider_bandwidth_bytes_per_second",
+		instrument.WithDescription("Quantiles of the bandwidth of recent successful retrievals from the busiest storage providers"),
+		instrument.WithFloat64Callback(m.providerQuantiles.observeBandwidth),
+	); err != nil {
+		return err
+	}
+
 	// averages
 	if m.indexerCandidatesPerRequestCount, err = meter.Int64Histogram(meterName+"/indexer_candidates_per_request_total",
 		instrument.WithDescription("The number of indexer candidates received per request"),
@@ -397,6 +532,11 @@ type stats struct {
 	bandwidthBytesPerSecond  instrument.Int64Histogram
 	retrievalDealSize        instrument.Int64Histogram
 
+	// attempts
+	retrievalAttemptCount           instrument.Int64Counter
+	retrievalAttemptDuration        instrument.Float64Histogram
+	retrievalAttemptTimeToFirstByte instrument.Float64Histogram
+
 	// error kinds
 	retrievalErrorRejectedCount             instrument.Int64Counter
 	retrievalErrorTooManyCount              instrument.Int64Counter
@@ -418,6 +558,22 @@ type stats struct {
 	retrievalErrorHTTPUnexpectedBlock       instrument.Int64Counter
 	retrievalErrorHTTPMissingBlock          instrument.Int64Counter
 	retrievalErrorHTTPMalformedCar          instrument.Int64Counter
+	unknownEventCount                       instrument.Int64Counter
+	instanceEventCount                      instrument.Int64Counter
+
+	// reporting
+	mongoReportsWrittenCount instrument.Int64Counter
+	mongoReportsFailedCount  instrument.Int64Counter
+	mongoReportsDroppedCount instrument.Int64Counter
+	mongoRollupsWrittenCount instrument.Int64Counter
+	mongoRollupsFailedCount  instrument.Int64Counter
+	mongoRollupsDroppedCount instrument.Int64Counter
+	clockOffset              instrument.Float64ObservableGauge
+	instanceLastSeen         instrument.Float64ObservableGauge
+	instanceEventRate        instrument.Float64ObservableGauge
+	instanceSilent           instrument.Int64ObservableGauge
+	providerTimeToFirstByte  instrument.Float64ObservableGauge
+	providerBandwidth        instrument.Float64ObservableGauge
 
 	// averages
 	indexerCandidatesPerRequestCount         instrument.Int64Histogram
@@ -0,0 +1,292 @@
+// Package migrations applies the versioned database schema used by the event
+// recorder.
+//
+// Migrations are embedded SQL files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, in a directory per database dialect. Applied
+// versions are tracked in the schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log/v2"
+)
+
+var logger = log.Logger("lassie/migrations")
+
+//go:embed postgres/*.sql sqlite/*.sql
+var migrationsFS embed.FS
+
+// Dialect is the kind of database migrations are applied to.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// schemaMigrationsTable is the statement creating the schema_migrations table
+// in each dialect.
+var schemaMigrationsTable = map[Dialect]string{
+	Postgres: `
+		create table if not exists schema_migrations(
+		  version bigint primary key,
+		  name text not null,
+		  applied_at timestamp with time zone not null default now()
+		)`,
+	SQLite: `
+		create table if not exists schema_migrations(
+		  version integer primary key,
+		  name text not null,
+		  applied_at timestamp not null default current_timestamp
+		)`,
+}
+
+// advisoryLockID is the postgres advisory lock held while migrating so that
+// multiple recorder replicas starting at once do not race each other.
+const advisoryLockID = 0x1a55_1e00
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// New returns a Migrator that applies the embedded postgres migrations to db.
+func New(db *sql.DB) (*Migrator, error) {
+	return NewForDialect(db, Postgres)
+}
+
+// NewForDialect returns a Migrator that applies the embedded migrations of the
+// given dialect to db.
+func NewForDialect(db *sql.DB, dialect Dialect) (*Migrator, error) {
+	if _, ok := schemaMigrationsTable[dialect]; !ok {
+		return nil, fmt.Errorf("unknown database dialect %q", dialect)
+	}
+	migrations, err := load(migrationsFS, string(dialect))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// Migrations returns all known migrations in version order.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, migrationName, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s must be named <version>_<name>.%s.sql", name, direction)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %s has an invalid version", name)
+		}
+		contents, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = mig
+		} else if mig.Name != migrationName {
+			return nil, fmt.Errorf("migration version %d has conflicting names %s and %s", version, mig.Name, migrationName)
+		}
+		if direction == "up" {
+			mig.Up = string(contents)
+		} else {
+			mig.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be contiguous starting at 1; missing version %d", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Up applies up to steps pending migrations in order, or all of them when
+// steps is zero. It returns the migrations that were applied.
+func (m *Migrator) Up(ctx context.Context, steps int) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if steps > 0 && len(applied) == steps {
+				break
+			}
+			if _, ok := versions[mig.Version]; ok {
+				continue
+			}
+			logger.Infow("Applying migration", "version", mig.Version, "name", mig.Name)
+			if err := inTx(ctx, conn, mig.Up, `insert into schema_migrations(version, name) values ($1, $2)`, mig.Version, mig.Name); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts up to steps applied migrations, newest first, or all of them
+// when steps is zero. It returns the migrations that were reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if steps > 0 && len(reverted) == steps {
+				break
+			}
+			if _, ok := versions[mig.Version]; !ok {
+				continue
+			}
+			logger.Infow("Reverting migration", "version", mig.Version, "name", mig.Name)
+			if err := inTx(ctx, conn, mig.Down, `delete from schema_migrations where version = $1`, mig.Version); err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status reports every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			appliedAt, applied := versions[mig.Version]
+			statuses = append(statuses, Status{Migration: mig, Applied: applied, AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// locked runs fn on a single connection, creating the schema_migrations table
+// first if needed. On postgres the migration advisory lock is held throughout;
+// SQLite databases are not shared between replicas.
+func (m *Migrator) locked(ctx context.Context, fn func(*sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if m.dialect == Postgres {
+		if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, advisoryLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, advisoryLockID); err != nil {
+				logger.Warnw("Failed to release migration lock", "err", err)
+			}
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, schemaMigrationsTable[m.dialect]); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// inTx runs a migration script and the statement recording it in a single
+// transaction.
+func inTx(ctx context.Context, conn *sql.Conn, script string, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
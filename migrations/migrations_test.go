@@ -0,0 +1,127 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for _, dialect := range []Dialect{Postgres, SQLite} {
+		t.Run(string(dialect), func(t *testing.T) {
+			m, err := NewForDialect(nil, dialect)
+			require.NoError(t, err)
+			require.NotEmpty(t, m.Migrations())
+			for i, mig := range m.Migrations() {
+				require.Equal(t, i+1, mig.Version)
+				require.NotEmpty(t, mig.Name)
+				require.NotEmpty(t, mig.Up)
+				require.NotEmpty(t, mig.Down)
+			}
+		})
+	}
+	_, err := NewForDialect(nil, "oracle")
+	require.Error(t, err)
+}
+
+// SQLite needs no external database, so its migrations are exercised here
+// rather than in the integration tests.
+func TestSQLiteMigrationsApplyCleanly(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "recorder.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	migrator, err := NewForDialect(db, SQLite)
+	require.NoError(t, err)
+
+	for _, mig := range migrator.Migrations() {
+		applied, err := migrator.Up(ctx, 1)
+		require.NoError(t, err, "migration %d_%s", mig.Version, mig.Name)
+		require.Len(t, applied, 1)
+	}
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		require.True(t, status.Applied, "migration %d_%s", status.Version, status.Name)
+		require.False(t, status.AppliedAt.IsZero())
+	}
+
+	reverted, err := migrator.Down(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, reverted, len(migrator.Migrations()))
+	applied, err := migrator.Up(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, applied, len(migrator.Migrations()))
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "ordered",
+			files: fstest.MapFS{
+				"m/0002_second.up.sql":   {Data: []byte("up2")},
+				"m/0002_second.down.sql": {Data: []byte("down2")},
+				"m/0001_first.up.sql":    {Data: []byte("up1")},
+				"m/0001_first.down.sql":  {Data: []byte("down1")},
+			},
+			want: []int{1, 2},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql": {Data: []byte("up1")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "gap",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql":   {Data: []byte("up1")},
+				"m/0001_first.down.sql": {Data: []byte("down1")},
+				"m/0003_third.up.sql":   {Data: []byte("up3")},
+				"m/0003_third.down.sql": {Data: []byte("down3")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "conflicting names",
+			files: fstest.MapFS{
+				"m/0001_first.up.sql":   {Data: []byte("up1")},
+				"m/0001_other.down.sql": {Data: []byte("down1")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "bad name",
+			files: fstest.MapFS{
+				"m/first.up.sql": {Data: []byte("up1")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := load(tt.files, "m")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var versions []int
+			for _, mig := range got {
+				versions = append(versions, mig.Version)
+			}
+			require.Equal(t, tt.want, versions)
+		})
+	}
+}
@@ -0,0 +1,3 @@
+drop table if exists retrieval_attempts;
+drop table if exists aggregate_retrieval_events;
+drop table if exists retrieval_events;
@@ -0,0 +1 @@
+drop index if exists retrieval_attempts_retrieval_id_idx;
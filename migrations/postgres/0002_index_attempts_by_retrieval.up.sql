@@ -0,0 +1,5 @@
+-- Attempts are looked up by their retrieval, both when reading a retrieval and
+-- when partition retention deletes the attempts of expired retrievals.
+-- Partitioning the event tables is not a migration: the recorder converts them
+-- when started with partitioning enabled.
+create index if not exists retrieval_attempts_retrieval_id_idx on retrieval_attempts (retrieval_id);
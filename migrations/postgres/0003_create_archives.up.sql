@@ -0,0 +1,10 @@
+-- Daily CAR archives of aggregate retrieval events, keyed by the UTC day of
+-- their start time.
+create table if not exists archives(
+  day date primary key,
+  root_cid character varying(256) not null,
+  path text not null,
+  event_count bigint not null,
+  size_bytes bigint not null,
+  created_at timestamp with time zone not null default now()
+);
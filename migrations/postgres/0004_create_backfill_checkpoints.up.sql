@@ -0,0 +1,7 @@
+-- Progress of resumable backfills, each of which has processed every event
+-- before its position.
+create table if not exists backfill_checkpoints(
+  name text primary key,
+  position timestamp with time zone not null,
+  updated_at timestamp with time zone not null default now()
+);
@@ -0,0 +1,6 @@
+alter table aggregate_retrieval_events
+  drop column if exists corrected_end_time,
+  drop column if exists corrected_start_time;
+alter table retrieval_events
+  drop column if exists corrected_event_time,
+  drop column if exists corrected_phase_start_time;
@@ -0,0 +1,9 @@
+-- Event times corrected for the estimated clock offset of the reporting
+-- instance, alongside the times as reported. Null when clock skew correction
+-- is disabled.
+alter table retrieval_events
+  add column if not exists corrected_phase_start_time timestamp with time zone,
+  add column if not exists corrected_event_time timestamp with time zone;
+alter table aggregate_retrieval_events
+  add column if not exists corrected_start_time timestamp with time zone,
+  add column if not exists corrected_end_time timestamp with time zone;
@@ -0,0 +1,6 @@
+alter table retrieval_attempts
+  drop column if exists endpoint,
+  drop column if exists blocks,
+  drop column if exists end_time,
+  drop column if exists start_time,
+  drop column if exists attempt_index;
@@ -0,0 +1,9 @@
+-- Attempts posted to /v3/retrieval-events are stored in order, with their
+-- timings, and a storage provider may have several. These columns are null
+-- for attempts posted to /v2/retrieval-events.
+alter table retrieval_attempts
+  add column if not exists attempt_index integer,
+  add column if not exists start_time timestamp with time zone,
+  add column if not exists end_time timestamp with time zone,
+  add column if not exists blocks bigint,
+  add column if not exists endpoint text;
@@ -0,0 +1,12 @@
+-- Registered Lassie instances and what is known about them. Events are joined
+-- to instances by instance_id.
+create table if not exists instances(
+  instance_id character varying(64) primary key,
+  operator text,
+  region text,
+  environment text,
+  lassie_version text,
+  active boolean not null default true,
+  created_at timestamp with time zone not null default now(),
+  updated_at timestamp with time zone not null default now()
+);
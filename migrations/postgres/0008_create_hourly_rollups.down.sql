@@ -0,0 +1,3 @@
+drop table if exists hourly_rollups;
+drop index if exists aggregate_retrieval_events_inserted_at_idx;
+alter table aggregate_retrieval_events drop column if exists inserted_at;
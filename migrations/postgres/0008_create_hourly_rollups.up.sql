@@ -0,0 +1,26 @@
+-- When each aggregate event was stored, so that hourly rollups can find the
+-- hours changed by events that arrive late.
+alter table aggregate_retrieval_events
+  add column if not exists inserted_at timestamp with time zone not null default now();
+create index if not exists aggregate_retrieval_events_inserted_at_idx on aggregate_retrieval_events (inserted_at);
+
+-- Aggregate events rolled up by the hour they started in. Time to first byte
+-- is counted in buckets by upper bound; retrievals without a first byte are
+-- not counted in any bucket.
+create table if not exists hourly_rollups(
+  hour timestamp with time zone not null,
+  instance_id character varying(64) not null,
+  filecoin_storage_provider_id character varying(16) not null,
+  protocol character varying(256) not null,
+  retrievals bigint not null,
+  successes bigint not null,
+  bytes_transferred bigint not null,
+  ttfb_under_100ms bigint not null,
+  ttfb_under_500ms bigint not null,
+  ttfb_under_1s bigint not null,
+  ttfb_under_5s bigint not null,
+  ttfb_under_30s bigint not null,
+  ttfb_over_30s bigint not null,
+  updated_at timestamp with time zone not null default now(),
+  primary key (hour, instance_id, filecoin_storage_provider_id, protocol)
+);
@@ -0,0 +1,20 @@
+-- Snapshots of the most retrieved and most failed CIDs of each period, as
+-- estimated by the hot content tracker. Counts may be overestimated.
+create table if not exists hot_content(
+  period_start timestamp with time zone not null,
+  period_end timestamp with time zone not null,
+  kind character varying(16) not null,
+  cid character varying(256) not null,
+  count bigint not null,
+  primary key (period_start, kind, cid)
+);
+
+-- The estimated number of distinct CIDs retrieved by each instance in each
+-- period.
+create table if not exists instance_unique_cids(
+  period_start timestamp with time zone not null,
+  period_end timestamp with time zone not null,
+  instance_id character varying(64) not null,
+  unique_cids bigint not null,
+  primary key (period_start, instance_id)
+);
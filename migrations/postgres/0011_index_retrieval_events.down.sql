@@ -0,0 +1,2 @@
+drop index if exists retrieval_events_retrieval_id_idx;
+drop index if exists retrieval_events_event_time_idx;
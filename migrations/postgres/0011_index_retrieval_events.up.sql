@@ -0,0 +1,4 @@
+-- Backfilling aggregate events reads v1 events in windows of event time, and
+-- looks up the events of the retrievals found in each window.
+create index if not exists retrieval_events_event_time_idx on retrieval_events (event_time);
+create index if not exists retrieval_events_retrieval_id_idx on retrieval_events (retrieval_id);
@@ -0,0 +1 @@
+alter table retrieval_attempts drop column if exists retrieval_start_time;
@@ -0,0 +1,6 @@
+-- The start time of an attempt's retrieval, by which attempts are partitioned
+-- along with their aggregate events, so that they are dropped together.
+-- Attempts stored before have a start time of -infinity, which adding the
+-- column sets without rewriting the table.
+alter table retrieval_attempts
+  add column if not exists retrieval_start_time timestamp with time zone not null default '-infinity';
@@ -0,0 +1,50 @@
+-- SQLite has no uuid, array or jsonb types: retrieval IDs are stored as text,
+-- protocol lists and event details as JSON text, and durations as nanoseconds.
+create table if not exists retrieval_events(
+  retrieval_id text not null,
+  instance_id text not null,
+  cid text not null,
+  storage_provider_id text,
+  phase text not null,
+  phase_start_time timestamp not null,
+  event_name text not null,
+  event_time timestamp not null,
+  event_details text
+);
+
+create index if not exists retrieval_events_event_time_idx on retrieval_events (event_time);
+
+create table if not exists aggregate_retrieval_events(
+  retrieval_id text not null unique,
+  root_cid text,
+  url_path text,
+  instance_id text not null,
+  storage_provider_id text,
+  filecoin_storage_provider_id text,
+  time_to_first_byte bigint,
+  bandwidth_bytes_sec bigint,
+  bytes_transferred bigint,
+  success boolean not null,
+  start_time timestamp not null,
+  end_time timestamp not null,
+  time_to_first_indexer_result bigint,
+  indexer_candidates_received integer,
+  indexer_candidates_filtered integer,
+  protocols_allowed text,
+  protocols_attempted text,
+  protocol_succeeded text
+);
+
+create index if not exists aggregate_retrieval_events_start_time_idx on aggregate_retrieval_events (start_time);
+
+create table if not exists retrieval_attempts(
+  retrieval_id text not null,
+  storage_provider_id text,
+  filecoin_storage_provider_id text,
+  time_to_first_byte bigint,
+  error text,
+  protocol text,
+  bytes_transferred bigint
+);
+
+create index if not exists retrieval_attempts_retrieval_id_idx on retrieval_attempts (retrieval_id);
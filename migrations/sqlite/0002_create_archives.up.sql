@@ -0,0 +1,10 @@
+-- Daily CAR archives of aggregate retrieval events, keyed by the UTC day of
+-- their start time in YYYY-MM-DD form.
+create table if not exists archives(
+  day text primary key,
+  root_cid text not null,
+  path text not null,
+  event_count bigint not null,
+  size_bytes bigint not null,
+  created_at timestamp not null default current_timestamp
+);
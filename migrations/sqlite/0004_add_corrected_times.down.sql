@@ -0,0 +1,4 @@
+alter table aggregate_retrieval_events drop column corrected_end_time;
+alter table aggregate_retrieval_events drop column corrected_start_time;
+alter table retrieval_events drop column corrected_event_time;
+alter table retrieval_events drop column corrected_phase_start_time;
@@ -0,0 +1,7 @@
+-- Event times corrected for the estimated clock offset of the reporting
+-- instance, alongside the times as reported. Null when clock skew correction
+-- is disabled.
+alter table retrieval_events add column corrected_phase_start_time timestamp;
+alter table retrieval_events add column corrected_event_time timestamp;
+alter table aggregate_retrieval_events add column corrected_start_time timestamp;
+alter table aggregate_retrieval_events add column corrected_end_time timestamp;
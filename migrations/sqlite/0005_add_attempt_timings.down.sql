@@ -0,0 +1,5 @@
+alter table retrieval_attempts drop column endpoint;
+alter table retrieval_attempts drop column blocks;
+alter table retrieval_attempts drop column end_time;
+alter table retrieval_attempts drop column start_time;
+alter table retrieval_attempts drop column attempt_index;
@@ -0,0 +1,8 @@
+-- Attempts posted to /v3/retrieval-events are stored in order, with their
+-- timings, and a storage provider may have several. These columns are null
+-- for attempts posted to /v2/retrieval-events.
+alter table retrieval_attempts add column attempt_index integer;
+alter table retrieval_attempts add column start_time timestamp;
+alter table retrieval_attempts add column end_time timestamp;
+alter table retrieval_attempts add column blocks bigint;
+alter table retrieval_attempts add column endpoint text;
@@ -0,0 +1,12 @@
+-- Registered Lassie instances and what is known about them. Events are joined
+-- to instances by instance_id.
+create table if not exists instances(
+  instance_id text primary key,
+  operator text,
+  region text,
+  environment text,
+  lassie_version text,
+  active boolean not null default true,
+  created_at timestamp not null default current_timestamp,
+  updated_at timestamp not null default current_timestamp
+);
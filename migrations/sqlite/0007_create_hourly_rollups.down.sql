@@ -0,0 +1,4 @@
+drop table if exists hourly_rollups;
+drop trigger if exists aggregate_retrieval_events_inserted_at;
+drop index if exists aggregate_retrieval_events_inserted_at_idx;
+alter table aggregate_retrieval_events drop column inserted_at;
@@ -0,0 +1,30 @@
+-- When each aggregate event was stored, so that hourly rollups can find the
+-- hours changed by events that arrive late. SQLite cannot add a column that
+-- defaults to the current time, so it is set by a trigger instead.
+alter table aggregate_retrieval_events add column inserted_at timestamp;
+create index if not exists aggregate_retrieval_events_inserted_at_idx on aggregate_retrieval_events (inserted_at);
+create trigger if not exists aggregate_retrieval_events_inserted_at after insert on aggregate_retrieval_events
+begin
+  update aggregate_retrieval_events set inserted_at = strftime('%Y-%m-%d %H:%M:%f', 'now') where rowid = new.rowid;
+end;
+
+-- Aggregate events rolled up by the hour they started in. Time to first byte
+-- is counted in buckets by upper bound; retrievals without a first byte are
+-- not counted in any bucket.
+create table if not exists hourly_rollups(
+  hour timestamp not null,
+  instance_id text not null,
+  filecoin_storage_provider_id text not null,
+  protocol text not null,
+  retrievals bigint not null,
+  successes bigint not null,
+  bytes_transferred bigint not null,
+  ttfb_under_100ms bigint not null,
+  ttfb_under_500ms bigint not null,
+  ttfb_under_1s bigint not null,
+  ttfb_under_5s bigint not null,
+  ttfb_under_30s bigint not null,
+  ttfb_over_30s bigint not null,
+  updated_at timestamp not null default current_timestamp,
+  primary key (hour, instance_id, filecoin_storage_provider_id, protocol)
+);
@@ -0,0 +1,2 @@
+drop table if exists instance_unique_cids;
+drop table if exists hot_content;
@@ -0,0 +1,7 @@
+-- The Lassie instances known to send aggregate events, whose v1 events are
+-- neither assembled into aggregate events nor counted as hot content, so that
+-- their retrievals are not recorded twice.
+create table if not exists aggregate_instances(
+  instance_id text primary key,
+  first_seen timestamp not null
+);
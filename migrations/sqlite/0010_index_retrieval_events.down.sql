@@ -0,0 +1 @@
+drop index if exists retrieval_events_retrieval_id_idx;
@@ -0,0 +1,3 @@
+-- Backfilling aggregate events looks up the v1 events of the retrievals found
+-- in each window of event time, which is already indexed.
+create index if not exists retrieval_events_retrieval_id_idx on retrieval_events (retrieval_id);
@@ -0,0 +1 @@
+alter table retrieval_attempts drop column retrieval_start_time;
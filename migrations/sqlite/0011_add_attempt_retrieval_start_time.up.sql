@@ -0,0 +1,3 @@
+-- The start time of an attempt's retrieval, by which postgres partitions
+-- attempts. It is null for attempts stored before.
+alter table retrieval_attempts add column retrieval_start_time timestamp;
@@ -0,0 +1,421 @@
+// Package replay re-ingests archived events through an event recorder, for
+// example to rebuild a database after a schema change or to load test a new
+// version of the recorder with real traffic.
+//
+// Events are read from JSON lines archives written by the filesink package,
+// CAR archives written by the cararchive package, or CSV dumps of the
+// retrieval_events table such as the partition archives written by the
+// recorder.
+package replay
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/cararchive"
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/filesink"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-log/v2"
+	"golang.org/x/time/rate"
+)
+
+var logger = log.Logger("lassie/replay")
+
+// Recorder is where replayed events are sent, usually an
+// eventrecorder.EventRecorder. Events are recorded as if they had been posted
+// to the recorder, or only stored when reporting is skipped.
+type Recorder interface {
+	RecordEvents(context.Context, []eventrecorder.Event) error
+	RecordAggregateEvents(context.Context, []eventrecorder.AggregateEvent) error
+	StoreEvents(context.Context, []eventrecorder.Event) error
+	StoreAggregateEvents(context.Context, []eventrecorder.AggregateEvent) error
+}
+
+type Config struct {
+	// From and To, if set, bound the replayed events to those whose event
+	// time, or start time for aggregate events, is within [From, To).
+	From time.Time
+	To   time.Time
+	// Rate is the maximum number of events replayed per second. Zero
+	// replays as fast as the recorder accepts them.
+	Rate float64
+	// BatchSize is the maximum number of events recorded at once. Defaults to
+	// 500.
+	BatchSize int
+	// DryRun only validates events and counts them, without recording them.
+	DryRun bool
+	// SkipReporting only stores events, without reporting them to metrics or
+	// rollups or forwarding them to sinks, so that events that were reported
+	// when first received, for example when rebuilding a database, are not
+	// counted twice. By default events are recorded as if they had been
+	// posted to the recorder, for example to load test it.
+	SkipReporting bool
+	// EventCodes, if set, are the phases and event codes accepted in v1
+	// events, which should match those the recorder is configured with.
+	// Defaults to those of Lassie v0.5.
+	EventCodes *eventrecorder.EventCodes
+}
+
+// Counts are the statistics of one kind of event.
+type Counts struct {
+	// Read is the number of events read from files.
+	Read int64
+	// Skipped is the number of events outside of the time range.
+	Skipped int64
+	// Invalid is the number of events that failed validation.
+	Invalid int64
+	// Recorded is the number of events recorded, or that would have been
+	// recorded in a dry run.
+	Recorded int64
+	// Failed is the number of events in batches the recorder failed to record.
+	Failed int64
+}
+
+type Stats struct {
+	Events          Counts
+	AggregateEvents Counts
+}
+
+// Replayer batches events read from files and records them.
+type Replayer struct {
+	recorder  Recorder
+	cfg       Config
+	limiter   *rate.Limiter
+	validator *eventrecorder.EventValidator
+
+	events          []eventrecorder.Event
+	aggregateEvents []eventrecorder.AggregateEvent
+	stats           Stats
+}
+
+// New returns a Replayer recording to recorder, which may be nil in a dry run.
+func New(recorder Recorder, cfg Config) (*Replayer, error) {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 500
+	}
+	switch {
+	case cfg.BatchSize < 0 || cfg.Rate < 0:
+		return nil, errors.New("replay limits cannot be negative")
+	case !cfg.From.IsZero() && !cfg.To.IsZero() && !cfg.From.Before(cfg.To):
+		return nil, errors.New("replay time range is empty")
+	case recorder == nil && !cfg.DryRun:
+		return nil, errors.New("a recorder is required unless replaying in dry run mode")
+	}
+	codes := eventrecorder.DefaultEventCodes()
+	if cfg.EventCodes != nil {
+		codes = *cfg.EventCodes
+	}
+	validator, err := eventrecorder.NewEventValidator(codes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event codes: %w", err)
+	}
+	r := &Replayer{recorder: recorder, cfg: cfg, validator: validator}
+	if cfg.Rate > 0 {
+		burst := cfg.BatchSize
+		if int(cfg.Rate) > burst {
+			burst = int(cfg.Rate)
+		}
+		r.limiter = rate.NewLimiter(rate.Limit(cfg.Rate), burst)
+	}
+	return r, nil
+}
+
+// ReplayFile replays every event in a file. Batches may be left pending until
+// the next call or Flush.
+func (r *Replayer) ReplayFile(ctx context.Context, path string) error {
+	return ReadFile(path, func(record filesink.Record) error {
+		switch {
+		case record.Event != nil:
+			return r.addEvent(ctx, *record.Event)
+		case record.AggregateEvent != nil:
+			return r.addAggregateEvent(ctx, *record.AggregateEvent)
+		}
+		return nil
+	})
+}
+
+func (r *Replayer) inRange(t time.Time) bool {
+	return (r.cfg.From.IsZero() || !t.Before(r.cfg.From)) && (r.cfg.To.IsZero() || t.Before(r.cfg.To))
+}
+
+func (r *Replayer) addEvent(ctx context.Context, event eventrecorder.Event) error {
+	r.stats.Events.Read++
+	if !r.inRange(event.EventTime) {
+		r.stats.Events.Skipped++
+		return nil
+	}
+	if err := r.validator.Validate(event); err != nil {
+		r.stats.Events.Invalid++
+		logger.Debugw("Skipped invalid event", "retrievalID", event.RetrievalId, "err", err)
+		return nil
+	}
+	r.events = append(r.events, event)
+	if len(r.events) >= r.cfg.BatchSize {
+		return r.flushEvents(ctx)
+	}
+	return nil
+}
+
+func (r *Replayer) addAggregateEvent(ctx context.Context, event eventrecorder.AggregateEvent) error {
+	r.stats.AggregateEvents.Read++
+	if !r.inRange(event.StartTime) {
+		r.stats.AggregateEvents.Skipped++
+		return nil
+	}
+	if err := event.Validate(); err != nil {
+		r.stats.AggregateEvents.Invalid++
+		logger.Debugw("Skipped invalid aggregate event", "retrievalID", event.RetrievalID, "err", err)
+		return nil
+	}
+	r.aggregateEvents = append(r.aggregateEvents, event)
+	if len(r.aggregateEvents) >= r.cfg.BatchSize {
+		return r.flushAggregateEvents(ctx)
+	}
+	return nil
+}
+
+func (r *Replayer) wait(ctx context.Context, n int) error {
+	if r.limiter == nil || r.cfg.DryRun {
+		return nil
+	}
+	return r.limiter.WaitN(ctx, n)
+}
+
+// flushEvents records the pending events. A batch the recorder fails to
+// record is counted and logged rather than stopping the replay; only context
+// errors are returned.
+func (r *Replayer) flushEvents(ctx context.Context) error {
+	if len(r.events) == 0 {
+		return nil
+	}
+	batch := r.events
+	r.events = nil
+	if err := r.wait(ctx, len(batch)); err != nil {
+		return err
+	}
+	if !r.cfg.DryRun {
+		record := r.recorder.RecordEvents
+		if r.cfg.SkipReporting {
+			record = r.recorder.StoreEvents
+		}
+		if err := record(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r.stats.Events.Failed += int64(len(batch))
+			logger.Errorw("Failed to replay events", "total", len(batch), "err", err)
+			return nil
+		}
+	}
+	r.stats.Events.Recorded += int64(len(batch))
+	return nil
+}
+
+func (r *Replayer) flushAggregateEvents(ctx context.Context) error {
+	if len(r.aggregateEvents) == 0 {
+		return nil
+	}
+	batch := r.aggregateEvents
+	r.aggregateEvents = nil
+	if err := r.wait(ctx, len(batch)); err != nil {
+		return err
+	}
+	if !r.cfg.DryRun {
+		record := r.recorder.RecordAggregateEvents
+		if r.cfg.SkipReporting {
+			record = r.recorder.StoreAggregateEvents
+		}
+		if err := record(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r.stats.AggregateEvents.Failed += int64(len(batch))
+			logger.Errorw("Failed to replay aggregate events", "total", len(batch), "err", err)
+			return nil
+		}
+	}
+	r.stats.AggregateEvents.Recorded += int64(len(batch))
+	return nil
+}
+
+// Flush records any pending events.
+func (r *Replayer) Flush(ctx context.Context) error {
+	if err := r.flushEvents(ctx); err != nil {
+		return err
+	}
+	return r.flushAggregateEvents(ctx)
+}
+
+func (r *Replayer) Stats() Stats {
+	return r.stats
+}
+
+// ReadFile calls fn with every record in a JSON lines archive (.jsonl), a
+// CAR archive (.car) or a CSV dump of retrieval_events (.csv), any of which
+// but CAR archives may be gzipped. Records read from CAR archives and CSV
+// dumps have no ReceivedAt time.
+func ReadFile(path string, fn func(filesink.Record) error) error {
+	name := strings.TrimSuffix(path, ".gz")
+	switch {
+	case strings.HasSuffix(name, ".jsonl"):
+		return filesink.ReadFile(path, fn)
+	case strings.HasSuffix(path, ".car"):
+		_, err := cararchive.ReadFile(path, func(event eventrecorder.AggregateEvent) error {
+			return fn(filesink.Record{AggregateEvent: &event})
+		})
+		return err
+	case strings.HasSuffix(name, ".csv"):
+		return readEventsCSV(path, func(event eventrecorder.Event) error {
+			return fn(filesink.Record{Event: &event})
+		})
+	default:
+		return fmt.Errorf("unknown archive format of %s", path)
+	}
+}
+
+// Files expands directories in paths to the archive files they contain that
+// can be replayed, in name order. Directories of partition archives also hold
+// dumps of aggregate_retrieval_events and of their attempts, which are
+// skipped: only CSV dumps of retrieval_events, whose names start with the
+// table name, are replayed.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var dirFiles []string
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), ".gz")
+			switch {
+			case entry.IsDir():
+				continue
+			case strings.HasSuffix(name, ".csv"):
+				if !strings.HasPrefix(name, "retrieval_events") || strings.HasSuffix(name, "_attempts.csv") {
+					logger.Infow("Skipped dump of another table than retrieval_events", "path", filepath.Join(path, entry.Name()))
+					continue
+				}
+			case !strings.HasSuffix(name, ".jsonl") && !strings.HasSuffix(entry.Name(), ".car"):
+				continue
+			}
+			dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// csvTimeLayouts are the timestamp formats of postgres and SQLite CSV output.
+var csvTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	time.RFC3339Nano,
+}
+
+func parseCSVTime(value string) (time.Time, error) {
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// readEventsCSV reads a CSV dump of retrieval_events with a header row.
+func readEventsCSV(path string, fn func(eventrecorder.Event) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var src io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	cr := csv.NewReader(src)
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header of %s: %w", path, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"retrieval_id", "instance_id", "cid", "storage_provider_id", "phase", "phase_start_time", "event_name", "event_time", "event_details"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("%s is not a dump of retrieval_events: missing column %s", path, name)
+		}
+	}
+
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		event, err := eventFromCSV(columns, row)
+		if err != nil {
+			return fmt.Errorf("failed to decode line %d of %s: %w", line, path, err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+func eventFromCSV(columns map[string]int, row []string) (eventrecorder.Event, error) {
+	value := func(name string) string { return row[columns[name]] }
+
+	var event eventrecorder.Event
+	if err := event.RetrievalId.UnmarshalText([]byte(value("retrieval_id"))); err != nil {
+		return event, err
+	}
+	var err error
+	event.InstanceId = value("instance_id")
+	event.Cid = value("cid")
+	event.StorageProviderId = value("storage_provider_id")
+	event.Phase = types.Phase(value("phase"))
+	event.EventName = types.EventCode(value("event_name"))
+	if event.PhaseStartTime, err = parseCSVTime(value("phase_start_time")); err != nil {
+		return event, err
+	}
+	if event.EventTime, err = parseCSVTime(value("event_time")); err != nil {
+		return event, err
+	}
+	if details := value("event_details"); details != "" {
+		if err := json.Unmarshal([]byte(details), &event.EventDetails); err != nil {
+			return event, fmt.Errorf("invalid event details: %w", err)
+		}
+	}
+	return event, nil
+}
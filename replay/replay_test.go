@@ -0,0 +1,270 @@
+package replay
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/filecoin-project/lassie-event-recorder/filesink"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	err             error
+	batches         int
+	events          []eventrecorder.Event
+	aggregateEvents []eventrecorder.AggregateEvent
+	// stored is the number of batches stored without being reported.
+	stored int
+}
+
+func (r *recorder) RecordEvents(_ context.Context, events []eventrecorder.Event) error {
+	r.batches++
+	if r.err != nil {
+		return r.err
+	}
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func (r *recorder) RecordAggregateEvents(_ context.Context, events []eventrecorder.AggregateEvent) error {
+	r.batches++
+	if r.err != nil {
+		return r.err
+	}
+	r.aggregateEvents = append(r.aggregateEvents, events...)
+	return nil
+}
+
+func (r *recorder) StoreEvents(ctx context.Context, events []eventrecorder.Event) error {
+	r.stored++
+	return r.RecordEvents(ctx, events)
+}
+
+func (r *recorder) StoreAggregateEvents(ctx context.Context, events []eventrecorder.AggregateEvent) error {
+	r.stored++
+	return r.RecordAggregateEvents(ctx, events)
+}
+
+const eventsCSV = `retrieval_id,instance_id,cid,storage_provider_id,phase,phase_start_time,event_name,event_time,event_details
+c8490080-b86f-4306-a657-a0b88ac43832,test-instance,bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4,,indexer,2023-05-01 12:00:00+00,started,2023-05-01 12:00:00.5+00,
+c8490080-b86f-4306-a657-a0b88ac43832,test-instance,bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4,,indexer,2023-05-01 12:00:00+00,candidates-found,2023-05-01 13:00:00.25+00,"{""candidateCount"":2}"
+c8490080-b86f-4306-a657-a0b88ac43832,test-instance,bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4,,indexer,2023-05-01 12:00:00+00,not-an-event,2023-05-01 14:00:00+00,
+`
+
+func writeCSV(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "retrieval_events_p20230501.csv.gz")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	zw := gzip.NewWriter(f)
+	_, err = zw.Write([]byte(eventsCSV))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+	return path
+}
+
+func writeJSONL(t *testing.T, dir string) string {
+	s, err := filesink.New(filesink.Config{Dir: dir})
+	require.NoError(t, err)
+	var events []eventrecorder.AggregateEvent
+	for i := 0; i < 3; i++ {
+		start := time.Date(2023, 5, 1, 12+i, 0, 0, 0, time.UTC)
+		events = append(events, eventrecorder.AggregateEvent{
+			InstanceID:  "test-instance",
+			RetrievalID: "c8490080-b86f-4306-a657-a0b88ac4383" + string(rune('0'+i)),
+			RootCid:     "bafybeic56z3yccnla3cutmvqsn5zy3g24muupcsjtoyp3pu5pm5amurjx4",
+			StartTime:   start,
+			EndTime:     start.Add(time.Second),
+		})
+	}
+	// An aggregate event that ends before it starts is invalid.
+	events[2].EndTime = events[2].StartTime.Add(-time.Second)
+	require.NoError(t, s.RecordAggregateEvents(context.Background(), events))
+	require.NoError(t, s.Close())
+	files, err := filesink.Files(dir, "events")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	return files[0]
+}
+
+func TestReadFile_CSV(t *testing.T) {
+	var events []eventrecorder.Event
+	require.NoError(t, ReadFile(writeCSV(t, t.TempDir()), func(r filesink.Record) error {
+		require.Nil(t, r.AggregateEvent)
+		events = append(events, *r.Event)
+		return nil
+	}))
+	require.Len(t, events, 3)
+	require.Equal(t, "c8490080-b86f-4306-a657-a0b88ac43832", events[0].RetrievalId.String())
+	require.Equal(t, types.IndexerPhase, events[0].Phase)
+	require.Equal(t, types.StartedCode, events[0].EventName)
+	require.Equal(t, time.Date(2023, 5, 1, 12, 0, 0, 500_000_000, time.UTC), events[0].EventTime.UTC())
+	require.Nil(t, events[0].EventDetails)
+	require.Equal(t, map[string]any{"candidateCount": float64(2)}, events[1].EventDetails)
+
+	bad := filepath.Join(t.TempDir(), "aggregate_retrieval_events.csv")
+	require.NoError(t, os.WriteFile(bad, []byte("retrieval_id,root_cid\n"), 0o644))
+	require.ErrorContains(t, ReadFile(bad, func(filesink.Record) error { return nil }), "missing column")
+	require.Error(t, ReadFile("events.txt", func(filesink.Record) error { return nil }))
+}
+
+func TestReplayer(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := writeCSV(t, dir)
+	jsonlPath := writeJSONL(t, dir)
+
+	tests := []struct {
+		name          string
+		cfg           Config
+		recorderErr   error
+		want          Stats
+		wantRecorded  int
+		wantAggregate int
+	}{
+		{
+			name: "all",
+			cfg:  Config{BatchSize: 1},
+			want: Stats{
+				Events:          Counts{Read: 3, Invalid: 1, Recorded: 2},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Recorded: 2},
+			},
+			wantRecorded:  2,
+			wantAggregate: 2,
+		},
+		{
+			name: "time range",
+			cfg:  Config{From: time.Date(2023, 5, 1, 13, 0, 0, 0, time.UTC), To: time.Date(2023, 5, 1, 14, 0, 0, 0, time.UTC)},
+			want: Stats{
+				Events:          Counts{Read: 3, Skipped: 2, Recorded: 1},
+				AggregateEvents: Counts{Read: 3, Skipped: 2, Recorded: 1},
+			},
+			wantRecorded:  1,
+			wantAggregate: 1,
+		},
+		{
+			name: "dry run",
+			cfg:  Config{DryRun: true},
+			want: Stats{
+				Events:          Counts{Read: 3, Invalid: 1, Recorded: 2},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Recorded: 2},
+			},
+		},
+		{
+			name: "event codes",
+			cfg: Config{EventCodes: &eventrecorder.EventCodes{
+				Phases:  []types.Phase{types.IndexerPhase},
+				Codes:   []types.EventCode{types.StartedCode, types.CandidatesFoundCode, "not-an-event"},
+				Unknown: eventrecorder.RejectUnknownEvents,
+			}},
+			want: Stats{
+				Events:          Counts{Read: 3, Recorded: 3},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Recorded: 2},
+			},
+			wantRecorded:  3,
+			wantAggregate: 2,
+		},
+		{
+			name: "skip reporting",
+			cfg:  Config{SkipReporting: true},
+			want: Stats{
+				Events:          Counts{Read: 3, Invalid: 1, Recorded: 2},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Recorded: 2},
+			},
+			wantRecorded:  2,
+			wantAggregate: 2,
+		},
+		{
+			name:        "recorder failure",
+			cfg:         Config{},
+			recorderErr: errors.New("boom"),
+			want: Stats{
+				Events:          Counts{Read: 3, Invalid: 1, Failed: 2},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Failed: 2},
+			},
+		},
+		{
+			name: "rate limited",
+			cfg:  Config{BatchSize: 1, Rate: 1000},
+			want: Stats{
+				Events:          Counts{Read: 3, Invalid: 1, Recorded: 2},
+				AggregateEvents: Counts{Read: 3, Invalid: 1, Recorded: 2},
+			},
+			wantRecorded:  2,
+			wantAggregate: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			rec := &recorder{err: tt.recorderErr}
+			r, err := New(rec, tt.cfg)
+			require.NoError(t, err)
+			require.NoError(t, r.ReplayFile(ctx, csvPath))
+			require.NoError(t, r.ReplayFile(ctx, jsonlPath))
+			require.NoError(t, r.Flush(ctx))
+			require.Equal(t, tt.want, r.Stats())
+			require.Len(t, rec.events, tt.wantRecorded)
+			require.Len(t, rec.aggregateEvents, tt.wantAggregate)
+			if tt.cfg.DryRun {
+				require.Zero(t, rec.batches)
+			}
+			// Events of both kinds are only stored when reporting is
+			// skipped, and recorded otherwise.
+			if tt.cfg.SkipReporting {
+				require.Equal(t, rec.batches, rec.stored)
+			} else {
+				require.Zero(t, rec.stored)
+			}
+		})
+	}
+
+	_, err := New(nil, Config{})
+	require.Error(t, err)
+	_, err = New(nil, Config{DryRun: true, From: time.Unix(10, 0), To: time.Unix(5, 0)})
+	require.Error(t, err)
+	_, err = New(nil, Config{DryRun: true, EventCodes: &eventrecorder.EventCodes{}})
+	require.ErrorContains(t, err, "invalid event codes")
+}
+
+func TestFiles_PartitionArchives(t *testing.T) {
+	dir := t.TempDir()
+	eventsPath := writeCSV(t, dir)
+	for name, header := range map[string]string{
+		"aggregate_retrieval_events_p20230501.csv.gz":          "retrieval_id,instance_id,storage_provider_id,time_to_first_byte,bandwidth_bytes_sec,bytes_transferred,success,start_time,end_time\n",
+		"aggregate_retrieval_events_p20230501_attempts.csv.gz": "retrieval_id,storage_provider_id,time_to_first_byte,error,protocol\n",
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		zw := gzip.NewWriter(f)
+		_, err = zw.Write([]byte(header))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		require.NoError(t, f.Close())
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "old"), 0o755))
+
+	files, err := Files([]string{dir})
+	require.NoError(t, err)
+	require.Equal(t, []string{eventsPath}, files)
+
+	r, err := New(nil, Config{DryRun: true})
+	require.NoError(t, err)
+	for _, path := range files {
+		require.NoError(t, r.ReplayFile(context.Background(), path))
+	}
+	require.NoError(t, r.Flush(context.Background()))
+	require.Equal(t, Counts{Read: 3, Invalid: 1, Recorded: 2}, r.Stats().Events)
+
+	// Files named explicitly are replayed whatever their name.
+	files, err = Files([]string{filepath.Join(dir, "notes.txt")})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
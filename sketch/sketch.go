@@ -0,0 +1,163 @@
+// Package sketch implements a mergeable quantile sketch with relative error
+// guarantees.
+//
+// Values are counted in logarithmically sized bins, so that any quantile is
+// estimated within a fixed relative error of the true value, and two sketches
+// with the same accuracy merge by adding their bin counts. Because bins are
+// identified by an integer index, sketches can also be accumulated by stores
+// that support atomic increments, one counter per bin.
+package sketch
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Sketch estimates quantiles of non-negative values. The zero value is not
+// usable; create sketches with New.
+type Sketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+
+	bins  map[int]uint64
+	zero  uint64
+	count uint64
+}
+
+// New returns an empty sketch whose quantile estimates are within
+// relativeAccuracy of the true value, which must be in (0, 1).
+func New(relativeAccuracy float64) (*Sketch, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, errors.New("relative accuracy must be within (0, 1)")
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &Sketch{
+		accuracy: relativeAccuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		bins:     make(map[int]uint64),
+	}, nil
+}
+
+// FromBins rebuilds a sketch from the counts returned by Bins of a sketch
+// with the same relative accuracy.
+func FromBins(relativeAccuracy float64, zero uint64, bins map[int]uint64) (*Sketch, error) {
+	s, err := New(relativeAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	s.zero = zero
+	s.count = zero
+	for index, n := range bins {
+		if n == 0 {
+			continue
+		}
+		s.bins[index] = n
+		s.count += n
+	}
+	return s, nil
+}
+
+// RelativeAccuracy returns the relative accuracy the sketch was created with.
+func (s *Sketch) RelativeAccuracy() float64 {
+	return s.accuracy
+}
+
+// Index returns the index of the bin counting v. Values less than or equal to
+// zero are counted separately and have no bin.
+func (s *Sketch) Index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the estimate for every value counted in the bin at index.
+func (s *Sketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// Add counts v once. Negative values are counted as zero.
+func (s *Sketch) Add(v float64) {
+	s.AddCount(v, 1)
+}
+
+// AddCount counts v n times. Negative values are counted as zero.
+func (s *Sketch) AddCount(v float64, n uint64) {
+	if n == 0 || math.IsNaN(v) {
+		return
+	}
+	if v <= 0 {
+		s.zero += n
+	} else {
+		s.bins[s.Index(v)] += n
+	}
+	s.count += n
+}
+
+// Merge adds the counts of other to s. Both sketches must have the same
+// relative accuracy.
+func (s *Sketch) Merge(other *Sketch) error {
+	if other.accuracy != s.accuracy {
+		return errors.New("cannot merge sketches with different relative accuracy")
+	}
+	for index, n := range other.bins {
+		s.bins[index] += n
+	}
+	s.zero += other.zero
+	s.count += other.count
+	return nil
+}
+
+// Count returns the number of values counted.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Bins returns the number of values counted as zero and the non-empty bins
+// keyed by their index. The returned map must not be modified.
+func (s *Sketch) Bins() (zero uint64, bins map[int]uint64) {
+	return s.zero, s.bins
+}
+
+// Quantile returns an estimate of the q-quantile, for q in [0, 1]. It returns
+// zero if the sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	q = math.Max(0, math.Min(1, q))
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zero {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.bins))
+	for index := range s.bins {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	seen := s.zero
+	for _, index := range indexes {
+		seen += s.bins[index]
+		if seen > rank {
+			return s.value(index)
+		}
+	}
+	return s.value(indexes[len(indexes)-1])
+}
+
+// Clone returns an independent copy of s.
+func (s *Sketch) Clone() *Sketch {
+	c := *s
+	c.bins = make(map[int]uint64, len(s.bins))
+	for index, n := range s.bins {
+		c.bins[index] = n
+	}
+	return &c
+}
+
+// Reset removes all counted values.
+func (s *Sketch) Reset() {
+	s.bins = make(map[int]uint64)
+	s.zero = 0
+	s.count = 0
+}
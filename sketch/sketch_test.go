@@ -0,0 +1,87 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketch_Quantile(t *testing.T) {
+	const accuracy = 0.01
+	s, err := New(accuracy)
+	require.NoError(t, err)
+	require.Equal(t, float64(0), s.Quantile(0.5))
+
+	rng := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	for i := range values {
+		values[i] = math.Exp(rng.Float64() * 10)
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+	require.Equal(t, uint64(len(values)), s.Count())
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		want := values[int(q*float64(len(values)-1))]
+		require.InEpsilon(t, want, s.Quantile(q), accuracy, "quantile %v", q)
+	}
+}
+
+func TestSketch_Zero(t *testing.T) {
+	s, err := New(0.01)
+	require.NoError(t, err)
+	s.AddCount(0, 3)
+	s.Add(-1)
+	s.Add(100)
+	require.Equal(t, uint64(5), s.Count())
+	require.Equal(t, float64(0), s.Quantile(0.5))
+	require.InEpsilon(t, 100, s.Quantile(1), 0.01)
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, err := New(0.02)
+	require.NoError(t, err)
+	b, err := New(0.02)
+	require.NoError(t, err)
+	all, err := New(0.02)
+	require.NoError(t, err)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+		all.Add(v)
+	}
+	require.NoError(t, a.Merge(b))
+	require.Equal(t, all.Count(), a.Count())
+	for _, q := range []float64{0.25, 0.5, 0.75, 0.95} {
+		require.Equal(t, all.Quantile(q), a.Quantile(q))
+	}
+
+	other, err := New(0.01)
+	require.NoError(t, err)
+	require.Error(t, a.Merge(other))
+}
+
+func TestFromBins(t *testing.T) {
+	s, err := New(0.01)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		s.Add(float64(i))
+	}
+	zero, bins := s.Bins()
+	rebuilt, err := FromBins(0.01, zero, bins)
+	require.NoError(t, err)
+	require.Equal(t, s.Count(), rebuilt.Count())
+	require.Equal(t, s.Quantile(0.9), rebuilt.Quantile(0.9))
+
+	clone := s.Clone()
+	s.Reset()
+	require.Equal(t, uint64(0), s.Count())
+	require.Equal(t, rebuilt.Quantile(0.9), clone.Quantile(0.9))
+}
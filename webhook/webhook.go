@@ -0,0 +1,459 @@
+// Package webhook forwards aggregate retrieval events accepted by the recorder
+// to HTTP endpoints.
+//
+// Each endpoint receives POST requests whose body has the same shape as the
+// recorder's /v2/retrieval-events payload. Events are batched, filtered per
+// endpoint, retried on failure and, if the endpoint has a secret, signed with
+// HMAC-SHA256 so that receivers can authenticate them with Verify.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/ipfs/go-log/v2"
+)
+
+var logger = log.Logger("lassie/webhook")
+
+const (
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the timestamp, a
+	// dot, and the request body, prefixed with "sha256=".
+	SignatureHeader = "X-Lassie-Signature"
+	// TimestampHeader holds the Unix time in seconds at which the request was
+	// signed.
+	TimestampHeader = "X-Lassie-Timestamp"
+)
+
+var _ eventrecorder.Sink = (*Sink)(nil)
+
+// Duration is a time.Duration that is encoded in JSON as a string such as
+// "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Filter selects the events sent to an endpoint. An empty filter selects
+// every event.
+type Filter struct {
+	// OnlyFailures selects failed retrievals only.
+	OnlyFailures bool `json:"onlyFailures,omitempty"`
+	// Instances, if set, selects retrievals recorded by these Lassie
+	// instances only.
+	Instances []string `json:"instances,omitempty"`
+	// StorageProviders, if set, selects retrievals that were served by or
+	// attempted against these storage providers only, by peer ID or, if the
+	// sink resolves them, by Filecoin SP ID such as f01234.
+	StorageProviders []string `json:"storageProviders,omitempty"`
+}
+
+// Match reports whether an event is selected by the filter. filecoinSPIDs
+// maps storage provider peer IDs to their Filecoin SP IDs, and may be nil to
+// match peer IDs only.
+func (f Filter) Match(event eventrecorder.AggregateEvent, filecoinSPIDs map[string]string) bool {
+	if f.OnlyFailures && event.Success {
+		return false
+	}
+	if len(f.Instances) > 0 && !contains(f.Instances, event.InstanceID) {
+		return false
+	}
+	if len(f.StorageProviders) > 0 {
+		if f.matchStorageProvider(event.StorageProviderID, filecoinSPIDs) {
+			return true
+		}
+		for storageProviderID := range event.RetrievalAttempts {
+			if f.matchStorageProvider(storageProviderID, filecoinSPIDs) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (f Filter) matchStorageProvider(storageProviderID string, filecoinSPIDs map[string]string) bool {
+	if contains(f.StorageProviders, storageProviderID) {
+		return true
+	}
+	filSPID := filecoinSPIDs[storageProviderID]
+	return filSPID != "" && contains(f.StorageProviders, filSPID)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type Endpoint struct {
+	// URL receives the POST requests.
+	URL string `json:"url"`
+	// Secret, if set, is the key used to sign requests.
+	Secret string `json:"secret,omitempty"`
+	Filter Filter `json:"filter,omitempty"`
+	// BatchSize is the maximum number of events sent in one request.
+	BatchSize int `json:"batchSize,omitempty"`
+	// FlushInterval is the longest an event waits before being sent.
+	FlushInterval Duration `json:"flushInterval,omitempty"`
+	// QueueSize is the maximum number of events waiting to be sent. Events
+	// are dropped while the queue is full.
+	QueueSize int `json:"queueSize,omitempty"`
+	// Timeout bounds each request.
+	Timeout Duration `json:"timeout,omitempty"`
+	// MaxRetries is the number of times a failed request is retried before
+	// its events are dropped. Defaults to 5 if unset; zero disables retries.
+	MaxRetries *int `json:"maxRetries,omitempty"`
+	// RetryBackoff is the wait before the first retry; it doubles with every
+	// further retry up to one minute.
+	RetryBackoff Duration `json:"retryBackoff,omitempty"`
+}
+
+func (e *Endpoint) applyDefaults() {
+	if e.BatchSize == 0 {
+		e.BatchSize = 100
+	}
+	if e.FlushInterval == 0 {
+		e.FlushInterval = Duration(time.Second)
+	}
+	if e.QueueSize == 0 {
+		e.QueueSize = 10_000
+	}
+	if e.Timeout == 0 {
+		e.Timeout = Duration(10 * time.Second)
+	}
+	if e.MaxRetries == nil {
+		maxRetries := 5
+		e.MaxRetries = &maxRetries
+	}
+	if e.RetryBackoff == 0 {
+		e.RetryBackoff = Duration(time.Second)
+	}
+}
+
+func (e Endpoint) validate() error {
+	u, err := url.Parse(e.URL)
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid webhook URL %q: %w", e.URL, err)
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("webhook URL %q must be http or https", e.URL)
+	case e.BatchSize < 0 || e.FlushInterval < 0 || e.QueueSize < 0 || e.Timeout < 0 || *e.MaxRetries < 0 || e.RetryBackoff < 0:
+		return fmt.Errorf("webhook %s limits cannot be negative", e.URL)
+	}
+	return nil
+}
+
+type Config struct {
+	Endpoints []Endpoint `json:"endpoints"`
+	// Client sends the requests. Defaults to http.DefaultClient.
+	Client *http.Client `json:"-"`
+	// ResolveStorageProviders, if set, maps storage provider peer IDs to
+	// their Filecoin SP IDs, so that filters can select storage providers by
+	// either, as EventRecorder.FilecoinSPIDs does. Filters match peer IDs
+	// only if unset.
+	ResolveStorageProviders func(context.Context, []string) (map[string]string, error) `json:"-"`
+}
+
+// LoadConfig reads a Config from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to decode webhook config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Sink forwards aggregate events to webhook endpoints.
+type Sink struct {
+	endpoints []*endpoint
+	resolve   func(context.Context, []string) (map[string]string, error)
+	// resolves is set when any filter selects storage providers, the only
+	// case in which their Filecoin SP IDs are needed.
+	resolves bool
+}
+
+func New(cfg Config) (*Sink, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("at least one webhook endpoint must be configured")
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := Sink{resolve: cfg.ResolveStorageProviders}
+	for _, e := range cfg.Endpoints {
+		e.applyDefaults()
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		s.endpoints = append(s.endpoints, newEndpoint(e, client))
+		s.resolves = s.resolves || (s.resolve != nil && len(e.Filter.StorageProviders) > 0)
+	}
+	return &s, nil
+}
+
+// RecordEvents does nothing; only aggregate events are forwarded.
+func (s *Sink) RecordEvents(context.Context, []eventrecorder.Event) error {
+	return nil
+}
+
+// RecordAggregateEvents queues the events selected by each endpoint's filter.
+// It never blocks on delivery.
+func (s *Sink) RecordAggregateEvents(ctx context.Context, events []eventrecorder.AggregateEvent) error {
+	filecoinSPIDs := s.filecoinSPIDs(ctx, events)
+	for _, e := range s.endpoints {
+		for _, event := range events {
+			if e.cfg.Filter.Match(event, filecoinSPIDs) {
+				e.enqueue(event)
+			}
+		}
+	}
+	return nil
+}
+
+// filecoinSPIDs resolves the storage providers of events if any filter needs
+// them. Filters match peer IDs only if resolution fails.
+func (s *Sink) filecoinSPIDs(ctx context.Context, events []eventrecorder.AggregateEvent) map[string]string {
+	if !s.resolves {
+		return nil
+	}
+	var storageProviderIDs []string
+	for _, event := range events {
+		storageProviderIDs = append(storageProviderIDs, event.StorageProviderID)
+		for storageProviderID := range event.RetrievalAttempts {
+			storageProviderIDs = append(storageProviderIDs, storageProviderID)
+		}
+	}
+	filecoinSPIDs, err := s.resolve(ctx, storageProviderIDs)
+	if err != nil {
+		logger.Warnw("Failed to resolve storage providers; filtering by peer ID only", "total", len(events), "err", err)
+		return nil
+	}
+	return filecoinSPIDs
+}
+
+// Close sends any queued events and stops delivery.
+func (s *Sink) Close() error {
+	for _, e := range s.endpoints {
+		e.close()
+	}
+	return nil
+}
+
+// endpoint batches and delivers events to a single URL.
+type endpoint struct {
+	cfg    Endpoint
+	client *http.Client
+
+	queue chan eventrecorder.AggregateEvent
+	// dropped counts the events dropped since last logged, so that a backed
+	// up endpoint is logged once per dropLogInterval rather than once per
+	// event.
+	dropped atomic.Int64
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// dropLogInterval is how often events dropped by an endpoint are logged.
+const dropLogInterval = time.Minute
+
+func newEndpoint(cfg Endpoint, client *http.Client) *endpoint {
+	e := &endpoint{
+		cfg:     cfg,
+		client:  client,
+		queue:   make(chan eventrecorder.AggregateEvent, cfg.QueueSize),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *endpoint) enqueue(event eventrecorder.AggregateEvent) {
+	select {
+	case <-e.closing:
+	default:
+		select {
+		case e.queue <- event:
+			return
+		default:
+		}
+	}
+	e.dropped.Add(1)
+}
+
+// logDropped logs the events dropped since last logged, if any.
+func (e *endpoint) logDropped() {
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		logger.Warnw("Dropped webhook events while the endpoint is backed up", "url", e.cfg.URL, "total", dropped)
+	}
+}
+
+func (e *endpoint) run() {
+	defer close(e.closed)
+
+	ticker := time.NewTicker(time.Duration(e.cfg.FlushInterval))
+	defer ticker.Stop()
+	dropTicker := time.NewTicker(dropLogInterval)
+	defer dropTicker.Stop()
+	batch := make([]eventrecorder.AggregateEvent, 0, e.cfg.BatchSize)
+	for {
+		select {
+		case event := <-e.queue:
+			batch = append(batch, event)
+			if len(batch) >= e.cfg.BatchSize {
+				e.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-dropTicker.C:
+			e.logDropped()
+		case <-e.closing:
+			for {
+				select {
+				case event := <-e.queue:
+					batch = append(batch, event)
+					if len(batch) >= e.cfg.BatchSize {
+						e.deliver(batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						e.deliver(batch)
+					}
+					e.logDropped()
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends a batch, retrying with exponential backoff. While closing,
+// failed batches are not retried so that shutdown is not held up.
+func (e *endpoint) deliver(batch []eventrecorder.AggregateEvent) {
+	body, err := json.Marshal(eventrecorder.AggregateEventBatch{Events: batch})
+	if err != nil {
+		logger.Errorw("Failed to encode webhook batch", "url", e.cfg.URL, "err", err)
+		return
+	}
+
+	backoff := time.Duration(e.cfg.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		retry, err := e.post(body)
+		if err == nil {
+			logger.Debugw("Delivered webhook batch", "url", e.cfg.URL, "total", len(batch))
+			return
+		}
+		if !retry || attempt >= *e.cfg.MaxRetries {
+			logger.Errorw("Failed to deliver webhook batch", "url", e.cfg.URL, "total", len(batch), "attempts", attempt+1, "err", err)
+			return
+		}
+		logger.Warnw("Retrying webhook batch", "url", e.cfg.URL, "total", len(batch), "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-e.closing:
+			logger.Errorw("Abandoned webhook batch on shutdown", "url", e.cfg.URL, "total", len(batch), "err", err)
+			return
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// post sends a single request, reporting whether a failure may succeed if
+// retried.
+func (e *endpoint) post(body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.cfg.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.cfg.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(e.cfg.Secret, timestamp, body))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded with %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+}
+
+func (e *endpoint) close() {
+	close(e.closing)
+	<-e.closed
+}
+
+// Sign returns the signature header value for a request body sent at the
+// given Unix timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request body in constant time. Receivers
+// should also reject timestamps too far from the current time to prevent
+// replays.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie-event-recorder/eventrecorder"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver records the batches posted to it, responding with the queued
+// status codes before succeeding.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	lk       sync.Mutex
+	statuses []int
+	requests int
+	batches  [][]eventrecorder.AggregateEvent
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(rc.t, err)
+	if rc.secret != "" {
+		require.True(rc.t, Verify(rc.secret, r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)))
+	}
+
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	rc.requests++
+	if len(rc.statuses) > 0 {
+		status := rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var batch eventrecorder.AggregateEventBatch
+	require.NoError(rc.t, json.Unmarshal(body, &batch))
+	rc.batches = append(rc.batches, batch.Events)
+}
+
+func (rc *receiver) retrievalIDs() [][]string {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	var ids [][]string
+	for _, batch := range rc.batches {
+		var batchIDs []string
+		for _, event := range batch {
+			batchIDs = append(batchIDs, event.RetrievalID)
+		}
+		ids = append(ids, batchIDs)
+	}
+	return ids
+}
+
+func events(ids ...string) []eventrecorder.AggregateEvent {
+	var events []eventrecorder.AggregateEvent
+	for _, id := range ids {
+		events = append(events, eventrecorder.AggregateEvent{RetrievalID: id, InstanceID: "test-instance", Success: true})
+	}
+	return events
+}
+
+func TestSink_BatchesAndSigns(t *testing.T) {
+	rc := &receiver{t: t, secret: "s3cret"}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	s, err := New(Config{Endpoints: []Endpoint{{
+		URL:           ts.URL,
+		Secret:        "s3cret",
+		BatchSize:     2,
+		FlushInterval: Duration(time.Hour),
+	}}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.RecordAggregateEvents(context.Background(), events("a", "b", "c")))
+	require.Eventually(t, func() bool { return len(rc.retrievalIDs()) == 1 }, time.Second, 10*time.Millisecond)
+	// The remainder is sent on close.
+	require.NoError(t, s.Close())
+	require.Equal(t, [][]string{{"a", "b"}, {"c"}}, rc.retrievalIDs())
+}
+
+func TestSink_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		statuses     []int
+		wantRequests int
+		wantBatches  int
+	}{
+		{name: "server error", maxRetries: 2, statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}, wantRequests: 3, wantBatches: 1},
+		{name: "rate limited", maxRetries: 2, statuses: []int{http.StatusTooManyRequests}, wantRequests: 2, wantBatches: 1},
+		{name: "gives up", maxRetries: 2, statuses: []int{500, 500, 500, 500}, wantRequests: 3, wantBatches: 0},
+		{name: "client error", maxRetries: 2, statuses: []int{http.StatusBadRequest}, wantRequests: 1, wantBatches: 0},
+		{name: "no retries", maxRetries: 0, statuses: []int{http.StatusInternalServerError}, wantRequests: 1, wantBatches: 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{t: t, statuses: tt.statuses}
+			ts := httptest.NewServer(rc)
+			defer ts.Close()
+
+			s, err := New(Config{Endpoints: []Endpoint{{
+				URL:           ts.URL,
+				FlushInterval: Duration(time.Millisecond),
+				MaxRetries:    &tt.maxRetries,
+				RetryBackoff:  Duration(time.Millisecond),
+			}}})
+			require.NoError(t, err)
+			require.NoError(t, s.RecordAggregateEvents(context.Background(), events("a")))
+			require.Eventually(t, func() bool {
+				rc.lk.Lock()
+				defer rc.lk.Unlock()
+				return rc.requests == tt.wantRequests
+			}, time.Second, time.Millisecond)
+			// Let any unexpected retries happen before checking.
+			time.Sleep(20 * time.Millisecond)
+			require.NoError(t, s.Close())
+			require.Equal(t, tt.wantRequests, rc.requests)
+			require.Len(t, rc.batches, tt.wantBatches)
+		})
+	}
+}
+
+func TestSink_FiltersByFilecoinSPID(t *testing.T) {
+	rc := &receiver{t: t}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	s, err := New(Config{
+		Endpoints: []Endpoint{{
+			URL:           ts.URL,
+			FlushInterval: Duration(time.Hour),
+			Filter:        Filter{StorageProviders: []string{"f01234"}},
+		}},
+		ResolveStorageProviders: func(_ context.Context, ids []string) (map[string]string, error) {
+			filecoinSPIDs := make(map[string]string)
+			for _, id := range ids {
+				if id == "peer-a" {
+					filecoinSPIDs[id] = "f01234"
+				}
+			}
+			return filecoinSPIDs, nil
+		},
+	})
+	require.NoError(t, err)
+	served := events("a", "b")
+	served[0].StorageProviderID = "peer-a"
+	served[1].StorageProviderID = "peer-b"
+	require.NoError(t, s.RecordAggregateEvents(context.Background(), served))
+	require.NoError(t, s.Close())
+	require.Equal(t, [][]string{{"a"}}, rc.retrievalIDs())
+}
+
+func TestFilter_Match(t *testing.T) {
+	event := eventrecorder.AggregateEvent{
+		InstanceID:        "instance-a",
+		StorageProviderID: "peer-a",
+		Success:           true,
+		RetrievalAttempts: map[string]*eventrecorder.RetrievalAttempt{"peer-a": {}, "peer-b": {Error: "boom"}},
+	}
+	failure := event
+	failure.Success = false
+	failure.StorageProviderID = ""
+
+	tests := []struct {
+		name   string
+		filter Filter
+		event  eventrecorder.AggregateEvent
+		want   bool
+	}{
+		{name: "empty", event: event, want: true},
+		{name: "only failures with success", filter: Filter{OnlyFailures: true}, event: event, want: false},
+		{name: "only failures with failure", filter: Filter{OnlyFailures: true}, event: failure, want: true},
+		{name: "instance match", filter: Filter{Instances: []string{"instance-a"}}, event: event, want: true},
+		{name: "instance mismatch", filter: Filter{Instances: []string{"instance-b"}}, event: event, want: false},
+		{name: "serving provider", filter: Filter{StorageProviders: []string{"peer-a"}}, event: event, want: true},
+		{name: "attempted provider", filter: Filter{StorageProviders: []string{"peer-b"}}, event: failure, want: true},
+		{name: "uninvolved provider", filter: Filter{StorageProviders: []string{"peer-c"}}, event: event, want: false},
+		{name: "all must match", filter: Filter{OnlyFailures: true, StorageProviders: []string{"peer-a"}}, event: event, want: false},
+		{name: "serving provider by Filecoin SP ID", filter: Filter{StorageProviders: []string{"f01234"}}, event: event, want: true},
+		{name: "attempted provider by Filecoin SP ID", filter: Filter{StorageProviders: []string{"f05678"}}, event: failure, want: true},
+		{name: "uninvolved Filecoin SP ID", filter: Filter{StorageProviders: []string{"f09999"}}, event: event, want: false},
+	}
+	filecoinSPIDs := map[string]string{"peer-a": "f01234", "peer-b": "f05678", "peer-c": "f09999"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.filter.Match(tt.event, filecoinSPIDs))
+		})
+	}
+	// Without resolution, only peer IDs match.
+	require.False(t, Filter{StorageProviders: []string{"f01234"}}.Match(event, nil))
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"endpoints": [
+			{"url": "https://example.com/hook", "secret": "s3cret", "flushInterval": "5s", "maxRetries": 0, "filter": {"onlyFailures": true}}
+		]
+	}`), 0o644))
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, cfg.Endpoints, 1)
+	require.Equal(t, Duration(5*time.Second), cfg.Endpoints[0].FlushInterval)
+	require.True(t, cfg.Endpoints[0].Filter.OnlyFailures)
+	// An explicit zero disables retries rather than taking the default.
+	require.NotNil(t, cfg.Endpoints[0].MaxRetries)
+	require.Zero(t, *cfg.Endpoints[0].MaxRetries)
+
+	_, err = New(Config{Endpoints: []Endpoint{{URL: "ftp://example.com"}}})
+	require.Error(t, err)
+	_, err = New(Config{})
+	require.Error(t, err)
+}
+
+func TestEndpoint_CountsDropped(t *testing.T) {
+	// Without a running endpoint, events beyond the queue are dropped and
+	// counted until logged.
+	e := &endpoint{
+		cfg:     Endpoint{URL: "http://example.com"},
+		queue:   make(chan eventrecorder.AggregateEvent, 1),
+		closing: make(chan struct{}),
+	}
+	for _, event := range events("a", "b", "c") {
+		e.enqueue(event)
+	}
+	require.Equal(t, int64(2), e.dropped.Load())
+	e.logDropped()
+	require.Zero(t, e.dropped.Load())
+}